@@ -1,232 +1,680 @@
+//go:build !notelemetry
+
 package agent
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"math/rand"
+	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	pb "github.com/yourorg/telemetry/gen/proto"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 )
 
-// Config holds agent configuration
-type Config struct {
-	AggregatorAddr string
-	ServiceName    string
-	InstanceID     string
-	APIKey         string
-	PushInterval   time.Duration
-	BatchSize      int
-}
-
-// DefaultConfig returns default agent configuration
-func DefaultConfig() Config {
-	return Config{
-		AggregatorAddr: "localhost:9000",
-		ServiceName:    "default",
-		InstanceID:     generateInstanceID(),
-		PushInterval:   20 * time.Millisecond,
-		BatchSize:      100,
-	}
-}
-
 // Agent collects and pushes telemetry to the aggregator
 type Agent struct {
 	config Config
 	conn   *grpc.ClientConn
-	stream grpc.ClientStreamingClient[pb.TelemetryBatch, pb.Ack]
-
-	// Metric collectors
-	gauges     map[string]*float64
-	counters   map[string]*uint64
-	histograms map[string]*Histogram
-	mu         sync.RWMutex
+	client pb.TelemetryIngestorClient
+	stream batchStream
+
+	// logger is Config.Logger, or the standard logger
+	logger Logger
+
+	// metadata is Config.Metadata as validated key/value pairs
+	metadata []string
+
+	// Resource labels sent with every batch
+	attributes map[string]string
+
+	// Key issued for BootstrapToken; only touched by Connect and push
+	issued issuedKey
+
+	// Metric collectors, keyed by seriesKey
+	series        map[string]series
+	gauges        map[string]*float64
+	counters      map[string]*atomic.Uint64
+	floatCounters map[string]*float64
+	histograms    map[string]*Histogram
+	exemplars     map[string]*exemplarReservoir
+	rejected      map[string]bool // series whose dropped values were logged
+	gaugeFuncs    map[string]func() float64
+	dbPools       map[string]*dbPool
+	routes        map[string]bool // route labels seen, up to MaxRoutes
+	summaries     map[string]*summary
+	gaugeWindows  map[string]*gaugeWindow // SetGaugeAgg gauges, by series key
+	mu            sync.RWMutex
+
+	// counterIndex mirrors counters for the lock-free increment path;
+	// entries are added and removed under mu
+	counterIndex sync.Map // series key -> *atomic.Uint64
+
+	// Up-down counters, keyed by seriesKey, with their own lock-free index
+	upDowns     map[string]*atomic.Int64
+	upDownIndex sync.Map // series key -> *atomic.Int64
+
+	// Timestamped samples from SetGaugeAt and RecordHistogramAt until the
+	// next push, keyed by seriesKey and guarded by mu
+	gaugesAt         map[string][]*pb.MetricSample
+	histogramsAt     map[string]*histogramAt
+	samplesAtDropped atomic.Uint64
+
+	// SetGauge values within the current push window, with
+	// Config.GaugeHistory; keyed by seriesKey and guarded by mu
+	gaugeHistory map[string]*gaugeHistory
+
+	// MarkRate meters, keyed by their <name>_per_sec gauge
+	meters map[string]*rateMeter
+
+	// Metric descriptions
+	descs  *descriptions
+	descMu sync.Mutex
+
+	// Events recorded since the last collection, see RecordEvent
+	events        []*pb.Event
+	eventsDropped atomic.Uint64
+	eventMu       sync.Mutex
 
 	// Inflight tracking
 	inflight atomic.Int64
 
-	// Control
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
-}
-
-// Histogram tracks latency distribution
-type Histogram struct {
-	bounds []float64
-	counts []uint64
-	mu     sync.Mutex
+	// rates feeds the rps and error_rate gauges of HTTPMiddleware
+	rates requestRates
+
+	// self is the agent's pipeline telemetry, sent with Config.SelfTelemetry
+	self selfStats
+
+	// health backs Health and OnStateChange
+	health health
+
+	// throttle stretches the push interval under backpressure
+	throttle pushThrottle
+
+	// remote holds the configuration pushed with Config.RemoteConfig
+	remote remoteConfig
+
+	// Series refused by Config.MaxSeries; seriesDropLogged is guarded by mu
+	droppedSeries    atomic.Uint64
+	seriesDropLogged time.Time
+
+	// Control. stopLoop ends the push loop before ctx, which carries the
+	// stream, so Stop can flush on the open stream. loopCtx ends with the
+	// push loop and carries the config watch and clock probes.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopLoop context.CancelFunc
+	loopCtx  context.Context
+	loopDone <-chan struct{}
+	wg       sync.WaitGroup
+
+	// stopOnce makes Stop idempotent; draining makes its final flush
+	// reconnect without waiting for the backoff
+	stopOnce sync.Once
+	draining atomic.Bool
+
+	// connected is set once Connect succeeds and the sender runs
+	connected atomic.Bool
+
+	// paused makes the push loop skip ticks; Resume wakes it through
+	// resumed for an immediate push
+	paused  atomic.Bool
+	resumed chan struct{}
+
+	// Collection and sending are decoupled: the push loop and Flush
+	// collect batches into queue under collectMu, and the sender goroutine
+	// sends them in order. queueDropped counts batches dropped from a full
+	// queue; sendStop ends the sender.
+	collectMu    sync.Mutex
+	queue        chan queuedBatch
+	queueDropped atomic.Uint64
+	sendStop     chan struct{}
+	sendWg       sync.WaitGroup
+
+	// groupNext is when each metric group is next due; guarded by
+	// collectMu
+	groupNext map[string]time.Time
+
+	// pushMu guards the stream and the reconnect state below, used by the
+	// sender
+	pushMu sync.Mutex
+
+	// Rate limits for the stream's failure log lines
+	lostLog      logLimiter
+	reconnectLog logLimiter
+
+	// Reconnect state: stream is nil while disconnected, and batches wait
+	// in pendingBatches until reconnectAt
+	pendingBatches []*pb.TelemetryBatch
+	droppedBatches uint64
+	backoff        time.Duration
+	reconnectAt    time.Time
+
+	// Failover state: addrIndex picks the aggregator address, failures
+	// and failingSince track sends and reconnects failing since the last
+	// success
+	addrIndex    atomic.Int32
+	failures     int
+	failingSince time.Time
+
+	// Clock skew correction: clockOffset is the aggregator's clock minus
+	// ours in ns, added to every timestamp; only clockProbeLoop touches
+	// the rest
+	clockOffset    atomic.Int64
+	smoothedOffset float64
+	clockProbed    bool
+
+	// mirror, if set, gets a copy of every batch; mirrorMu serializes
+	// EnableMirror, DisableMirror and Stop
+	mirror   atomic.Pointer[mirror]
+	mirrorMu sync.Mutex
+
+	// Servers started by ServePrometheus, closed by Stop
+	promServers []*http.Server
+	promMu      sync.Mutex
+
+	// Push scheduling
+	clock clock
+	rng   *rand.Rand
 }
 
-// NewHistogram creates a new histogram with default latency bounds
-func NewHistogram() *Histogram {
-	return &Histogram{
-		bounds: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000},
-		counts: make([]uint64, 13), // +1 for overflow bucket
+// NewAgent creates a new telemetry agent
+func NewAgent(config Config) (*Agent, error) {
+	if config.AllowDefaults {
+		config = config.withDefaults()
 	}
-}
-
-// Record records a value in the histogram
-func (h *Histogram) Record(value float64) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	for i, bound := range h.bounds {
-		if value <= bound {
-			h.counts[i]++
-			return
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	for name, bounds := range config.HistogramBounds {
+		if err := ValidateBounds(bounds); err != nil {
+			return nil, fmt.Errorf("histogram %q: %w", name, err)
 		}
 	}
-	h.counts[len(h.counts)-1]++ // Overflow bucket
-}
-
-// Snapshot returns current histogram state and resets
-func (h *Histogram) Snapshot() ([]float64, []uint64) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	bounds := make([]float64, len(h.bounds))
-	counts := make([]uint64, len(h.counts))
-	copy(bounds, h.bounds)
-	copy(counts, h.counts)
-
-	// Reset counts
-	for i := range h.counts {
-		h.counts[i] = 0
+	if err := validateSampleRates(config.HistogramSampleRate); err != nil {
+		return nil, err
+	}
+	if err := validateCompression(config.Compression); err != nil {
+		return nil, err
+	}
+	md, err := metadataPairs(config.Metadata)
+	if err != nil {
+		return nil, err
 	}
 
-	return bounds, counts
-}
-
-// NewAgent creates a new telemetry agent
-func NewAgent(config Config) (*Agent, error) {
 	ctx, cancel := context.WithCancel(context.Background())
+	loopCtx, stopLoop := context.WithCancel(ctx)
+
+	var kubernetes map[string]string
+	if config.AutoDetectKubernetes {
+		kubernetes = detectKubernetes(osKubernetesEnv, kubernetesDetectTimeout)
+	}
+	if config.InstanceID == "" && config.InstanceIDFunc != nil {
+		config.InstanceID = config.InstanceIDFunc()
+	}
+	if config.InstanceID == "" {
+		config.InstanceID = kubernetes[LabelPodName]
+	}
+	if config.InstanceID == "" {
+		config.InstanceID = generateInstanceID()
+	}
 
 	agent := &Agent{
-		config:     config,
-		gauges:     make(map[string]*float64),
-		counters:   make(map[string]*uint64),
-		histograms: make(map[string]*Histogram),
-		ctx:        ctx,
-		cancel:     cancel,
+		config:        config,
+		logger:        config.logger(),
+		metadata:      md,
+		attributes:    resourceAttributes(config.ResourceAttributes, kubernetes),
+		series:        make(map[string]series),
+		gauges:        make(map[string]*float64),
+		counters:      make(map[string]*atomic.Uint64),
+		floatCounters: make(map[string]*float64),
+		histograms:    make(map[string]*Histogram),
+		exemplars:     make(map[string]*exemplarReservoir),
+		rejected:      make(map[string]bool),
+		gaugeFuncs:    make(map[string]func() float64),
+		dbPools:       make(map[string]*dbPool),
+		upDowns:       make(map[string]*atomic.Int64),
+		gaugesAt:      make(map[string][]*pb.MetricSample),
+		histogramsAt:  make(map[string]*histogramAt),
+		meters:        make(map[string]*rateMeter),
+		gaugeHistory:  make(map[string]*gaugeHistory),
+		routes:        make(map[string]bool),
+		summaries:     make(map[string]*summary),
+		gaugeWindows:  make(map[string]*gaugeWindow),
+		groupNext:     make(map[string]time.Time),
+		queue:         make(chan queuedBatch, config.sendQueueSize()),
+		sendStop:      make(chan struct{}),
+		descs:         newDescriptions(),
+		ctx:           ctx,
+		cancel:        cancel,
+		stopLoop:      stopLoop,
+		loopCtx:       loopCtx,
+		loopDone:      loopCtx.Done(),
+		resumed:       make(chan struct{}, 1),
+		clock:         realClock{},
+		rng:           rand.New(rand.NewSource(jitterSeed(config))),
 	}
 
+	// Built-in metrics arrive self-documenting
+	agent.Describe("inflight", Description{Type: "gauge", Unit: "requests", Help: "Requests currently in flight"})
+	agent.Describe("latency", Description{Type: "histogram", Unit: "ms", Help: "Tracked request latency"})
+	agent.Describe("errors_total", Description{Type: "counter", Unit: "errors", Help: "Errors recorded with RecordError"})
+	agent.Describe("grpc_latency", Description{Type: "histogram", Unit: "ms", Help: "Server RPC latency by method and status code"})
+	agent.Describe("grpc_requests_total", Description{Type: "counter", Unit: "requests", Help: "Server RPCs by method and status code"})
+	agent.Describe("grpc_errors_total", Description{Type: "counter", Unit: "requests", Help: "Server RPCs that returned an error, by method and status code"})
+	agent.Describe("grpc_inflight", Description{Type: "gauge", Unit: "requests", Help: "Server RPCs in progress by method"})
+	agent.Describe("latency_cancelled", Description{Type: "histogram", Unit: "ms", Help: "Latency of requests whose context was cancelled before they finished"})
+	agent.Describe("requests_cancelled_total", Description{Type: "counter", Unit: "requests", Help: "Requests tracked with TrackRequestContext whose context was cancelled first"})
+	agent.Describe("requests_total", Description{Type: "counter", Unit: "requests", Help: "Requests tracked with TrackRequestWithInfo"})
+	agent.Describe("reconnects_total", Description{Type: "counter", Unit: "reconnects", Help: "Streams re-established after a failure"})
+	agent.Describe("failovers_total", Description{Type: "counter", Unit: "failovers", Help: "Moves to the next of Config.AggregatorAddrs"})
+	agent.Describe("agent_active_aggregator", Description{Type: "gauge", Help: "Index in Config.AggregatorAddrs of the aggregator in use, labeled with its address"})
+	agent.Describe("agent_dropped_series_total", Description{Type: "counter", Unit: "series", Help: "New series dropped by the MaxSeries cap"})
+	agent.Describe("agent_batches_sent_total", Description{Type: "counter", Unit: "batches", Help: "Batches the aggregator stream accepted"})
+	agent.Describe("agent_batch_send_errors_total", Description{Type: "counter", Unit: "batches", Help: "Batch sends that failed"})
+	agent.Describe("agent_samples_sent_total", Description{Type: "counter", Unit: "samples", Help: "Samples in accepted batches"})
+	agent.Describe("agent_last_send_unix_seconds", Description{Type: "gauge", Unit: "s", Help: "Time of the last accepted batch"})
+	agent.Describe("agent_push_duration_ms", Description{Type: "gauge", Unit: "ms", Help: "Duration of the previous push, including reconnects"})
+	agent.Describe("dropped_batches_total", Description{Type: "counter", Unit: "batches", Help: "Batches dropped because the offline buffer was full"})
+	agent.Describe("agent_clock_offset_ms", Description{Type: "gauge", Unit: "ms", Help: "Estimated aggregator clock minus the local clock, added to timestamps"})
+	agent.Describe("send_queue_dropped_total", Description{Type: "counter", Unit: "batches", Help: "Collected batches dropped because the send queue was full"})
+	agent.Describe("backdated_samples_dropped_total", Description{Type: "counter", Unit: "samples", Help: "SetGaugeAt and RecordHistogramAt samples dropped because more than 1000 were held for one series between pushes"})
+	agent.Describe("events_dropped_total", Description{Type: "counter", Unit: "events", Help: "Events dropped because more than 100 were recorded between pushes"})
+
 	return agent, nil
 }
 
 // Connect establishes connection to the aggregator
 func (a *Agent) Connect() error {
+	return a.ConnectContext(context.Background())
+}
+
+// ConnectContext is Connect bounded by ctx. If ctx ends first it returns
+// ctx's error and leaves the agent unconnected, so it may be called again;
+// the stream itself outlives ctx.
+func (a *Agent) ConnectContext(ctx context.Context) error {
+	if a.connected.Load() {
+		return errors.New("agent is already connected")
+	}
+	if a.config.MirrorAddr != "" && a.mirror.Load() == nil {
+		if err := a.EnableMirror(a.config.MirrorAddr); err != nil {
+			return err
+		}
+	}
+	if a.config.Sink != nil {
+		// Nothing to dial; batches go straight to the sink
+		a.openStream(ctx)
+		a.startSender()
+		return nil
+	}
+	// Addresses are tried in order; the first to take a stream wins
 	var err error
-	a.conn, err = grpc.NewClient(
-		a.config.AggregatorAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
-	if err != nil {
+	for i, addr := range a.config.aggregatorAddrs() {
+		if err = a.connectTo(ctx, i); err == nil {
+			if err = a.openStream(ctx); err == nil {
+				a.logf("Connected to aggregator at %s", addr)
+				a.startSender()
+				return nil
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		a.logf("Aggregator at %s unavailable: %v", addr, err)
+	}
+	if a.client == nil || a.config.BootstrapToken != "" && a.issued.key == "" {
+		// Bad TLS files, or the last address issued no key to stream with
 		return err
 	}
+	// The push loop keeps retrying with backoff, failing over between
+	// addresses
+	a.logf("No aggregator available, will retry")
+	a.disconnect(err)
+	a.startSender()
+	return nil
+}
 
-	client := pb.NewTelemetryIngestorClient(a.conn)
+// streamContext carries the metadata and current API key for a stream
+func (a *Agent) streamContext() context.Context {
+	return a.withAPIKey(a.outgoingContext())
+}
 
-	// Add API key to context if configured
-	ctx := a.ctx
-	if a.config.APIKey != "" {
-		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", a.config.APIKey)
+// withAPIKey adds the current API key to ctx
+func (a *Agent) withAPIKey(ctx context.Context) context.Context {
+	if key := a.apiKey(); key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", key)
 	}
+	return ctx
+}
 
-	a.stream, err = client.StreamTelemetry(ctx)
+// openStream starts a telemetry stream with the current API key, or
+// attaches Config.Sink. ctx only bounds establishing it: the stream lives
+// on a.ctx.
+func (a *Agent) openStream(ctx context.Context) error {
+	if a.config.Sink != nil {
+		a.stream = sinkStream{a.config.Sink}
+		a.resendDescriptions()
+		a.setStreaming(true)
+		return nil
+	}
+	streamCtx, cancel := context.WithCancel(a.streamContext())
+	stop := context.AfterFunc(ctx, cancel)
+	stream, err := a.client.StreamTelemetry(streamCtx, a.config.callOptions()...)
+	if !stop() {
+		// ctx ended first and took the stream, if any, with it
+		cancel()
+		return ctx.Err()
+	}
 	if err != nil {
+		cancel()
 		return err
 	}
+	a.stream = cancelingStream{stream, cancel}
 
-	log.Printf("Connected to aggregator at %s", a.config.AggregatorAddr)
+	// A new stream has not seen any descriptions yet
+	a.resendDescriptions()
+	a.setStreaming(true)
 	return nil
 }
 
-// Start begins the metric collection and push loop
-func (a *Agent) Start() {
+// Start begins the metric collection and push loop. It returns
+// ErrNotConnected, and starts nothing, before a successful Connect.
+func (a *Agent) Start() error {
+	if !a.connected.Load() {
+		return ErrNotConnected
+	}
 	a.wg.Add(1)
 	go a.pushLoop()
+	if a.config.RemoteConfig {
+		a.wg.Add(1)
+		go a.watchConfig()
+	}
+	if a.config.probesClock() {
+		a.wg.Add(1)
+		go a.clockProbeLoop()
+	}
+	return nil
+}
+
+// cancelingStream releases a stream's context once it is closed
+type cancelingStream struct {
+	grpc.ClientStreamingClient[pb.TelemetryBatch, pb.Ack]
+	cancel context.CancelFunc
+}
+
+func (s cancelingStream) CloseAndRecv() (*pb.Ack, error) {
+	defer s.cancel()
+	return s.ClientStreamingClient.CloseAndRecv()
 }
 
-// Stop gracefully stops the agent
+// Stop is StopWithTimeout(DefaultStopTimeout)
 func (a *Agent) Stop() {
-	a.cancel()
+	a.StopWithTimeout(DefaultStopTimeout)
+}
+
+// StopWithTimeout gracefully stops the agent. It collects a final batch
+// and, within timeout, sends the offline buffer, the queued batches and
+// that batch, reconnecting at once if the stream is down, then half-closes
+// the stream and waits for the aggregator's ack. Whatever is still unsent
+// at the deadline is dropped. Later and concurrent calls, say from a
+// signal handler and a defer, wait for the first to finish.
+func (a *Agent) StopWithTimeout(timeout time.Duration) {
+	a.stopOnce.Do(func() { a.stop(timeout) })
+}
+
+func (a *Agent) stop(timeout time.Duration) {
+	a.stopLoop()
 	a.wg.Wait()
 
-	if a.stream != nil {
-		a.stream.CloseAndRecv()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// The final flush should not wait out a reconnect backoff
+	a.draining.Store(true)
+	if a.connected.Load() {
+		// Sent after everything already queued, so this drains the queue
+		if err := a.Flush(ctx); err != nil {
+			a.logf("Failed to flush metrics on stop: %v", err)
+		}
+	}
+	close(a.sendStop)
+	stopped := make(chan struct{})
+	go func() {
+		a.sendWg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		// The sender is gone, so the stream is ours
+		if a.stream != nil {
+			// Half-close so the aggregator reads everything before the
+			// ack; cancelling a.ctx below cuts it short at the deadline
+			closed := make(chan struct{})
+			go func() {
+				a.stream.CloseAndRecv()
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-ctx.Done():
+			}
+		}
+	case <-ctx.Done():
+		// A send is stuck; cancelling a.ctx releases it
 	}
+	a.stopMirror(ctx)
+	a.cancel()
+	a.sendWg.Wait()
 	if a.conn != nil {
 		a.conn.Close()
 	}
+	a.setStreaming(false)
+	if n := a.health.buffered.Load(); n > 0 {
+		a.logf("Stopped with %d batches unsent", n)
+	}
+
+	a.closePrometheus()
+
+	// Drop the pools so a stopped agent does not keep them reachable
+	a.mu.Lock()
+	clear(a.dbPools)
+	a.mu.Unlock()
+}
+
+// Flush collects a batch now and returns once it, and the batches queued
+// before it, are on the stream, or ctx ends. A batch still queued when ctx
+// ends is sent afterwards. Before a successful Connect it returns
+// ErrNotConnected.
+func (a *Agent) Flush(ctx context.Context) error {
+	if !a.connected.Load() {
+		return ErrNotConnected
+	}
+	done := make(chan error, 1)
+	a.collect(true, done)
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // pushLoop periodically sends metrics to the aggregator
 func (a *Agent) pushLoop() {
 	defer a.wg.Done()
 
-	ticker := time.NewTicker(a.config.PushInterval)
-	defer ticker.Stop()
+	base := a.clock.Now().Add(a.initialDelay())
+	timer := a.clock.NewTimer(base.Sub(a.clock.Now()))
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-a.ctx.Done():
+		case <-a.loopDone:
 			return
-		case <-ticker.C:
-			batch := a.collectMetrics()
-			if len(batch.Metrics) > 0 {
-				if err := a.stream.Send(batch); err != nil {
-					log.Printf("Failed to send batch: %v", err)
-				}
+		case <-a.resumed:
+			// Off schedule; the timer keeps the next tick where it was
+			if !a.paused.Load() {
+				a.collect(false, nil)
+			}
+			continue
+		case <-timer.C():
+			a.expireRemoteConfig(a.clock.Now())
+			if !a.paused.Load() {
+				a.collect(false, nil)
+			}
+
+			// Advance the schedule base by whole intervals and jitter only
+			// the sleep, so jitter never accumulates into drift. The
+			// interval stretches under backpressure, see MaxPushInterval.
+			interval := a.pushInterval()
+			now := a.clock.Now()
+			base = base.Add(interval)
+			for !base.After(now) {
+				base = base.Add(interval)
 			}
+			sleep := base.Add(a.jitter()).Sub(now)
+			if sleep < 0 {
+				sleep = 0
+			}
+			timer.Reset(sleep)
 		}
 	}
 }
 
+// initialDelay spreads first pushes uniformly over one interval
+func (a *Agent) initialDelay() time.Duration {
+	if a.config.PushJitter <= 0 {
+		return a.config.PushInterval
+	}
+	return time.Duration(a.rng.Int63n(int64(a.config.PushInterval)))
+}
+
+// jitter returns a random offset within ±PushJitter/2 of the interval
+func (a *Agent) jitter() time.Duration {
+	if a.config.PushJitter <= 0 {
+		return 0
+	}
+	span := float64(a.basePushInterval()) * a.config.PushJitter
+	return time.Duration((a.rng.Float64() - 0.5) * span)
+}
+
 // collectMetrics gathers all current metrics into a batch
-func (a *Agent) collectMetrics() *pb.TelemetryBatch {
+func (a *Agent) collectMetrics(due map[string]bool) *pb.TelemetryBatch {
+	// Zero unless Config.CorrectClockSkew
+	offset := a.clockOffset.Load()
+	now := uint64(time.Now().UnixNano() + offset)
+	metrics := a.collectGaugeFuncs(now)
+	metrics = append(metrics, a.collectDBStats(now)...)
+	metrics = append(metrics, a.collectSamplesAt()...)
+	metrics = append(metrics, a.collectRates(now)...)
+	history := a.takeGaugeHistory(due)
+
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
-	now := uint64(time.Now().UnixNano())
-	metrics := make([]*pb.Metric, 0)
+	// Collect gauges; a callback of the same name takes precedence, and
+	// SetGaugeAgg gauges send their window's aggregate
+	for key, val := range a.gauges {
+		if _, ok := a.gaugeFuncs[key]; ok || !a.inDueGroup(key, due) {
+			continue
+		}
+		if samples, ok := history[key]; ok {
+			metrics = append(metrics, &pb.Metric{
+				Name:    a.series[key].name,
+				Labels:  a.series[key].labels,
+				Samples: samples,
+			})
+			continue
+		}
+		value := *val
+		if w, ok := a.gaugeWindows[key]; ok {
+			value = w.take()
+		}
+		metrics = append(metrics, &pb.Metric{
+			Name:   a.series[key].name,
+			Labels: a.series[key].labels,
+			Samples: []*pb.MetricSample{
+				{
+					TimestampNs: now,
+					Value:       &pb.MetricSample_Gauge{Gauge: value},
+				},
+			},
+		})
+	}
+
+	// Collect counters. Increments do not take mu, so each counter is
+	// read atomically on its own; one landing mid-collection is in this
+	// push or the next, never lost.
+	for key, val := range a.counters {
+		metrics = append(metrics, &pb.Metric{
+			Name:   a.series[key].name,
+			Labels: a.series[key].labels,
+			Samples: []*pb.MetricSample{
+				{
+					TimestampNs: now,
+					Value:       &pb.MetricSample_Counter{Counter: val.Load()},
+				},
+			},
+		})
+	}
 
-	// Collect gauges
-	for name, val := range a.gauges {
+	// Sent as gauges; a gauge set on the same key by another path, or a
+	// callback of the same name, takes precedence
+	for key, val := range a.upDowns {
+		if _, ok := a.gauges[key]; ok {
+			continue
+		}
+		if _, ok := a.gaugeFuncs[key]; ok {
+			continue
+		}
 		metrics = append(metrics, &pb.Metric{
-			Name: name,
+			Name:   a.series[key].name,
+			Labels: a.series[key].labels,
 			Samples: []*pb.MetricSample{
 				{
 					TimestampNs: now,
-					Value:       &pb.MetricSample_Gauge{Gauge: *val},
+					Value:       &pb.MetricSample_Gauge{Gauge: float64(val.Load())},
 				},
 			},
 		})
 	}
 
-	// Collect counters
-	for name, val := range a.counters {
+	for key, val := range a.floatCounters {
 		metrics = append(metrics, &pb.Metric{
-			Name: name,
+			Name:   a.series[key].name,
+			Labels: a.series[key].labels,
 			Samples: []*pb.MetricSample{
 				{
 					TimestampNs: now,
-					Value:       &pb.MetricSample_Counter{Counter: *val},
+					Value:       &pb.MetricSample_FloatCounter{FloatCounter: *val},
 				},
 			},
 		})
 	}
 
 	// Collect histograms
-	for name, hist := range a.histograms {
-		bounds, counts := hist.Snapshot()
+	for key, hist := range a.histograms {
+		bounds, counts, sum, count := hist.snapshot()
+		if rate, ok := a.sampleRate(a.series[key].name); ok && rate < 1 {
+			counts, sum, count = scaleSampled(counts, sum, rate)
+		}
+		var exemplars []*pb.Exemplar
+		if res, ok := a.exemplars[key]; ok {
+			exemplars = res.Drain()
+			for _, e := range exemplars {
+				e.TimestampNs = uint64(int64(e.TimestampNs) + offset)
+			}
+		}
 		metrics = append(metrics, &pb.Metric{
-			Name: name,
+			Name:      a.series[key].name,
+			Labels:    a.series[key].labels,
+			Exemplars: exemplars,
 			Samples: []*pb.MetricSample{
 				{
 					TimestampNs: now,
@@ -234,6 +682,8 @@ func (a *Agent) collectMetrics() *pb.TelemetryBatch {
 						Histogram: &pb.Histogram{
 							Bounds: bounds,
 							Counts: counts,
+							Sum:    &sum,
+							Count:  &count,
 						},
 					},
 				},
@@ -241,6 +691,8 @@ func (a *Agent) collectMetrics() *pb.TelemetryBatch {
 		})
 	}
 
+	metrics = a.collectSummaries(now, metrics)
+
 	// Add inflight metric
 	metrics = append(metrics, &pb.Metric{
 		Name: "inflight",
@@ -252,10 +704,28 @@ func (a *Agent) collectMetrics() *pb.TelemetryBatch {
 		},
 	})
 
+	metrics = append(metrics, a.selfMetrics(now)...)
+
+	// Sent outside the series maps so the cap can never drop it
+	if dropped := a.droppedSeries.Load(); dropped > 0 {
+		metrics = append(metrics, &pb.Metric{
+			Name: "agent_dropped_series_total",
+			Samples: []*pb.MetricSample{
+				{
+					TimestampNs: now,
+					Value:       &pb.MetricSample_Counter{Counter: dropped},
+				},
+			},
+		})
+	}
+
 	return &pb.TelemetryBatch{
-		Service:  a.config.ServiceName,
-		Instance: a.config.InstanceID,
-		Metrics:  metrics,
+		Service:    a.config.ServiceName,
+		Instance:   a.config.InstanceID,
+		Metrics:    metrics,
+		Attributes: a.attributes,
+
+		HistogramTemporality: pb.HistogramTemporality(a.config.HistogramTemporality),
 	}
 }
 
@@ -263,53 +733,31 @@ func (a *Agent) collectMetrics() *pb.TelemetryBatch {
 
 // SetGauge sets a gauge metric value
 func (a *Agent) SetGauge(name string, value float64) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	if a.gauges[name] == nil {
-		v := value
-		a.gauges[name] = &v
-	} else {
-		*a.gauges[name] = value
-	}
+	a.SetGaugeWithLabels(name, nil, value)
 }
 
 // IncCounter increments a counter metric
 func (a *Agent) IncCounter(name string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	if a.counters[name] == nil {
-		v := uint64(1)
-		a.counters[name] = &v
-	} else {
-		*a.counters[name]++
-	}
+	a.AddCounterWithLabels(name, nil, 1)
 }
 
 // AddCounter adds to a counter metric
 func (a *Agent) AddCounter(name string, delta uint64) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	if a.counters[name] == nil {
-		a.counters[name] = &delta
-	} else {
-		*a.counters[name] += delta
-	}
+	a.AddCounterWithLabels(name, nil, delta)
 }
 
 // RecordHistogram records a value in a histogram
 func (a *Agent) RecordHistogram(name string, value float64) {
-	a.mu.Lock()
-	hist, exists := a.histograms[name]
-	if !exists {
-		hist = NewHistogram()
-		a.histograms[name] = hist
-	}
-	a.mu.Unlock()
+	a.RecordHistogramWithLabels(name, nil, value)
+}
 
-	hist.Record(value)
+// RecordHistogramWithBounds records a value in a histogram created with
+// the given bounds on first use (nil means the configured or default
+// bounds). Invalid bounds, or bounds that differ
+// from those the histogram was created with, drop the value; the first
+// rejection per histogram is logged.
+func (a *Agent) RecordHistogramWithBounds(name string, bounds []float64, value float64) {
+	a.recordHistogram(name, nil, bounds, value)
 }
 
 // --- Request Tracking ---
@@ -317,16 +765,124 @@ func (a *Agent) RecordHistogram(name string, value float64) {
 // TrackRequest returns a function to call when request completes
 // Usage: defer agent.TrackRequest()()
 func (a *Agent) TrackRequest() func() {
+	return a.trackRequest(ExemplarInfo{})
+}
+
+// TrackRequestNamed is TrackRequest with the operation recorded on any
+// exemplar captured for a slow completion
+func (a *Agent) TrackRequestNamed(operation string) func() {
+	return a.trackRequest(ExemplarInfo{Operation: operation})
+}
+
+// TrackRequestCtx is TrackRequest with exemplar details (operation, trace ID,
+// labels) taken from ctx, see ContextWithExemplarInfo
+func (a *Agent) TrackRequestCtx(ctx context.Context) func() {
+	info, _ := ctx.Value(exemplarInfoKey{}).(ExemplarInfo)
+	return a.trackRequest(info)
+}
+
+// TrackRequestContext is TrackRequestCtx that also watches ctx: if it is
+// cancelled before the returned function is called, the request counts in
+// requests_cancelled_total and its latency so far goes to latency_cancelled
+// instead of latency. Whichever happens first wins and the other is a
+// no-op, so inflight drops exactly once. Nothing runs per request until
+// ctx is cancelled, and calling the function releases the watch.
+func (a *Agent) TrackRequestContext(ctx context.Context) func() {
+	info, _ := ctx.Value(exemplarInfoKey{}).(ExemplarInfo)
 	start := time.Now()
 	a.inflight.Add(1)
 
+	var finished atomic.Bool
+	stop := context.AfterFunc(ctx, func() {
+		if !finished.CompareAndSwap(false, true) {
+			return
+		}
+		a.inflight.Add(-1)
+		a.RecordHistogram("latency_cancelled", durationMs(time.Since(start)))
+		a.IncCounter("requests_cancelled_total")
+	})
+
+	return func() {
+		stop()
+		if !finished.CompareAndSwap(false, true) {
+			return
+		}
+		a.inflight.Add(-1)
+		elapsed := time.Since(start)
+		a.RecordHistogram("latency", durationMs(elapsed))
+		a.offerExemplar("latency", elapsed, info)
+	}
+}
+
+func (a *Agent) trackRequest(info ExemplarInfo) func() {
+	timer := a.StartTimer("latency")
+	a.inflight.Add(1)
+
 	return func() {
 		a.inflight.Add(-1)
-		latency := float64(time.Since(start).Milliseconds())
-		a.RecordHistogram("latency", latency)
+		a.offerExemplar("latency", timer.ObserveDuration(), info)
 	}
 }
 
+// TrackRequestWithInfo is TrackRequest for HTTP handlers: the returned
+// function labels the latency histogram and requests_total with the status
+// class and route, and a 5xx status is recorded as an error.
+// Usage: done := agent.TrackRequestWithInfo(); ...; done(status, route)
+func (a *Agent) TrackRequestWithInfo() func(status int, route string) {
+	timer := a.StartTimer("latency")
+	a.inflight.Add(1)
+
+	return func(status int, route string) {
+		a.inflight.Add(-1)
+		class := statusClass(status)
+		labels := map[string]string{"status": class, "route": a.routeLabel(route)}
+		elapsed := timer.ObserveDurationWithLabels(labels)
+		a.IncCounterWithLabels("requests_total", labels)
+		if status >= 500 {
+			a.RecordError(class)
+		}
+		a.offerExemplar("latency", elapsed, ExemplarInfo{Operation: route, Labels: labels})
+	}
+}
+
+// statusClass maps an HTTP status to its class, such as "2xx"
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// routeLabel returns route while under the MaxRoutes distinct routes, and
+// "other" for routes beyond it
+func (a *Agent) routeLabel(route string) string {
+	limit := a.config.MaxRoutes
+	if limit <= 0 {
+		limit = DefaultMaxRoutes
+	}
+
+	a.mu.RLock()
+	known := a.routes[route]
+	full := len(a.routes) >= limit
+	a.mu.RUnlock()
+	if known {
+		return route
+	}
+	if full {
+		return "other"
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.routes[route] {
+		if len(a.routes) >= limit {
+			return "other"
+		}
+		a.routes[route] = true
+	}
+	return route
+}
+
 // RecordError records an error occurrence
 func (a *Agent) RecordError(errorType string) {
 	a.IncCounter("errors_" + errorType)
@@ -335,11 +891,12 @@ func (a *Agent) RecordError(errorType string) {
 
 // --- Helper Functions ---
 
-func generateInstanceID() string {
-	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
-	b := make([]byte, 8)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
-	}
-	return string(b)
+// jitterSeed derives a per-agent seed so jitter differs across the fleet
+// but is reproducible for a given service and instance
+func jitterSeed(config Config) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(config.ServiceName))
+	h.Write([]byte{0})
+	h.Write([]byte(config.InstanceID))
+	return int64(h.Sum64())
 }
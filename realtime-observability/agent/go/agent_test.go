@@ -0,0 +1,59 @@
+//go:build !notelemetry
+
+package agent_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	agent "github.com/yourorg/agent"
+)
+
+func TestStartBeforeConnect(t *testing.T) {
+	cfg := agent.DefaultConfig()
+	cfg.ServiceName = "test-service"
+	cfg.AutoDetectKubernetes = false
+	a, err := agent.NewAgent(cfg)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	defer a.Stop()
+
+	if err := a.Start(); !errors.Is(err, agent.ErrNotConnected) {
+		t.Fatalf("Start before Connect: err = %v, want ErrNotConnected", err)
+	}
+	if err := a.Flush(context.Background()); !errors.Is(err, agent.ErrNotConnected) {
+		t.Fatalf("Flush before Connect: err = %v, want ErrNotConnected", err)
+	}
+}
+
+// newBenchAgent returns an agent that records but is never connected, so
+// benchmarks measure the recording path alone
+func newBenchAgent(b *testing.B, change func(cfg *agent.Config)) *agent.Agent {
+	b.Helper()
+	cfg := agent.DefaultConfig()
+	cfg.ServiceName = "bench-service"
+	cfg.AutoDetectKubernetes = false
+	if change != nil {
+		change(&cfg)
+	}
+	a, err := agent.NewAgent(cfg)
+	if err != nil {
+		b.Fatalf("NewAgent: %v", err)
+	}
+	b.Cleanup(a.Stop)
+	return a
+}
+
+func BenchmarkIncCounterParallel(b *testing.B) {
+	a := newBenchAgent(b, nil)
+	a.IncCounter("requests_total")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			a.IncCounter("requests_total")
+		}
+	})
+}
@@ -0,0 +1,51 @@
+// Package agentgrpc instruments gRPC servers through an agent. It is kept
+// apart from the agent package so that the agent's notelemetry build does
+// not link gRPC; built with that tag the interceptors call the handler
+// directly.
+//
+// Usage:
+//
+//	grpc.NewServer(
+//		grpc.UnaryInterceptor(agentgrpc.UnaryServerInterceptor(a)),
+//		grpc.StreamInterceptor(agentgrpc.StreamServerInterceptor(a)),
+//	)
+package agentgrpc
+
+import (
+	"context"
+
+	agent "github.com/yourorg/agent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor instruments unary RPCs through the agent: the
+// grpc_latency histogram and grpc_requests_total by method and status
+// code, grpc_errors_total for codes other than OK, and grpc_inflight by
+// method. Methods in Config.GRPCSkipMethods are not recorded. The
+// handler's response and error are returned unchanged.
+func UnaryServerInterceptor(a *agent.Agent) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		done := a.TrackRPC(info.FullMethod)
+		if done == nil {
+			return handler(ctx, req)
+		}
+		resp, err := handler(ctx, req)
+		done(status.Code(err).String())
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streaming RPCs;
+// latency covers the whole stream
+func StreamServerInterceptor(a *agent.Agent) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		done := a.TrackRPC(info.FullMethod)
+		if done == nil {
+			return handler(srv, ss)
+		}
+		err := handler(srv, ss)
+		done(status.Code(err).String())
+		return err
+	}
+}
@@ -0,0 +1,176 @@
+// Package agenttest captures what an agent sends, in memory, so code
+// instrumented with the agent can be tested without an aggregator.
+//
+// New returns a connected agent whose batches land in a Recorder. The
+// agent is not started: every Recorder query flushes it first, so it sees
+// exactly what was recorded up to the call:
+//
+//	func TestHandler(t *testing.T) {
+//		a, rec := agenttest.New(t)
+//		handler(a).ServeHTTP(httptest.NewRecorder(), req)
+//		if n := rec.CounterValue("errors_timeout"); n != 1 {
+//			t.Errorf("errors_timeout = %d, want 1", n)
+//		}
+//	}
+//
+// Built with the notelemetry tag, the agent sends nothing and every query
+// returns zero.
+package agenttest
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+
+	agent "github.com/yourorg/agent"
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// flushTimeout bounds the flush before each query
+const flushTimeout = 5 * time.Second
+
+// Recorder is an agent.Sink keeping every batch it is sent
+type Recorder struct {
+	t     testing.TB
+	agent *agent.Agent
+
+	batches []*pb.TelemetryBatch
+	mu      sync.Mutex
+}
+
+// New creates an agent for service "test-service" sending to a new
+// Recorder, and stops it with t.Cleanup
+func New(t testing.TB) (*agent.Agent, *Recorder) {
+	t.Helper()
+	cfg := agent.DefaultConfig()
+	cfg.ServiceName = "test-service"
+	cfg.AutoDetectKubernetes = false
+	return NewWithConfig(t, cfg)
+}
+
+// NewWithConfig is New with the agent configured by cfg; its Sink is
+// replaced by the Recorder
+func NewWithConfig(t testing.TB, cfg agent.Config) (*agent.Agent, *Recorder) {
+	t.Helper()
+	rec := &Recorder{t: t}
+	cfg.Sink = rec
+
+	a, err := agent.NewAgent(cfg)
+	if err != nil {
+		t.Fatalf("agenttest: new agent: %v", err)
+	}
+	if err := a.Connect(); err != nil {
+		t.Fatalf("agenttest: connect agent: %v", err)
+	}
+	rec.agent = a
+	t.Cleanup(a.Stop)
+	return a, rec
+}
+
+// Send records a batch; it never fails
+func (r *Recorder) Send(batch *pb.TelemetryBatch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, batch)
+	return nil
+}
+
+// Batches flushes the agent and returns every batch received, oldest first
+func (r *Recorder) Batches() []*pb.TelemetryBatch {
+	r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*pb.TelemetryBatch(nil), r.batches...)
+}
+
+// GaugeValue returns the last value sent for the unlabeled gauge name, or
+// 0 if none was
+func (r *Recorder) GaugeValue(name string) float64 {
+	return r.GaugeValueWithLabels(name, nil)
+}
+
+// GaugeValueWithLabels is GaugeValue for one label combination
+func (r *Recorder) GaugeValueWithLabels(name string, labels map[string]string) float64 {
+	var value float64
+	r.samples(name, labels, func(_ *pb.TelemetryBatch, s *pb.MetricSample) {
+		if g, ok := s.Value.(*pb.MetricSample_Gauge); ok {
+			value = g.Gauge
+		}
+	})
+	return value
+}
+
+// CounterValue returns the last total sent for the unlabeled counter name,
+// or 0 if none was
+func (r *Recorder) CounterValue(name string) uint64 {
+	return r.CounterValueWithLabels(name, nil)
+}
+
+// CounterValueWithLabels is CounterValue for one label combination
+func (r *Recorder) CounterValueWithLabels(name string, labels map[string]string) uint64 {
+	var value uint64
+	r.samples(name, labels, func(_ *pb.TelemetryBatch, s *pb.MetricSample) {
+		if c, ok := s.Value.(*pb.MetricSample_Counter); ok {
+			value = c.Counter
+		}
+	})
+	return value
+}
+
+// HistogramCount returns the number of observations sent for the
+// unlabeled histogram name, under either temporality
+func (r *Recorder) HistogramCount(name string) uint64 {
+	return r.HistogramCountWithLabels(name, nil)
+}
+
+// HistogramCountWithLabels is HistogramCount for one label combination
+func (r *Recorder) HistogramCountWithLabels(name string, labels map[string]string) uint64 {
+	var total uint64
+	r.samples(name, labels, func(b *pb.TelemetryBatch, s *pb.MetricSample) {
+		h, ok := s.Value.(*pb.MetricSample_Histogram)
+		if !ok {
+			return
+		}
+		count := h.Histogram.GetCount()
+		if b.HistogramTemporality == pb.HistogramTemporality_HISTOGRAM_TEMPORALITY_CUMULATIVE {
+			total = count
+		} else {
+			total += count
+		}
+	})
+	return total
+}
+
+// samples flushes the agent and calls fn for every sample of the series,
+// oldest first
+func (r *Recorder) samples(name string, labels map[string]string, fn func(*pb.TelemetryBatch, *pb.MetricSample)) {
+	for _, b := range r.Batches() {
+		for _, m := range b.Metrics {
+			if m.Name != name || !sameLabels(m.Labels, labels) {
+				continue
+			}
+			for _, s := range m.Samples {
+				fn(b, s)
+			}
+		}
+	}
+}
+
+// flush sends everything recorded so far, when the Recorder has an agent
+func (r *Recorder) flush() {
+	if r.agent == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := r.agent.Flush(ctx); err != nil {
+		r.t.Fatalf("agenttest: flush: %v", err)
+	}
+}
+
+// sameLabels treats nil and empty label sets alike
+func sameLabels(a, b map[string]string) bool {
+	return len(a) == 0 && len(b) == 0 || maps.Equal(a, b)
+}
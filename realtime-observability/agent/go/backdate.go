@@ -0,0 +1,148 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// maxSamplesAtPerPush bounds the timestamped samples a series holds until
+// the next push; past it the oldest are dropped and counted in
+// backdated_samples_dropped_total
+const maxSamplesAtPerPush = 1000
+
+// histogramAt is a RecordHistogramAt series: hist accumulates as any
+// histogram does, and samples holds a snapshot per observation
+type histogramAt struct {
+	hist    *Histogram
+	samples []*pb.MetricSample
+}
+
+// SetGaugeAt sets the gauge name as of ts, for readings that arrive with
+// their own time. Each call is sent with the next push as its own sample
+// stamped ts, so several within one push are all kept. ts is sent as
+// given, without the clock skew correction.
+func (a *Agent) SetGaugeAt(name string, value float64, ts time.Time) {
+	a.SetGaugeAtWithLabels(name, nil, value, ts)
+}
+
+// SetGaugeAtWithLabels is SetGaugeAt for one label combination
+func (a *Agent) SetGaugeAtWithLabels(name string, labels map[string]string, value float64, ts time.Time) {
+	key := seriesKey(name, labels)
+	sample := &pb.MetricSample{
+		TimestampNs: uint64(ts.UnixNano()),
+		Value:       &pb.MetricSample_Gauge{Gauge: value},
+	}
+
+	a.mu.Lock()
+	if !a.track(key, name, labels) {
+		a.mu.Unlock()
+		return
+	}
+	samples, dropped := trimSamplesAt(append(a.gaugesAt[key], sample))
+	a.gaugesAt[key] = samples
+	a.mu.Unlock()
+
+	a.dropSamplesAt(dropped)
+}
+
+// RecordHistogramAt records a value in the histogram name as of ts. Each
+// call is sent with the next push as its own sample stamped ts, holding
+// that observation, or the running totals with Cumulative temporality. It
+// uses the bounds of Config.HistogramBounds and is kept apart from
+// RecordHistogram's histogram of the same name.
+func (a *Agent) RecordHistogramAt(name string, value float64, ts time.Time) {
+	a.RecordHistogramAtWithLabels(name, nil, value, ts)
+}
+
+// RecordHistogramAtWithLabels is RecordHistogramAt for one label
+// combination
+func (a *Agent) RecordHistogramAtWithLabels(name string, labels map[string]string, value float64, ts time.Time) {
+	key := seriesKey(name, labels)
+	a.mu.Lock()
+	h, ok := a.histogramsAt[key]
+	if !ok {
+		bounds := a.config.HistogramBounds[name]
+		if bounds == nil {
+			bounds = DefaultHistogramBounds
+		}
+		hist, err := NewHistogramWithBounds(bounds)
+		if err != nil {
+			a.rejectValue(key, "histogram "+name, err)
+			a.mu.Unlock()
+			return
+		}
+		if !a.track(key, name, labels) {
+			a.mu.Unlock()
+			return
+		}
+		hist.cumulative = a.config.HistogramTemporality == Cumulative
+		h = &histogramAt{hist: hist}
+		a.histogramsAt[key] = h
+	}
+
+	h.hist.Record(value)
+	bounds, counts, sum, count := h.hist.snapshot()
+	sample := &pb.MetricSample{
+		TimestampNs: uint64(ts.UnixNano()),
+		Value: &pb.MetricSample_Histogram{
+			Histogram: &pb.Histogram{Bounds: bounds, Counts: counts, Sum: &sum, Count: &count},
+		},
+	}
+	var dropped int
+	h.samples, dropped = trimSamplesAt(append(h.samples, sample))
+	a.mu.Unlock()
+
+	a.dropSamplesAt(dropped)
+}
+
+// trimSamplesAt drops the oldest samples past maxSamplesAtPerPush and
+// returns the rest and how many were dropped
+func trimSamplesAt(samples []*pb.MetricSample) ([]*pb.MetricSample, int) {
+	dropped := len(samples) - maxSamplesAtPerPush
+	if dropped <= 0 {
+		return samples, 0
+	}
+	return append(samples[:0], samples[dropped:]...), dropped
+}
+
+// dropSamplesAt counts dropped timestamped samples; called without a.mu
+func (a *Agent) dropSamplesAt(dropped int) {
+	if dropped == 0 {
+		return
+	}
+	if a.samplesAtDropped.Add(uint64(dropped)) == uint64(dropped) {
+		a.logf("More than %d timestamped samples for one series between pushes; dropping the oldest", maxSamplesAtPerPush)
+	}
+	a.AddCounter("backdated_samples_dropped_total", uint64(dropped))
+}
+
+// collectSamplesAt takes the timestamped samples recorded since the last
+// collection, one metric per series; caller holds collectMu
+func (a *Agent) collectSamplesAt() []*pb.Metric {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var metrics []*pb.Metric
+	take := func(key string, samples []*pb.MetricSample) {
+		if len(samples) == 0 {
+			return
+		}
+		metrics = append(metrics, &pb.Metric{
+			Name:    a.series[key].name,
+			Labels:  a.series[key].labels,
+			Samples: samples,
+		})
+	}
+	for key, samples := range a.gaugesAt {
+		take(key, samples)
+		a.gaugesAt[key] = nil
+	}
+	for key, h := range a.histogramsAt {
+		take(key, h.samples)
+		h.samples = nil
+	}
+	return metrics
+}
@@ -0,0 +1,53 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricOverhead is the field tag and length prefix around each metric in
+// an encoded batch
+const metricOverhead = 6
+
+// splitBatch cuts a collected batch into batches of at most
+// Config.BatchSize metrics and about Config.MaxBatchBytes encoded bytes.
+// A metric is never split, so one larger than the byte cap goes alone.
+// Every batch keeps the service, instance and attributes; descriptions
+// and events ride on the first.
+func (a *Agent) splitBatch(batch *pb.TelemetryBatch) []*pb.TelemetryBatch {
+	maxMetrics, maxBytes := a.config.BatchSize, a.config.MaxBatchBytes
+	if maxMetrics <= 0 && maxBytes <= 0 {
+		return []*pb.TelemetryBatch{batch}
+	}
+
+	chunk := func(metrics []*pb.Metric) *pb.TelemetryBatch {
+		return &pb.TelemetryBatch{
+			Service:    batch.Service,
+			Instance:   batch.Instance,
+			Metrics:    metrics,
+			Attributes: batch.Attributes,
+
+			HistogramTemporality: batch.HistogramTemporality,
+		}
+	}
+	header := proto.Size(chunk(nil))
+
+	var batches []*pb.TelemetryBatch
+	start, size := 0, header+proto.Size(&pb.TelemetryBatch{Descriptions: batch.Descriptions, Events: batch.Events})
+	for i, m := range batch.Metrics {
+		msize := proto.Size(m) + metricOverhead
+		full := maxMetrics > 0 && i-start >= maxMetrics ||
+			maxBytes > 0 && size+msize > maxBytes && i > start
+		if full {
+			batches = append(batches, chunk(batch.Metrics[start:i]))
+			start, size = i, header
+		}
+		size += msize
+	}
+	batches = append(batches, chunk(batch.Metrics[start:]))
+	batches[0].Descriptions = batch.Descriptions
+	batches[0].Events = batch.Events
+	return batches
+}
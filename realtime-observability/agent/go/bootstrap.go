@@ -0,0 +1,82 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// renewRetryInterval spaces out renewal attempts after a failure
+const renewRetryInterval = 5 * time.Second
+
+// issuedKey is the per-instance key obtained through ExchangeToken
+type issuedKey struct {
+	key      string
+	renewAt  time.Time
+	expireAt time.Time
+}
+
+// apiKey returns the key streams authenticate with
+func (a *Agent) apiKey() string {
+	if a.config.BootstrapToken != "" {
+		return a.issued.key
+	}
+	return a.config.APIKey
+}
+
+// exchangeToken trades the bootstrap token, or the current issued key, for
+// a fresh key. Renewal is scheduled at 80% of the lifetime, measured on the
+// local clock so skew with the aggregator does not matter.
+func (a *Agent) exchangeToken(ctx context.Context) error {
+	req := &pb.ExchangeTokenRequest{Instance: a.config.InstanceID}
+	if a.issued.key != "" {
+		req.CurrentKey = a.issued.key
+	} else {
+		req.BootstrapToken = a.config.BootstrapToken
+	}
+
+	resp, err := a.client.ExchangeToken(a.withMetadata(ctx), req)
+	if err != nil {
+		return fmt.Errorf("token exchange: %w", err)
+	}
+	if resp.Service != a.config.ServiceName {
+		a.logf("Issued key is scoped to service %q, agent reports as %q", resp.Service, a.config.ServiceName)
+	}
+
+	now := a.clock.Now()
+	lifetime := time.Unix(0, resp.ExpiresAt).Sub(time.Now())
+	a.issued = issuedKey{
+		key:      resp.ApiKey,
+		renewAt:  now.Add(lifetime * 4 / 5),
+		expireAt: now.Add(lifetime),
+	}
+	return nil
+}
+
+// renewKey re-exchanges the issued key once it is due and moves sending to
+// a stream opened with the new key; a failure is retried on later pushes
+// while the old key is still valid
+func (a *Agent) renewKey() {
+	if a.config.BootstrapToken == "" || a.clock.Now().Before(a.issued.renewAt) {
+		return
+	}
+
+	if err := a.exchangeToken(a.ctx); err != nil {
+		a.logf("Failed to renew API key (expires %s): %v", a.issued.expireAt.Format(time.RFC3339), err)
+		a.issued.renewAt = a.clock.Now().Add(renewRetryInterval)
+		return
+	}
+
+	old := a.stream
+	if err := a.openStream(a.ctx); err != nil {
+		a.logf("Failed to reopen stream with renewed key: %v", err)
+		return
+	}
+	if old != nil {
+		old.CloseAndRecv()
+	}
+}
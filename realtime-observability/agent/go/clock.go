@@ -0,0 +1,34 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"time"
+)
+
+// clock abstracts time so the push schedule can be driven by a fake in tests
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+}
+
+// timer is the subset of *time.Timer used by the push loop
+type timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+func (t realTimer) Stop() bool { return t.t.Stop() }
@@ -0,0 +1,88 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// clockProbeInterval spaces out clock offset probes
+	clockProbeInterval = 30 * time.Second
+	// clockProbeTimeout bounds one probe
+	clockProbeTimeout = 5 * time.Second
+	// clockOffsetAlpha weighs each probe in the smoothed offset
+	clockOffsetAlpha = 0.2
+)
+
+// probesClock reports whether the agent runs clockProbeLoop: to read
+// the aggregator's push interval hint, or to correct clock skew
+func (c Config) probesClock() bool {
+	return c.Sink == nil && (c.CorrectClockSkew || c.adaptive())
+}
+
+// clockProbeLoop probes the aggregator at Start and then every
+// clockProbeInterval until Stop, on its own goroutine so a slow aggregator
+// never holds up sends
+func (a *Agent) clockProbeLoop() {
+	defer a.wg.Done()
+	for {
+		a.probeClock()
+		t := a.clock.NewTimer(clockProbeInterval)
+		select {
+		case <-a.loopDone:
+			t.Stop()
+			return
+		case <-t.C():
+		}
+	}
+}
+
+// probeClock opens an empty stream and closes it at once. The ack carries
+// the aggregator's push interval hint, which streams otherwise only see
+// when the agent ends them. With Config.CorrectClockSkew it also measures
+// the offset from the local clock to the aggregator's: the ack's time is
+// taken to be half the round trip after the send, and the offset is an
+// EWMA of those measurements.
+func (a *Agent) probeClock() {
+	// The sender replaces the client and the issued key under pushMu
+	a.pushMu.Lock()
+	client := a.client
+	streamCtx := a.withAPIKey(a.withMetadata(a.loopCtx))
+	a.pushMu.Unlock()
+	if client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(streamCtx, clockProbeTimeout)
+	defer cancel()
+	sent := time.Now()
+	stream, err := client.StreamTelemetry(ctx, a.config.callOptions()...)
+	if err != nil {
+		return
+	}
+	ack, err := stream.CloseAndRecv()
+	rtt := time.Since(sent)
+	if err == nil {
+		a.pushMu.Lock()
+		a.applyHint(ack)
+		a.pushMu.Unlock()
+	}
+	if !a.config.CorrectClockSkew || err != nil || ack.ReceiveTimeNs == 0 {
+		// Down, or an aggregator too old to report its time
+		return
+	}
+
+	measured := float64(int64(ack.ReceiveTimeNs) - sent.Add(rtt/2).UnixNano())
+	if !a.clockProbed {
+		a.clockProbed = true
+		a.smoothedOffset = measured
+	} else {
+		a.smoothedOffset += clockOffsetAlpha * (measured - a.smoothedOffset)
+	}
+	offset := time.Duration(a.smoothedOffset)
+	if prev := time.Duration(a.clockOffset.Swap(int64(offset))); prev.Abs() < time.Second && offset.Abs() >= time.Second {
+		a.logf("Local clock is %v off the aggregator's; correcting sample timestamps", offset.Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+// validateCompression checks Config.Compression
+func validateCompression(name string) error {
+	switch name {
+	case "", "none", gzip.Name:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q; use \"none\" or \"gzip\"", name)
+}
+
+// callOptions returns the options for the telemetry stream
+func (c Config) callOptions() []grpc.CallOption {
+	if c.Compression == gzip.Name {
+		return []grpc.CallOption{grpc.UseCompressor(gzip.Name)}
+	}
+	return nil
+}
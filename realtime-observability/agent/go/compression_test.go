@@ -0,0 +1,231 @@
+//go:build !notelemetry
+
+package agent_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	agent "github.com/yourorg/agent"
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ingestor is a TelemetryIngestor keeping every batch it receives and the
+// encoding of every stream
+type ingestor struct {
+	pb.UnimplementedTelemetryIngestorServer
+
+	batches   []*pb.TelemetryBatch
+	encodings []string
+	mu        sync.Mutex
+}
+
+func (s *ingestor) StreamTelemetry(stream grpc.ClientStreamingServer[pb.TelemetryBatch, pb.Ack]) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&pb.Ack{Ok: true})
+		}
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.batches = append(s.batches, batch)
+		s.mu.Unlock()
+	}
+}
+
+// TagRPC, HandleRPC, TagConn and HandleConn make ingestor a stats.Handler
+// recording the grpc-encoding of incoming streams
+func (s *ingestor) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+
+func (s *ingestor) HandleRPC(_ context.Context, st stats.RPCStats) {
+	if h, ok := st.(*stats.InHeader); ok {
+		s.mu.Lock()
+		s.encodings = append(s.encodings, h.Compression)
+		s.mu.Unlock()
+	}
+}
+
+func (s *ingestor) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+
+func (s *ingestor) HandleConn(context.Context, stats.ConnStats) {}
+
+// sentBatches is a stream interceptor keeping a copy of every batch the
+// agent sends, before compression
+type sentBatches struct {
+	batches []*pb.TelemetryBatch
+	mu      sync.Mutex
+}
+
+func (c *sentBatches) intercept(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return capturingStream{stream, c}, nil
+}
+
+type capturingStream struct {
+	grpc.ClientStream
+	sent *sentBatches
+}
+
+func (s capturingStream) SendMsg(m any) error {
+	if batch, ok := m.(*pb.TelemetryBatch); ok {
+		s.sent.mu.Lock()
+		s.sent.batches = append(s.sent.batches, proto.Clone(batch).(*pb.TelemetryBatch))
+		s.sent.mu.Unlock()
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+// newCompressionAgent returns a connected agent sending to addr with the
+// given compression
+func newCompressionAgent(t *testing.T, addr, compression string, change func(cfg *agent.Config)) *agent.Agent {
+	t.Helper()
+	cfg := agent.DefaultConfig()
+	cfg.ServiceName = "edge-service"
+	cfg.AutoDetectKubernetes = false
+	cfg.AggregatorAddr = addr
+	cfg.Compression = compression
+	if change != nil {
+		change(&cfg)
+	}
+	a, err := agent.NewAgent(cfg)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	if err := a.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(a.Stop)
+	return a
+}
+
+func TestCompressedStreamRoundTrips(t *testing.T) {
+	for _, tc := range []struct {
+		compression string
+		encoding    string
+	}{
+		{"", ""},
+		{"none", ""},
+		{"gzip", "gzip"},
+	} {
+		srv := &ingestor{}
+		server := grpc.NewServer(grpc.StatsHandler(srv))
+		pb.RegisterTelemetryIngestorServer(server, srv)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		go server.Serve(lis)
+
+		sent := &sentBatches{}
+		a := newCompressionAgent(t, lis.Addr().String(), tc.compression, func(cfg *agent.Config) {
+			cfg.DialOptions = []agent.DialOption{grpc.WithStreamInterceptor(sent.intercept)}
+		})
+		// Repeated names are what compression is for
+		for i := range 50 {
+			a.SetGauge("edge_link_utilization_ratio", float64(i))
+			a.IncCounter("edge_link_requests_total")
+			a.RecordHistogram("edge_link_request_duration_ms", float64(i))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := a.Flush(ctx); err != nil {
+			t.Fatalf("compression %q: Flush: %v", tc.compression, err)
+		}
+		cancel()
+		a.Stop()
+		server.Stop()
+
+		if len(sent.batches) == 0 {
+			t.Fatalf("compression %q: no batch sent", tc.compression)
+		}
+		if len(srv.batches) != len(sent.batches) {
+			t.Fatalf("compression %q: received %d batches, sent %d", tc.compression, len(srv.batches), len(sent.batches))
+		}
+		for i := range sent.batches {
+			if !proto.Equal(srv.batches[i], sent.batches[i]) {
+				t.Fatalf("compression %q: batch %d received as\n%v\nwant\n%v", tc.compression, i, srv.batches[i], sent.batches[i])
+			}
+		}
+		if len(srv.encodings) == 0 {
+			t.Fatalf("compression %q: no stream seen", tc.compression)
+		}
+		for _, enc := range srv.encodings {
+			if enc != tc.encoding {
+				t.Fatalf("compression %q: stream encoding %q, want %q", tc.compression, enc, tc.encoding)
+			}
+		}
+	}
+}
+
+func TestUnknownCompressionRejected(t *testing.T) {
+	cfg := agent.DefaultConfig()
+	cfg.ServiceName = "edge-service"
+	cfg.AutoDetectKubernetes = false
+	cfg.Compression = "zstd"
+	if _, err := agent.NewAgent(cfg); err == nil {
+		t.Fatalf("NewAgent with compression zstd: want an error")
+	}
+}
+
+func TestServerWithoutDecompressor(t *testing.T) {
+	// gzip is registered process-wide once the agent imports it, so no
+	// server in this binary lacks it. The stream is handed to the server
+	// under an encoding nothing registers, as gzip is to an aggregator
+	// built without it.
+	srv := &ingestor{}
+	server := grpc.NewServer()
+	pb.RegisterTelemetryIngestorServer(server, srv)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("grpc-encoding") == "gzip" {
+			r.Header.Set("grpc-encoding", "gzip-unavailable")
+		}
+		server.ServeHTTP(w, r)
+	})
+	hs := httptest.NewUnstartedServer(handler)
+	hs.EnableHTTP2 = true
+	hs.StartTLS()
+	defer hs.Close()
+	defer server.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+	a := newCompressionAgent(t, hs.Listener.Addr().String(), "gzip", func(cfg *agent.Config) {
+		cfg.TLSConfig = &tls.Config{RootCAs: roots}
+	})
+
+	// The first send is buffered before the server answers; the stream's
+	// status surfaces on the next one
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var err error
+	for err == nil {
+		a.SetGauge("edge_link_utilization_ratio", 1)
+		err = a.Flush(ctx)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("Flush hung until the deadline")
+	}
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Flush = %v, want Unimplemented", err)
+	}
+	if len(srv.batches) != 0 {
+		t.Fatalf("server decoded %d batches without a decompressor", len(srv.batches))
+	}
+}
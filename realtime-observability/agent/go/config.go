@@ -0,0 +1,311 @@
+package agent
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Reconnect defaults, used when the Config fields are zero
+const (
+	DefaultReconnectMinBackoff = 100 * time.Millisecond
+	DefaultReconnectMaxBackoff = 10 * time.Second
+	DefaultMaxBufferedBatches  = 500
+	DefaultFailoverAfter       = 3
+	DefaultSendQueueSize       = 16
+	DefaultMaxBatchBytes       = 1 << 20
+	DefaultSendTimeout         = 5 * time.Second
+	DefaultStopTimeout         = 2 * time.Second
+	DefaultMaxPushInterval     = 5 * time.Second
+)
+
+// DefaultGRPCSkipMethods are left unrecorded by the gRPC interceptors when
+// Config.GRPCSkipMethods is nil: health checks would swamp real traffic
+var DefaultGRPCSkipMethods = []string{
+	"/grpc.health.v1.Health/Check",
+	"/grpc.health.v1.Health/Watch",
+}
+
+// DefaultMaxSeries caps the series an agent holds when Config.MaxSeries
+// is zero
+const DefaultMaxSeries = 10000
+
+// DefaultMaxRoutes caps the distinct routes TrackRequestWithInfo labels
+// when Config.MaxRoutes is zero
+const DefaultMaxRoutes = 100
+
+// Config holds agent configuration
+type Config struct {
+	// AggregatorAddr is host:port, or unix:///path for a local socket
+	AggregatorAddr string
+	// AggregatorAddrs, if set, replaces AggregatorAddr with several
+	// aggregators: Connect tries them in order, and after FailoverAfter
+	// failed sends or reconnects in a row (DefaultFailoverAfter when
+	// zero), or FailoverWindow without a successful send, the agent moves
+	// to the next one, round-robin
+	AggregatorAddrs []string
+	FailoverAfter   int
+	FailoverWindow  time.Duration
+	ServiceName     string
+	// InstanceID identifies this process. When empty it comes from
+	// InstanceIDFunc, else the pod name when Kubernetes is detected, else a
+	// random 16-character ID.
+	InstanceID string
+	// InstanceIDFunc, if set, builds the instance ID when InstanceID is
+	// empty, for schemes such as hostname-pid; an empty result falls
+	// through to the next source
+	InstanceIDFunc func() string
+	APIKey         string
+	// BootstrapToken, if set, is exchanged at Connect for a short-lived
+	// per-instance API key, which is renewed before it expires and never
+	// written anywhere. APIKey is ignored.
+	BootstrapToken string
+	// Metadata is sent as extra gRPC headers on every call, for proxies in
+	// front of the aggregator. Keys are lowercased; x-api-key is refused
+	// in favour of APIKey.
+	Metadata map[string]string
+	// DialOptions are passed to grpc.NewClient after the agent's own, so
+	// they can override them
+	DialOptions []DialOption
+	// Compression is "gzip" to compress the stream, for constrained
+	// links, or "none" (or empty) to send it as is
+	Compression string
+	// MirrorAddr, if set, also streams every batch to this aggregator, as
+	// when migrating to a new one. The mirror has its own connection,
+	// queue, offline buffer and reconnect backoff, so its failures never
+	// delay the primary; it authenticates with APIKey and Metadata even
+	// with BootstrapToken. See EnableMirror to change it at runtime.
+	MirrorAddr string
+	// CorrectClockSkew estimates the offset to the aggregator's clock
+	// every 30s and shifts sample timestamps by it, for hosts whose clocks
+	// drift
+	CorrectClockSkew bool
+
+	// PushInterval is how often metrics are sent, at least MinPushInterval
+	PushInterval time.Duration
+	// MaxPushInterval lets the interval double on each failed send, send
+	// slower than the interval, or Ack asking for it, up to this; it steps
+	// back by a quarter after every 10 quick sends. At or below
+	// PushInterval (such as zero) the interval stays fixed.
+	MaxPushInterval time.Duration
+	// BatchSize and MaxBatchBytes split each push into batches of at most
+	// this many metrics (at least 1) and about this many encoded bytes
+	// (0 = no limit), keeping them under the gRPC message limit (4MB by
+	// default). A metric's samples always stay in one batch.
+	BatchSize     int
+	MaxBatchBytes int
+
+	// AllowDefaults lets NewAgent fill a zero AggregatorAddr,
+	// PushInterval and BatchSize with the DefaultConfig values instead of
+	// rejecting them, so Config{ServiceName: "x"} is enough
+	AllowDefaults bool
+
+	// ReconnectMinBackoff and ReconnectMaxBackoff bound the exponential
+	// backoff between attempts to re-open a failed stream.
+	// MaxBufferedBatches caps the batches buffered meanwhile, and so the
+	// memory held during an outage; past it the oldest are dropped so the
+	// newest data wins. Zero values use the Default* constants.
+	ReconnectMinBackoff time.Duration
+	ReconnectMaxBackoff time.Duration
+	MaxBufferedBatches  int
+
+	// SendQueueSize bounds the batches collected but not yet handed to
+	// the sender goroutine (DefaultSendQueueSize when zero); past it the
+	// oldest are dropped and counted in send_queue_dropped_total
+	SendQueueSize int
+
+	// SendTimeout bounds each batch Send on the aggregator stream
+	// (DefaultSendTimeout when zero). A send still blocked after it, as on
+	// a blackholed connection, fails: the stream is abandoned and
+	// reopened after the reconnect backoff, and the batch is buffered.
+	SendTimeout time.Duration
+
+	// PushJitter randomizes each push by up to this fraction of
+	// PushInterval (0.1 = ±5%) so a fleet restarted together does not push
+	// in lockstep. The first push is also delayed by a random fraction of
+	// the interval. The schedule itself stays drift-free.
+	PushJitter float64
+
+	// ExemplarThreshold captures tracked requests at least this slow as
+	// exemplars on the latency histogram (0 = no minimum)
+	ExemplarThreshold time.Duration
+	// ExemplarsPerSecond keeps at most the slowest N exemplars per second
+	// per histogram (0 = default of 5 when ExemplarThreshold is set)
+	ExemplarsPerSecond int
+
+	// GaugeHistory, if positive, sends up to this many SetGauge values per
+	// gauge per push, each stamped when it was set, instead of only the
+	// last. Past the bound the window is downsampled evenly, keeping the
+	// last value.
+	GaugeHistory int
+
+	// GaugeAggregation sets how SetGaugeAgg combines values between
+	// pushes, by gauge name; unlisted names use AggLast
+	GaugeAggregation map[string]AggMode
+
+	// GroupIntervals sets the push interval of each metric group named in
+	// SetGaugeInGroup; ungrouped metrics go every PushInterval, and
+	// intervals are rounded to whole pushes
+	GroupIntervals map[string]time.Duration
+
+	// RateSmoothing, if set, also sends each MarkRate gauge as
+	// <name>_per_sec_ewma, an exponentially weighted moving average with
+	// this time constant, e.g. 10s
+	RateSmoothing time.Duration
+
+	// SummaryMaxAge makes RecordSummary quantiles cover a sliding window
+	// of this age instead of resetting on every push
+	SummaryMaxAge time.Duration
+
+	// SelfTelemetry sends the agent's own pipeline metrics (agent_*) with
+	// every batch; DefaultConfig enables it
+	SelfTelemetry bool
+
+	// MaxSeries caps the gauge, counter and histogram series the agent
+	// holds; values for new series past it are dropped and counted in
+	// agent_dropped_series_total
+	MaxSeries int
+
+	// MaxRoutes caps the distinct route labels from TrackRequestWithInfo;
+	// later routes are labeled "other" so series stay bounded
+	MaxRoutes int
+	// RouteNormalizer maps requests to routes in HTTPMiddleware (default
+	// DefaultRouteNormalizer)
+	RouteNormalizer RouteNormalizer
+	// GRPCSkipMethods are full method names the gRPC interceptors do not
+	// record; nil uses DefaultGRPCSkipMethods, empty records everything
+	GRPCSkipMethods []string
+
+	// HistogramBounds sets the bucket upper bounds of histograms by metric
+	// name; others use DefaultHistogramBounds. Bounds must be strictly
+	// increasing, which NewAgent checks.
+	HistogramBounds map[string][]float64
+
+	// HistogramSampleRate records only this fraction, in (0, 1], of the
+	// values of the named histograms, skipping the rest before any lock;
+	// counts and sums are scaled back up when sent. Unlisted histograms
+	// record every value.
+	HistogramSampleRate map[string]float64
+
+	// HistogramTemporality is Delta (default) to send each push's
+	// observations, or Cumulative to send running totals; the batch says
+	// which, and the aggregator diffs cumulative ones
+	HistogramTemporality Temporality
+
+	// Logger receives the agent's log output (default: the standard
+	// logger). Lines about a failing stream are limited to one per 5s,
+	// with a count of those suppressed.
+	Logger Logger
+
+	// ResourceAttributes are sent with every batch so the aggregator can
+	// show where instances run. They override the detected host.name,
+	// process.pid, process.runtime.version, service.version and Kubernetes
+	// attributes; an empty value removes one.
+	ResourceAttributes map[string]string
+
+	// AutoDetectKubernetes attaches the pod name, namespace, node and
+	// container ID as resource labels from the downward API env vars
+	// (POD_NAME, POD_NAMESPACE, NODE_NAME) and mounted files. Detection is
+	// bounded by a short timeout and adds nothing off-cluster. DefaultConfig
+	// enables it when KUBERNETES_SERVICE_HOST is set.
+	AutoDetectKubernetes bool
+
+	// TLSEnabled connects to the aggregator over TLS, verifying it against
+	// TLSCAFile (default: system roots). TLSCertFile and TLSKeyFile add a
+	// client certificate. Connect fails if a file cannot be loaded.
+	TLSEnabled            bool
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSCAFile             string
+	TLSInsecureSkipVerify bool
+	// TLSConfig, if set, is used as-is and overrides the fields above
+	TLSConfig *tls.Config
+
+	// Sink, if set, receives the batches instead of an aggregator: Connect
+	// dials nothing and the address fields are ignored. See the agenttest
+	// package for an in-memory one.
+	Sink Sink
+
+	// RemoteConfig, from Start, watches the configuration the aggregator
+	// pushes for ServiceName and applies its push interval, metric
+	// denylist, histogram sample rates and FeatureFlags values within
+	// RemoteConfigBounds. Each push holds for the lease it names; once that
+	// runs out without a renewal, as when the aggregator dies, the agent
+	// goes back to this Config. The applied version is sent as the
+	// telemetry.config.version resource attribute.
+	RemoteConfig       bool
+	RemoteConfigBounds RemoteConfigBounds
+
+	// FeatureFlags declares the flags read with FeatureFlag, with their
+	// local values; RemoteConfig may only set flags declared here
+	FeatureFlags map[string]bool
+}
+
+// RemoteConfigBounds limits what a configuration pushed through
+// Config.RemoteConfig may change; pushed values are clamped to them
+type RemoteConfigBounds struct {
+	// MinPushInterval and MaxPushInterval bound a pushed push interval;
+	// zero means PushInterval and 10 times it, so by default the
+	// aggregator may only slow the agent down
+	MinPushInterval time.Duration
+	MaxPushInterval time.Duration
+	// MinSampleRate is the lowest histogram sample rate applied; lower
+	// pushed rates are raised to it (0 means 0.01)
+	MinSampleRate float64
+	// ProtectedMetrics are never dropped by a pushed denylist
+	ProtectedMetrics []string
+}
+
+// DefaultConfig returns default agent configuration
+func DefaultConfig() Config {
+	return Config{
+		AggregatorAddr: DefaultAggregatorAddr,
+		ServiceName:    "default",
+		PushInterval:   DefaultPushInterval,
+		BatchSize:      DefaultBatchSize,
+		MaxBatchBytes:  DefaultMaxBatchBytes,
+		PushJitter:     0.1,
+		MaxRoutes:      DefaultMaxRoutes,
+		MaxSeries:      DefaultMaxSeries,
+		SelfTelemetry:  true,
+
+		ReconnectMinBackoff: DefaultReconnectMinBackoff,
+		ReconnectMaxBackoff: DefaultReconnectMaxBackoff,
+		MaxBufferedBatches:  DefaultMaxBufferedBatches,
+		MaxPushInterval:     DefaultMaxPushInterval,
+
+		AutoDetectKubernetes: os.Getenv("KUBERNETES_SERVICE_HOST") != "",
+	}
+}
+
+// instanceIDLength is the length of a generated instance ID; 16 base-36
+// characters make a collision in a fleet of a million about 1 in 10^13
+const instanceIDLength = 16
+
+// generateInstanceID returns a random instance ID from crypto/rand. Bytes
+// past the last multiple of 36 are skipped so every character is equally
+// likely.
+func generateInstanceID() string {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	const limit = 256 - 256%len(charset)
+
+	id := make([]byte, 0, instanceIDLength)
+	buf := make([]byte, instanceIDLength*2)
+	for len(id) < instanceIDLength {
+		if _, err := cryptorand.Read(buf); err != nil {
+			// Not expected from the OS source; math/rand is seeded per
+			// process, so IDs still differ between replicas
+			for i := range buf {
+				buf[i] = byte(rand.Intn(limit))
+			}
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(id) < instanceIDLength {
+				id = append(id, charset[int(b)%len(charset)])
+			}
+		}
+	}
+	return string(id)
+}
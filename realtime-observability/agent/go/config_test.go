@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// discardSink is a Sink that drops every batch
+type discardSink struct{}
+
+func (discardSink) Send(*pb.TelemetryBatch) error { return nil }
+
+func TestConfigValidate(t *testing.T) {
+	valid := DefaultConfig()
+	valid.ServiceName = "checkout"
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		fields []string
+	}{
+		{name: "default config with a service name"},
+		{name: "unix socket", change: func(c *Config) { c.AggregatorAddr = "unix:///run/aggregator.sock" }},
+		{name: "grpc target", change: func(c *Config) { c.AggregatorAddr = "dns:///aggregator:9000" }},
+		{name: "failover addresses", change: func(c *Config) {
+			c.AggregatorAddr = ""
+			c.AggregatorAddrs = []string{"a:9000", "b:9000"}
+		}},
+		{name: "sink needs no address", change: func(c *Config) {
+			c.AggregatorAddr = ""
+			c.Sink = discardSink{}
+		}},
+		{name: "blank service name", change: func(c *Config) { c.ServiceName = "  " }, fields: []string{"ServiceName"}},
+		{name: "push interval below minimum", change: func(c *Config) { c.PushInterval = MinPushInterval - 1 }, fields: []string{"PushInterval"}},
+		{name: "zero batch size", change: func(c *Config) { c.BatchSize = 0 }, fields: []string{"BatchSize"}},
+		{name: "negative gauge history", change: func(c *Config) { c.GaugeHistory = -1 }, fields: []string{"GaugeHistory"}},
+		{name: "negative max push interval", change: func(c *Config) { c.MaxPushInterval = -1 }, fields: []string{"MaxPushInterval"}},
+		{name: "negative rate smoothing", change: func(c *Config) { c.RateSmoothing = -1 }, fields: []string{"RateSmoothing"}},
+		{name: "unknown temporality", change: func(c *Config) { c.HistogramTemporality = 7 }, fields: []string{"HistogramTemporality"}},
+		{name: "missing port", change: func(c *Config) { c.AggregatorAddr = "localhost" }, fields: []string{"AggregatorAddr"}},
+		{name: "port out of range", change: func(c *Config) { c.AggregatorAddr = "localhost:70000" }, fields: []string{"AggregatorAddr"}},
+		{name: "empty socket path", change: func(c *Config) { c.AggregatorAddr = "unix://" }, fields: []string{"AggregatorAddr"}},
+		{name: "empty grpc target", change: func(c *Config) { c.AggregatorAddr = "dns:///" }, fields: []string{"AggregatorAddr"}},
+		{name: "bad failover address", change: func(c *Config) { c.AggregatorAddrs = []string{"a:9000", "b"} }, fields: []string{"AggregatorAddrs[1]"}},
+		{name: "bad mirror address", change: func(c *Config) { c.MirrorAddr = "mirror" }, fields: []string{"MirrorAddr"}},
+		{name: "sink with bootstrap token", change: func(c *Config) {
+			c.Sink = discardSink{}
+			c.BootstrapToken = "token"
+		}, fields: []string{"BootstrapToken"}},
+		{name: "sink with clock skew correction", change: func(c *Config) {
+			c.Sink = discardSink{}
+			c.CorrectClockSkew = true
+		}, fields: []string{"CorrectClockSkew"}},
+		{name: "every problem at once", change: func(c *Config) {
+			c.ServiceName = ""
+			c.PushInterval = 0
+			c.BatchSize = 0
+		}, fields: []string{"ServiceName", "PushInterval", "BatchSize"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			if tt.change != nil {
+				tt.change(&cfg)
+			}
+			if got := configErrorFields(cfg.Validate()); !slices.Equal(got, tt.fields) {
+				t.Fatalf("invalid fields = %v, want %v", got, tt.fields)
+			}
+		})
+	}
+}
+
+func TestConfigWithDefaults(t *testing.T) {
+	cfg := Config{ServiceName: "checkout"}.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate after withDefaults: %v", err)
+	}
+	if cfg.AggregatorAddr != DefaultAggregatorAddr || cfg.PushInterval != DefaultPushInterval || cfg.BatchSize != DefaultBatchSize {
+		t.Fatalf("withDefaults = %+v", cfg)
+	}
+
+	// Failover addresses stand in for AggregatorAddr
+	cfg = Config{ServiceName: "checkout", AggregatorAddrs: []string{"a:9000"}}.withDefaults()
+	if cfg.AggregatorAddr != "" {
+		t.Fatalf("AggregatorAddr = %q, want it left empty", cfg.AggregatorAddr)
+	}
+}
+
+// configErrorFields returns the fields of the *ConfigErrors joined in err
+func configErrorFields(err error) []string {
+	if err == nil {
+		return nil
+	}
+	var fields []string
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var ce *ConfigError
+		if errors.As(e, &ce) {
+			fields = append(fields, ce.Field)
+		}
+	}
+	return fields
+}
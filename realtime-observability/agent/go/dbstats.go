@@ -0,0 +1,86 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// dbPool is a connection pool reported by CollectDBStats. last holds the
+// cumulative stats of the previous push, so wait and close counts go out
+// per interval; it is only touched under collectMu.
+type dbPool struct {
+	db   *sql.DB
+	last sql.DBStats
+}
+
+// CollectDBStats reports db.Stats() on every push as gauges prefixed
+// db_<name>_: open_connections, in_use and idle as they are, and
+// wait_count, wait_duration_ms and max_idle_closed as the change since
+// the previous push. Registering a name again replaces its pool; an empty
+// name or nil db is logged and ignored.
+func (a *Agent) CollectDBStats(name string, db *sql.DB) {
+	if name == "" || db == nil {
+		a.logf("Ignoring database stats for pool %q: name and db are required", name)
+		return
+	}
+	pool := &dbPool{db: db, last: db.Stats()}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.dbPools[name] = pool
+}
+
+// StopDBStats stops reporting the pool registered under name
+func (a *Agent) StopDBStats(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.dbPools, name)
+}
+
+// collectDBStats snapshots every pool, outside a.mu since Stats takes the
+// pool's own lock; caller holds collectMu
+func (a *Agent) collectDBStats(now uint64) []*pb.Metric {
+	a.mu.RLock()
+	if len(a.dbPools) == 0 {
+		a.mu.RUnlock()
+		return nil
+	}
+	names := make([]string, 0, len(a.dbPools))
+	pools := make(map[string]*dbPool, len(a.dbPools))
+	for name, pool := range a.dbPools {
+		names = append(names, name)
+		pools[name] = pool
+	}
+	a.mu.RUnlock()
+	sort.Strings(names)
+
+	metrics := make([]*pb.Metric, 0, 6*len(names))
+	for _, name := range names {
+		pool := pools[name]
+		stats := pool.db.Stats()
+		prefix := "db_" + name + "_"
+		gauge := func(suffix string, value float64) {
+			metrics = append(metrics, &pb.Metric{
+				Name: prefix + suffix,
+				Samples: []*pb.MetricSample{
+					{
+						TimestampNs: now,
+						Value:       &pb.MetricSample_Gauge{Gauge: value},
+					},
+				},
+			})
+		}
+		gauge("open_connections", float64(stats.OpenConnections))
+		gauge("in_use", float64(stats.InUse))
+		gauge("idle", float64(stats.Idle))
+		gauge("wait_count", float64(stats.WaitCount-pool.last.WaitCount))
+		gauge("wait_duration_ms", float64(stats.WaitDuration-pool.last.WaitDuration)/float64(time.Millisecond))
+		gauge("max_idle_closed", float64(stats.MaxIdleClosed-pool.last.MaxIdleClosed))
+		pool.last = stats
+	}
+	return metrics
+}
@@ -0,0 +1,182 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"sort"
+	"sync"
+)
+
+// DeleteGauge stops sending the gauge, up-down counter or MarkRate gauge
+// name, with every label combination, and drops its pending SetGaugeAt
+// samples. A callback
+// registered with RegisterGaugeFunc is left alone.
+func (a *Agent) DeleteGauge(name string) {
+	a.deleteGauge(name, nil)
+}
+
+// deleteGauge is DeleteGauge for the series carrying every label in
+// within, or all of them when within is empty
+func (a *Agent) deleteGauge(name string, within map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Before gauges, whose deletion forgets the series
+	deleteSeries(a, a.gaugeHistory, name, within)
+	deleteSeries(a, a.gaugeWindows, name, within)
+	deleteSeries(a, a.gauges, name, within)
+	deleteSeries(a, a.upDowns, name, within)
+	deleteSeries(a, a.gaugesAt, name, within)
+	deleteSeries(a, a.meters, name, within)
+	syncIndex(&a.upDownIndex, a.upDowns)
+}
+
+// DeleteCounter stops sending the counter name, integer or float, with
+// every label combination
+func (a *Agent) DeleteCounter(name string) {
+	a.deleteCounter(name, nil)
+}
+
+// deleteCounter is DeleteCounter limited as deleteGauge is
+func (a *Agent) deleteCounter(name string, within map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deleteSeries(a, a.counters, name, within)
+	deleteSeries(a, a.floatCounters, name, within)
+	syncIndex(&a.counterIndex, a.counters)
+}
+
+// DeleteHistogram stops sending the histogram name, with every label
+// combination, and drops its pending exemplars and timestamped samples
+func (a *Agent) DeleteHistogram(name string) {
+	a.deleteHistogram(name, nil)
+}
+
+// deleteHistogram is DeleteHistogram limited as deleteGauge is
+func (a *Agent) deleteHistogram(name string, within map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deleteSeries(a, a.histograms, name, within)
+	deleteSeries(a, a.histogramsAt, name, within)
+	if len(within) == 0 {
+		// Exemplars are kept for the unlabeled series only
+		delete(a.exemplars, name)
+	}
+}
+
+// ResetAll forgets every gauge, counter, histogram and summary, as if
+// none had been recorded. Gauge callbacks and descriptions are kept.
+func (a *Agent) ResetAll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	clear(a.series)
+	a.health.series.Store(0)
+	clear(a.gauges)
+	clear(a.gaugeWindows)
+	clear(a.counters)
+	clear(a.upDowns)
+	clear(a.gaugesAt)
+	clear(a.histogramsAt)
+	clear(a.meters)
+	clear(a.gaugeHistory)
+	clear(a.floatCounters)
+	clear(a.histograms)
+	clear(a.exemplars)
+	clear(a.rejected)
+	clear(a.summaries)
+	clear(a.routes)
+	syncIndex(&a.counterIndex, a.counters)
+	syncIndex(&a.upDownIndex, a.upDowns)
+}
+
+// syncIndex drops entries of a lock-free index whose metric was deleted
+// from m; caller holds a.mu for writing. An increment that loaded one just
+// before is lost with the metric, as if it had landed before the delete.
+func syncIndex[V any](index *sync.Map, m map[string]V) {
+	index.Range(func(key, _ any) bool {
+		if _, ok := m[key.(string)]; !ok {
+			index.Delete(key)
+		}
+		return true
+	})
+}
+
+// MetricNames returns the sorted names of every metric the agent sends,
+// each once however many label combinations it has
+func (a *Agent) MetricNames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	seen := make(map[string]struct{}, len(a.series)+len(a.gaugeFuncs)+len(a.summaries))
+	for _, s := range a.series {
+		seen[s.name] = struct{}{}
+	}
+	for name := range a.gaugeFuncs {
+		seen[name] = struct{}{}
+	}
+	for name := range a.summaries {
+		seen[name] = struct{}{}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deleteSeries removes every series of name carrying the labels in
+// within from m, and forgets a series no other map still holds; caller
+// holds a.mu for writing
+func deleteSeries[V any](a *Agent, m map[string]V, name string, within map[string]string) {
+	for key, s := range a.series {
+		if s.name != name || !hasLabels(s.labels, within) {
+			continue
+		}
+		if _, ok := m[key]; !ok {
+			continue
+		}
+		delete(m, key)
+		delete(a.rejected, key)
+		if !a.holds(key) {
+			delete(a.series, key)
+			a.health.series.Add(-1)
+		}
+	}
+}
+
+// holds reports whether any metric map still has key; caller holds a.mu
+func (a *Agent) holds(key string) bool {
+	if _, ok := a.gauges[key]; ok {
+		return true
+	}
+	if _, ok := a.counters[key]; ok {
+		return true
+	}
+	if _, ok := a.floatCounters[key]; ok {
+		return true
+	}
+	if _, ok := a.upDowns[key]; ok {
+		return true
+	}
+	if _, ok := a.gaugesAt[key]; ok {
+		return true
+	}
+	if _, ok := a.histogramsAt[key]; ok {
+		return true
+	}
+	if _, ok := a.meters[key]; ok {
+		return true
+	}
+	_, ok := a.histograms[key]
+	return ok
+}
+
+// hasLabels reports whether labels holds every pair in want
+func hasLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
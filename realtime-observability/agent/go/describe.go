@@ -0,0 +1,110 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// descriptions holds metadata recorded through Describe and tracks which
+// entries still have to reach the aggregator on the current stream
+type descriptions struct {
+	byName  map[string]Description
+	pending map[string]struct{}
+	strings map[string]string
+}
+
+func newDescriptions() *descriptions {
+	return &descriptions{
+		byName:  make(map[string]Description),
+		pending: make(map[string]struct{}),
+		strings: make(map[string]string),
+	}
+}
+
+// intern returns a shared copy of s; types and units repeat across metrics
+func (d *descriptions) intern(s string) string {
+	if v, ok := d.strings[s]; ok {
+		return v
+	}
+	d.strings[s] = s
+	return s
+}
+
+// Describe records metadata for a metric. It is shipped with the next push
+// and again after every reconnect, so describing a metric that is already
+// reporting works. Repeating an identical description is a no-op.
+func (a *Agent) Describe(name string, d Description) {
+	a.descMu.Lock()
+	defer a.descMu.Unlock()
+
+	d.Type = a.descs.intern(d.Type)
+	d.Unit = a.descs.intern(d.Unit)
+	if prev, ok := a.descs.byName[name]; ok && prev == d {
+		return
+	}
+	a.descs.byName[name] = d
+	a.descs.pending[name] = struct{}{}
+}
+
+// takeDescriptions returns the descriptions not yet sent on this stream
+func (a *Agent) takeDescriptions() []*pb.MetricDescription {
+	a.descMu.Lock()
+	defer a.descMu.Unlock()
+
+	if len(a.descs.pending) == 0 {
+		return nil
+	}
+	result := make([]*pb.MetricDescription, 0, len(a.descs.pending))
+	for name := range a.descs.pending {
+		d := a.descs.byName[name]
+		result = append(result, &pb.MetricDescription{
+			Name: name,
+			Type: d.Type,
+			Unit: d.Unit,
+			Help: d.Help,
+		})
+	}
+	clear(a.descs.pending)
+	return result
+}
+
+// requeueDescriptions marks descriptions from a failed send as pending again
+func (a *Agent) requeueDescriptions(sent []*pb.MetricDescription) {
+	if len(sent) == 0 {
+		return
+	}
+	a.descMu.Lock()
+	defer a.descMu.Unlock()
+	for _, d := range sent {
+		a.descs.pending[d.Name] = struct{}{}
+	}
+	a.logf("Requeued %d metric descriptions", len(sent))
+}
+
+// resendDescriptions marks every description pending for a new stream
+func (a *Agent) resendDescriptions() {
+	a.descMu.Lock()
+	defer a.descMu.Unlock()
+	for name := range a.descs.byName {
+		a.descs.pending[name] = struct{}{}
+	}
+}
+
+// allDescriptions returns every description, for a stream that has seen
+// none, without touching what is pending on the main stream
+func (a *Agent) allDescriptions() []*pb.MetricDescription {
+	a.descMu.Lock()
+	defer a.descMu.Unlock()
+
+	result := make([]*pb.MetricDescription, 0, len(a.descs.byName))
+	for name, d := range a.descs.byName {
+		result = append(result, &pb.MetricDescription{
+			Name: name,
+			Type: d.Type,
+			Unit: d.Unit,
+			Help: d.Help,
+		})
+	}
+	return result
+}
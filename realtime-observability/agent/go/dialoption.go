@@ -0,0 +1,11 @@
+//go:build !notelemetry
+
+package agent
+
+import "google.golang.org/grpc"
+
+// DialOption is a grpc.DialOption for Config.DialOptions. It is declared
+// here so that Config, which both builds share, names no gRPC type: built
+// with the notelemetry tag it is any, and the agent package does not link
+// gRPC.
+type DialOption = grpc.DialOption
@@ -0,0 +1,77 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"maps"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// maxEventsPerPush bounds the events held until the next push; past it the
+// oldest are dropped and counted in events_dropped_total
+const maxEventsPerPush = 100
+
+// RecordEvent records a discrete event, such as a deploy, restart or config
+// change, to send with the next push. It is stamped with the current time,
+// shifted by the clock offset like every other timestamp, and attrs is
+// copied.
+func (a *Agent) RecordEvent(kind, message string, attrs map[string]string) {
+	e := &pb.Event{
+		TimestampNs: uint64(time.Now().UnixNano() + a.clockOffset.Load()),
+		Kind:        kind,
+		Message:     message,
+	}
+	if len(attrs) > 0 {
+		e.Attributes = maps.Clone(attrs)
+	}
+
+	a.eventMu.Lock()
+	a.events = append(a.events, e)
+	dropped := a.trimEvents()
+	a.eventMu.Unlock()
+
+	if dropped > 0 {
+		a.AddCounter("events_dropped_total", uint64(dropped))
+	}
+}
+
+// trimEvents drops the oldest events past maxEventsPerPush and returns how
+// many; caller holds eventMu
+func (a *Agent) trimEvents() int {
+	dropped := len(a.events) - maxEventsPerPush
+	if dropped <= 0 {
+		return 0
+	}
+	if a.eventsDropped.Add(uint64(dropped)) == uint64(dropped) {
+		a.logf("More than %d events between pushes; dropping the oldest", maxEventsPerPush)
+	}
+	a.events = append(a.events[:0], a.events[dropped:]...)
+	return dropped
+}
+
+// takeEvents returns the events recorded since the last collection
+func (a *Agent) takeEvents() []*pb.Event {
+	a.eventMu.Lock()
+	defer a.eventMu.Unlock()
+	events := a.events
+	a.events = nil
+	return events
+}
+
+// requeueEvents puts the events of a dropped batch back ahead of newer
+// ones, still bounded by maxEventsPerPush
+func (a *Agent) requeueEvents(events []*pb.Event) {
+	if len(events) == 0 {
+		return
+	}
+	a.eventMu.Lock()
+	a.events = append(events, a.events...)
+	dropped := a.trimEvents()
+	a.eventMu.Unlock()
+
+	if dropped > 0 {
+		a.AddCounter("events_dropped_total", uint64(dropped))
+	}
+}
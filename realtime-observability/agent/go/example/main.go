@@ -19,6 +19,10 @@ func main() {
 	config.InstanceID = getEnv("INSTANCE_ID", "mac-node-2")
 	config.AggregatorAddr = getEnv("AGGREGATOR_ADDR", "localhost:9000")
 	config.APIKey = getEnv("API_KEY", "dev-key-123")
+	config.TLSEnabled = getEnv("AGGREGATOR_TLS", "") == "true"
+	config.TLSCAFile = getEnv("TLS_CA_FILE", "")
+	config.TLSCertFile = getEnv("TLS_CERT_FILE", "")
+	config.TLSKeyFile = getEnv("TLS_KEY_FILE", "")
 
 	pushInterval, _ := strconv.Atoi(getEnv("PUSH_INTERVAL_MS", "20"))
 	config.PushInterval = time.Duration(pushInterval) * time.Millisecond
@@ -35,19 +39,15 @@ func main() {
 		log.Fatalf("❌ Failed to create agent: %v", err)
 	}
 
-	// Retry connection with backoff
-	maxRetries := 30
-	for i := 0; i < maxRetries; i++ {
-		if err := a.Connect(); err != nil {
-			log.Printf("⏳ Connection attempt %d/%d failed: %v", i+1, maxRetries, err)
-			time.Sleep(time.Duration(i+1) * time.Second)
-			continue
-		}
-		break
+	// The agent reconnects on its own if the aggregator is not up yet
+	if err := a.Connect(); err != nil {
+		log.Fatalf("❌ Failed to connect agent: %v", err)
 	}
 
 	// Start the agent
-	a.Start()
+	if err := a.Start(); err != nil {
+		log.Fatalf("❌ Failed to start agent: %v", err)
+	}
 	log.Printf("✅ Agent connected and streaming telemetry")
 
 	// Simulate realistic workload
@@ -0,0 +1,108 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"sync"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// defaultExemplarsPerSecond caps exemplar capture when only a threshold is set
+const defaultExemplarsPerSecond = 5
+
+// exemplarReservoir keeps the slowest observations per second, bounded by
+// a per-second budget so an outage where everything is slow cannot flood
+// the stream
+type exemplarReservoir struct {
+	limit    int
+	second   int64
+	accepted int
+	pending  []*pb.Exemplar
+	mu       sync.Mutex
+}
+
+func newExemplarReservoir(limit int) *exemplarReservoir {
+	return &exemplarReservoir{
+		limit:   limit,
+		pending: make([]*pb.Exemplar, 0, limit),
+	}
+}
+
+// Offer considers an observation; once the second's budget is spent it can
+// only replace a faster pending exemplar
+func (r *exemplarReservoir) Offer(now time.Time, valueMs float64, info ExemplarInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sec := now.Unix(); sec != r.second {
+		r.second = sec
+		r.accepted = 0
+	}
+
+	if r.accepted < r.limit && len(r.pending) < r.limit {
+		r.accepted++
+		r.pending = append(r.pending, newExemplar(now, valueMs, info))
+		return
+	}
+
+	fastest := -1
+	for i, e := range r.pending {
+		if e.Value < valueMs && (fastest < 0 || e.Value < r.pending[fastest].Value) {
+			fastest = i
+		}
+	}
+	if fastest >= 0 {
+		r.pending[fastest] = newExemplar(now, valueMs, info)
+	}
+}
+
+// Drain returns and clears the pending exemplars
+func (r *exemplarReservoir) Drain() []*pb.Exemplar {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pending) == 0 {
+		return nil
+	}
+	out := r.pending
+	r.pending = make([]*pb.Exemplar, 0, r.limit)
+	return out
+}
+
+func newExemplar(now time.Time, valueMs float64, info ExemplarInfo) *pb.Exemplar {
+	return &pb.Exemplar{
+		TimestampNs: uint64(now.UnixNano()),
+		Value:       valueMs,
+		Operation:   info.Operation,
+		TraceId:     info.TraceID,
+		Labels:      info.Labels,
+	}
+}
+
+// exemplarsEnabled reports whether slow-request capture is configured
+func (a *Agent) exemplarsEnabled() bool {
+	return a.config.ExemplarThreshold > 0 || a.config.ExemplarsPerSecond > 0
+}
+
+// offerExemplar captures a request that exceeded the exemplar threshold
+func (a *Agent) offerExemplar(histogram string, d time.Duration, info ExemplarInfo) {
+	if !a.exemplarsEnabled() || d < a.config.ExemplarThreshold {
+		return
+	}
+
+	a.mu.Lock()
+	res, exists := a.exemplars[histogram]
+	if !exists {
+		limit := a.config.ExemplarsPerSecond
+		if limit <= 0 {
+			limit = defaultExemplarsPerSecond
+		}
+		res = newExemplarReservoir(limit)
+		a.exemplars[histogram] = res
+	}
+	a.mu.Unlock()
+
+	res.Offer(time.Now(), float64(d)/float64(time.Millisecond), info)
+}
@@ -0,0 +1,106 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc"
+)
+
+// aggregatorAddrs returns the addresses to connect to, in order
+func (c Config) aggregatorAddrs() []string {
+	if len(c.AggregatorAddrs) > 0 {
+		return c.AggregatorAddrs
+	}
+	return []string{c.AggregatorAddr}
+}
+
+// failoverAfter returns the consecutive failures that trigger a failover
+func (c Config) failoverAfter() int {
+	if c.FailoverAfter > 0 {
+		return c.FailoverAfter
+	}
+	return DefaultFailoverAfter
+}
+
+// CurrentAggregator returns the address the agent sends to, or tries to
+func (a *Agent) CurrentAggregator() string {
+	return a.config.aggregatorAddrs()[a.addrIndex.Load()]
+}
+
+// connectTo replaces the connection with one to the i-th address and, with
+// a bootstrap token, exchanges it there within ctx: a key issued by one
+// aggregator is not assumed to work on another
+func (a *Agent) connectTo(ctx context.Context, i int) error {
+	creds, err := a.config.transportCredentials()
+	if err != nil {
+		return err
+	}
+	cfg := a.config
+	cfg.AggregatorAddr = cfg.aggregatorAddrs()[i]
+	target, opts := cfg.dialTarget()
+	opts = append(opts,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithConnectParams(a.config.connectParams()),
+	)
+	// Caller options go last so they win
+	conn, err := grpc.NewClient(target, append(opts, a.config.DialOptions...)...)
+	if err != nil {
+		return err
+	}
+	if a.conn != nil {
+		a.conn.Close()
+	}
+	a.conn = conn
+	a.client = pb.NewTelemetryIngestorClient(conn)
+	a.addrIndex.Store(int32(i))
+
+	if a.config.BootstrapToken != "" {
+		a.issued = issuedKey{}
+		return a.exchangeToken(ctx)
+	}
+	return nil
+}
+
+// noteFailure counts a failed send or reconnect and fails over to the next
+// address once Config.FailoverAfter failures in a row, or
+// Config.FailoverWindow without a successful send, have passed. It reports
+// whether it failed over; caller holds pushMu.
+func (a *Agent) noteFailure() bool {
+	now := a.clock.Now()
+	a.failures++
+	a.health.failures.Add(1)
+	a.slowDown("send failures")
+	if a.failingSince.IsZero() {
+		a.failingSince = now
+	}
+	addrs := a.config.aggregatorAddrs()
+	if len(addrs) < 2 || a.config.Sink != nil {
+		return false
+	}
+	window := a.config.FailoverWindow
+	if a.failures < a.config.failoverAfter() && (window <= 0 || now.Sub(a.failingSince) < window) {
+		return false
+	}
+
+	from := a.CurrentAggregator()
+	next := (int(a.addrIndex.Load()) + 1) % len(addrs)
+	a.failures, a.failingSince = 0, time.Time{}
+	if err := a.connectTo(a.ctx, next); err != nil {
+		// Counted against the new address like any other failure
+		a.logf("Failed over from %s to %s: %v", from, addrs[next], err)
+	} else {
+		a.logf("Failed over from %s to %s", from, addrs[next])
+	}
+	a.AddCounter("failovers_total", 1)
+	return true
+}
+
+// noteSuccess resets the failover counts after a send; caller holds pushMu
+func (a *Agent) noteSuccess() {
+	a.failures, a.failingSince = 0, time.Time{}
+	a.health.failures.Store(0)
+}
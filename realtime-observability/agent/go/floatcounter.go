@@ -0,0 +1,42 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// AddCounterFloat adds a fractional amount, such as credits or dollars, to
+// a float counter. A name is either a float counter or an integer one;
+// values for the other kind, and negative or non-finite deltas, are dropped
+// with the first drop logged.
+func (a *Agent) AddCounterFloat(name string, delta float64) {
+	a.AddCounterFloatWithLabels(name, nil, delta)
+}
+
+// AddCounterFloatWithLabels adds to the float counter for one label
+// combination
+func (a *Agent) AddCounterFloatWithLabels(name string, labels map[string]string, delta float64) {
+	key := seriesKey(name, labels)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.counters[key]; ok {
+		a.rejectValue(key, "counter "+name, errors.New("it is an integer counter; use AddCounter"))
+		return
+	}
+	if delta < 0 || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		a.rejectValue(key, "counter "+name, fmt.Errorf("delta %v is negative or not finite", delta))
+		return
+	}
+	if !a.track(key, name, labels) {
+		return
+	}
+	if a.floatCounters[key] == nil {
+		a.floatCounters[key] = &delta
+	} else {
+		*a.floatCounters[key] += delta
+	}
+}
@@ -0,0 +1,99 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"math"
+	"sync"
+)
+
+// SetGaugeAgg sets a gauge whose values within one push window are
+// combined by Config.GaugeAggregation[name] (default AggLast), so a spike
+// between pushes is not lost to the value set after it. A window without
+// values sends the previous aggregate again, or 0 for AggSum.
+func (a *Agent) SetGaugeAgg(name string, value float64) {
+	a.SetGaugeAggWithLabels(name, nil, value)
+}
+
+// SetGaugeAggWithLabels is SetGaugeAgg for one label combination
+func (a *Agent) SetGaugeAggWithLabels(name string, labels map[string]string, value float64) {
+	key := seriesKey(name, labels)
+	a.mu.RLock()
+	w, ok := a.gaugeWindows[key]
+	a.mu.RUnlock()
+	if !ok {
+		a.mu.Lock()
+		if w, ok = a.gaugeWindows[key]; !ok {
+			if !a.track(key, name, labels) {
+				a.mu.Unlock()
+				return
+			}
+			w = &gaugeWindow{mode: a.config.GaugeAggregation[name]}
+			a.gaugeWindows[key] = w
+			if a.gauges[key] == nil {
+				a.gauges[key] = new(float64)
+			}
+		}
+		a.mu.Unlock()
+	}
+	w.observe(value)
+}
+
+// gaugeWindow accumulates the values of one push window
+type gaugeWindow struct {
+	mu       sync.Mutex
+	mode     AggMode
+	n        int
+	min, max float64
+	sum      float64
+	last     float64
+	prev     float64 // aggregate sent for the previous window
+}
+
+func (w *gaugeWindow) observe(value float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.n == 0 {
+		w.min, w.max, w.sum = value, value, 0
+	}
+	w.n++
+	w.min = math.Min(w.min, value)
+	w.max = math.Max(w.max, value)
+	w.sum += value
+	w.last = value
+}
+
+// current returns the last value observed, leaving the window as it is
+func (w *gaugeWindow) current() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+// take returns the window's aggregate and starts the next window
+func (w *gaugeWindow) take() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.n == 0 {
+		if w.mode == AggSum {
+			return 0
+		}
+		return w.prev
+	}
+
+	var v float64
+	switch w.mode {
+	case AggMin:
+		v = w.min
+	case AggMax:
+		v = w.max
+	case AggAvg:
+		v = w.sum / float64(w.n)
+	case AggSum:
+		v = w.sum
+	default:
+		v = w.last
+	}
+	w.prev, w.n = v, 0
+	return v
+}
@@ -0,0 +1,76 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"sort"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// RegisterGaugeFunc reports the result of fn as the gauge name on every
+// push. fn runs on the push goroutine and should be quick. It replaces an
+// earlier callback of the same name and takes precedence over SetGauge for
+// that name.
+func (a *Agent) RegisterGaugeFunc(name string, fn func() float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gaugeFuncs[name] = fn
+}
+
+// UnregisterGaugeFunc stops calling the callback registered for name
+func (a *Agent) UnregisterGaugeFunc(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.gaugeFuncs, name)
+}
+
+// collectGaugeFuncs calls every gauge callback, outside a.mu so callbacks
+// may record metrics themselves. A panicking callback is logged and its
+// gauge skipped for this push.
+func (a *Agent) collectGaugeFuncs(now uint64) []*pb.Metric {
+	a.mu.RLock()
+	if len(a.gaugeFuncs) == 0 {
+		a.mu.RUnlock()
+		return nil
+	}
+	type gaugeFunc struct {
+		name string
+		fn   func() float64
+	}
+	funcs := make([]gaugeFunc, 0, len(a.gaugeFuncs))
+	for name, fn := range a.gaugeFuncs {
+		funcs = append(funcs, gaugeFunc{name, fn})
+	}
+	a.mu.RUnlock()
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].name < funcs[j].name })
+
+	metrics := make([]*pb.Metric, 0, len(funcs))
+	for _, f := range funcs {
+		value, ok := a.callGaugeFunc(f.name, f.fn)
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, &pb.Metric{
+			Name: f.name,
+			Samples: []*pb.MetricSample{
+				{
+					TimestampNs: now,
+					Value:       &pb.MetricSample_Gauge{Gauge: value},
+				},
+			},
+		})
+	}
+	return metrics
+}
+
+// callGaugeFunc calls fn, recovering from a panic
+func (a *Agent) callGaugeFunc(name string, fn func() float64) (value float64, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			a.logf("Gauge callback %s panicked: %v", name, r)
+			ok = false
+		}
+	}()
+	return fn(), true
+}
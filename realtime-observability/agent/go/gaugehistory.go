@@ -0,0 +1,80 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// gaugeHistory holds the timestamped values of one gauge within a push
+// window, up to Config.GaugeHistory. Past the bound every other sample is
+// dropped and only one value in stride is kept from then on, so the
+// window stays evenly covered; last is always sent, so the gauge still
+// ends on its current value.
+type gaugeHistory struct {
+	samples []*pb.MetricSample
+	stride  int
+	skipped int
+	last    *pb.MetricSample
+}
+
+// recordHistory appends a SetGauge value to the key's window; caller holds
+// a.mu for writing
+func (a *Agent) recordHistory(key string, value float64) {
+	limit := a.config.GaugeHistory
+	sample := &pb.MetricSample{
+		TimestampNs: uint64(time.Now().UnixNano() + a.clockOffset.Load()),
+		Value:       &pb.MetricSample_Gauge{Gauge: value},
+	}
+	h, ok := a.gaugeHistory[key]
+	if !ok {
+		h = &gaugeHistory{samples: make([]*pb.MetricSample, 0, min(limit, 8)), stride: 1}
+		a.gaugeHistory[key] = h
+	}
+	h.last = sample
+	if h.skipped++; h.skipped < h.stride {
+		return
+	}
+	h.skipped = 0
+	if len(h.samples) >= limit {
+		// Keep every other sample and halve the rate from here on
+		kept := h.samples[:0]
+		for i := 0; i < len(h.samples); i += 2 {
+			kept = append(kept, h.samples[i])
+		}
+		clear(h.samples[len(kept):])
+		h.samples = kept
+		h.stride *= 2
+	}
+	h.samples = append(h.samples, sample)
+}
+
+// takeGaugeHistory returns the window's samples of every gauge due, and
+// starts the next window for them
+func (a *Agent) takeGaugeHistory(due map[string]bool) map[string][]*pb.MetricSample {
+	if a.config.GaugeHistory <= 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	taken := make(map[string][]*pb.MetricSample, len(a.gaugeHistory))
+	for key, h := range a.gaugeHistory {
+		if !a.inDueGroup(key, due) {
+			continue
+		}
+		samples := h.samples
+		if n := len(samples); n == 0 || samples[n-1] != h.last {
+			if n >= a.config.GaugeHistory {
+				samples[n-1] = h.last
+			} else {
+				samples = append(samples, h.last)
+			}
+		}
+		taken[key] = samples
+		delete(a.gaugeHistory, key)
+	}
+	return taken
+}
@@ -5,6 +5,7 @@ go 1.22
 require (
 	github.com/yourorg/telemetry/gen v0.0.0
 	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
@@ -12,7 +13,6 @@ require (
 	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
 )
 
 replace github.com/yourorg/telemetry/gen => ../../gen
@@ -0,0 +1,61 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"time"
+)
+
+// SetGaugeInGroup sets a gauge that is sent on its group's schedule from
+// Config.GroupIntervals rather than every PushInterval. A group without an
+// interval is sent every push.
+func (a *Agent) SetGaugeInGroup(name string, value float64, group string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.track(name, name, nil) {
+		return
+	}
+	s := a.series[name]
+	s.group = group
+	a.series[name] = s
+	if a.gauges[name] == nil {
+		v := value
+		a.gauges[name] = &v
+	} else {
+		*a.gauges[name] = value
+	}
+}
+
+// dueGroups returns the groups whose interval has passed, and schedules
+// their next push; all makes every group due. Caller holds collectMu.
+func (a *Agent) dueGroups(now time.Time, all bool) map[string]bool {
+	if len(a.config.GroupIntervals) == 0 {
+		return nil
+	}
+	// Half a push of slack, so pushes firing a little early are not
+	// pushed back a whole interval
+	soon := now.Add(a.config.PushInterval / 2)
+	due := make(map[string]bool, len(a.config.GroupIntervals))
+	for group, interval := range a.config.GroupIntervals {
+		if !all && soon.Before(a.groupNext[group]) {
+			continue
+		}
+		due[group] = true
+		a.groupNext[group] = now.Add(interval)
+	}
+	return due
+}
+
+// inDueGroup reports whether a series is sent in this batch: ungrouped
+// series always are; caller holds a.mu
+func (a *Agent) inDueGroup(key string, due map[string]bool) bool {
+	group := a.series[key].group
+	if group == "" {
+		return true
+	}
+	if _, ok := a.config.GroupIntervals[group]; !ok {
+		return true
+	}
+	return due[group]
+}
@@ -0,0 +1,63 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// health holds the HealthStatus fields kept outside the agent's locks
+type health struct {
+	streaming atomic.Bool
+	failures  atomic.Int64
+	buffered  atomic.Int64
+	series    atomic.Int64
+
+	// OnStateChange callbacks
+	funcs []func(connected bool)
+	mu    sync.Mutex
+}
+
+// Health reports whether telemetry is flowing. It reads atomics only, so
+// it is cheap enough for every health check request and never waits on a
+// push.
+func (a *Agent) Health() HealthStatus {
+	status := HealthStatus{
+		Connected:               a.health.streaming.Load(),
+		ConsecutiveSendFailures: int(a.health.failures.Load()),
+		BufferedBatches:         int(a.health.buffered.Load()),
+		SeriesCount:             int(a.health.series.Load()),
+		PushInterval:            a.pushInterval(),
+		ConfigVersion:           a.configVersion(),
+	}
+	if ns := a.self.lastSendNs.Load(); ns != 0 {
+		status.LastSuccessfulSend = time.Unix(0, ns)
+	}
+	return status
+}
+
+// OnStateChange calls fn with true when a stream to the aggregator opens
+// and false when it is lost or closed by Stop. fn runs where the change
+// happens, in Connect, the sender goroutine or Stop, so it must return
+// quickly and must not call Flush or Stop.
+func (a *Agent) OnStateChange(fn func(connected bool)) {
+	a.health.mu.Lock()
+	defer a.health.mu.Unlock()
+	a.health.funcs = append(a.health.funcs, fn)
+}
+
+// setStreaming records whether a stream is open, calling the
+// OnStateChange callbacks on a change
+func (a *Agent) setStreaming(up bool) {
+	if a.health.streaming.Swap(up) == up {
+		return
+	}
+	a.health.mu.Lock()
+	funcs := a.health.funcs
+	a.health.mu.Unlock()
+	for _, fn := range funcs {
+		fn(up)
+	}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+)
+
+// Histogram tracks latency distribution
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+	mu     sync.Mutex
+
+	// cumulative keeps counts across snapshots, see Config.HistogramTemporality
+	cumulative bool
+
+	// Running totals that snapshots never reset, for the Prometheus
+	// endpoint
+	totals     []uint64
+	totalSum   float64
+	totalCount uint64
+}
+
+// DefaultHistogramBounds are latency bounds in milliseconds, from 1ms to 10s
+var DefaultHistogramBounds = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// NewHistogram creates a new histogram with default latency bounds
+func NewHistogram() *Histogram {
+	h, _ := NewHistogramWithBounds(DefaultHistogramBounds)
+	return h
+}
+
+// NewHistogramWithBounds creates a histogram with the given bucket upper
+// bounds; values above the last bound land in an overflow bucket
+func NewHistogramWithBounds(bounds []float64) (*Histogram, error) {
+	if err := ValidateBounds(bounds); err != nil {
+		return nil, err
+	}
+	return &Histogram{
+		bounds: slices.Clone(bounds),
+		counts: make([]uint64, len(bounds)+1), // +1 for overflow bucket
+		totals: make([]uint64, len(bounds)+1),
+	}, nil
+}
+
+// ValidateBounds checks that bucket bounds are non-empty, finite and
+// strictly increasing
+func ValidateBounds(bounds []float64) error {
+	if len(bounds) == 0 {
+		return errors.New("histogram bounds are empty")
+	}
+	for i, b := range bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("histogram bound %d is %v", i, b)
+		}
+		if i > 0 && b <= bounds[i-1] {
+			return fmt.Errorf("histogram bounds must be strictly increasing: %v follows %v", b, bounds[i-1])
+		}
+	}
+	return nil
+}
+
+// hasBounds reports whether the histogram uses exactly these bounds
+func (h *Histogram) hasBounds(bounds []float64) bool {
+	return slices.Equal(h.bounds, bounds)
+}
+
+// Record records a value in the histogram
+func (h *Histogram) Record(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sum += value
+	h.count++
+	h.totalSum += value
+	h.totalCount++
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+			h.totals[i]++
+			return
+		}
+	}
+	h.counts[len(h.counts)-1]++ // Overflow bucket
+	h.totals[len(h.totals)-1]++
+}
+
+// add adds bucket counts, one per bound plus overflow, and their sum;
+// the caller checks the lengths match
+func (h *Histogram) add(counts []uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, c := range counts {
+		h.counts[i] += c
+		h.totals[i] += c
+		h.count += c
+		h.totalCount += c
+	}
+	h.sum += sum
+	h.totalSum += sum
+}
+
+// totalsSnapshot returns the bounds and the running totals, which
+// snapshot does not reset
+func (h *Histogram) totalsSnapshot() ([]float64, []uint64, float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.bounds), slices.Clone(h.totals), h.totalSum, h.totalCount
+}
+
+// Snapshot returns current histogram state and resets it, unless the
+// histogram belongs to an agent sending Cumulative histograms
+func (h *Histogram) Snapshot() ([]float64, []uint64) {
+	bounds, counts, _, _ := h.snapshot()
+	return bounds, counts
+}
+
+// snapshot is Snapshot that also returns, and resets alike, the sum and
+// count of observations
+func (h *Histogram) snapshot() ([]float64, []uint64, float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	bounds := make([]float64, len(h.bounds))
+	counts := make([]uint64, len(h.counts))
+	copy(bounds, h.bounds)
+	copy(counts, h.counts)
+	sum, count := h.sum, h.count
+	if h.cumulative {
+		return bounds, counts, sum, count
+	}
+
+	// Reset counts
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.sum, h.count = 0, 0
+
+	return bounds, counts, sum, count
+}
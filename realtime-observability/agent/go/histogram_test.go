@@ -0,0 +1,25 @@
+//go:build !notelemetry
+
+package agent_test
+
+import (
+	"fmt"
+	"testing"
+
+	agent "github.com/yourorg/agent"
+)
+
+func BenchmarkRecordHistogram(b *testing.B) {
+	for _, rate := range []float64{1, 0.1, 0.01} {
+		b.Run(fmt.Sprintf("rate=%v", rate), func(b *testing.B) {
+			a := newBenchAgent(b, func(cfg *agent.Config) {
+				cfg.HistogramSampleRate = map[string]float64{"latency_ms": rate}
+			})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				a.RecordHistogram("latency_ms", float64(i%500))
+			}
+		})
+	}
+}
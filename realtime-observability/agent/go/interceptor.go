@@ -0,0 +1,55 @@
+//go:build !notelemetry
+
+package agent
+
+import "slices"
+
+// TrackRPC starts recording a gRPC call to method and returns the function
+// that finishes it with the call's status code name, such as "OK". It
+// records the grpc_latency histogram and grpc_requests_total by method
+// and code, grpc_errors_total for codes other than OK, and grpc_inflight
+// by method. It returns nil for methods in Config.GRPCSkipMethods. The
+// agentgrpc interceptors are built on it.
+func (a *Agent) TrackRPC(method string) func(code string) {
+	if a.skipGRPC(method) {
+		return nil
+	}
+	timer := a.StartTimer("grpc_latency")
+	methodLabels := map[string]string{"method": method}
+	a.addGaugeWithLabels("grpc_inflight", methodLabels, 1)
+
+	return func(code string) {
+		a.addGaugeWithLabels("grpc_inflight", methodLabels, -1)
+		labels := map[string]string{"method": method, "code": code}
+		timer.ObserveDurationWithLabels(labels)
+		a.IncCounterWithLabels("grpc_requests_total", labels)
+		if code != "OK" {
+			a.IncCounterWithLabels("grpc_errors_total", labels)
+		}
+	}
+}
+
+// skipGRPC reports whether a method is left unrecorded
+func (a *Agent) skipGRPC(method string) bool {
+	skip := a.config.GRPCSkipMethods
+	if skip == nil {
+		skip = DefaultGRPCSkipMethods
+	}
+	return slices.Contains(skip, method)
+}
+
+// addGaugeWithLabels adds delta to the gauge for one label combination
+func (a *Agent) addGaugeWithLabels(name string, labels map[string]string, delta float64) {
+	key := seriesKey(name, labels)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.track(key, name, labels) {
+		return
+	}
+	if a.gauges[key] == nil {
+		a.gauges[key] = &delta
+	} else {
+		*a.gauges[key] += delta
+	}
+}
@@ -0,0 +1,150 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time moves only when a test fires its timer.
+// Every arming of a timer is reported on armed.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	timer *fakeTimer
+	armed chan time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_000_000, 0), armed: make(chan time.Duration, 1)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.mu.Lock()
+	c.timer = t
+	c.mu.Unlock()
+	c.armed <- d
+	return t
+}
+
+// fire waits for the timer to be armed, moves the clock to its deadline
+// and delivers the tick, returning the time it fired at
+func (c *fakeClock) fire(t *testing.T) time.Time {
+	t.Helper()
+	select {
+	case d := <-c.armed:
+		c.mu.Lock()
+		c.now = c.now.Add(d)
+		now, timer := c.now, c.timer
+		c.mu.Unlock()
+		timer.c <- now
+		return now
+	case <-time.After(5 * time.Second):
+		t.Fatalf("push loop never armed its timer")
+		return time.Time{}
+	}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.armed <- d
+	return true
+}
+
+func (t *fakeTimer) Stop() bool { return true }
+
+// pushSchedule runs an agent's push loop under a fake clock and returns
+// when its first n pushes happened
+func pushSchedule(t *testing.T, instance string, jitter float64, n int) []time.Time {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ServiceName = "checkout"
+	cfg.InstanceID = instance
+	cfg.AutoDetectKubernetes = false
+	cfg.PushInterval = time.Second
+	cfg.PushJitter = jitter
+	cfg.Sink = discardSink{}
+	a, err := NewAgent(cfg)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	clock := newFakeClock()
+	a.clock = clock
+	if err := a.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := a.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	start := clock.Now()
+	ticks := []time.Time{start}
+	for range n {
+		ticks = append(ticks, clock.fire(t))
+	}
+	// Let the loop arm its next timer, then stop it
+	<-clock.armed
+	a.Stop()
+	return ticks
+}
+
+func TestPushJitterIsDeterministic(t *testing.T) {
+	const n = 50
+	ticks := pushSchedule(t, "pod-1", 0.1, n)
+
+	// The first push lands within one interval of the start
+	start, first := ticks[0], ticks[1]
+	if delay := first.Sub(start); delay < 0 || delay >= time.Second {
+		t.Fatalf("first push after %v, want within one interval", delay)
+	}
+
+	// Later pushes stay within ±5% of the interval of their slot on the
+	// schedule, however many ticks in: jitter never accumulates
+	var offsets []time.Duration
+	for k := 1; k < n; k++ {
+		slot := first.Add(time.Duration(k) * time.Second)
+		offset := ticks[k+1].Sub(slot)
+		if offset < -50*time.Millisecond || offset > 50*time.Millisecond {
+			t.Fatalf("push %d is %v off its slot, want within ±50ms", k, offset)
+		}
+		offsets = append(offsets, offset)
+	}
+	slices.Sort(offsets)
+	if offsets[0] == offsets[len(offsets)-1] {
+		t.Fatalf("every push is %v off its slot, want jitter", offsets[0])
+	}
+
+	// The same agent under the same clock pushes at the same instants;
+	// another instance does not
+	if again := pushSchedule(t, "pod-1", 0.1, n); !slices.Equal(again, ticks) {
+		t.Fatalf("second run pushed at\n%v\nwant\n%v", again, ticks)
+	}
+	if other := pushSchedule(t, "pod-2", 0.1, n); slices.Equal(other, ticks) {
+		t.Fatalf("pod-2 pushed at the same instants as pod-1")
+	}
+}
+
+func TestNoJitterKeepsTheInterval(t *testing.T) {
+	ticks := pushSchedule(t, "pod-1", 0, 10)
+	for k := 1; k < len(ticks); k++ {
+		if d := ticks[k].Sub(ticks[k-1]); d != time.Second {
+			t.Fatalf("push %d came %v after the previous, want exactly the interval", k, d)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Resource labels set by Kubernetes detection
+const (
+	LabelPodName     = "k8s.pod.name"
+	LabelNamespace   = "k8s.namespace.name"
+	LabelNodeName    = "k8s.node.name"
+	LabelContainerID = "container.id"
+)
+
+// kubernetesDetectTimeout bounds detection so a slow mount never delays
+// NewAgent
+const kubernetesDetectTimeout = 100 * time.Millisecond
+
+// Files read by detection, relative to kubernetesEnv.fsys
+const (
+	serviceAccountNamespace = "var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	selfCgroup              = "proc/self/cgroup"
+)
+
+// containerIDPattern finds the 64-hex container ID in a cgroup path, e.g.
+// /kubepods/burstable/pod<uid>/<id> or .../cri-containerd-<id>.scope
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// kubernetesEnv is the process environment as seen by detection; tests
+// replace it with fakes
+type kubernetesEnv struct {
+	getenv   func(string) string
+	fsys     fs.FS // the root filesystem
+	hostname func() (string, error)
+}
+
+var osKubernetesEnv = kubernetesEnv{
+	getenv:   os.Getenv,
+	fsys:     os.DirFS("/"),
+	hostname: os.Hostname,
+}
+
+// detectKubernetes returns the resource labels of the pod the process runs
+// in, or nil off-cluster or if detection does not finish within timeout
+func detectKubernetes(env kubernetesEnv, timeout time.Duration) map[string]string {
+	done := make(chan map[string]string, 1)
+	go func() { done <- env.labels() }()
+
+	select {
+	case labels := <-done:
+		return labels
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// labels reads the downward-API variables, falling back to the hostname
+// (the pod name unless overridden), the service account namespace file and
+// the cgroup path. Anything unreadable is left out.
+func (env kubernetesEnv) labels() map[string]string {
+	if env.getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	set := func(key, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			labels[key] = value
+		}
+	}
+
+	pod := env.getenv("POD_NAME")
+	if pod == "" {
+		pod, _ = env.hostname()
+	}
+	set(LabelPodName, pod)
+
+	namespace := env.getenv("POD_NAMESPACE")
+	if namespace == "" {
+		if data, err := fs.ReadFile(env.fsys, serviceAccountNamespace); err == nil {
+			namespace = string(data)
+		}
+	}
+	set(LabelNamespace, namespace)
+	set(LabelNodeName, env.getenv("NODE_NAME"))
+
+	if data, err := fs.ReadFile(env.fsys, selfCgroup); err == nil {
+		set(LabelContainerID, cgroupContainerID(string(data)))
+	}
+	return labels
+}
+
+// cgroupContainerID returns the last container ID in /proc/self/cgroup, or
+// "" under cgroup v2 namespaces where the path is just "/"
+func cgroupContainerID(cgroup string) string {
+	var id string
+	for _, line := range strings.Split(cgroup, "\n") {
+		if ids := containerIDPattern.FindAllString(line, -1); len(ids) > 0 {
+			id = ids[len(ids)-1]
+		}
+	}
+	return id
+}
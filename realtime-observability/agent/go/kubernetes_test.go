@@ -0,0 +1,154 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"errors"
+	"io/fs"
+	"maps"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+const testContainerID = "3f4e8b2a1c9d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"
+
+// fakeKubernetesEnv returns an environment with the given variables and
+// files and a hostname of "host-pod"
+func fakeKubernetesEnv(vars map[string]string, files fstest.MapFS) kubernetesEnv {
+	return kubernetesEnv{
+		getenv:   func(key string) string { return vars[key] },
+		fsys:     files,
+		hostname: func() (string, error) { return "host-pod", nil },
+	}
+}
+
+func TestKubernetesLabels(t *testing.T) {
+	onCluster := map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1"}
+	withVars := func(vars map[string]string) map[string]string {
+		merged := maps.Clone(onCluster)
+		maps.Copy(merged, vars)
+		return merged
+	}
+	mountedFiles := fstest.MapFS{
+		serviceAccountNamespace: {Data: []byte("payments\n")},
+		selfCgroup: {Data: []byte("12:memory:/kubepods/burstable/pod1234/" + testContainerID + "\n" +
+			"0::/kubepods.slice/cri-containerd-" + testContainerID + ".scope\n")},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		vars  map[string]string
+		files fstest.MapFS
+		want  map[string]string
+	}{
+		{
+			name:  "off cluster",
+			vars:  map[string]string{"POD_NAME": "checkout-7d9f"},
+			files: mountedFiles,
+			want:  nil,
+		},
+		{
+			name: "downward API",
+			vars: withVars(map[string]string{
+				"POD_NAME": "checkout-7d9f", "POD_NAMESPACE": "shop", "NODE_NAME": "node-3",
+			}),
+			files: mountedFiles,
+			want: map[string]string{
+				LabelPodName: "checkout-7d9f", LabelNamespace: "shop", LabelNodeName: "node-3",
+				LabelContainerID: testContainerID,
+			},
+		},
+		{
+			name:  "fallbacks",
+			vars:  onCluster,
+			files: mountedFiles,
+			want: map[string]string{
+				LabelPodName: "host-pod", LabelNamespace: "payments", LabelContainerID: testContainerID,
+			},
+		},
+		{
+			name: "cgroup v2 namespace",
+			vars: onCluster,
+			files: fstest.MapFS{
+				selfCgroup: {Data: []byte("0::/\n")},
+			},
+			want: map[string]string{LabelPodName: "host-pod"},
+		},
+		{
+			name:  "nothing mounted",
+			vars:  withVars(map[string]string{"POD_NAMESPACE": "  "}),
+			files: fstest.MapFS{},
+			want:  map[string]string{LabelPodName: "host-pod"},
+		},
+	} {
+		got := fakeKubernetesEnv(tc.vars, tc.files).labels()
+		if !maps.Equal(got, tc.want) {
+			t.Errorf("%s: labels = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// blockingFS is a filesystem whose reads hang until release is closed, as
+// a stuck mount would
+type blockingFS struct {
+	release chan struct{}
+}
+
+func (f blockingFS) Open(name string) (fs.File, error) {
+	<-f.release
+	return nil, fs.ErrNotExist
+}
+
+func TestKubernetesDetectionNeverBlocks(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	env := fakeKubernetesEnv(map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1"}, nil)
+	env.fsys = blockingFS{release}
+
+	start := time.Now()
+	if labels := detectKubernetes(env, 20*time.Millisecond); labels != nil {
+		t.Fatalf("detectKubernetes = %v, want nil once the timeout passes", labels)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("detectKubernetes took %v with a 20ms timeout", elapsed)
+	}
+
+	// A failing hostname lookup is left out like an unreadable file
+	env = fakeKubernetesEnv(map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1", "NODE_NAME": "node-3"}, fstest.MapFS{})
+	env.hostname = func() (string, error) { return "", errors.New("no hostname") }
+	if labels := detectKubernetes(env, time.Second); !maps.Equal(labels, map[string]string{LabelNodeName: "node-3"}) {
+		t.Fatalf("detectKubernetes = %v, want the node alone", labels)
+	}
+}
+
+func TestNewAgentUsesPodAsInstance(t *testing.T) {
+	saved := osKubernetesEnv
+	defer func() { osKubernetesEnv = saved }()
+	osKubernetesEnv = fakeKubernetesEnv(map[string]string{
+		"KUBERNETES_SERVICE_HOST": "10.0.0.1", "POD_NAME": "checkout-7d9f", "POD_NAMESPACE": "shop",
+	}, fstest.MapFS{})
+
+	for _, tc := range []struct {
+		instance, want string
+	}{
+		{"", "checkout-7d9f"},
+		{"explicit", "explicit"},
+	} {
+		cfg := DefaultConfig()
+		cfg.ServiceName = "checkout"
+		cfg.AutoDetectKubernetes = true
+		cfg.InstanceID = tc.instance
+		a, err := NewAgent(cfg)
+		if err != nil {
+			t.Fatalf("NewAgent: %v", err)
+		}
+		if a.config.InstanceID != tc.want {
+			t.Errorf("InstanceID %q: got %q, want %q", tc.instance, a.config.InstanceID, tc.want)
+		}
+		if a.attributes[LabelPodName] != "checkout-7d9f" || a.attributes[LabelNamespace] != "shop" {
+			t.Errorf("attributes = %v, want the pod and namespace", a.attributes)
+		}
+		a.Stop()
+	}
+}
@@ -0,0 +1,236 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// seriesDropLogInterval rate-limits the log line for series dropped by
+// Config.MaxSeries
+const seriesDropLogInterval = time.Minute
+
+// series is a metric name with its label set
+type series struct {
+	name   string
+	labels map[string]string
+	group  string // push group, see SetGaugeInGroup
+}
+
+// seriesKey identifies a metric and label set in the agent's maps. Without
+// labels the key is the bare name, so the unlabeled API keeps its keys.
+func seriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		// NUL cannot appear in a sane name or label, so keys never collide
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+	}
+	return b.String()
+}
+
+// track remembers the series behind a new key and reports whether it may
+// be stored: past Config.MaxSeries new keys are dropped, while existing
+// ones keep updating; caller holds a.mu
+func (a *Agent) track(key, name string, labels map[string]string) bool {
+	if _, ok := a.series[key]; ok {
+		return true
+	}
+	if len(a.series) >= a.maxSeries() {
+		a.dropSeries(name)
+		return false
+	}
+	s := series{name: name}
+	if len(labels) > 0 {
+		// Copied so later changes to the caller's map cannot rename it
+		s.labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			s.labels[k] = v
+		}
+	}
+	a.series[key] = s
+	a.health.series.Add(1)
+	return true
+}
+
+func (a *Agent) maxSeries() int {
+	if a.config.MaxSeries > 0 {
+		return a.config.MaxSeries
+	}
+	return DefaultMaxSeries
+}
+
+// dropSeries counts a series refused by the cap and logs at most once per
+// seriesDropLogInterval; caller holds a.mu
+func (a *Agent) dropSeries(name string) {
+	a.droppedSeries.Add(1)
+	now := a.clock.Now()
+	if now.Sub(a.seriesDropLogged) < seriesDropLogInterval {
+		return
+	}
+	a.seriesDropLogged = now
+	a.logf("Series limit of %d reached; dropping new series such as %s (%d dropped so far)",
+		a.maxSeries(), name, a.droppedSeries.Load())
+}
+
+// SeriesCount returns the number of series the agent holds, against
+// Config.MaxSeries
+func (a *Agent) SeriesCount() int {
+	return int(a.health.series.Load())
+}
+
+// SetGaugeWithLabels sets the gauge for one label combination
+func (a *Agent) SetGaugeWithLabels(name string, labels map[string]string, value float64) {
+	key := seriesKey(name, labels)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.upDowns[key]; ok {
+		a.rejectValue(key, "gauge "+name, errors.New("it is an up-down counter; use AddUpDown"))
+		return
+	}
+	if !a.track(key, name, labels) {
+		return
+	}
+	if a.gauges[key] == nil {
+		v := value
+		a.gauges[key] = &v
+	} else {
+		*a.gauges[key] = value
+	}
+	if a.config.GaugeHistory > 0 {
+		a.recordHistory(key, value)
+	}
+}
+
+// AddCounterWithLabels adds to the counter for one label combination.
+// Adding to an existing counter takes no lock.
+func (a *Agent) AddCounterWithLabels(name string, labels map[string]string, delta uint64) {
+	key := seriesKey(name, labels)
+	if c, ok := a.counterIndex.Load(key); ok {
+		c.(*atomic.Uint64).Add(delta)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.floatCounters[key]; ok {
+		a.rejectValue(key, "counter "+name, errors.New("it is a float counter; use AddCounterFloat"))
+		return
+	}
+	if !a.track(key, name, labels) {
+		return
+	}
+	c, ok := a.counters[key]
+	if !ok {
+		c = new(atomic.Uint64)
+		a.counters[key] = c
+		a.counterIndex.Store(key, c)
+	}
+	c.Add(delta)
+}
+
+// IncCounterWithLabels increments the counter for one label combination
+func (a *Agent) IncCounterWithLabels(name string, labels map[string]string) {
+	a.AddCounterWithLabels(name, labels, 1)
+}
+
+// RecordHistogramWithLabels records a value in the histogram for one label
+// combination
+func (a *Agent) RecordHistogramWithLabels(name string, labels map[string]string, value float64) {
+	a.recordHistogram(name, labels, nil, value)
+}
+
+// recordHistogram records into a series' histogram, creating it with
+// bounds, else the configured bounds for name, else the defaults. Explicit
+// bounds must match an existing histogram's.
+func (a *Agent) recordHistogram(name string, labels map[string]string, bounds []float64, value float64) {
+	if a.skipSample(name) {
+		return
+	}
+	if hist := a.histogramFor(name, labels, bounds); hist != nil {
+		hist.Record(value)
+	}
+}
+
+// AddHistogramBuckets adds observations already counted into buckets, as
+// from another metrics library, to the histogram name. counts holds one
+// count per bound plus the overflow bucket, and sum is the observations'
+// sum. The bounds must match an existing histogram's. Counts are not
+// subject to Config.HistogramSampleRate, so leave name out of it.
+func (a *Agent) AddHistogramBuckets(name string, bounds []float64, counts []uint64, sum float64) {
+	a.AddHistogramBucketsWithLabels(name, nil, bounds, counts, sum)
+}
+
+// AddHistogramBucketsWithLabels is AddHistogramBuckets for one label
+// combination
+func (a *Agent) AddHistogramBucketsWithLabels(name string, labels map[string]string, bounds []float64, counts []uint64, sum float64) {
+	if len(bounds) == 0 || len(counts) != len(bounds)+1 {
+		key := seriesKey(name, labels)
+		a.mu.Lock()
+		a.rejectValue(key, "histogram "+name, fmt.Errorf("%d counts for %d bounds, want one more count than bounds", len(counts), len(bounds)))
+		a.mu.Unlock()
+		return
+	}
+	if hist := a.histogramFor(name, labels, bounds); hist != nil {
+		hist.add(counts, sum)
+	}
+}
+
+// histogramFor returns a series' histogram, creating it as recordHistogram
+// describes, or nil when its values are dropped
+func (a *Agent) histogramFor(name string, labels map[string]string, bounds []float64) *Histogram {
+	key := seriesKey(name, labels)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	hist, exists := a.histograms[key]
+	if !exists {
+		if bounds == nil {
+			bounds = a.config.HistogramBounds[name]
+		}
+		if bounds == nil {
+			bounds = DefaultHistogramBounds
+		}
+		var err error
+		if hist, err = NewHistogramWithBounds(bounds); err != nil {
+			a.rejectValue(key, "histogram "+name, err)
+			return nil
+		}
+		if !a.track(key, name, labels) {
+			return nil
+		}
+		hist.cumulative = a.config.HistogramTemporality == Cumulative
+		a.histograms[key] = hist
+	} else if bounds != nil && !hist.hasBounds(bounds) {
+		a.rejectValue(key, "histogram "+name, fmt.Errorf("bounds %v differ from existing %v", bounds, hist.bounds))
+		return nil
+	}
+	return hist
+}
+
+// rejectValue logs the first dropped value of a series; caller holds a.mu
+func (a *Agent) rejectValue(key, what string, err error) {
+	if a.rejected[key] {
+		return
+	}
+	a.rejected[key] = true
+	a.logf("Dropping values for %s: %v", what, err)
+}
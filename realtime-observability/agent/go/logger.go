@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Logger receives the agent's log lines. *log.Logger satisfies it; wrap a
+// *slog.Logger with SlogLogger, or zap with zap.NewStdLog.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// SlogLogger adapts l to Logger, logging every line at level
+func SlogLogger(l *slog.Logger, level slog.Level) Logger {
+	return slogLogger{l: l, level: level}
+}
+
+type slogLogger struct {
+	l     *slog.Logger
+	level slog.Level
+}
+
+func (s slogLogger) Printf(format string, v ...any) {
+	s.l.Log(context.Background(), s.level, fmt.Sprintf(format, v...))
+}
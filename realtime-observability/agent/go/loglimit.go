@@ -0,0 +1,57 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"log"
+	"time"
+)
+
+// sendFailureLogInterval rate-limits the log lines of a failing or
+// flapping stream, which would otherwise repeat every push
+const sendFailureLogInterval = 5 * time.Second
+
+// logf writes a line to Config.Logger, or the standard logger
+func (a *Agent) logf(format string, v ...any) {
+	a.logger.Printf(format, v...)
+}
+
+func (c Config) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return log.Default()
+}
+
+// logLimiter lets a log line through at most once per
+// sendFailureLogInterval and counts the ones it holds back
+type logLimiter struct {
+	last       time.Time
+	suppressed int
+}
+
+// allow reports whether to log at now, and how many lines were suppressed
+// since the last one logged
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	if !l.last.IsZero() && now.Sub(l.last) < sendFailureLogInterval {
+		l.suppressed++
+		return false, 0
+	}
+	suppressed := l.suppressed
+	l.last, l.suppressed = now, 0
+	return true, suppressed
+}
+
+// logLimited logs through l, noting how many similar lines were held back;
+// the caller serializes use of l
+func (a *Agent) logLimited(l *logLimiter, format string, v ...any) {
+	ok, suppressed := l.allow(a.clock.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		format += " (%d similar suppressed)"
+		v = append(v, suppressed)
+	}
+	a.logf(format, v...)
+}
@@ -0,0 +1,78 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// metadataPairs validates Config.Metadata and flattens it, keys lowercased
+// and sorted, for metadata.AppendToOutgoingContext
+func metadataPairs(md map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(md))
+	values := make(map[string]string, len(md))
+	for k, v := range md {
+		key := strings.ToLower(k)
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("metadata key %q is set twice with different case", key)
+		}
+		if err := validateMetadata(key, v); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		values[key] = v
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k, values[k])
+	}
+	return pairs, nil
+}
+
+// validateMetadata applies the gRPC rules for a header key and value
+func validateMetadata(key, value string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("metadata key is empty")
+	case key == "x-api-key":
+		return fmt.Errorf("metadata key x-api-key conflicts with APIKey; set APIKey instead")
+	case strings.HasPrefix(key, "grpc-"):
+		return fmt.Errorf("metadata key %q uses the reserved grpc- prefix", key)
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("metadata key %q contains %q", key, c)
+		}
+	}
+	if strings.HasSuffix(key, "-bin") {
+		// Binary values are base64-encoded on the wire
+		return nil
+	}
+	for _, c := range value {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("metadata value for %q contains %q; use a -bin key for binary values", key, c)
+		}
+	}
+	return nil
+}
+
+// outgoingContext is the agent context carrying Config.Metadata, for every
+// call to the aggregator
+func (a *Agent) outgoingContext() context.Context {
+	return a.withMetadata(a.ctx)
+}
+
+// withMetadata adds Config.Metadata to ctx
+func (a *Agent) withMetadata(ctx context.Context) context.Context {
+	if len(a.metadata) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, a.metadata...)
+}
@@ -0,0 +1,162 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindow is how often the middleware's rps and error_rate gauges are
+// recomputed; shorter windows make them jumpy at low traffic
+const rateWindow = time.Second
+
+// HTTPMiddleware instruments handlers through the agent. Each request is
+// tracked like TrackRequestWithInfo under the route from
+// Config.RouteNormalizer (default DefaultRouteNormalizer), and also into
+// the unlabeled latency histogram. The rps and error_rate gauges are
+// derived from the requests served, so no SetGauge calls are needed.
+// Usage: http.ListenAndServe(addr, agent.HTTPMiddleware(a)(mux))
+func HTTPMiddleware(a *Agent) func(http.Handler) http.Handler {
+	normalize := a.config.RouteNormalizer
+	if normalize == nil {
+		normalize = DefaultRouteNormalizer
+	}
+	a.RegisterGaugeFunc("rps", a.rates.rps)
+	a.RegisterGaugeFunc("error_rate", a.rates.errorRate)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timer := a.StartTimer("latency")
+			done := a.TrackRequestWithInfo()
+			rec := &statusRecorder{ResponseWriter: w}
+
+			// A panicking handler is counted as a 500 before the panic
+			// continues up to the server
+			panicking := true
+			defer func() {
+				status := rec.status
+				if status == 0 {
+					status = http.StatusOK
+					if panicking {
+						status = http.StatusInternalServerError
+					}
+				}
+				done(status, normalize(r))
+				timer.ObserveDuration()
+				a.rates.observe(status)
+			}()
+
+			next.ServeHTTP(rec, r)
+			panicking = false
+		})
+	}
+}
+
+// statusRecorder captures the status a handler writes. Flush and Hijack
+// pass through when the underlying writer supports them, and Unwrap lets
+// http.ResponseController reach its other optional interfaces.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	// 1xx responses are informational and followed by the real status
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// requestRates counts the requests served through HTTPMiddleware and turns
+// them into per-window rates for the rps and error_rate gauges
+type requestRates struct {
+	requests atomic.Uint64
+	errors   atomic.Uint64
+
+	mu           sync.Mutex
+	windowStart  time.Time
+	lastRequests uint64
+	lastErrors   uint64
+	lastRPS      float64
+	lastErrRate  float64
+}
+
+// observe counts a completed request; 5xx statuses are errors
+func (r *requestRates) observe(status int) {
+	r.requests.Add(1)
+	if status >= 500 {
+		r.errors.Add(1)
+	}
+}
+
+func (r *requestRates) rps() float64 {
+	rps, _ := r.update(time.Now())
+	return rps
+}
+
+func (r *requestRates) errorRate() float64 {
+	_, errRate := r.update(time.Now())
+	return errRate
+}
+
+// update recomputes the rates once a window has passed and returns the
+// rates of the last complete window
+func (r *requestRates) update(now time.Time) (rps, errRate float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.windowStart.IsZero() {
+		r.windowStart = now
+		r.lastRequests, r.lastErrors = r.requests.Load(), r.errors.Load()
+		return 0, 0
+	}
+	if elapsed := now.Sub(r.windowStart); elapsed >= rateWindow {
+		requests, failed := r.requests.Load(), r.errors.Load()
+		served := requests - r.lastRequests
+		r.lastRPS = float64(served) / elapsed.Seconds()
+		r.lastErrRate = 0
+		if served > 0 {
+			r.lastErrRate = float64(failed-r.lastErrors) / float64(served)
+		}
+		r.windowStart, r.lastRequests, r.lastErrors = now, requests, failed
+	}
+	return r.lastRPS, r.lastErrRate
+}
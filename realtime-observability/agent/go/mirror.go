@@ -0,0 +1,302 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// mirror streams a copy of every batch to a second aggregator, see
+// Config.MirrorAddr. It has its own connection, stream, queue, offline
+// buffer and reconnect backoff, all used by its own goroutine, so a slow
+// or failing mirror never holds up the primary stream.
+type mirror struct {
+	agent  *Agent
+	addr   string
+	conn   *grpc.ClientConn
+	client pb.TelemetryIngestorClient
+
+	// queue takes batches from collect; drain asks run to send what is
+	// queued and return, and cancel makes it return at once
+	queue  chan *pb.TelemetryBatch
+	drain  chan struct{}
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Used by run only. describe is set on a new stream, whose first
+	// batch carries every description.
+	stream       *cancelingStream
+	describe     bool
+	draining     bool
+	pending      []*pb.TelemetryBatch
+	backoff      time.Duration
+	reconnectAt  time.Time
+	failures     int
+	lostLog      logLimiter
+	reconnectLog logLimiter
+
+	// Reported in the self-telemetry
+	batchesSent atomic.Uint64
+	sendErrors  atomic.Uint64
+}
+
+// EnableMirror starts sending a copy of every batch to the aggregator at
+// addr, replacing any mirror already running, which gets up to
+// DefaultStopTimeout to send what it holds; see Config.MirrorAddr. It
+// dials lazily, so an unreachable mirror is not an error here.
+func (a *Agent) EnableMirror(addr string) error {
+	if err := validateAddr(addr); err != nil {
+		return &ConfigError{Field: "MirrorAddr", Reason: err.Error()}
+	}
+	if a.ctx.Err() != nil {
+		return errors.New("agent is stopped")
+	}
+	m, err := a.newMirror(addr)
+	if err != nil {
+		return fmt.Errorf("mirror %s: %w", addr, err)
+	}
+
+	a.mirrorMu.Lock()
+	defer a.mirrorMu.Unlock()
+	if old := a.mirror.Swap(m); old != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultStopTimeout)
+		defer cancel()
+		old.stop(ctx)
+	}
+	go m.run()
+	a.logf("Mirroring batches to %s", addr)
+	return nil
+}
+
+// DisableMirror stops mirroring, giving the mirror up to
+// DefaultStopTimeout to send what it holds
+func (a *Agent) DisableMirror() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultStopTimeout)
+	defer cancel()
+	if addr := a.stopMirror(ctx); addr != "" {
+		a.logf("Stopped mirroring to %s", addr)
+	}
+}
+
+// stopMirror stops the mirror, if any, once it has sent what it holds or
+// ctx ends, and returns its address
+func (a *Agent) stopMirror(ctx context.Context) string {
+	a.mirrorMu.Lock()
+	defer a.mirrorMu.Unlock()
+	m := a.mirror.Swap(nil)
+	if m == nil {
+		return ""
+	}
+	m.stop(ctx)
+	return m.addr
+}
+
+// newMirror dials addr the way connectTo dials an aggregator
+func (a *Agent) newMirror(addr string) (*mirror, error) {
+	creds, err := a.config.transportCredentials()
+	if err != nil {
+		return nil, err
+	}
+	cfg := a.config
+	cfg.AggregatorAddr = addr
+	target, opts := cfg.dialTarget()
+	opts = append(opts,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithConnectParams(a.config.connectParams()),
+	)
+	conn, err := grpc.NewClient(target, append(opts, a.config.DialOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(a.ctx)
+	return &mirror{
+		agent:  a,
+		addr:   addr,
+		conn:   conn,
+		client: pb.NewTelemetryIngestorClient(conn),
+		queue:  make(chan *pb.TelemetryBatch, a.config.sendQueueSize()),
+		drain:  make(chan struct{}),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// offerMirror hands the mirror its own copy of a collected batch, since
+// the primary path changes batches it buffers. When the mirror's queue is
+// full the oldest batch is dropped; caller holds collectMu.
+func (a *Agent) offerMirror(batch *pb.TelemetryBatch) {
+	m := a.mirror.Load()
+	if m == nil {
+		return
+	}
+	batch = proto.Clone(batch).(*pb.TelemetryBatch)
+	for {
+		select {
+		case m.queue <- batch:
+			return
+		default:
+		}
+		select {
+		case <-m.queue:
+			a.AddCounter("mirror_dropped_batches_total", 1)
+		default:
+		}
+	}
+}
+
+// stop drains the mirror until ctx ends, then closes it
+func (m *mirror) stop(ctx context.Context) {
+	close(m.drain)
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		m.cancel()
+		<-m.done
+	}
+	m.cancel()
+	m.conn.Close()
+}
+
+// run sends queued batches in order until drained or cancelled
+func (m *mirror) run() {
+	defer close(m.done)
+	for {
+		select {
+		case <-m.ctx.Done():
+			m.close()
+			return
+		case <-m.drain:
+			m.draining = true
+			for len(m.queue) > 0 {
+				m.push(<-m.queue)
+			}
+			if len(m.pending) > 0 {
+				m.push(nil)
+			}
+			m.close()
+			return
+		case batch := <-m.queue:
+			m.push(batch)
+		}
+	}
+}
+
+// push buffers batch, if any, then sends the buffer oldest first,
+// reconnecting as needed; whatever fails stays buffered
+func (m *mirror) push(batch *pb.TelemetryBatch) {
+	if batch != nil {
+		m.bufferBatch(batch)
+	}
+	if m.stream == nil && !m.reconnect() {
+		return
+	}
+	for len(m.pending) > 0 {
+		if err := m.send(m.pending[0]); err != nil {
+			m.disconnect(err)
+			return
+		}
+		m.pending[0] = nil
+		m.pending = m.pending[1:]
+	}
+}
+
+// send sends a batch on the stream, recording the outcome
+func (m *mirror) send(batch *pb.TelemetryBatch) error {
+	if m.describe {
+		batch.Descriptions = m.agent.allDescriptions()
+	}
+	if err := sendBounded(*m.stream, batch, m.agent.config.sendTimeout()); err != nil {
+		m.sendErrors.Add(1)
+		return err
+	}
+	m.describe = false
+	m.failures = 0
+	m.batchesSent.Add(1)
+	return nil
+}
+
+// openStream starts a stream to the mirror with Config.Metadata and
+// Config.APIKey; an issued bootstrap key belongs to the primary
+func (m *mirror) openStream() error {
+	ctx, cancel := context.WithCancel(m.ctx)
+	streamCtx := m.agent.withMetadata(ctx)
+	if key := m.agent.config.APIKey; key != "" {
+		streamCtx = metadata.AppendToOutgoingContext(streamCtx, "x-api-key", key)
+	}
+	stream, err := m.client.StreamTelemetry(streamCtx, m.agent.config.callOptions()...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	m.stream = &cancelingStream{stream, cancel}
+	m.describe = true
+	return nil
+}
+
+// reconnect opens a new stream once the backoff has passed, or at once
+// while draining, and reports whether the mirror is connected
+func (m *mirror) reconnect() bool {
+	if !m.draining && m.agent.clock.Now().Before(m.reconnectAt) {
+		return false
+	}
+	if err := m.openStream(); err != nil {
+		m.disconnect(err)
+		return false
+	}
+	m.backoff = 0
+	m.agent.logLimited(&m.reconnectLog, "Connected to mirror at %s", m.addr)
+	return true
+}
+
+// disconnect drops a failed stream and schedules a reconnect
+func (m *mirror) disconnect(err error) {
+	if m.stream != nil {
+		if _, status := m.stream.CloseAndRecv(); errors.Is(err, io.EOF) && status != nil {
+			err = status
+		}
+		m.stream = nil
+	}
+	m.failures++
+	m.agent.logLimited(&m.lostLog, "Mirror at %s failing (%d in a row): %v", m.addr, m.failures, err)
+	var wait time.Duration
+	m.backoff, wait = m.agent.config.nextBackoff(m.backoff)
+	m.reconnectAt = m.agent.clock.Now().Add(wait)
+}
+
+// bufferBatch queues a batch for the stream, dropping the oldest past
+// Config.MaxBufferedBatches
+func (m *mirror) bufferBatch(batch *pb.TelemetryBatch) {
+	limit := m.agent.config.MaxBufferedBatches
+	if limit <= 0 {
+		limit = DefaultMaxBufferedBatches
+	}
+	if len(m.pending) >= limit {
+		m.agent.AddCounter("mirror_dropped_batches_total", 1)
+		m.pending = m.pending[1:]
+	}
+	m.pending = append(m.pending, batch)
+}
+
+// close half-closes the stream and waits for the mirror's ack, or for
+// cancel
+func (m *mirror) close() {
+	if m.stream != nil {
+		m.stream.CloseAndRecv()
+		m.stream = nil
+	}
+	if n := len(m.pending); n > 0 {
+		m.agent.logf("Stopped mirroring to %s with %d batches unsent", m.addr, n)
+	}
+}
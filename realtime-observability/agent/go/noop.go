@@ -0,0 +1,326 @@
+//go:build notelemetry
+
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// Built with the notelemetry tag, Agent keeps its API but every method is
+// an empty body the compiler inlines away: no goroutines, no allocations
+// and no connection. Nothing here names a gRPC or protobuf type, so the
+// package does not link them; Sink and DialOption accept any value.
+// Callers need no build-specific code.
+
+// Agent collects and pushes telemetry to the aggregator
+type Agent struct{}
+
+// Sink would receive the agent's batches; any value is accepted and sent
+// nothing
+type Sink interface{}
+
+// DialOption would be passed to grpc.NewClient; any value is accepted and
+// ignored
+type DialOption = any
+
+// NewAgent creates a new telemetry agent
+func NewAgent(config Config) (*Agent, error) { return &Agent{}, nil }
+
+// Connect establishes connection to the aggregator
+func (a *Agent) Connect() error { return nil }
+
+// ConnectContext is Connect bounded by ctx
+func (a *Agent) ConnectContext(ctx context.Context) error { return nil }
+
+// Start begins the metric collection and push loop
+func (a *Agent) Start() error { return nil }
+
+// Stop gracefully stops the agent
+func (a *Agent) Stop() {}
+
+// StopWithTimeout is Stop with a deadline for the final drain
+func (a *Agent) StopWithTimeout(timeout time.Duration) {}
+
+// Flush sends pending metrics immediately
+func (a *Agent) Flush(ctx context.Context) error { return nil }
+
+// CollectDBStats reports a database/sql pool's stats on every push
+func (a *Agent) CollectDBStats(name string, db *sql.DB) {}
+
+// StopDBStats stops reporting a pool
+func (a *Agent) StopDBStats(name string) {}
+
+// Health reports a zero HealthStatus
+func (a *Agent) Health() HealthStatus { return HealthStatus{} }
+
+// FeatureFlag reports false; no configuration is read
+func (a *Agent) FeatureFlag(name string) bool { return false }
+
+// OnStateChange never calls fn
+func (a *Agent) OnStateChange(fn func(connected bool)) {}
+
+// Pause stops pushes until Resume
+func (a *Agent) Pause() {}
+
+// Resume undoes Pause
+func (a *Agent) Resume() {}
+
+// IsPaused reports whether pushes are paused
+func (a *Agent) IsPaused() bool { return false }
+
+// Describe records metadata for a metric
+func (a *Agent) Describe(name string, d Description) {}
+
+// RecordEvent records a discrete event to send with the next push
+func (a *Agent) RecordEvent(kind, message string, attrs map[string]string) {}
+
+// SetGauge sets a gauge metric value
+func (a *Agent) SetGauge(name string, value float64) {}
+
+// SetGaugeAgg sets a gauge aggregated between pushes
+func (a *Agent) SetGaugeAgg(name string, value float64) {}
+
+// SetGaugeAggWithLabels is SetGaugeAgg for one label combination
+func (a *Agent) SetGaugeAggWithLabels(name string, labels map[string]string, value float64) {}
+
+// IncCounter increments a counter metric
+func (a *Agent) IncCounter(name string) {}
+
+// AddCounter adds to a counter metric
+func (a *Agent) AddCounter(name string, delta uint64) {}
+
+// AddCounterFloat adds a fractional amount to a float counter
+func (a *Agent) AddCounterFloat(name string, delta float64) {}
+
+// AddCounterFloatWithLabels adds to the float counter for one label
+// combination
+func (a *Agent) AddCounterFloatWithLabels(name string, labels map[string]string, delta float64) {}
+
+// RecordHistogram records a value in a histogram
+func (a *Agent) RecordHistogram(name string, value float64) {}
+
+// CurrentAggregator returns the address the agent sends to
+func (a *Agent) CurrentAggregator() string { return "" }
+
+// EnableMirror mirrors nothing and returns nil
+func (a *Agent) EnableMirror(addr string) error { return nil }
+
+// DisableMirror does nothing
+func (a *Agent) DisableMirror() {}
+
+// SetGaugeInGroup sets a gauge sent on its group's push interval
+func (a *Agent) SetGaugeInGroup(name string, value float64, group string) {}
+
+// SetGaugeWithLabels sets the gauge for one label combination
+func (a *Agent) SetGaugeWithLabels(name string, labels map[string]string, value float64) {}
+
+// IncCounterWithLabels increments the counter for one label combination
+func (a *Agent) IncCounterWithLabels(name string, labels map[string]string) {}
+
+// AddUpDown adds delta to an up-down counter sent as a gauge
+func (a *Agent) AddUpDown(name string, delta int64) {}
+
+// AddUpDownWithLabels adds delta to the up-down counter for one label
+// combination
+func (a *Agent) AddUpDownWithLabels(name string, labels map[string]string, delta int64) {}
+
+// SetGaugeAt sets a gauge as of ts
+func (a *Agent) SetGaugeAt(name string, value float64, ts time.Time) {}
+
+// SetGaugeAtWithLabels is SetGaugeAt for one label combination
+func (a *Agent) SetGaugeAtWithLabels(name string, labels map[string]string, value float64, ts time.Time) {
+}
+
+// RecordHistogramAt records a histogram value as of ts
+func (a *Agent) RecordHistogramAt(name string, value float64, ts time.Time) {}
+
+// RecordHistogramAtWithLabels is RecordHistogramAt for one label
+// combination
+func (a *Agent) RecordHistogramAtWithLabels(name string, labels map[string]string, value float64, ts time.Time) {
+}
+
+// AddCounterWithLabels adds to the counter for one label combination
+func (a *Agent) AddCounterWithLabels(name string, labels map[string]string, delta uint64) {}
+
+// RecordHistogramWithLabels records a value in the histogram for one label
+// combination
+func (a *Agent) RecordHistogramWithLabels(name string, labels map[string]string, value float64) {}
+
+// RecordHistogramWithBounds records a value in a histogram with custom
+// bounds
+func (a *Agent) RecordHistogramWithBounds(name string, bounds []float64, value float64) {}
+
+// RecordSummary records a value in a summary
+func (a *Agent) RecordSummary(name string, value float64) {}
+
+// DeleteGauge stops sending a gauge
+func (a *Agent) DeleteGauge(name string) {}
+
+// DeleteCounter stops sending a counter
+func (a *Agent) DeleteCounter(name string) {}
+
+// DeleteHistogram stops sending a histogram
+func (a *Agent) DeleteHistogram(name string) {}
+
+// ResetAll forgets every recorded metric
+func (a *Agent) ResetAll() {}
+
+// SeriesCount returns the number of series the agent holds
+func (a *Agent) SeriesCount() int { return 0 }
+
+// MetricNames returns the names of the metrics the agent sends
+func (a *Agent) MetricNames() []string { return nil }
+
+// RegisterGaugeFunc reports the result of fn as a gauge on every push
+func (a *Agent) RegisterGaugeFunc(name string, fn func() float64) {}
+
+// UnregisterGaugeFunc stops calling the callback registered for name
+func (a *Agent) UnregisterGaugeFunc(name string) {}
+
+// RecordError records an error occurrence
+func (a *Agent) RecordError(errorType string) {}
+
+// noopDone is shared by every tracked request, so tracking never allocates
+func noopDone() {}
+
+// TrackRequest returns a function to call when request completes
+func (a *Agent) TrackRequest() func() { return noopDone }
+
+// TrackRequestNamed is TrackRequest with an operation name
+func (a *Agent) TrackRequestNamed(operation string) func() { return noopDone }
+
+// TrackRequestCtx is TrackRequest with exemplar details taken from ctx
+func (a *Agent) TrackRequestCtx(ctx context.Context) func() { return noopDone }
+
+// TrackRequestContext is TrackRequestCtx that also counts cancellations
+func (a *Agent) TrackRequestContext(ctx context.Context) func() { return noopDone }
+
+// TrackRequestWithInfo is TrackRequest labeled by status class and route
+func (a *Agent) TrackRequestWithInfo() func(status int, route string) { return noopDoneWithInfo }
+
+// noopDoneWithInfo is shared like noopDone
+func noopDoneWithInfo(status int, route string) {}
+
+// HTTPMiddleware returns handlers unchanged
+func HTTPMiddleware(a *Agent) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler { return next }
+}
+
+// TrackRPC records nothing; the agentgrpc interceptors then call the
+// handler directly
+func (a *Agent) TrackRPC(method string) func(code string) { return nil }
+
+// Timer times one code section into a histogram
+type Timer struct{}
+
+// noopTimer is shared by every StartTimer, so timing never allocates
+var noopTimer = &Timer{}
+
+// StartTimer starts timing a code section recorded into the named histogram
+func (a *Agent) StartTimer(name string) *Timer { return noopTimer }
+
+// ObserveDuration records the time since StartTimer and returns it
+func (t *Timer) ObserveDuration() time.Duration { return 0 }
+
+// ObserveDurationWithLabels records the time since StartTimer for one
+// label combination and returns it
+func (t *Timer) ObserveDurationWithLabels(labels map[string]string) time.Duration { return 0 }
+
+// AddHistogramBuckets adds observations already counted into buckets to
+// the histogram name
+func (a *Agent) AddHistogramBuckets(name string, bounds []float64, counts []uint64, sum float64) {}
+
+// AddHistogramBucketsWithLabels is AddHistogramBuckets for one label
+// combination
+func (a *Agent) AddHistogramBucketsWithLabels(name string, labels map[string]string, bounds []float64, counts []uint64, sum float64) {
+}
+
+// MarkRate counts one event of name for the <name>_per_sec gauge
+func (a *Agent) MarkRate(name string) {}
+
+// MarkRateN is MarkRate for n events at once
+func (a *Agent) MarkRateN(name string, n uint64) {}
+
+// PrometheusHandler returns a handler serving an empty exposition
+func (a *Agent) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+}
+
+// ServePrometheus serves nothing and returns nil
+func (a *Agent) ServePrometheus(addr string) error { return nil }
+
+// Scope is a view of an agent for one component
+type Scope struct{}
+
+// WithPrefix returns a Scope prepending prefix to every metric name
+func (a *Agent) WithPrefix(prefix string) *Scope { return &Scope{} }
+
+// WithLabels returns a Scope adding labels to every series
+func (a *Agent) WithLabels(labels map[string]string) *Scope { return &Scope{} }
+
+// WithPrefix returns a Scope whose prefix follows this one's
+func (s *Scope) WithPrefix(prefix string) *Scope { return &Scope{} }
+
+// WithLabels returns a Scope with labels added to this one's, replacing
+// any with the same key
+func (s *Scope) WithLabels(labels map[string]string) *Scope { return &Scope{} }
+
+// SetGauge sets the scoped gauge name
+func (s *Scope) SetGauge(name string, value float64) {}
+
+// SetGaugeWithLabels sets the scoped gauge for one label combination
+func (s *Scope) SetGaugeWithLabels(name string, labels map[string]string, value float64) {}
+
+// IncCounter increments the scoped counter name
+func (s *Scope) IncCounter(name string) {}
+
+// AddCounter adds to the scoped counter name
+func (s *Scope) AddCounter(name string, delta uint64) {}
+
+// IncCounterWithLabels increments the scoped counter for one label
+// combination
+func (s *Scope) IncCounterWithLabels(name string, labels map[string]string) {}
+
+// AddCounterWithLabels adds to the scoped counter for one label
+// combination
+func (s *Scope) AddCounterWithLabels(name string, labels map[string]string, delta uint64) {}
+
+// AddCounterFloat adds a fractional amount to the scoped float counter
+func (s *Scope) AddCounterFloat(name string, delta float64) {}
+
+// AddCounterFloatWithLabels adds to the scoped float counter for one label
+// combination
+func (s *Scope) AddCounterFloatWithLabels(name string, labels map[string]string, delta float64) {}
+
+// AddUpDown adds delta, positive or negative, to the scoped up-down
+// counter name
+func (s *Scope) AddUpDown(name string, delta int64) {}
+
+// AddUpDownWithLabels adds to the scoped up-down counter for one label
+// combination
+func (s *Scope) AddUpDownWithLabels(name string, labels map[string]string, delta int64) {}
+
+// RecordHistogram records a value in the scoped histogram name
+func (s *Scope) RecordHistogram(name string, value float64) {}
+
+// RecordHistogramWithLabels records a value in the scoped histogram for
+// one label combination
+func (s *Scope) RecordHistogramWithLabels(name string, labels map[string]string, value float64) {}
+
+// Describe records metadata for the scoped metric name
+func (s *Scope) Describe(name string, d Description) {}
+
+// DeleteGauge stops sending the scoped gauge or up-down counter name, for
+// the label combinations carrying the Scope's labels only
+func (s *Scope) DeleteGauge(name string) {}
+
+// DeleteCounter stops sending the scoped counter name, for the label
+// combinations carrying the Scope's labels only
+func (s *Scope) DeleteCounter(name string) {}
+
+// DeleteHistogram stops sending the scoped histogram name, for the label
+// combinations carrying the Scope's labels only
+func (s *Scope) DeleteHistogram(name string) {}
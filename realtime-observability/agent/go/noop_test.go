@@ -0,0 +1,49 @@
+//go:build notelemetry
+
+package agent_test
+
+import (
+	"testing"
+
+	agent "github.com/yourorg/agent"
+)
+
+// record makes the recording calls an instrumented request path makes
+func record(a *agent.Agent, labels map[string]string) {
+	a.IncCounter("requests_total")
+	a.AddCounterWithLabels("bytes_total", labels, 512)
+	a.SetGauge("queue_depth", 3)
+	a.SetGaugeWithLabels("pool_size", labels, 8)
+	a.AddUpDown("inflight", 1)
+	a.RecordHistogram("latency", 12.5)
+	a.RecordHistogramWithLabels("latency", labels, 12.5)
+	a.RecordSummary("query_ms", 4)
+	a.MarkRate("requests")
+	a.StartTimer("db_query_ms").ObserveDuration()
+	a.TrackRequest()()
+	a.TrackRequestWithInfo()(200, "/checkout")
+}
+
+func TestNoopRecordingDoesNotAllocate(t *testing.T) {
+	a, err := agent.NewAgent(agent.DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	labels := map[string]string{"route": "/checkout"}
+	if allocs := testing.AllocsPerRun(100, func() { record(a, labels) }); allocs != 0 {
+		t.Fatalf("recording allocated %v times per run, want 0", allocs)
+	}
+}
+
+func BenchmarkNoopRecording(b *testing.B) {
+	a, err := agent.NewAgent(agent.DefaultConfig())
+	if err != nil {
+		b.Fatalf("NewAgent: %v", err)
+	}
+	labels := map[string]string{"route": "/checkout"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		record(a, labels)
+	}
+}
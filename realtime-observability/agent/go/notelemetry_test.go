@@ -0,0 +1,40 @@
+package agent_test
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestNotelemetryBuild builds the package and the example with the
+// notelemetry tag, as the CI matrix does, and checks that the tagged
+// agent links neither gRPC nor the generated protobuf types
+func TestNotelemetryBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the go command")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+
+	out, err := exec.Command(goTool, "build", "-tags", "notelemetry", "-o", "/dev/null", "./example").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build -tags notelemetry ./example: %v\n%s", err, out)
+	}
+	out, err = exec.Command(goTool, "vet", "-tags", "notelemetry", "./...").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go vet -tags notelemetry ./...: %v\n%s", err, out)
+	}
+
+	out, err = exec.Command(goTool, "list", "-tags", "notelemetry", "-deps", ".").Output()
+	if err != nil {
+		t.Fatalf("go list -tags notelemetry -deps: %v", err)
+	}
+	for _, dep := range strings.Fields(string(out)) {
+		if strings.HasPrefix(dep, "google.golang.org/grpc") || strings.HasPrefix(dep, "google.golang.org/protobuf") ||
+			strings.HasPrefix(dep, "github.com/yourorg/telemetry/gen") {
+			t.Errorf("notelemetry build depends on %s", dep)
+		}
+	}
+}
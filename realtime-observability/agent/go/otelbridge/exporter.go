@@ -0,0 +1,262 @@
+// Package otelbridge feeds metrics recorded with the OpenTelemetry SDK
+// into an agent, so services instrumented with OTel can report to the
+// aggregator without rewriting their instrumentation.
+//
+// Register an Exporter with a periodic reader:
+//
+//	provider := sdkmetric.NewMeterProvider(
+//		sdkmetric.WithResource(res),
+//		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(otelbridge.New(a))),
+//	)
+//
+// and set cfg.ResourceAttributes = otelbridge.ResourceAttributes(res) so
+// the agent's batches carry the same resource.
+//
+// It is a separate module so the agent itself does not depend on the
+// OpenTelemetry SDK.
+package otelbridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	agent "github.com/yourorg/agent"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// errShutdown reports an Export after Shutdown
+var errShutdown = errors.New("otelbridge: exporter is shut down")
+
+// Exporter is an sdkmetric.Exporter recording every data point into an
+// agent, which pushes them on its own schedule:
+//
+//   - gauges become SetGauge values
+//   - monotonic sums become counters, float ones AddCounterFloat
+//   - non-monotonic sums (up-down counters) become gauges of their total
+//   - explicit-bucket histograms become agent histograms with the same
+//     bounds, through AddHistogramBuckets
+//
+// Attributes become labels. Delta and cumulative temporality are both
+// accepted: cumulative points are turned into deltas against the previous
+// export, and a point whose start time moved is taken as a restart.
+// Exponential histograms and summaries are not supported; Export skips
+// them and reports it in its error. Data point timestamps are dropped, as
+// the agent stamps samples when it pushes.
+type Exporter struct {
+	agent *agent.Agent
+
+	mu       sync.Mutex
+	last     map[streamKey]*lastPoint // cumulative points, for deltas
+	totals   map[streamKey]float64    // delta up-down sums, for totals
+	shutdown bool
+}
+
+// streamKey identifies one instrument and attribute set
+type streamKey struct {
+	name  string
+	attrs attribute.Distinct
+}
+
+// lastPoint is the previous cumulative point of a stream
+type lastPoint struct {
+	start  time.Time
+	value  float64
+	counts []uint64
+	sum    float64
+}
+
+// New returns an Exporter recording into a
+func New(a *agent.Agent) *Exporter {
+	return &Exporter{
+		agent:  a,
+		last:   make(map[streamKey]*lastPoint),
+		totals: make(map[streamKey]float64),
+	}
+}
+
+// ResourceAttributes returns res as string attributes for
+// agent.Config.ResourceAttributes
+func ResourceAttributes(res *resource.Resource) map[string]string {
+	attrs := make(map[string]string, res.Len())
+	for iter := res.Iter(); iter.Next(); {
+		kv := iter.Attribute()
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+// Temporality returns the SDK default, cumulative; Export converts it
+func (e *Exporter) Temporality(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+	return sdkmetric.DefaultTemporalitySelector(kind)
+}
+
+// Aggregation returns the SDK default, explicit-bucket histograms included
+func (e *Exporter) Aggregation(kind sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(kind)
+}
+
+// Export records rm into the agent. Unsupported aggregations are skipped
+// and named in the returned error; everything else is still recorded.
+func (e *Exporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.shutdown {
+		return errShutdown
+	}
+
+	var errs []error
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if err := e.record(m); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ForceFlush does nothing: data points are recorded into the agent as
+// they are exported, and the agent pushes them itself
+func (e *Exporter) ForceFlush(ctx context.Context) error {
+	return nil
+}
+
+// Shutdown makes later Exports fail; the agent is left running
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shutdown = true
+	clear(e.last)
+	clear(e.totals)
+	return nil
+}
+
+// record records one metric; caller holds e.mu
+func (e *Exporter) record(m metricdata.Metrics) error {
+	switch data := m.Data.(type) {
+	case metricdata.Gauge[int64]:
+		e.describe(m, "gauge")
+		for _, dp := range data.DataPoints {
+			e.agent.SetGaugeWithLabels(m.Name, labels(dp.Attributes), float64(dp.Value))
+		}
+	case metricdata.Gauge[float64]:
+		e.describe(m, "gauge")
+		for _, dp := range data.DataPoints {
+			e.agent.SetGaugeWithLabels(m.Name, labels(dp.Attributes), dp.Value)
+		}
+	case metricdata.Sum[int64]:
+		recordSum(e, m, data)
+	case metricdata.Sum[float64]:
+		recordSum(e, m, data)
+	case metricdata.Histogram[int64]:
+		recordHistogram(e, m, data)
+	case metricdata.Histogram[float64]:
+		recordHistogram(e, m, data)
+	default:
+		return fmt.Errorf("otelbridge: %s: unsupported aggregation %T", m.Name, m.Data)
+	}
+	return nil
+}
+
+// describe passes the instrument's description and unit to the agent,
+// which ignores repeats
+func (e *Exporter) describe(m metricdata.Metrics, typ string) {
+	e.agent.Describe(m.Name, agent.Description{Type: typ, Unit: m.Unit, Help: m.Description})
+}
+
+// recordSum records a sum as a counter, or as a gauge of its total when it
+// is not monotonic; caller holds e.mu
+func recordSum[N int64 | float64](e *Exporter, m metricdata.Metrics, data metricdata.Sum[N]) {
+	cumulative := data.Temporality == metricdata.CumulativeTemporality
+	if !data.IsMonotonic {
+		e.describe(m, "gauge")
+		for _, dp := range data.DataPoints {
+			value := float64(dp.Value)
+			if !cumulative {
+				key := streamKey{m.Name, dp.Attributes.Equivalent()}
+				value += e.totals[key]
+				e.totals[key] = value
+			}
+			e.agent.SetGaugeWithLabels(m.Name, labels(dp.Attributes), value)
+		}
+		return
+	}
+
+	e.describe(m, "counter")
+	for _, dp := range data.DataPoints {
+		delta := float64(dp.Value)
+		if cumulative {
+			key := streamKey{m.Name, dp.Attributes.Equivalent()}
+			prev, ok := e.last[key]
+			if ok && prev.start.Equal(dp.StartTime) && delta >= prev.value {
+				delta -= prev.value
+			}
+			e.last[key] = &lastPoint{start: dp.StartTime, value: float64(dp.Value)}
+		}
+		if delta == 0 {
+			continue
+		}
+		switch any(dp.Value).(type) {
+		case int64:
+			e.agent.AddCounterWithLabels(m.Name, labels(dp.Attributes), uint64(delta))
+		default:
+			e.agent.AddCounterFloatWithLabels(m.Name, labels(dp.Attributes), delta)
+		}
+	}
+}
+
+// recordHistogram adds a histogram's bucket counts; caller holds e.mu
+func recordHistogram[N int64 | float64](e *Exporter, m metricdata.Metrics, data metricdata.Histogram[N]) {
+	e.describe(m, "histogram")
+	for _, dp := range data.DataPoints {
+		counts, sum := dp.BucketCounts, float64(dp.Sum)
+		if data.Temporality == metricdata.CumulativeTemporality {
+			key := streamKey{m.Name, dp.Attributes.Equivalent()}
+			prev, ok := e.last[key]
+			e.last[key] = &lastPoint{start: dp.StartTime, counts: append([]uint64(nil), counts...), sum: sum}
+			if ok && prev.start.Equal(dp.StartTime) {
+				counts, sum = histogramDelta(prev, counts, sum)
+			}
+		}
+		if len(dp.Bounds) == 0 {
+			// A single bucket has nowhere to go in an agent histogram
+			continue
+		}
+		e.agent.AddHistogramBucketsWithLabels(m.Name, labels(dp.Attributes), dp.Bounds, counts, sum)
+	}
+}
+
+// histogramDelta returns the observations since prev, or the point as is
+// when a bucket went down, which only a restart explains
+func histogramDelta(prev *lastPoint, counts []uint64, sum float64) ([]uint64, float64) {
+	if len(prev.counts) != len(counts) {
+		return counts, sum
+	}
+	delta := make([]uint64, len(counts))
+	for i, c := range counts {
+		if c < prev.counts[i] {
+			return counts, sum
+		}
+		delta[i] = c - prev.counts[i]
+	}
+	return delta, sum - prev.sum
+}
+
+// labels converts attributes to agent labels, nil when there are none
+func labels(set attribute.Set) map[string]string {
+	if set.Len() == 0 {
+		return nil
+	}
+	l := make(map[string]string, set.Len())
+	for iter := set.Iter(); iter.Next(); {
+		kv := iter.Attribute()
+		l[string(kv.Key)] = kv.Value.Emit()
+	}
+	return l
+}
@@ -0,0 +1,86 @@
+package otelbridge_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/yourorg/agent/otelbridge"
+	"github.com/yourorg/aggregator/aggregatortest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func TestInstrumentsReachAggregator(t *testing.T) {
+	h := aggregatortest.New(t, aggregatortest.Options{ServiceName: "checkout"})
+
+	// A reader that never fires on its own; ForceFlush exports
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(
+		sdkmetric.NewPeriodicReader(otelbridge.New(h.Agent), sdkmetric.WithInterval(time.Hour)),
+	))
+	defer provider.Shutdown(context.Background())
+	meter := provider.Meter("checkout")
+	ctx := context.Background()
+
+	requests, err := meter.Int64Counter("requests_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := meter.Int64UpDownCounter("queue_depth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	temperature, err := meter.Float64Gauge("temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latency, err := meter.Float64Histogram("latency", metric.WithExplicitBucketBoundaries(5, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart := metric.WithAttributes(attribute.String("route", "/cart"))
+
+	requests.Add(ctx, 3, cart)
+	queue.Add(ctx, 5)
+	temperature.Record(ctx, 21.5)
+	latency.Record(ctx, 1)
+	latency.Record(ctx, 7)
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatalf("ForceFlush: %v", err)
+	}
+
+	// The second export carries cumulative totals; only the increase
+	// since the first may reach the aggregator
+	requests.Add(ctx, 2, cart)
+	queue.Add(ctx, -2)
+	latency.Record(ctx, 30)
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatalf("ForceFlush: %v", err)
+	}
+
+	const counter = `requests_total{route="/cart"}`
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v, _ := h.LatestCounter("checkout", counter)
+		q, _ := h.LatestGauge("checkout", "queue_depth")
+		hist, ok := h.Registry.FindHistogramRing("checkout", "latency")
+		var merged []uint64
+		if ok {
+			if m, ok := hist.MergeSince(0); ok {
+				merged = m.Counts
+			}
+		}
+		if v == 5 && q == 3 && slices.Equal(merged, []uint64{1, 1, 1}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %v, queue_depth = %v, latency counts = %v; want 5, 3 and [1 1 1]", counter, v, q, merged)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, ok := h.LatestGauge("checkout", "temperature"); !ok || v != 21.5 {
+		t.Fatalf("temperature = %v, %v; want 21.5", v, ok)
+	}
+}
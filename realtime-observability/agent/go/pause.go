@@ -0,0 +1,30 @@
+//go:build !notelemetry
+
+package agent
+
+// Pause stops the push loop from collecting and sending until Resume. The
+// connection stays open and metrics keep accumulating locally, so the
+// first push after Resume carries everything recorded meanwhile. Flush and
+// Stop still send. Pausing a paused or unstarted agent does nothing.
+func (a *Agent) Pause() {
+	if a.paused.CompareAndSwap(false, true) {
+		a.logf("Telemetry pushes paused")
+	}
+}
+
+// Resume undoes Pause and pushes right away rather than at the next tick
+func (a *Agent) Resume() {
+	if !a.paused.CompareAndSwap(true, false) {
+		return
+	}
+	a.logf("Telemetry pushes resumed")
+	select {
+	case a.resumed <- struct{}{}:
+	default:
+	}
+}
+
+// IsPaused reports whether pushes are paused
+func (a *Agent) IsPaused() bool {
+	return a.paused.Load()
+}
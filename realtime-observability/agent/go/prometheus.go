@@ -0,0 +1,280 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prometheusContentType is the text exposition format, version 0.0.4
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// promFamily is one metric name in the exposition, with its samples
+type promFamily struct {
+	typ     string
+	samples []promSample
+}
+
+// promSample is one line: the family name plus suffix, labels and value
+type promSample struct {
+	suffix string
+	labels map[string]string
+	le     string // bucket bound, for _bucket lines
+	value  float64
+}
+
+// promHistogram is a histogram read under a.mu and snapshotted after
+type promHistogram struct {
+	name   string
+	labels map[string]string
+	hist   *Histogram
+	rate   float64
+}
+
+// PrometheusHandler returns a handler rendering the agent's current
+// gauges, counters and histograms in the Prometheus text format, for
+// scraping alongside or instead of pushing. Histograms are cumulative
+// since the agent started, whatever Config.HistogramTemporality says, and
+// summaries are left out. Names are sanitized to Prometheus' rules, and a
+// name already rendered with another type is skipped.
+func (a *Agent) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		a.writePrometheus(&buf)
+		w.Header().Set("Content-Type", prometheusContentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// ServePrometheus serves PrometheusHandler at /metrics on addr until the
+// agent stops. It returns once addr is bound, with the error if it cannot
+// be.
+func (a *Agent) ServePrometheus(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.PrometheusHandler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	a.promMu.Lock()
+	a.promServers = append(a.promServers, srv)
+	a.promMu.Unlock()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.logf("Prometheus endpoint on %s failed: %v", addr, err)
+		}
+	}()
+	return nil
+}
+
+// closePrometheus closes the servers started by ServePrometheus
+func (a *Agent) closePrometheus() {
+	a.promMu.Lock()
+	defer a.promMu.Unlock()
+	for _, srv := range a.promServers {
+		srv.Close()
+	}
+	a.promServers = nil
+}
+
+// writePrometheus renders the exposition. Values are copied under a.mu
+// and everything else, gauge callbacks and histogram snapshots included,
+// runs after it is released, so a scrape holds up recording no longer
+// than a push does.
+func (a *Agent) writePrometheus(buf *bytes.Buffer) {
+	families := make(map[string]*promFamily)
+	add := func(name, typ string, s promSample) {
+		name = sanitizeMetricName(name)
+		f, ok := families[name]
+		if !ok {
+			f = &promFamily{typ: typ}
+			families[name] = f
+		} else if f.typ != typ {
+			return
+		}
+		f.samples = append(f.samples, s)
+	}
+
+	a.mu.RLock()
+	funcs := make(map[string]func() float64, len(a.gaugeFuncs))
+	for name, fn := range a.gaugeFuncs {
+		funcs[name] = fn
+	}
+	for key, val := range a.gauges {
+		if _, ok := funcs[key]; ok {
+			continue
+		}
+		value := *val
+		if w, ok := a.gaugeWindows[key]; ok {
+			value = w.current()
+		}
+		add(a.series[key].name, "gauge", promSample{labels: a.series[key].labels, value: value})
+	}
+	for key, val := range a.upDowns {
+		if _, ok := a.gauges[key]; ok {
+			continue
+		}
+		if _, ok := funcs[key]; ok {
+			continue
+		}
+		add(a.series[key].name, "gauge", promSample{labels: a.series[key].labels, value: float64(val.Load())})
+	}
+	for key, val := range a.counters {
+		add(a.series[key].name, "counter", promSample{labels: a.series[key].labels, value: float64(val.Load())})
+	}
+	for key, val := range a.floatCounters {
+		add(a.series[key].name, "counter", promSample{labels: a.series[key].labels, value: *val})
+	}
+	hists := make([]promHistogram, 0, len(a.histograms))
+	for key, hist := range a.histograms {
+		name := a.series[key].name
+		rate, ok := a.config.HistogramSampleRate[name]
+		if !ok {
+			rate = 1
+		}
+		hists = append(hists, promHistogram{name: name, labels: a.series[key].labels, hist: hist, rate: rate})
+	}
+	a.mu.RUnlock()
+
+	for name, fn := range funcs {
+		if value, ok := a.callGaugeFunc(name, fn); ok {
+			add(name, "gauge", promSample{value: value})
+		}
+	}
+	for _, h := range hists {
+		bounds, counts, sum, count := h.hist.totalsSnapshot()
+		if h.rate < 1 {
+			counts, sum, count = scaleSampled(counts, sum, h.rate)
+		}
+		var cum uint64
+		for i, c := range counts {
+			cum += c
+			le := "+Inf"
+			if i < len(bounds) {
+				le = formatPromFloat(bounds[i])
+			}
+			add(h.name, "histogram", promSample{suffix: "_bucket", labels: h.labels, le: le, value: float64(cum)})
+		}
+		add(h.name, "histogram", promSample{suffix: "_sum", labels: h.labels, value: sum})
+		add(h.name, "histogram", promSample{suffix: "_count", labels: h.labels, value: float64(count)})
+	}
+	if _, ok := families["inflight"]; !ok {
+		add("inflight", "gauge", promSample{value: float64(a.inflight.Load())})
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	a.descMu.Lock()
+	help := make(map[string]string, len(names))
+	for name, d := range a.descs.byName {
+		if d.Help != "" {
+			help[sanitizeMetricName(name)] = d.Help
+		}
+	}
+	a.descMu.Unlock()
+
+	for _, name := range names {
+		f := families[name]
+		if h, ok := help[name]; ok {
+			buf.WriteString("# HELP " + name + " " + escapePromHelp(h) + "\n")
+		}
+		buf.WriteString("# TYPE " + name + " " + f.typ + "\n")
+		// Histogram lines keep their bucket order within each series
+		sort.SliceStable(f.samples, func(i, j int) bool {
+			return promLabelString(f.samples[i].labels, "") < promLabelString(f.samples[j].labels, "")
+		})
+		for _, s := range f.samples {
+			buf.WriteString(name + s.suffix + promLabelString(s.labels, s.le) + " " + formatPromFloat(s.value) + "\n")
+		}
+	}
+}
+
+// promLabelString renders labels as {k="v",...} in key order, with le last
+// when set
+func promLabelString(labels map[string]string, le string) string {
+	if len(labels) == 0 && le == "" {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(sanitizeLabelName(k) + `="` + escapePromLabel(labels[k]) + `"`)
+	}
+	if le != "" {
+		if len(keys) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`le="` + le + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// sanitizeMetricName maps name onto [a-zA-Z_:][a-zA-Z0-9_:]*, replacing
+// other characters with _
+func sanitizeMetricName(name string) string {
+	return sanitizePromName(name, true)
+}
+
+// sanitizeLabelName maps name onto [a-zA-Z_][a-zA-Z0-9_]*
+func sanitizeLabelName(name string) string {
+	return sanitizePromName(name, false)
+}
+
+func sanitizePromName(name string, colons bool) string {
+	if name == "" {
+		return "_"
+	}
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9':
+		case c == ':' && colons:
+		default:
+			b[i] = '_'
+		}
+	}
+	if b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+var (
+	promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	promHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapePromLabel(s string) string { return promLabelEscaper.Replace(s) }
+
+func escapePromHelp(s string) string { return promHelpEscaper.Replace(s) }
+
+// formatPromFloat formats v as Prometheus parses it, +Inf, -Inf and NaN
+// included
+func formatPromFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,121 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// rateSuffix and rateEWMASuffix name the gauges MarkRate feeds
+const (
+	rateSuffix     = "_per_sec"
+	rateEWMASuffix = "_per_sec_ewma"
+)
+
+// MarkRate counts one event of name, such as a request. Every push sends
+// the gauge <name>_per_sec, the events per second since the previous
+// push, and with Config.RateSmoothing also <name>_per_sec_ewma.
+func (a *Agent) MarkRate(name string) {
+	a.MarkRateN(name, 1)
+}
+
+// MarkRateN is MarkRate for n events at once, such as bytes written
+func (a *Agent) MarkRateN(name string, n uint64) {
+	key := name + rateSuffix
+	a.mu.RLock()
+	m, ok := a.meters[key]
+	a.mu.RUnlock()
+	if !ok {
+		a.mu.Lock()
+		if m, ok = a.meters[key]; !ok {
+			if !a.track(key, key, nil) {
+				a.mu.Unlock()
+				return
+			}
+			m = &rateMeter{start: time.Now()}
+			a.meters[key] = m
+		}
+		a.mu.Unlock()
+	}
+	m.count.Add(n)
+}
+
+// rateMeter counts events and turns them into a rate per window
+type rateMeter struct {
+	count atomic.Uint64
+
+	mu     sync.Mutex
+	start  time.Time // window start
+	taken  uint64    // count at window start
+	rate   float64   // rate of the last window
+	ewma   float64
+	primed bool // ewma holds a value
+}
+
+// take closes the window at now and returns its rate and the smoothed
+// rate. The window is the actual time since the last one closed, so
+// jittered pushes and a Pause keep the rate true: events counted while
+// paused are spread over the pause, not the next interval. A window
+// shorter than minWindow, such as a Flush just after a push, is left
+// open and the last rates are repeated, since a handful of events over a
+// few milliseconds would read as a spike.
+func (m *rateMeter) take(now time.Time, minWindow, smoothing time.Duration) (rate, ewma float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := now.Sub(m.start)
+	if elapsed < minWindow || elapsed <= 0 {
+		return m.rate, m.ewma
+	}
+	count := m.count.Load()
+	m.rate = float64(count-m.taken) / elapsed.Seconds()
+	m.start, m.taken = now, count
+
+	if !m.primed || smoothing <= 0 {
+		m.ewma, m.primed = m.rate, true
+	} else {
+		// Weighted by the window's length, so irregular windows smooth
+		// alike
+		alpha := 1 - math.Exp(-float64(elapsed)/float64(smoothing))
+		m.ewma += alpha * (m.rate - m.ewma)
+	}
+	return m.rate, m.ewma
+}
+
+// collectRates closes every rate window and returns the rate gauges
+func (a *Agent) collectRates(now uint64) []*pb.Metric {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.meters) == 0 {
+		return nil
+	}
+
+	wall := time.Now()
+	smoothing := a.config.RateSmoothing
+	metrics := make([]*pb.Metric, 0, len(a.meters))
+	gauge := func(name string, value float64) *pb.Metric {
+		return &pb.Metric{
+			Name: name,
+			Samples: []*pb.MetricSample{
+				{
+					TimestampNs: now,
+					Value:       &pb.MetricSample_Gauge{Gauge: value},
+				},
+			},
+		}
+	}
+	for key, m := range a.meters {
+		rate, ewma := m.take(wall, a.config.PushInterval/2, smoothing)
+		metrics = append(metrics, gauge(key, rate))
+		if smoothing > 0 {
+			base := key[:len(key)-len(rateSuffix)]
+			metrics = append(metrics, gauge(base+rateEWMASuffix, ewma))
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,137 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+)
+
+// errDisconnected reports a batch buffered while the stream is down
+var errDisconnected = errors.New("not connected to the aggregator; batch buffered")
+
+// connectParams makes the connection redial on the same backoff as the
+// stream; gRPC's default waits up to two minutes, and streams fail fast
+// until the connection is back
+func (c Config) connectParams() grpc.ConnectParams {
+	params := grpc.ConnectParams{Backoff: backoff.DefaultConfig, MinConnectTimeout: 5 * time.Second}
+	params.Backoff.BaseDelay, params.Backoff.MaxDelay = c.reconnectBackoff()
+	return params
+}
+
+// reconnectBackoff returns the configured backoff bounds, or the defaults
+func (c Config) reconnectBackoff() (minBackoff, maxBackoff time.Duration) {
+	minBackoff, maxBackoff = c.ReconnectMinBackoff, c.ReconnectMaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultReconnectMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultReconnectMaxBackoff
+	}
+	return minBackoff, maxBackoff
+}
+
+// disconnect drops a failed stream and schedules a reconnect with
+// exponential backoff and jitter. It returns err, or the stream's status
+// when err is only Send's io.EOF. Caller holds pushMu.
+func (a *Agent) disconnect(err error) error {
+	if a.stream != nil {
+		// The stream has failed, so this returns its status at once and
+		// releases it; Send only reports io.EOF
+		ack, status := a.stream.CloseAndRecv()
+		if errors.Is(err, io.EOF) && status != nil {
+			err = status
+		}
+		// An aggregator may end the stream itself with an Ack asking to
+		// slow down
+		a.applyHint(ack)
+		a.logLimited(&a.lostLog, "Lost stream to aggregator: %v", err)
+		a.stream = nil
+		a.setStreaming(false)
+	}
+	if a.noteFailure() {
+		// Try the next address on the next push
+		a.backoff, a.reconnectAt = 0, a.clock.Now()
+		return err
+	}
+
+	var wait time.Duration
+	a.backoff, wait = a.config.nextBackoff(a.backoff)
+	a.reconnectAt = a.clock.Now().Add(wait)
+	return err
+}
+
+// nextBackoff doubles the reconnect backoff, within the configured bounds,
+// and returns it with how long to wait: between half and all of it, so a
+// fleet that lost the same aggregator does not reconnect in lockstep
+func (c Config) nextBackoff(prev time.Duration) (backoff, wait time.Duration) {
+	minBackoff, maxBackoff := c.reconnectBackoff()
+	if prev == 0 {
+		backoff = minBackoff
+	} else {
+		backoff = min(prev*2, maxBackoff)
+	}
+	return backoff, backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// reconnect opens a new stream once the backoff has passed, or at once
+// while Stop drains, and reports whether the agent is connected; caller
+// holds pushMu
+func (a *Agent) reconnect() bool {
+	if !a.draining.Load() && a.clock.Now().Before(a.reconnectAt) {
+		return false
+	}
+	if err := a.openStream(a.ctx); err != nil {
+		a.disconnect(err)
+		return false
+	}
+	a.backoff = 0
+	a.AddCounter("reconnects_total", 1)
+	a.logLimited(&a.reconnectLog, "Reconnected to aggregator at %s", a.CurrentAggregator())
+	return true
+}
+
+// bufferBatch keeps a batch for the next stream, dropping the oldest past
+// the limit. Samples and events keep their timestamps, so a replay fills
+// the gap in place. Descriptions are left out: a new stream resends them
+// all.
+func (a *Agent) bufferBatch(batch *pb.TelemetryBatch) {
+	limit := a.config.MaxBufferedBatches
+	if limit <= 0 {
+		limit = DefaultMaxBufferedBatches
+	}
+	batch.Descriptions = nil
+	if len(a.pendingBatches) >= limit {
+		if a.droppedBatches == 0 {
+			a.logf("Pending batch buffer full (%d); dropping the oldest", limit)
+		}
+		a.droppedBatches++
+		a.AddCounter("dropped_batches_total", 1)
+		a.pendingBatches = a.pendingBatches[1:]
+	}
+	a.pendingBatches = append(a.pendingBatches, batch)
+	a.health.buffered.Store(int64(len(a.pendingBatches)))
+}
+
+// sendPending sends batches buffered while disconnected, oldest first
+func (a *Agent) sendPending() error {
+	for len(a.pendingBatches) > 0 {
+		if err := a.send(a.pendingBatches[0]); err != nil {
+			return err
+		}
+		a.pendingBatches[0] = nil
+		a.pendingBatches = a.pendingBatches[1:]
+		a.health.buffered.Store(int64(len(a.pendingBatches)))
+	}
+	if a.droppedBatches > 0 {
+		a.logf("Caught up after reconnect; %d batches were dropped", a.droppedBatches)
+		a.droppedBatches = 0
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LabelConfigVersion is the resource attribute carrying the version of the
+// configuration applied through Config.RemoteConfig
+const LabelConfigVersion = "telemetry.config.version"
+
+const (
+	// defaultRemoteMinSampleRate is RemoteConfigBounds.MinSampleRate when
+	// zero
+	defaultRemoteMinSampleRate = 0.01
+
+	// defaultRemoteLease holds a pushed configuration that names no lease
+	defaultRemoteLease = 30 * time.Second
+
+	// remoteConfigMaxBackoff is the longest wait between WatchConfig
+	// attempts, and the wait on an aggregator that pushes nothing
+	remoteConfigMaxBackoff = 30 * time.Second
+)
+
+// remoteConfig is the state of Config.RemoteConfig
+type remoteConfig struct {
+	// applied is the configuration in force, nil while on the local one;
+	// read on the recording path, so it is swapped whole
+	applied atomic.Pointer[remoteOverrides]
+
+	// failLog limits the watch failure log lines; only the watch
+	// goroutine touches it
+	failLog logLimiter
+}
+
+// remoteOverrides is a pushed configuration clamped to the agent's bounds
+type remoteOverrides struct {
+	version uint64
+	expires time.Time
+
+	pushInterval time.Duration // 0 keeps Config.PushInterval
+	denylist     []string
+	sampleRates  map[string]float64
+	flags        map[string]bool
+
+	// attributes are the resource attributes plus LabelConfigVersion
+	attributes map[string]string
+}
+
+// FeatureFlag reports a flag declared in Config.FeatureFlags: the value
+// pushed by the aggregator while one is applied, or the local one.
+// Undeclared flags are false.
+func (a *Agent) FeatureFlag(name string) bool {
+	if o := a.remote.applied.Load(); o != nil {
+		if v, ok := o.flags[name]; ok {
+			return v
+		}
+	}
+	return a.config.FeatureFlags[name]
+}
+
+// basePushInterval is the push interval before any backoff:
+// Config.PushInterval, or the one the aggregator pushed
+func (a *Agent) basePushInterval() time.Duration {
+	if o := a.remote.applied.Load(); o != nil && o.pushInterval > 0 {
+		return o.pushInterval
+	}
+	return a.config.PushInterval
+}
+
+// sampleRate returns the sample rate of the named histogram: the pushed
+// one while applied, or Config.HistogramSampleRate's
+func (a *Agent) sampleRate(name string) (float64, bool) {
+	if o := a.remote.applied.Load(); o != nil {
+		if rate, ok := o.sampleRates[name]; ok {
+			return rate, true
+		}
+	}
+	rate, ok := a.config.HistogramSampleRate[name]
+	return rate, ok
+}
+
+// configVersion returns the applied version, 0 for the local config
+func (a *Agent) configVersion() uint64 {
+	if o := a.remote.applied.Load(); o != nil {
+		return o.version
+	}
+	return 0
+}
+
+// applyRemoteBatch labels a collected batch with the applied version and
+// drops the metrics its denylist names
+func (a *Agent) applyRemoteBatch(batch *pb.TelemetryBatch) {
+	o := a.remote.applied.Load()
+	if o == nil {
+		return
+	}
+	batch.Attributes = o.attributes
+	if len(o.denylist) == 0 {
+		return
+	}
+	protected := a.config.RemoteConfigBounds.ProtectedMetrics
+	batch.Metrics = slices.DeleteFunc(batch.Metrics, func(m *pb.Metric) bool {
+		return o.denies(m.Name) && !slices.Contains(protected, m.Name)
+	})
+}
+
+// denies reports whether the denylist names a metric
+func (o *remoteOverrides) denies(name string) bool {
+	for _, pattern := range o.denylist {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// watchConfig keeps a WatchConfig stream open until Stop, applying what
+// the aggregator pushes, and reopens it with backoff when it fails
+func (a *Agent) watchConfig() {
+	defer a.wg.Done()
+
+	minBackoff, _ := a.config.reconnectBackoff()
+	backoff := minBackoff
+	for {
+		received, err := a.watchConfigOnce()
+		if a.loopCtx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = minBackoff
+		}
+		if status.Code(err) == codes.Unimplemented {
+			backoff = remoteConfigMaxBackoff
+		}
+		a.logLimited(&a.remote.failLog, "Config watch failed, retrying in %v: %v", backoff, err)
+
+		t := a.clock.NewTimer(backoff)
+		select {
+		case <-a.loopDone:
+			t.Stop()
+			return
+		case <-t.C():
+		}
+		backoff = min(backoff*2, remoteConfigMaxBackoff)
+	}
+}
+
+// watchConfigOnce runs one WatchConfig stream until it fails, reporting
+// whether it carried any configuration
+func (a *Agent) watchConfigOnce() (bool, error) {
+	// The sender replaces the client and the issued key under pushMu
+	a.pushMu.Lock()
+	client := a.client
+	ctx := a.withAPIKey(a.withMetadata(a.loopCtx))
+	a.pushMu.Unlock()
+	if client == nil {
+		return false, errors.New("not connected")
+	}
+
+	stream, err := client.WatchConfig(ctx, &pb.ConfigRequest{
+		Service:  a.config.ServiceName,
+		Instance: a.config.InstanceID,
+	}, a.config.callOptions()...)
+	if err != nil {
+		return false, err
+	}
+	received := false
+	for {
+		doc, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		a.applyRemoteConfig(doc, a.clock.Now())
+	}
+}
+
+// applyRemoteConfig takes a pushed configuration: version 0 drops the
+// applied one, the applied version again renews its lease, and a new
+// version replaces it
+func (a *Agent) applyRemoteConfig(doc *pb.AgentConfig, now time.Time) {
+	if doc.Version == 0 {
+		if prev := a.remote.applied.Swap(nil); prev != nil {
+			a.logf("Aggregator withdrew config version %d; back to the local config", prev.version)
+		}
+		return
+	}
+	lease := time.Duration(doc.LeaseMs) * time.Millisecond
+	if lease <= 0 {
+		lease = defaultRemoteLease
+	}
+	if prev := a.remote.applied.Load(); prev != nil && prev.version == doc.Version {
+		renewed := *prev
+		renewed.expires = now.Add(lease)
+		a.remote.applied.Store(&renewed)
+		return
+	}
+
+	o := a.clampRemoteConfig(doc)
+	o.expires = now.Add(lease)
+	a.remote.applied.Store(o)
+	a.logf("Applied config version %d from the aggregator", doc.Version)
+}
+
+// clampRemoteConfig keeps the parts of doc within Config.RemoteConfigBounds
+// and the declared FeatureFlags
+func (a *Agent) clampRemoteConfig(doc *pb.AgentConfig) *remoteOverrides {
+	bounds := a.config.RemoteConfigBounds
+	minInterval := bounds.MinPushInterval
+	if minInterval <= 0 {
+		minInterval = a.config.PushInterval
+	}
+	maxInterval := bounds.MaxPushInterval
+	if maxInterval <= 0 {
+		maxInterval = max(10*a.config.PushInterval, minInterval)
+	}
+	minRate := bounds.MinSampleRate
+	if minRate <= 0 {
+		minRate = defaultRemoteMinSampleRate
+	}
+
+	o := &remoteOverrides{
+		version:     doc.Version,
+		denylist:    doc.MetricDenylist,
+		sampleRates: make(map[string]float64, len(doc.HistogramSampleRate)),
+		flags:       make(map[string]bool, len(doc.FeatureFlags)),
+		attributes:  maps.Clone(a.attributes),
+	}
+	if doc.PushIntervalMs > 0 {
+		d := time.Duration(doc.PushIntervalMs) * time.Millisecond
+		o.pushInterval = min(max(d, minInterval), maxInterval)
+	}
+	for name, rate := range doc.HistogramSampleRate {
+		if rate > 0 && rate <= 1 {
+			o.sampleRates[name] = max(rate, minRate)
+		}
+	}
+	for name, v := range doc.FeatureFlags {
+		if _, declared := a.config.FeatureFlags[name]; declared {
+			o.flags[name] = v
+		}
+	}
+	if o.attributes == nil {
+		o.attributes = make(map[string]string)
+	}
+	o.attributes[LabelConfigVersion] = strconv.FormatUint(doc.Version, 10)
+	return o
+}
+
+// expireRemoteConfig goes back to the local configuration once the
+// applied one's lease has run out without a renewal
+func (a *Agent) expireRemoteConfig(now time.Time) {
+	o := a.remote.applied.Load()
+	if o == nil || now.Before(o.expires) {
+		return
+	}
+	// A renewal stored meanwhile wins
+	if a.remote.applied.CompareAndSwap(o, nil) {
+		a.logf("Config version %d from the aggregator expired; back to the local config", o.version)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+)
+
+// Resource attributes the agent detects on its own
+const (
+	LabelHostName       = "host.name"
+	LabelProcessPID     = "process.pid"
+	LabelRuntimeVersion = "process.runtime.version"
+	LabelServiceVersion = "service.version"
+)
+
+// resourceAttributes merges the attributes sent with every batch: detected
+// defaults, then Kubernetes detection, then Config.ResourceAttributes, where
+// an empty value removes an attribute
+func resourceAttributes(configured, kubernetes map[string]string) map[string]string {
+	attributes := make(map[string]string)
+	set := func(key, value string) {
+		if value != "" {
+			attributes[key] = value
+		}
+	}
+
+	host, _ := os.Hostname()
+	set(LabelHostName, host)
+	set(LabelProcessPID, strconv.Itoa(os.Getpid()))
+	set(LabelRuntimeVersion, runtime.Version())
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "(devel)" {
+		set(LabelServiceVersion, info.Main.Version)
+	}
+	// Downward API variables are honored off-cluster too, e.g. when
+	// KUBERNETES_SERVICE_HOST is hidden from the container
+	set(LabelPodName, os.Getenv("POD_NAME"))
+	set(LabelNodeName, os.Getenv("NODE_NAME"))
+
+	for k, v := range kubernetes {
+		attributes[k] = v
+	}
+	for k, v := range configured {
+		if v == "" {
+			delete(attributes, k)
+		} else {
+			attributes[k] = v
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RouteNormalizer maps a request to the route it is recorded under. It
+// should return the route pattern, such as "/users/:id", so per-route
+// series stay bounded.
+type RouteNormalizer func(*http.Request) string
+
+// DefaultRouteNormalizer returns the request path with ID-like segments,
+// numbers, UUIDs and long hex strings, replaced by ":id"
+func DefaultRouteNormalizer(r *http.Request) string {
+	path := r.URL.Path
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if isID(seg) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isID reports whether a path segment looks like an identifier
+func isID(seg string) bool {
+	if seg == "" {
+		return false
+	}
+	digits, hex := true, true
+	for _, c := range seg {
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F', c == '-':
+			digits = false
+		default:
+			return false
+		}
+	}
+	// A hex run must be long enough not to catch words like "add" or "cafe"
+	return digits || (hex && len(seg) >= 16)
+}
@@ -0,0 +1,43 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"fmt"
+	"math"
+	randv2 "math/rand/v2"
+)
+
+// validateSampleRates checks that every Config.HistogramSampleRate is in
+// (0, 1]
+func validateSampleRates(rates map[string]float64) error {
+	for name, rate := range rates {
+		if !(rate > 0 && rate <= 1) {
+			return fmt.Errorf("histogram %q: sample rate %v is not in (0, 1]", name, rate)
+		}
+	}
+	return nil
+}
+
+// skipSample reports whether a value for the named histogram is left out
+// by its sample rate. It runs before any lock, and the global v2 source
+// is per-goroutine, so a skipped value costs no contention.
+func (a *Agent) skipSample(name string) bool {
+	rate, ok := a.sampleRate(name)
+	return ok && rate < 1 && randv2.Float64() >= rate
+}
+
+// scaleSampled scales sampled bucket counts up by 1/rate. Cumulative
+// counts are rounded, not each bucket, so the total is the rounded scaled
+// total and the percentiles keep their shape; the sum scales alike.
+func scaleSampled(counts []uint64, sum float64, rate float64) ([]uint64, float64, uint64) {
+	var cum uint64
+	var prev uint64
+	for i, c := range counts {
+		cum += c
+		scaled := uint64(math.Round(float64(cum) / rate))
+		counts[i] = scaled - prev
+		prev = scaled
+	}
+	return counts, sum / rate, prev
+}
@@ -0,0 +1,151 @@
+//go:build !notelemetry
+
+package agent
+
+// Scope is a view of an agent for one component: every name it records is
+// prefixed and every series carries its default labels, while storage,
+// series limits and pushes stay the agent's. Scopes are cheap, so library
+// code can be handed one per component, and they nest: a.WithPrefix("db_")
+// .WithPrefix("pool_") records db_pool_* names.
+type Scope struct {
+	agent  *Agent
+	prefix string
+	labels map[string]string // never modified once the Scope exists
+}
+
+// WithPrefix returns a Scope prepending prefix to every metric name
+func (a *Agent) WithPrefix(prefix string) *Scope {
+	return &Scope{agent: a, prefix: prefix}
+}
+
+// WithLabels returns a Scope adding labels to every series; labels given
+// to a call take precedence over them
+func (a *Agent) WithLabels(labels map[string]string) *Scope {
+	return (&Scope{agent: a}).WithLabels(labels)
+}
+
+// WithPrefix returns a Scope whose prefix follows this one's
+func (s *Scope) WithPrefix(prefix string) *Scope {
+	return &Scope{agent: s.agent, prefix: s.prefix + prefix, labels: s.labels}
+}
+
+// WithLabels returns a Scope with labels added to this one's, replacing
+// any with the same key
+func (s *Scope) WithLabels(labels map[string]string) *Scope {
+	merged := make(map[string]string, len(s.labels)+len(labels))
+	for k, v := range s.labels {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return &Scope{agent: s.agent, prefix: s.prefix, labels: merged}
+}
+
+// SetGauge sets the scoped gauge name
+func (s *Scope) SetGauge(name string, value float64) {
+	s.SetGaugeWithLabels(name, nil, value)
+}
+
+// SetGaugeWithLabels sets the scoped gauge for one label combination
+func (s *Scope) SetGaugeWithLabels(name string, labels map[string]string, value float64) {
+	s.agent.SetGaugeWithLabels(s.prefix+name, mergeLabels(s.labels, labels), value)
+}
+
+// IncCounter increments the scoped counter name
+func (s *Scope) IncCounter(name string) {
+	s.AddCounterWithLabels(name, nil, 1)
+}
+
+// AddCounter adds to the scoped counter name
+func (s *Scope) AddCounter(name string, delta uint64) {
+	s.AddCounterWithLabels(name, nil, delta)
+}
+
+// IncCounterWithLabels increments the scoped counter for one label
+// combination
+func (s *Scope) IncCounterWithLabels(name string, labels map[string]string) {
+	s.AddCounterWithLabels(name, labels, 1)
+}
+
+// AddCounterWithLabels adds to the scoped counter for one label
+// combination
+func (s *Scope) AddCounterWithLabels(name string, labels map[string]string, delta uint64) {
+	s.agent.AddCounterWithLabels(s.prefix+name, mergeLabels(s.labels, labels), delta)
+}
+
+// AddCounterFloat adds a fractional amount to the scoped float counter
+func (s *Scope) AddCounterFloat(name string, delta float64) {
+	s.AddCounterFloatWithLabels(name, nil, delta)
+}
+
+// AddCounterFloatWithLabels adds to the scoped float counter for one label
+// combination
+func (s *Scope) AddCounterFloatWithLabels(name string, labels map[string]string, delta float64) {
+	s.agent.AddCounterFloatWithLabels(s.prefix+name, mergeLabels(s.labels, labels), delta)
+}
+
+// AddUpDown adds delta, positive or negative, to the scoped up-down
+// counter name
+func (s *Scope) AddUpDown(name string, delta int64) {
+	s.AddUpDownWithLabels(name, nil, delta)
+}
+
+// AddUpDownWithLabels adds to the scoped up-down counter for one label
+// combination
+func (s *Scope) AddUpDownWithLabels(name string, labels map[string]string, delta int64) {
+	s.agent.AddUpDownWithLabels(s.prefix+name, mergeLabels(s.labels, labels), delta)
+}
+
+// RecordHistogram records a value in the scoped histogram name
+func (s *Scope) RecordHistogram(name string, value float64) {
+	s.RecordHistogramWithLabels(name, nil, value)
+}
+
+// RecordHistogramWithLabels records a value in the scoped histogram for
+// one label combination
+func (s *Scope) RecordHistogramWithLabels(name string, labels map[string]string, value float64) {
+	s.agent.RecordHistogramWithLabels(s.prefix+name, mergeLabels(s.labels, labels), value)
+}
+
+// Describe records metadata for the scoped metric name
+func (s *Scope) Describe(name string, d Description) {
+	s.agent.Describe(s.prefix+name, d)
+}
+
+// DeleteGauge stops sending the scoped gauge or up-down counter name, for
+// the label combinations carrying the Scope's labels only
+func (s *Scope) DeleteGauge(name string) {
+	s.agent.deleteGauge(s.prefix+name, s.labels)
+}
+
+// DeleteCounter stops sending the scoped counter name, for the label
+// combinations carrying the Scope's labels only
+func (s *Scope) DeleteCounter(name string) {
+	s.agent.deleteCounter(s.prefix+name, s.labels)
+}
+
+// DeleteHistogram stops sending the scoped histogram name, for the label
+// combinations carrying the Scope's labels only
+func (s *Scope) DeleteHistogram(name string) {
+	s.agent.deleteHistogram(s.prefix+name, s.labels)
+}
+
+// mergeLabels returns labels over base, without copying when either is
+// empty; the agent copies labels it keeps
+func mergeLabels(base, labels map[string]string) map[string]string {
+	if len(base) == 0 {
+		return labels
+	}
+	if len(labels) == 0 {
+		return base
+	}
+	merged := make(map[string]string, len(base)+len(labels))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,94 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// selfStats is the agent's telemetry about its own pipeline. It lives in
+// atomics outside the series maps, so MetricNames, MaxSeries and deletes
+// never touch it, and failed sends keep accumulating until one succeeds.
+type selfStats struct {
+	batchesSent atomic.Uint64
+	sendErrors  atomic.Uint64
+	samplesSent atomic.Uint64
+	lastSendNs  atomic.Int64
+	pushNs      atomic.Int64
+}
+
+// send sends a batch on the stream, recording the outcome; caller holds
+// pushMu
+func (a *Agent) send(batch *pb.TelemetryBatch) error {
+	start := time.Now()
+	if err := a.sendWithTimeout(batch); err != nil {
+		a.self.sendErrors.Add(1)
+		return err
+	}
+	samples := 0
+	for _, m := range batch.Metrics {
+		samples += len(m.Samples)
+	}
+	a.self.batchesSent.Add(1)
+	a.self.samplesSent.Add(uint64(samples))
+	a.self.lastSendNs.Store(time.Now().UnixNano())
+	a.noteSuccess()
+	a.notePace(time.Since(start))
+	return nil
+}
+
+// selfMetrics returns the self-telemetry samples for a batch collected at
+// now, or nil when Config.SelfTelemetry is off
+func (a *Agent) selfMetrics(now uint64) []*pb.Metric {
+	if !a.config.SelfTelemetry {
+		return nil
+	}
+	counter := func(name string, v uint64) *pb.Metric {
+		return &pb.Metric{Name: name, Samples: []*pb.MetricSample{
+			{TimestampNs: now, Value: &pb.MetricSample_Counter{Counter: v}},
+		}}
+	}
+	gauge := func(name string, v float64) *pb.Metric {
+		return &pb.Metric{Name: name, Samples: []*pb.MetricSample{
+			{TimestampNs: now, Value: &pb.MetricSample_Gauge{Gauge: v}},
+		}}
+	}
+
+	destination := func(m *pb.Metric, d string) *pb.Metric {
+		m.Labels = map[string]string{"destination": d}
+		return m
+	}
+
+	metrics := []*pb.Metric{
+		destination(counter("agent_batches_sent_total", a.self.batchesSent.Load()), "primary"),
+		destination(counter("agent_batch_send_errors_total", a.self.sendErrors.Load()), "primary"),
+		counter("agent_samples_sent_total", a.self.samplesSent.Load()),
+	}
+	if m := a.mirror.Load(); m != nil {
+		metrics = append(metrics,
+			destination(counter("agent_batches_sent_total", m.batchesSent.Load()), "mirror"),
+			destination(counter("agent_batch_send_errors_total", m.sendErrors.Load()), "mirror"),
+		)
+	}
+	if last := a.self.lastSendNs.Load(); last > 0 {
+		metrics = append(metrics, gauge("agent_last_send_unix_seconds", float64(last)/1e9))
+	}
+	if push := a.self.pushNs.Load(); push > 0 {
+		metrics = append(metrics, gauge("agent_push_duration_ms", durationMs(time.Duration(push))))
+	}
+	if a.config.adaptive() {
+		metrics = append(metrics, gauge("agent_push_interval_ms", durationMs(a.pushInterval())))
+	}
+	if a.config.CorrectClockSkew {
+		metrics = append(metrics, gauge("agent_clock_offset_ms", durationMs(time.Duration(a.clockOffset.Load()))))
+	}
+	if len(a.config.AggregatorAddrs) > 1 {
+		active := gauge("agent_active_aggregator", float64(a.addrIndex.Load()))
+		active.Labels = map[string]string{"address": a.CurrentAggregator()}
+		metrics = append(metrics, active)
+	}
+	return metrics
+}
@@ -0,0 +1,182 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// errQueueFull reports a flushed batch dropped from a full send queue
+var errQueueFull = errors.New("send queue full; batch dropped")
+
+// errSendTimeout reports a Send still blocked after Config.SendTimeout
+var errSendTimeout = errors.New("send timed out")
+
+// queuedBatch is a collected batch waiting for the sender; done, if set,
+// receives the outcome of its send
+type queuedBatch struct {
+	batch *pb.TelemetryBatch
+	done  chan error
+}
+
+// sendQueueSize returns the configured queue length, or the default
+func (c Config) sendQueueSize() int {
+	if c.SendQueueSize > 0 {
+		return c.SendQueueSize
+	}
+	return DefaultSendQueueSize
+}
+
+// collect gathers the metric groups now due, or every group when flushAll
+// is set, and queues them for the sender, split to the batch limits; done
+// goes with the last batch. Collection never waits on the stream, so a
+// slow send cannot delay the next collection.
+func (a *Agent) collect(flushAll bool, done chan error) {
+	a.collectMu.Lock()
+	defer a.collectMu.Unlock()
+
+	batch := a.collectMetrics(a.dueGroups(a.clock.Now(), flushAll))
+	a.applyRemoteBatch(batch)
+	batch.Descriptions = a.takeDescriptions()
+	batch.Events = a.takeEvents()
+	batches := a.splitBatch(batch)
+	for i, b := range batches {
+		a.offerMirror(b)
+		qb := queuedBatch{batch: b}
+		if i == len(batches)-1 {
+			qb.done = done
+		}
+		a.enqueue(qb)
+	}
+}
+
+// enqueue adds a batch to the send queue, dropping the oldest when it is
+// full so the newest data wins; caller holds collectMu
+func (a *Agent) enqueue(qb queuedBatch) {
+	for {
+		select {
+		case a.queue <- qb:
+			return
+		default:
+		}
+		select {
+		case old := <-a.queue:
+			a.dropQueued(old)
+		default:
+		}
+	}
+}
+
+// dropQueued discards a batch the sender did not get to
+func (a *Agent) dropQueued(qb queuedBatch) {
+	if a.queueDropped.Add(1) == 1 {
+		a.logf("Send queue full (%d); dropping the oldest batch", cap(a.queue))
+	}
+	a.AddCounter("send_queue_dropped_total", 1)
+	// The next batch carries its descriptions and events instead
+	a.requeueDescriptions(qb.batch.Descriptions)
+	a.requeueEvents(qb.batch.Events)
+	if qb.done != nil {
+		qb.done <- errQueueFull
+	}
+}
+
+// startSender marks the agent connected and runs the sender goroutine;
+// Connect calls it once the client exists
+func (a *Agent) startSender() {
+	a.connected.Store(true)
+	a.sendWg.Add(1)
+	go a.sendLoop()
+}
+
+// sendLoop sends queued batches in order until Stop
+func (a *Agent) sendLoop() {
+	defer a.sendWg.Done()
+	for {
+		select {
+		case <-a.sendStop:
+			return
+		case qb := <-a.queue:
+			err := a.push(qb.batch)
+			if qb.done != nil {
+				qb.done <- err
+			}
+		}
+	}
+}
+
+// sendWithTimeout sends a batch on the stream, giving up after
+// Config.SendTimeout. On timeout the stream's context is cancelled, which
+// releases the blocked Send on that stream only, and it is waited for so
+// nothing else touches the stream concurrently; the caller then abandons
+// it. A Sink has no context to cancel and is not bounded. Caller holds
+// pushMu.
+func (a *Agent) sendWithTimeout(batch *pb.TelemetryBatch) error {
+	stream, ok := a.stream.(cancelingStream)
+	if !ok {
+		return a.stream.Send(batch)
+	}
+	return sendBounded(stream, batch, a.config.sendTimeout())
+}
+
+// sendBounded sends a batch on stream, cancelling it and waiting for the
+// Send to return if that takes longer than timeout
+func sendBounded(stream cancelingStream, batch *pb.TelemetryBatch, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- stream.Send(batch) }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		stream.cancel()
+		<-done
+		return fmt.Errorf("%w after %v", errSendTimeout, timeout)
+	}
+}
+
+// sendTimeout returns the configured send timeout, or the default
+func (c Config) sendTimeout() time.Duration {
+	if c.SendTimeout > 0 {
+		return c.SendTimeout
+	}
+	return DefaultSendTimeout
+}
+
+// push sends one collected batch, reconnecting and replaying the offline
+// buffer first as needed
+func (a *Agent) push(batch *pb.TelemetryBatch) error {
+	a.pushMu.Lock()
+	defer a.pushMu.Unlock()
+
+	// Reported with the next batch
+	start := time.Now()
+	defer func() { a.self.pushNs.Store(int64(time.Since(start))) }()
+
+	a.renewKey()
+
+	if a.stream == nil && !a.reconnect() {
+		a.bufferBatch(batch)
+		return errDisconnected
+	}
+	if err := a.sendPending(); err != nil {
+		err = a.disconnect(err)
+		a.bufferBatch(batch)
+		return err
+	}
+	if len(batch.Metrics) == 0 && len(batch.Descriptions) == 0 && len(batch.Events) == 0 {
+		return nil
+	}
+	if err := a.send(batch); err != nil {
+		err = a.disconnect(err)
+		a.bufferBatch(batch)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// Sink receives every batch the agent sends, in order, from the sender
+// goroutine. The aggregator stream is one; Config.Sink replaces it. A
+// Send error is handled like a lost stream: the batch is buffered and the
+// sink is tried again after the reconnect backoff.
+type Sink interface {
+	Send(batch *pb.TelemetryBatch) error
+}
+
+// batchStream is where the sender sends: an aggregator stream, or a
+// sinkStream
+type batchStream interface {
+	Sink
+	CloseAndRecv() (*pb.Ack, error)
+}
+
+// sinkStream adapts a Config.Sink to batchStream
+type sinkStream struct {
+	Sink
+}
+
+func (sinkStream) CloseAndRecv() (*pb.Ack, error) {
+	return &pb.Ack{Ok: true}, nil
+}
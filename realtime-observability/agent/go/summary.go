@@ -0,0 +1,254 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// summaryQuantiles are reported for every summary as <name><suffix>
+var summaryQuantiles = []struct {
+	q      float64
+	suffix string
+}{
+	{0.5, "_p50"},
+	{0.9, "_p90"},
+	{0.99, "_p99"},
+}
+
+// summaryAgeBuckets is how many staggered sketches approximate a sliding
+// SummaryMaxAge window; each covers between (n-1)/n and all of it
+const summaryAgeBuckets = 5
+
+// RecordSummary records a value in the named summary. Its quantiles are
+// estimated in constant memory and sent as the gauges <name>_p50,
+// <name>_p90 and <name>_p99, covering the push window or, with
+// Config.SummaryMaxAge, a sliding window.
+func (a *Agent) RecordSummary(name string, value float64) {
+	a.mu.RLock()
+	s, ok := a.summaries[name]
+	a.mu.RUnlock()
+	if !ok {
+		a.mu.Lock()
+		if s, ok = a.summaries[name]; !ok {
+			s = newSummary(a.config.SummaryMaxAge, a.clock.Now())
+			a.summaries[name] = s
+		}
+		a.mu.Unlock()
+	}
+	if s.maxAge > 0 {
+		s.observe(value, a.clock.Now())
+	} else {
+		s.observe(value, time.Time{})
+	}
+}
+
+// collectSummaries reports the quantiles of every summary with values in
+// its window; caller holds a.mu
+func (a *Agent) collectSummaries(now uint64, metrics []*pb.Metric) []*pb.Metric {
+	at := a.clock.Now()
+	for name, s := range a.summaries {
+		estimates, ok := s.snapshot(at)
+		if !ok {
+			continue
+		}
+		for i, q := range summaryQuantiles {
+			metrics = append(metrics, &pb.Metric{
+				Name: name + q.suffix,
+				Samples: []*pb.MetricSample{
+					{
+						TimestampNs: now,
+						Value:       &pb.MetricSample_Gauge{Gauge: estimates[i]},
+					},
+				},
+			})
+		}
+	}
+	return metrics
+}
+
+// summary holds the quantile sketches of one summary. Without a max age
+// there is one sketch, reset on every snapshot; with one, every value goes
+// into all sketches, the oldest is reported, and sketches are reset in
+// turn every maxAge/summaryAgeBuckets.
+type summary struct {
+	mu       sync.Mutex
+	sketches [][]p2Quantile // [sketch][quantile]
+	head     int
+	maxAge   time.Duration
+	rotateAt time.Time
+}
+
+func newSummary(maxAge time.Duration, now time.Time) *summary {
+	n := 1
+	if maxAge > 0 {
+		n = summaryAgeBuckets
+	}
+	s := &summary{sketches: make([][]p2Quantile, n), maxAge: maxAge}
+	for i := range s.sketches {
+		s.sketches[i] = newSketch()
+	}
+	if maxAge > 0 {
+		s.rotateAt = now.Add(maxAge / summaryAgeBuckets)
+	}
+	return s
+}
+
+func newSketch() []p2Quantile {
+	sketch := make([]p2Quantile, len(summaryQuantiles))
+	for i, q := range summaryQuantiles {
+		sketch[i] = newP2Quantile(q.q)
+	}
+	return sketch
+}
+
+// observe adds a value; now is only read with a max age
+func (s *summary) observe(value float64, now time.Time) {
+	if math.IsNaN(value) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(now)
+	for _, sketch := range s.sketches {
+		for i := range sketch {
+			sketch[i].observe(value)
+		}
+	}
+}
+
+// snapshot returns the estimates of the current window; ok is false when
+// it holds no values
+func (s *summary) snapshot(now time.Time) (estimates []float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(now)
+
+	sketch := s.sketches[s.head]
+	if sketch[0].count == 0 {
+		return nil, false
+	}
+	estimates = make([]float64, len(sketch))
+	for i := range sketch {
+		estimates[i] = sketch[i].estimate()
+	}
+	if s.maxAge == 0 {
+		s.sketches[0] = newSketch()
+	}
+	return estimates, true
+}
+
+// rotate resets the sketches whose turn has come by now; caller holds s.mu
+func (s *summary) rotate(now time.Time) {
+	if s.maxAge > 0 && !now.Before(s.rotateAt) {
+		interval := s.maxAge / summaryAgeBuckets
+		if now.Sub(s.rotateAt) >= s.maxAge {
+			// Idle for a whole window: every sketch is stale
+			for i := range s.sketches {
+				s.sketches[i] = newSketch()
+			}
+			s.rotateAt = now.Add(interval)
+		}
+		for !now.Before(s.rotateAt) {
+			s.sketches[s.head] = newSketch()
+			s.head = (s.head + 1) % len(s.sketches)
+			s.rotateAt = s.rotateAt.Add(interval)
+		}
+	}
+}
+
+// p2Quantile estimates one quantile with the P² algorithm (Jain and
+// Chlamtac, 1985): five markers whose heights track the minimum, p/2, p,
+// (1+p)/2 and maximum quantiles, in constant memory
+type p2Quantile struct {
+	p       float64
+	count   int
+	heights [5]float64
+	pos     [5]float64 // actual marker positions
+	want    [5]float64 // desired marker positions
+	step    [5]float64 // desired position increments per value
+}
+
+func newP2Quantile(p float64) p2Quantile {
+	return p2Quantile{
+		p:    p,
+		pos:  [5]float64{0, 1, 2, 3, 4},
+		want: [5]float64{0, 2 * p, 4 * p, 2 + 2*p, 4},
+		step: [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+func (e *p2Quantile) observe(x float64) {
+	if e.count < 5 {
+		e.heights[e.count] = x
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.heights[:])
+		}
+		return
+	}
+	e.count++
+
+	// Find the cell holding x, stretching the extremes if needed
+	var k int
+	switch {
+	case x < e.heights[0]:
+		e.heights[0] = x
+		k = 0
+	case x >= e.heights[4]:
+		e.heights[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3 && x >= e.heights[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.want {
+		e.want[i] += e.step[i]
+	}
+
+	// Move the middle markers toward their desired positions
+	for i := 1; i <= 3; i++ {
+		d := e.want[i] - e.pos[i]
+		if (d >= 1 && e.pos[i+1]-e.pos[i] > 1) || (d <= -1 && e.pos[i-1]-e.pos[i] < -1) {
+			s := math.Copysign(1, d)
+			h := e.parabolic(i, s)
+			if h <= e.heights[i-1] || h >= e.heights[i+1] {
+				h = e.linear(i, s)
+			}
+			e.heights[i] = h
+			e.pos[i] += s
+		}
+	}
+}
+
+func (e *p2Quantile) parabolic(i int, s float64) float64 {
+	n, q := &e.pos, &e.heights
+	return q[i] + s/(n[i+1]-n[i-1])*
+		((n[i]-n[i-1]+s)*(q[i+1]-q[i])/(n[i+1]-n[i])+
+			(n[i+1]-n[i]-s)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+func (e *p2Quantile) linear(i int, s float64) float64 {
+	j := i + int(s)
+	return e.heights[i] + s*(e.heights[j]-e.heights[i])/(e.pos[j]-e.pos[i])
+}
+
+// estimate returns the quantile; below five values it is read from the
+// sorted values directly
+func (e *p2Quantile) estimate() float64 {
+	if e.count >= 5 {
+		return e.heights[2]
+	}
+	values := make([]float64, e.count)
+	copy(values, e.heights[:e.count])
+	sort.Float64s(values)
+	return values[int(math.Round(e.p*float64(e.count-1)))]
+}
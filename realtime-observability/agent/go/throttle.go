@@ -0,0 +1,110 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// throttleSuccesses is how many sends in a row must succeed, each quicker
+// than the push interval, before the interval steps back toward
+// Config.PushInterval
+const throttleSuccesses = 10
+
+// pushThrottle is the adaptive push schedule of Config.MaxPushInterval
+type pushThrottle struct {
+	// interval is the effective push interval in ns, 0 until throttled;
+	// read by the push loop
+	interval atomic.Int64
+
+	// Guarded by pushMu
+	successes int
+	hint      time.Duration // last Ack's min_push_interval_ms
+}
+
+// pushInterval returns the interval pushes are currently scheduled at;
+// a pushed interval above the throttled one wins
+func (a *Agent) pushInterval() time.Duration {
+	base := a.basePushInterval()
+	if d := time.Duration(a.throttle.interval.Load()); d > base {
+		return d
+	}
+	return base
+}
+
+// adaptive reports whether the push interval may grow under backpressure
+func (c Config) adaptive() bool {
+	return c.MaxPushInterval > c.PushInterval
+}
+
+// throttleFloor is the shortest interval allowed: the base interval, or
+// the aggregator's hint, capped at MaxPushInterval
+func (a *Agent) throttleFloor() time.Duration {
+	return max(a.basePushInterval(), min(a.throttle.hint, a.config.MaxPushInterval))
+}
+
+// slowDown doubles the push interval, up to MaxPushInterval, after a
+// failed or slow send; caller holds pushMu
+func (a *Agent) slowDown(reason string) {
+	if !a.config.adaptive() {
+		return
+	}
+	a.throttle.successes = 0
+	cur := a.pushInterval()
+	a.setPushInterval(cur, max(min(cur*2, a.config.MaxPushInterval), a.throttleFloor()), reason)
+}
+
+// notePace counts a successful send that took d: one slower than the
+// push interval is backpressure, and a run of quick ones brings the
+// interval back down by a quarter; caller holds pushMu
+func (a *Agent) notePace(d time.Duration) {
+	if !a.config.adaptive() {
+		return
+	}
+	cur := a.pushInterval()
+	if d > cur {
+		a.slowDown("slow sends")
+		return
+	}
+	floor := a.throttleFloor()
+	if cur <= floor {
+		a.throttle.successes = 0
+		return
+	}
+	if a.throttle.successes++; a.throttle.successes < throttleSuccesses {
+		return
+	}
+	a.throttle.successes = 0
+	a.setPushInterval(cur, max(cur*3/4, floor), "")
+}
+
+// applyHint takes the push interval the aggregator asked for in an Ack;
+// caller holds pushMu
+func (a *Agent) applyHint(ack *pb.Ack) {
+	if !a.config.adaptive() || ack == nil {
+		return
+	}
+	a.throttle.hint = time.Duration(ack.MinPushIntervalMs) * time.Millisecond
+	if cur, floor := a.pushInterval(), a.throttleFloor(); cur < floor {
+		a.setPushInterval(cur, floor, "aggregator asked")
+	}
+}
+
+// setPushInterval moves the push interval from cur to next, logging when
+// throttling starts and ends
+func (a *Agent) setPushInterval(cur, next time.Duration, reason string) {
+	if next == cur {
+		return
+	}
+	a.throttle.interval.Store(int64(next))
+	base := a.basePushInterval()
+	switch {
+	case cur == base:
+		a.logf("Aggregator backpressure (%s); pushing every %v, up to %v", reason, next, a.config.MaxPushInterval)
+	case next == base:
+		a.logf("Backpressure eased; pushing every %v again", base)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"time"
+)
+
+// Timer times one code section into a histogram; see StartTimer
+type Timer struct {
+	agent *Agent
+	name  string
+	start time.Time
+}
+
+// StartTimer starts timing a code section that is recorded, in
+// milliseconds, into the named histogram.
+// Usage: defer agent.StartTimer("db_query_ms").ObserveDuration()
+func (a *Agent) StartTimer(name string) *Timer {
+	return &Timer{agent: a, name: name, start: time.Now()}
+}
+
+// ObserveDuration records the time since StartTimer and returns it
+func (t *Timer) ObserveDuration() time.Duration {
+	return t.ObserveDurationWithLabels(nil)
+}
+
+// ObserveDurationWithLabels records the time since StartTimer for one
+// label combination and returns it
+func (t *Timer) ObserveDurationWithLabels(labels map[string]string) time.Duration {
+	elapsed := time.Since(t.start)
+	t.agent.recordHistogram(t.name, labels, nil, durationMs(elapsed))
+	return elapsed
+}
+
+// durationMs converts d to fractional milliseconds, so sub-millisecond
+// sections do not record as zero
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
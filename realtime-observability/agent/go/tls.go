@@ -0,0 +1,45 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// transportCredentials builds the connection credentials from the TLS
+// settings; files are read here so a bad path fails Connect
+func (c Config) transportCredentials() (credentials.TransportCredentials, error) {
+	if c.TLSConfig != nil {
+		return credentials.NewTLS(c.TLSConfig.Clone()), nil
+	}
+	if !c.TLSEnabled {
+		return insecure.NewCredentials(), nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: c.TLSInsecureSkipVerify}
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.TLSCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return credentials.NewTLS(cfg), nil
+}
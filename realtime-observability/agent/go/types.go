@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotConnected is returned by Start and Flush before a successful
+// Connect
+var ErrNotConnected = errors.New("agent is not connected")
+
+// Description documents a metric so dashboards need not guess its unit
+type Description struct {
+	Type string // "gauge", "counter" or "histogram"
+	Unit string // e.g. "ms", "bytes", "MiB", "1" for ratios
+	Help string
+}
+
+// AggMode is how SetGaugeAgg combines the values set within one push
+// window
+type AggMode int
+
+const (
+	// AggLast sends the last value set, as SetGauge does
+	AggLast AggMode = iota
+	// AggMin sends the smallest value set
+	AggMin
+	// AggMax sends the largest value set
+	AggMax
+	// AggAvg sends the mean of the values set
+	AggAvg
+	// AggSum sends the sum of the values set, and 0 for an empty window
+	AggSum
+)
+
+// Temporality is what the histograms in each push count
+type Temporality int
+
+const (
+	// Delta sends the observations since the previous push, then resets
+	Delta Temporality = iota
+	// Cumulative sends every observation since the histogram was created,
+	// as Prometheus does
+	Cumulative
+)
+
+// HealthStatus is a snapshot of whether telemetry is flowing, for a
+// service's own health check; see Agent.Health
+type HealthStatus struct {
+	// Connected is whether a stream to the aggregator, or Config.Sink, is
+	// open
+	Connected bool `json:"connected"`
+	// LastSuccessfulSend is when a batch was last accepted; zero if never
+	LastSuccessfulSend time.Time `json:"last_successful_send"`
+	// ConsecutiveSendFailures counts failed sends and reconnects since
+	// the last accepted batch
+	ConsecutiveSendFailures int `json:"consecutive_send_failures"`
+	// BufferedBatches are waiting for the stream to come back
+	BufferedBatches int `json:"buffered_batches"`
+	// SeriesCount is the number of series held, against Config.MaxSeries
+	SeriesCount int `json:"series_count"`
+	// PushInterval is the interval pushes run at, above Config.PushInterval
+	// while the agent backs off from a struggling aggregator
+	PushInterval time.Duration `json:"push_interval"`
+	// ConfigVersion is the version of the configuration applied from the
+	// aggregator with Config.RemoteConfig; 0 while on the local one
+	ConfigVersion uint64 `json:"config_version,omitempty"`
+}
+
+// ExemplarInfo describes the request an exemplar was captured for
+type ExemplarInfo struct {
+	Operation string
+	TraceID   string
+	Labels    map[string]string
+}
+
+type exemplarInfoKey struct{}
+
+// ContextWithExemplarInfo attaches exemplar details for TrackRequestCtx
+func ContextWithExemplarInfo(ctx context.Context, info ExemplarInfo) context.Context {
+	return context.WithValue(ctx, exemplarInfoKey{}, info)
+}
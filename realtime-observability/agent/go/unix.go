@@ -0,0 +1,27 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// dialTarget returns the gRPC target for AggregatorAddr, with a dialer for
+// unix:// addresses so a sidecar aggregator is reached without TCP
+func (c Config) dialTarget() (string, []grpc.DialOption) {
+	path, ok := strings.CutPrefix(c.AggregatorAddr, unixScheme)
+	if !ok {
+		return c.AggregatorAddr, nil
+	}
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	// passthrough hands the target to the dialer unresolved; "localhost"
+	// is the authority, and the server name TLS verifies
+	return "passthrough:///localhost", []grpc.DialOption{grpc.WithContextDialer(dial)}
+}
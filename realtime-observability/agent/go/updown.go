@@ -0,0 +1,43 @@
+//go:build !notelemetry
+
+package agent
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// AddUpDown adds delta, which may be negative, to the up-down counter
+// name. It is sent as a gauge but, unlike SetGauge, concurrent adjustments
+// all land, and adjusting an existing counter takes no lock.
+func (a *Agent) AddUpDown(name string, delta int64) {
+	a.AddUpDownWithLabels(name, nil, delta)
+}
+
+// AddUpDownWithLabels adds delta to the up-down counter for one label
+// combination
+func (a *Agent) AddUpDownWithLabels(name string, labels map[string]string, delta int64) {
+	key := seriesKey(name, labels)
+	if c, ok := a.upDownIndex.Load(key); ok {
+		c.(*atomic.Int64).Add(delta)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.gauges[key]; ok {
+		a.rejectValue(key, "up-down counter "+name, errors.New("it is a gauge; use SetGauge"))
+		return
+	}
+	if !a.track(key, name, labels) {
+		return
+	}
+	c, ok := a.upDowns[key]
+	if !ok {
+		c = new(atomic.Int64)
+		a.upDowns[key] = c
+		a.upDownIndex.Store(key, c)
+	}
+	c.Add(delta)
+}
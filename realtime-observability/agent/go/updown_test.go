@@ -0,0 +1,29 @@
+//go:build !notelemetry
+
+package agent_test
+
+import "testing"
+
+func BenchmarkAddUpDownParallel(b *testing.B) {
+	a := newBenchAgent(b, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			a.AddUpDown("in_flight", 1)
+		}
+	})
+}
+
+// BenchmarkSetGaugeParallel is the gauge a caller would otherwise keep in
+// step with AddUpDown's count
+func BenchmarkSetGaugeParallel(b *testing.B) {
+	a := newBenchAgent(b, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			a.SetGauge("in_flight", 1)
+		}
+	})
+}
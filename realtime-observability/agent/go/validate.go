@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults applied by Config.AllowDefaults, matching DefaultConfig
+const (
+	DefaultAggregatorAddr = "localhost:9000"
+	DefaultPushInterval   = 20 * time.Millisecond
+	DefaultBatchSize      = 100
+)
+
+// MinPushInterval is the shortest PushInterval Validate accepts
+const MinPushInterval = time.Millisecond
+
+// unixScheme prefixes an AggregatorAddr that is a Unix socket path
+const unixScheme = "unix://"
+
+// ConfigError reports an invalid Config field and why
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid Config." + e.Field + ": " + e.Reason
+}
+
+// Validate reports every invalid field, each as a *ConfigError, joined.
+// NewAgent calls it after applying defaults when AllowDefaults is set.
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(field, format string, v ...any) {
+		errs = append(errs, &ConfigError{Field: field, Reason: fmt.Sprintf(format, v...)})
+	}
+
+	if strings.TrimSpace(c.ServiceName) == "" {
+		invalid("ServiceName", "must not be empty")
+	}
+	if c.PushInterval < MinPushInterval {
+		invalid("PushInterval", "%v is below the minimum of %v", c.PushInterval, MinPushInterval)
+	}
+	if c.BatchSize < 1 {
+		invalid("BatchSize", "%d must be at least 1", c.BatchSize)
+	}
+	if c.GaugeHistory < 0 {
+		invalid("GaugeHistory", "%d must not be negative", c.GaugeHistory)
+	}
+	if c.MaxPushInterval < 0 {
+		invalid("MaxPushInterval", "%v must not be negative", c.MaxPushInterval)
+	}
+	if c.RateSmoothing < 0 {
+		invalid("RateSmoothing", "%v must not be negative", c.RateSmoothing)
+	}
+	if b := c.RemoteConfigBounds; b.MinPushInterval < 0 || b.MaxPushInterval < 0 ||
+		b.MaxPushInterval > 0 && b.MaxPushInterval < b.MinPushInterval {
+		invalid("RemoteConfigBounds", "push intervals must not be negative, nor the maximum below the minimum")
+	}
+	if r := c.RemoteConfigBounds.MinSampleRate; r < 0 || r > 1 {
+		invalid("RemoteConfigBounds", "MinSampleRate %v is not in [0, 1]", r)
+	}
+	if c.HistogramTemporality != Delta && c.HistogramTemporality != Cumulative {
+		invalid("HistogramTemporality", "%d is neither Delta nor Cumulative", c.HistogramTemporality)
+	}
+	if c.MirrorAddr != "" {
+		if err := validateAddr(c.MirrorAddr); err != nil {
+			invalid("MirrorAddr", "%v", err)
+		}
+	}
+	if c.Sink != nil {
+		if c.BootstrapToken != "" {
+			invalid("BootstrapToken", "needs an aggregator; it cannot be used with Sink")
+		}
+		if c.CorrectClockSkew {
+			invalid("CorrectClockSkew", "needs an aggregator; it cannot be used with Sink")
+		}
+		if c.RemoteConfig {
+			invalid("RemoteConfig", "needs an aggregator; it cannot be used with Sink")
+		}
+		return errors.Join(errs...)
+	}
+	if len(c.AggregatorAddrs) == 0 {
+		if err := validateAddr(c.AggregatorAddr); err != nil {
+			invalid("AggregatorAddr", "%v", err)
+		}
+	}
+	for i, addr := range c.AggregatorAddrs {
+		if err := validateAddr(addr); err != nil {
+			invalid(fmt.Sprintf("AggregatorAddrs[%d]", i), "%v", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateAddr accepts host:port, unix:///path or another gRPC target
+// with a scheme, such as dns:///host:port
+func validateAddr(addr string) error {
+	if addr == "" {
+		return errors.New("must not be empty")
+	}
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		if path == "" {
+			return fmt.Errorf("%q has no socket path", addr)
+		}
+		return nil
+	}
+	if scheme, target, ok := strings.Cut(addr, "://"); ok {
+		if scheme == "" || strings.Trim(target, "/") == "" {
+			return fmt.Errorf("%q is not a valid gRPC target", addr)
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%q is not host:port or unix:///path", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%q has an invalid port", addr)
+	}
+	return nil
+}
+
+// withDefaults fills the zero fields Validate would reject, and
+// AggregatorAddr, with the DefaultConfig values
+func (c Config) withDefaults() Config {
+	if c.AggregatorAddr == "" && len(c.AggregatorAddrs) == 0 {
+		c.AggregatorAddr = DefaultAggregatorAddr
+	}
+	if c.PushInterval == 0 {
+		c.PushInterval = DefaultPushInterval
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = DefaultBatchSize
+	}
+	return c
+}
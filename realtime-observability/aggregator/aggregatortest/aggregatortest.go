@@ -0,0 +1,287 @@
+// Package aggregatortest runs the aggregator pipeline in-process for tests.
+//
+// New starts the ingest and query servers, registry, hub and authenticator,
+// serves gRPC over both bufconn and a loopback listener (the agent dials the
+// latter) and the WebSocket endpoint over httptest. Everything is torn down in reverse
+// start order by t.Cleanup, so tests can combine it with goleak:
+//
+//	func TestPipeline(t *testing.T) {
+//		aggregatortest.VerifyNoLeaks(t)
+//		h := aggregatortest.New(t, aggregatortest.Options{})
+//		h.Agent.SetGauge("cpu", 42)
+//		h.WaitForMetric("test-service", "cpu", time.Second)
+//	}
+//
+// This is the supported way to test integrations against the aggregator.
+package aggregatortest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	agent "github.com/yourorg/agent"
+	"github.com/yourorg/aggregator/internal/agentconfig"
+	"github.com/yourorg/aggregator/internal/auth"
+	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/ingest"
+	"github.com/yourorg/aggregator/internal/query"
+	"github.com/yourorg/aggregator/internal/ws"
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufconnSize = 1 << 20
+
+// Options configures a Harness
+type Options struct {
+	// ServiceName for the ready-made agent (default "test-service")
+	ServiceName string
+	// APIKey enables authentication with this single key when set
+	APIKey string
+	// PushInterval for the agent (default 5ms)
+	PushInterval time.Duration
+	// BroadcastInterval for the hub (default 5ms)
+	BroadcastInterval time.Duration
+	// NoAgent skips creating and connecting the agent
+	NoAgent bool
+	// AgentConfigFile enables the WatchConfig RPC with this file, loaded
+	// once; call AgentConfig.Reload after changing it. The agent watches
+	// it with Config.RemoteConfig.
+	AgentConfigFile string
+	// AgentConfigLease is how long agents keep a pushed config
+	// (default agentconfig.DefaultLease)
+	AgentConfigLease time.Duration
+	// MinPushInterval is the push interval hint sent to agents, as with
+	// ingest.Server.SetMinPushInterval
+	MinPushInterval time.Duration
+	// ConfigureAgent, if set, adjusts the agent's config before NewAgent
+	ConfigureAgent func(cfg *agent.Config)
+}
+
+// Harness holds handles to an in-process aggregator
+type Harness struct {
+	t testing.TB
+
+	Registry *buffer.Registry
+	Hub      *ws.Hub
+	Auth     *auth.Authenticator
+	Ingest   *ingest.Server
+	// AgentConfig is set with Options.AgentConfigFile
+	AgentConfig *agentconfig.Store
+
+	// GRPCAddr is the loopback address the gRPC server listens on
+	GRPCAddr string
+	// WSURL is the ws:// URL of the hub's WebSocket endpoint
+	WSURL string
+	// Agent is connected and started unless Options.NoAgent was set
+	Agent *agent.Agent
+
+	grpcServer *grpc.Server
+	bufLis     *bufconn.Listener
+	httpServer *httptest.Server
+	wsClient   *WSClient
+}
+
+// New starts an aggregator and registers its teardown with t.Cleanup
+func New(t testing.TB, opts Options) *Harness {
+	t.Helper()
+
+	if opts.ServiceName == "" {
+		opts.ServiceName = "test-service"
+	}
+	if opts.PushInterval == 0 {
+		opts.PushInterval = 5 * time.Millisecond
+	}
+	if opts.BroadcastInterval == 0 {
+		opts.BroadcastInterval = 5 * time.Millisecond
+	}
+
+	h := &Harness{t: t}
+	h.Registry = buffer.NewRegistry()
+	h.Hub = ws.NewHub(h.Registry)
+	h.Auth = auth.NewAuthenticator()
+	if opts.APIKey != "" {
+		h.Auth.AddAPIKey(opts.APIKey)
+	} else {
+		h.Auth.Disable()
+	}
+	h.Ingest = ingest.NewServer(h.Registry, h.Hub)
+	h.Ingest.SetMinPushInterval(opts.MinPushInterval)
+	if opts.AgentConfigFile != "" {
+		store, err := agentconfig.LoadFile(opts.AgentConfigFile, opts.AgentConfigLease)
+		if err != nil {
+			t.Fatalf("aggregatortest: load agent config: %v", err)
+		}
+		h.AgentConfig = store
+		h.Ingest.SetAgentConfig(store)
+	}
+
+	go h.Hub.Run()
+	go h.Hub.StartBroadcastLoop(opts.BroadcastInterval)
+	t.Cleanup(h.Hub.Stop)
+
+	h.grpcServer = grpc.NewServer(
+		grpc.UnaryInterceptor(h.Auth.UnaryInterceptor()),
+		grpc.StreamInterceptor(h.Auth.StreamInterceptor()),
+	)
+	pb.RegisterTelemetryIngestorServer(h.grpcServer, h.Ingest)
+	pb.RegisterTelemetryQueryServer(h.grpcServer, query.NewServer(h.Registry, h.Hub))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("aggregatortest: listen: %v", err)
+	}
+	h.GRPCAddr = lis.Addr().String()
+	h.bufLis = bufconn.Listen(bufconnSize)
+	go h.grpcServer.Serve(lis)
+	go h.grpcServer.Serve(h.bufLis)
+	t.Cleanup(h.grpcServer.Stop)
+
+	mux := newMux(h.Hub)
+	h.httpServer = httptest.NewServer(mux)
+	h.WSURL = "ws" + strings.TrimPrefix(h.httpServer.URL, "http") + "/ws"
+	t.Cleanup(h.httpServer.Close)
+
+	if !opts.NoAgent {
+		cfg := agent.DefaultConfig()
+		cfg.AggregatorAddr = h.GRPCAddr
+		cfg.ServiceName = opts.ServiceName
+		cfg.APIKey = opts.APIKey
+		cfg.PushInterval = opts.PushInterval
+		cfg.RemoteConfig = opts.AgentConfigFile != ""
+		if opts.ConfigureAgent != nil {
+			opts.ConfigureAgent(&cfg)
+		}
+
+		a, err := agent.NewAgent(cfg)
+		if err != nil {
+			t.Fatalf("aggregatortest: new agent: %v", err)
+		}
+		if err := a.Connect(); err != nil {
+			t.Fatalf("aggregatortest: connect agent: %v", err)
+		}
+		if err := a.Start(); err != nil {
+			t.Fatalf("aggregatortest: start agent: %v", err)
+		}
+		h.Agent = a
+		// Registered last so it runs first: the agent needs the server
+		// to accept its final CloseAndRecv
+		t.Cleanup(a.Stop)
+	}
+
+	return h
+}
+
+// StopGRPC stops the gRPC server as a dead aggregator would, ending every
+// stream; agents keep retrying until they are stopped
+func (h *Harness) StopGRPC() {
+	h.grpcServer.Stop()
+}
+
+// DialGRPC returns a client connection to the in-process gRPC server over bufconn
+func (h *Harness) DialGRPC(opts ...grpc.DialOption) *grpc.ClientConn {
+	h.t.Helper()
+
+	opts = append([]grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return h.bufLis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, opts...)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn", opts...)
+	if err != nil {
+		h.t.Fatalf("aggregatortest: dial bufconn: %v", err)
+	}
+	h.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// QueryClient returns a TelemetryQuery client over bufconn
+func (h *Harness) QueryClient(opts ...grpc.DialOption) pb.TelemetryQueryClient {
+	h.t.Helper()
+	return pb.NewTelemetryQueryClient(h.DialGRPC(opts...))
+}
+
+// WaitForMetric blocks until the registry knows the metric or fails the test
+func (h *Harness) WaitForMetric(service, name string, timeout time.Duration) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, m := range h.Registry.ListMetrics(service) {
+			if m == name {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("aggregatortest: metric %s/%s not received within %v", service, name, timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// LatestGauge returns the newest value of a gauge
+func (h *Harness) LatestGauge(service, name string) (float64, bool) {
+	s, ok := h.Registry.LatestSnapshot().Gauges[buffer.MetricKey{Service: service, Name: name}]
+	return s.Val, ok
+}
+
+// LatestCounter returns the newest value of a counter
+func (h *Harness) LatestCounter(service, name string) (float64, bool) {
+	s, ok := h.Registry.LatestSnapshot().Counters[buffer.MetricKey{Service: service, Name: name}]
+	return s.Val, ok
+}
+
+// WSClient returns a shared WebSocket client connected to the hub
+func (h *Harness) WSClient() *WSClient {
+	h.t.Helper()
+	if h.wsClient == nil {
+		h.wsClient = h.DialWS()
+	}
+	return h.wsClient
+}
+
+// DialWS connects a new WebSocket client to the hub, negotiating the
+// latest protocol version
+func (h *Harness) DialWS() *WSClient {
+	h.t.Helper()
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{fmt.Sprintf("telemetry.v%d", ws.LatestProtocol)}
+	conn, _, err := dialer.Dial(h.WSURL, nil)
+	if err != nil {
+		h.t.Fatalf("aggregatortest: dial websocket: %v", err)
+	}
+	c := newWSClient(h.t, conn)
+	h.t.Cleanup(c.Close)
+	return c
+}
+
+// CollectWSMessages reads n messages from the shared WebSocket client
+func (h *Harness) CollectWSMessages(n int) []WSMessage {
+	h.t.Helper()
+	return h.WSClient().Collect(n, 5*time.Second)
+}
+
+// VerifyNoLeaks registers a cleanup that fails the test if goroutines are
+// still running once the test ends. Call it before New so the check runs
+// after the harness teardown.
+func VerifyNoLeaks(t testing.TB, opts ...goleak.Option) {
+	t.Helper()
+	opts = append([]goleak.Option{goleak.IgnoreCurrent()}, opts...)
+	t.Cleanup(func() {
+		if err := goleak.Find(opts...); err != nil {
+			t.Errorf("aggregatortest: %v", err)
+		}
+	})
+}
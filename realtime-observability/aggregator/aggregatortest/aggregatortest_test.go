@@ -0,0 +1,203 @@
+package aggregatortest_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	agent "github.com/yourorg/agent"
+	"github.com/yourorg/aggregator/aggregatortest"
+	"github.com/yourorg/aggregator/internal/ws"
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+func TestIngestPipeline(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{})
+
+	h.Agent.SetGauge("cpu", 42)
+	h.Agent.AddCounter("requests_total", 3)
+	h.WaitForMetric("test-service", "cpu", 5*time.Second)
+	h.WaitForMetric("test-service", "requests_total", 5*time.Second)
+
+	if v, ok := h.LatestGauge("test-service", "cpu"); !ok || v != 42 {
+		t.Fatalf("cpu = %v, %v; want 42", v, ok)
+	}
+	if v, ok := h.LatestCounter("test-service", "requests_total"); !ok || v != 3 {
+		t.Fatalf("requests_total = %v, %v; want 3", v, ok)
+	}
+
+	resp, err := h.QueryClient().ListMetrics(context.Background(), &pb.ListMetricsRequest{Service: "test-service"})
+	if err != nil {
+		t.Fatalf("ListMetrics: %v", err)
+	}
+	if !slices.ContainsFunc(resp.Metrics, func(m *pb.MetricInfo) bool { return m.Name == "cpu" && m.Kind == "gauge" }) {
+		t.Fatalf("ListMetrics = %v, want the cpu gauge among them", resp.Metrics)
+	}
+}
+
+func TestIngestWithAPIKey(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{APIKey: "secret"})
+
+	h.Agent.SetGauge("cpu", 1)
+	h.WaitForMetric("test-service", "cpu", 5*time.Second)
+}
+
+func TestHubStreamsSnapshots(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{})
+
+	h.Agent.SetGauge("cpu", 42)
+	h.Agent.SetGauge("mem", 7)
+	h.WaitForMetric("test-service", "cpu", 5*time.Second)
+	h.WaitForMetric("test-service", "mem", 5*time.Second)
+
+	client := h.WSClient()
+	client.Subscribe(ws.Subscription{Service: "test-service", Metric: "cpu"})
+	// Snapshots sent before the subscription lands are unfiltered
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msg := client.Next(time.Until(deadline))
+		if msg.Type != "snapshot" {
+			continue
+		}
+		if _, ok := msg.Gauges["test-service/mem"]; ok {
+			continue
+		}
+		if s, ok := msg.Gauges["test-service/cpu"]; !ok || s.Val != 42 || len(msg.Gauges) != 1 {
+			t.Fatalf("subscribed snapshot = %s, want only cpu at 42", msg.Raw)
+		}
+		return
+	}
+}
+
+func TestAgentConfigPush(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	const interval = 250 * time.Millisecond
+	const lease = 600 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "agents.json")
+	writeAgentConfig(t, path, `{"services": {}}`)
+	h := aggregatortest.New(t, aggregatortest.Options{
+		PushInterval:     interval,
+		AgentConfigFile:  path,
+		AgentConfigLease: lease,
+		ConfigureAgent: func(cfg *agent.Config) {
+			// A fixed interval, so backoff from the dead aggregator below
+			// does not hide the revert
+			cfg.MaxPushInterval = 0
+			cfg.FeatureFlags = map[string]bool{"new_checkout": false}
+			cfg.RemoteConfigBounds.MinPushInterval = 100 * time.Millisecond
+			cfg.RemoteConfigBounds.MaxPushInterval = 400 * time.Millisecond
+		},
+	})
+	defer h.Agent.StopWithTimeout(10 * time.Millisecond)
+	h.Agent.SetGauge("cpu", 1)
+	h.WaitForMetric("test-service", "cpu", 5*time.Second)
+
+	// The interval is clamped to the agent's bounds, and flags it does
+	// not declare are ignored
+	const pushed = `{"services": {"test-service": {
+		"push_interval_ms": 1000,
+		"metric_denylist": ["debug_*"],
+		"histogram_sample_rate": {"latency": 0.5},
+		"feature_flags": {"new_checkout": true, "undeclared": true}
+	}}}`
+	writeAgentConfig(t, path, pushed)
+	reloadAgentConfig(t, h)
+	waitUntil(t, interval, "the agent applies the pushed config", func() bool {
+		return h.Agent.Health().ConfigVersion != 0
+	})
+	version := h.Agent.Health().ConfigVersion
+	if got := h.Agent.Health().PushInterval; got != 400*time.Millisecond {
+		t.Fatalf("PushInterval = %v, want the pushed 1s clamped to 400ms", got)
+	}
+	if !h.Agent.FeatureFlag("new_checkout") || h.Agent.FeatureFlag("undeclared") {
+		t.Fatalf("flags new_checkout=%v undeclared=%v, want true and false",
+			h.Agent.FeatureFlag("new_checkout"), h.Agent.FeatureFlag("undeclared"))
+	}
+
+	// The version reaches the aggregator as a resource attribute, and
+	// denied metrics stay behind
+	h.Agent.SetGauge("debug_queue", 1)
+	h.Agent.SetGauge("cpu", 2)
+	waitUntil(t, 5*time.Second, "the version attribute and cpu=2 arrive", func() bool {
+		v, _ := h.LatestGauge("test-service", "cpu")
+		instances := h.Registry.Instances()["test-service"]
+		return v == 2 && len(instances) == 1 &&
+			instances[0].Attributes[agent.LabelConfigVersion] == strconv.FormatUint(version, 10)
+	})
+	if slices.Contains(h.Registry.ListMetrics("test-service"), "debug_queue") {
+		t.Fatal("debug_queue was sent despite the denylist")
+	}
+
+	// Dropping the service's section withdraws the overrides at once, and
+	// restoring it brings back the same version
+	writeAgentConfig(t, path, `{"services": {}}`)
+	reloadAgentConfig(t, h)
+	waitUntil(t, interval, "the agent drops the withdrawn config", func() bool {
+		return h.Agent.Health().ConfigVersion == 0
+	})
+	writeAgentConfig(t, path, pushed)
+	reloadAgentConfig(t, h)
+	waitUntil(t, interval, "the agent applies the restored config", func() bool {
+		return h.Agent.Health().ConfigVersion == version
+	})
+
+	// Without renewals the lease runs out and the local config returns
+	h.StopGRPC()
+	waitUntil(t, 5*time.Second, "the lease expires", func() bool {
+		return h.Agent.Health().ConfigVersion == 0
+	})
+	if got := h.Agent.Health().PushInterval; got != interval {
+		t.Fatalf("PushInterval after expiry = %v, want the local %v", got, interval)
+	}
+	if h.Agent.FeatureFlag("new_checkout") {
+		t.Fatal("new_checkout still set after expiry")
+	}
+}
+
+func TestBackpressureHintSlowsDefaultAgent(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	const hint = 200 * time.Millisecond
+	// The agent keeps DefaultConfig's MaxPushInterval and skew settings,
+	// so its stream stays open and only the probe carries the hint
+	h := aggregatortest.New(t, aggregatortest.Options{MinPushInterval: hint})
+
+	h.Agent.SetGauge("cpu", 1)
+	h.WaitForMetric("test-service", "cpu", 5*time.Second)
+	waitUntil(t, 5*time.Second, "the agent slows to the hint", func() bool {
+		return h.Agent.Health().PushInterval == hint
+	})
+}
+
+func writeAgentConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reloadAgentConfig(t *testing.T, h *aggregatortest.Harness) {
+	t.Helper()
+	if changed, err := h.AgentConfig.Reload(); err != nil || !changed {
+		t.Fatalf("Reload = %v, %v; want a change", changed, err)
+	}
+}
+
+// waitUntil polls cond until it holds or fails the test after timeout
+func waitUntil(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v waiting until %s", timeout, what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
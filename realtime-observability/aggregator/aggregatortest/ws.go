@@ -0,0 +1,182 @@
+package aggregatortest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yourorg/aggregator/internal/ws"
+)
+
+// WSSample is a scalar value in a snapshot message
+type WSSample struct {
+	Ts     int64   `json:"ts"`
+	Val    float64 `json:"val"`
+	Marker string  `json:"marker,omitempty"` // "gap" or "resume"; Val is then unset
+	Exact  string  `json:"exact,omitempty"`  // counters only: the exact uint64 value
+}
+
+// WSHistogram is a histogram value in a snapshot message
+type WSHistogram struct {
+	Ts     int64     `json:"ts"`
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    *float64  `json:"sum,omitempty"`   // unset for agents that do not send it
+	Count  *uint64   `json:"count,omitempty"` // observations, with Sum
+	Marker string    `json:"marker,omitempty"`
+}
+
+// WSMessage is a decoded hub message. Raw holds the original JSON so tests
+// can inspect fields the typed view does not cover.
+type WSMessage struct {
+	Type       string                 `json:"type"`
+	Timestamp  int64                  `json:"timestamp"`
+	Received   int64                  `json:"received"`
+	Gauges     map[string]WSSample    `json:"gauges"`
+	Counters   map[string]WSSample    `json:"counters"`
+	Histograms map[string]WSHistogram `json:"histograms"`
+
+	Raw json.RawMessage `json:"-"`
+}
+
+// WSClient is a test WebSocket client reading hub messages in the background
+type WSClient struct {
+	t        testing.TB
+	conn     *websocket.Conn
+	messages chan WSMessage
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newMux(hub *ws.Hub) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", hub.HandleWebSocket)
+	return mux
+}
+
+func newWSClient(t testing.TB, conn *websocket.Conn) *WSClient {
+	c := &WSClient{
+		t:        t,
+		conn:     conn,
+		messages: make(chan WSMessage, 1024),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// wsChunk is one part of a snapshot the hub split across frames
+type wsChunk struct {
+	Type       string `json:"type"`
+	SnapshotID uint64 `json:"snapshot_id"`
+	Part       int    `json:"part"`
+	Of         int    `json:"of"`
+	Data       string `json:"data"`
+}
+
+// readLoop splits frames into messages; the hub batches pending messages
+// into one frame separated by newlines. Chunked snapshots are reassembled
+// and delivered as the original message; a set missing a part is dropped.
+func (c *WSClient) readLoop() {
+	defer close(c.messages)
+
+	var assembling bytes.Buffer
+	var chunkID uint64
+	var next int
+	for {
+		_, frame, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		for _, line := range bytes.Split(frame, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var chunk wsChunk
+			if json.Unmarshal(line, &chunk) == nil && chunk.Type == "chunk" {
+				if chunk.SnapshotID != chunkID || chunk.Part != next {
+					assembling.Reset()
+					chunkID, next = chunk.SnapshotID, 1
+					if chunk.Part != 1 {
+						continue
+					}
+				}
+				assembling.WriteString(chunk.Data)
+				next++
+				if chunk.Part < chunk.Of {
+					continue
+				}
+				line = append([]byte(nil), assembling.Bytes()...)
+				assembling.Reset()
+			}
+			msg := WSMessage{Raw: append(json.RawMessage(nil), line...)}
+			if err := json.Unmarshal(line, &msg); err != nil {
+				continue
+			}
+			select {
+			case c.messages <- msg:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// Send writes a JSON message to the hub
+func (c *WSClient) Send(v interface{}) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(v); err != nil {
+		c.t.Fatalf("aggregatortest: websocket write: %v", err)
+	}
+}
+
+// Subscribe replaces the client's subscriptions
+func (c *WSClient) Subscribe(subs ...ws.Subscription) {
+	c.t.Helper()
+	c.Send(map[string]interface{}{
+		"type":          "subscribe",
+		"subscriptions": subs,
+	})
+}
+
+// Next returns the next message or fails the test after timeout
+func (c *WSClient) Next(timeout time.Duration) WSMessage {
+	c.t.Helper()
+
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("aggregatortest: websocket closed")
+		}
+		return msg
+	case <-time.After(timeout):
+		c.t.Fatalf("aggregatortest: no websocket message within %v", timeout)
+	}
+	return WSMessage{}
+}
+
+// Collect reads n messages, failing the test if they do not arrive in time
+func (c *WSClient) Collect(n int, timeout time.Duration) []WSMessage {
+	c.t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	result := make([]WSMessage, 0, n)
+	for len(result) < n {
+		result = append(result, c.Next(time.Until(deadline)))
+	}
+	return result
+}
+
+// Close disconnects the client and waits for its reader to exit
+func (c *WSClient) Close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+		for range c.messages {
+		}
+	})
+}
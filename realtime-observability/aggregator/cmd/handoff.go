@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// Listener handoff on SIGUSR2: the running process exports its registry,
+// starts a copy of itself with the listening sockets as inherited file
+// descriptors, waits for the child to report ready and then drains. The
+// sockets never close, so connections queue in the kernel backlog instead of
+// being refused while the child starts.
+const (
+	// handoffEnv is set in the child; its value is the state file to import
+	handoffEnv = "TELEMETRY_HANDOFF_STATE"
+
+	// inherited descriptors: listeners in handoffListeners order, then the
+	// readiness pipe
+	firstInheritedFD = 3
+
+	handoffReadyTimeout = 30 * time.Second
+)
+
+// handoffListeners names the listeners passed to the child, in fd order
+var handoffListeners = []string{"grpc", "ws", "metrics"}
+
+// inHandoffChild reports whether this process was started by a handoff
+func inHandoffChild() bool {
+	return os.Getenv(handoffEnv) != ""
+}
+
+// listen binds addr, or adopts the listener inherited from the parent
+func listen(name, addr string) (net.Listener, error) {
+	if !inHandoffChild() {
+		return net.Listen("tcp", addr)
+	}
+	for i, n := range handoffListeners {
+		if n == name {
+			f := os.NewFile(uintptr(firstInheritedFD+i), name)
+			defer f.Close()
+			return net.FileListener(f)
+		}
+	}
+	return nil, fmt.Errorf("no inherited listener named %s", name)
+}
+
+// importHandoffState loads the registry exported by the parent
+func importHandoffState(registry *buffer.Registry) {
+	path := os.Getenv(handoffEnv)
+	if err := importState(registry, path, 0); err != nil {
+		log.Printf("Handoff: failed to import parent state: %v", err)
+	}
+	os.Remove(path)
+}
+
+// signalReady tells the parent that every listener is being served
+func signalReady() {
+	if !inHandoffChild() {
+		return
+	}
+	ready := os.NewFile(uintptr(firstInheritedFD+len(handoffListeners)), "ready")
+	defer ready.Close()
+	if _, err := ready.Write([]byte("ready\n")); err != nil {
+		log.Printf("Handoff: failed to signal parent: %v", err)
+	}
+}
+
+// handoff starts the replacement process and waits until it is serving.
+// On error the child is killed and the caller keeps serving.
+func handoff(registry *buffer.Registry, listeners []net.Listener) error {
+	state, err := os.CreateTemp("", "aggregator-handoff-*.state")
+	if err != nil {
+		return err
+	}
+	exportErr := registry.ExportState(state)
+	state.Close()
+	if exportErr != nil {
+		os.Remove(state.Name())
+		return fmt.Errorf("export state: %w", exportErr)
+	}
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			os.Remove(state.Name())
+			return fmt.Errorf("dup listener %s: %w", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		os.Remove(state.Name())
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), handoffEnv+"="+state.Name())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		os.Remove(state.Name())
+		return fmt.Errorf("start child: %w", err)
+	}
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := bufio.NewReader(readyR).ReadString('\n')
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			log.Printf("Handoff: child pid %d is serving", cmd.Process.Pid)
+			go cmd.Wait()
+			return nil
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("child exited before becoming ready: %w", err)
+	case <-time.After(handoffReadyTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("child not ready after %s", handoffReadyTimeout)
+	}
+}
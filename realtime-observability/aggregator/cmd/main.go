@@ -2,32 +2,136 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yourorg/aggregator/internal/agentconfig"
+	"github.com/yourorg/aggregator/internal/api"
 	"github.com/yourorg/aggregator/internal/auth"
 	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/cardinality"
 	"github.com/yourorg/aggregator/internal/export"
+	"github.com/yourorg/aggregator/internal/health"
 	"github.com/yourorg/aggregator/internal/ingest"
+	"github.com/yourorg/aggregator/internal/query"
+	"github.com/yourorg/aggregator/internal/usage"
 	"github.com/yourorg/aggregator/internal/ws"
 	pb "github.com/yourorg/telemetry/gen/proto"
 	"google.golang.org/grpc"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export-state" {
+		if err := runExportState(os.Args[2:]); err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		return
+	}
+
+	importPath := flag.String("import-state", "", "load a state file exported with export-state at startup")
+	importLoop := flag.Duration("import-loop", 0, "replay the last N of imported series until real data arrives (0 disables)")
+	flag.Parse()
+
 	log.Println("Starting aggregator...")
 
 	// Initialize components
-	registry := buffer.NewRegistry()
+	ringSizes, err := buffer.ParseRingSizes(os.Getenv("TELEMETRY_RING_SIZES"))
+	if err != nil {
+		log.Fatalf("Invalid TELEMETRY_RING_SIZES: %v", err)
+	}
+	registryOptions := buffer.Options{
+		SeriesTTL:     time.Duration(envInt("TELEMETRY_SERIES_TTL_S", 0)) * time.Second,
+		SweepInterval: time.Duration(envInt("TELEMETRY_SWEEP_INTERVAL_S", 30)) * time.Second,
+
+		MaxSeriesPerService: envInt("TELEMETRY_MAX_SERIES_PER_SERVICE", 0),
+		MaxSeriesTotal:      envInt("TELEMETRY_MAX_SERIES", 0),
+		DisableRollups:      envInt("TELEMETRY_ROLLUPS", 1) == 0,
+
+		DefaultRingSize:   envInt("TELEMETRY_RING_SIZE", buffer.DefaultRingSize),
+		HistogramRingSize: envInt("TELEMETRY_HISTOGRAM_RING_SIZE", buffer.HistogramRingSize),
+		PerMetricSizes:    ringSizes,
+		HistogramBucket:   time.Duration(envInt("TELEMETRY_HISTOGRAM_BUCKET_MS", 1000)) * time.Millisecond,
+	}
+	if err := registryOptions.Validate(); err != nil {
+		log.Fatalf("Invalid ring sizes: %v", err)
+	}
+	registry := buffer.NewRegistryWithOptions(registryOptions)
+	defer registry.Close()
+	orderMode, err := buffer.ParseOrderMode(os.Getenv("TELEMETRY_OUT_OF_ORDER"))
+	if err != nil {
+		log.Fatalf("Invalid TELEMETRY_OUT_OF_ORDER: %v", err)
+	}
+	registry.SetOrderPolicy(buffer.OrderPolicy{
+		Mode:   orderMode,
+		Window: time.Duration(envInt("TELEMETRY_REORDER_WINDOW_MS", 500)) * time.Millisecond,
+	})
+	canonicalBounds, err := buffer.ParseCanonicalBounds(os.Getenv("TELEMETRY_HISTOGRAM_BOUNDS"))
+	if err != nil {
+		log.Fatalf("Invalid TELEMETRY_HISTOGRAM_BOUNDS: %v", err)
+	}
+	registry.SetCanonicalBounds(canonicalBounds)
+	gaugeAggregation, err := buffer.ParseGaugeAggregation(os.Getenv("TELEMETRY_GAUGE_AGGREGATION"))
+	if err != nil {
+		log.Fatalf("Invalid TELEMETRY_GAUGE_AGGREGATION: %v", err)
+	}
+	registry.SetGaugeAggregation(gaugeAggregation)
 	hub := ws.NewHub(registry)
+	hub.SetBandwidthLimits(
+		int64(envInt("TELEMETRY_WS_CLIENT_BUDGET_BPS", 0)),
+		int64(envInt("TELEMETRY_WS_MAX_CLIENT_BUDGET_BPS", 0)),
+	)
+	hub.SetMaxFrameBytes(envInt("TELEMETRY_WS_MAX_FRAME_BYTES", ws.DefaultMaxFrameBytes))
 	authenticator := auth.NewAuthenticator()
+	authenticator.SetIssuedKeyLimits(
+		time.Duration(envInt("TELEMETRY_ISSUED_KEY_TTL_S", 3600))*time.Second,
+		envInt("TELEMETRY_MAX_ISSUED_KEYS", auth.DefaultMaxIssuedKeys),
+	)
 	exporter := export.NewPrometheusExporter(registry)
+	exporter.SetLatency(hub.Latency())
+	exporter.SetPerInstance(envInt("TELEMETRY_PROM_PER_INSTANCE", 0) != 0)
+	registry.OnDelete(exporter.HandleDelete)
+	registry.OnDeleteService(exporter.HandleDeleteService)
+
+	if path := os.Getenv("TELEMETRY_VIEWS_FILE"); path != "" {
+		views, err := ws.LoadViewsFile(path)
+		if err != nil {
+			log.Fatalf("Failed to load views: %v", err)
+		}
+		for _, v := range views {
+			hub.Views().Put(v)
+		}
+		log.Printf("Loaded %d dashboard views from %s", len(views), path)
+	}
+
+	quotas, err := usage.ParseQuotas(os.Getenv("TELEMETRY_USAGE_QUOTAS"))
+	if err != nil {
+		log.Fatalf("Invalid TELEMETRY_USAGE_QUOTAS: %v", err)
+	}
+	retention := time.Duration(envInt("TELEMETRY_USAGE_RETENTION_DAYS", 30)) * 24 * time.Hour
+	usageTracker, err := usage.NewTracker(os.Getenv("TELEMETRY_USAGE_FILE"), retention, quotas)
+	if err != nil {
+		log.Fatalf("Failed to load usage store: %v", err)
+	}
+
+	snapshotPath := os.Getenv("TELEMETRY_SNAPSHOT_PATH")
+	if inHandoffChild() {
+		importHandoffState(registry)
+	} else if *importPath != "" {
+		if err := importState(registry, *importPath, *importLoop); err != nil {
+			log.Printf("Failed to import state: %v", err)
+		}
+	} else if snapshotPath != "" {
+		loadSnapshot(registry, snapshotPath)
+	}
 
 	// Start WebSocket hub
 	go hub.Run()
@@ -38,9 +142,46 @@ func main() {
 		grpc.StreamInterceptor(authenticator.StreamInterceptor()),
 	)
 	ingestServer := ingest.NewServer(registry, hub)
+	ingestServer.SetUsage(usageTracker)
+	ingestServer.SetAuthenticator(authenticator)
+	staleness := ingest.NewStalenessSweeper(registry, time.Duration(envInt("TELEMETRY_STALE_AFTER_MS", 10000))*time.Millisecond)
+	ingestServer.SetStalenessSweeper(staleness)
+	ingestServer.SetMinPushInterval(time.Duration(envInt("TELEMETRY_MIN_PUSH_INTERVAL_MS", 0)) * time.Millisecond)
+	if path := os.Getenv("TELEMETRY_AGENT_CONFIG_FILE"); path != "" {
+		lease := time.Duration(envInt("TELEMETRY_AGENT_CONFIG_LEASE_MS", 30000)) * time.Millisecond
+		agentConfig, err := agentconfig.LoadFile(path, lease)
+		if err != nil {
+			log.Fatalf("Failed to load agent config: %v", err)
+		}
+		ingestServer.SetAgentConfig(agentConfig)
+		go agentConfig.Run(time.Duration(envInt("TELEMETRY_AGENT_CONFIG_RELOAD_MS", 5000)) * time.Millisecond)
+		log.Printf("Loaded agent config with %d services from %s", agentConfig.Len(), path)
+	}
 	pb.RegisterTelemetryIngestorServer(grpcServer, ingestServer)
+	queryServer := query.NewServer(registry, hub)
+	if v := os.Getenv("TELEMETRY_GAP_FACTOR"); v != "" {
+		factor, err := strconv.ParseFloat(v, 64)
+		if err != nil || factor < 1 {
+			log.Fatalf("Invalid TELEMETRY_GAP_FACTOR %q: must be a number of at least 1", v)
+		}
+		queryServer.SetGapFactor(factor)
+		hub.SetGapFactor(factor)
+	}
+	pb.RegisterTelemetryQueryServer(grpcServer, queryServer)
+	apiServer := api.NewServer(registry, authenticator, ingestServer.Accounting(), hub.Views(), usageTracker)
+
+	healthConfigs := health.Configs{Default: health.DefaultConfig()}
+	if path := os.Getenv("TELEMETRY_HEALTH_FILE"); path != "" {
+		if healthConfigs, err = health.LoadConfigFile(path); err != nil {
+			log.Fatalf("Failed to load health config: %v", err)
+		}
+		log.Printf("Loaded health config with %d service overrides from %s", len(healthConfigs.Services), path)
+	}
+	scorer := health.NewScorer(registry, healthConfigs)
+	apiServer.SetHealth(scorer)
+	go scorer.Run(time.Duration(envInt("TELEMETRY_HEALTH_INTERVAL_MS", 5000)) * time.Millisecond)
 
-	grpcLis, err := net.Listen("tcp", ":9000")
+	grpcLis, err := listen("grpc", ":9000")
 	if err != nil {
 		log.Fatalf("Failed to listen on gRPC port: %v", err)
 	}
@@ -51,20 +192,51 @@ func main() {
 		}
 	}()
 
+	// Same-host agents can skip TCP through a Unix socket
+	var udsLis *net.UnixListener
+	if path := os.Getenv("TELEMETRY_UDS_PATH"); path != "" {
+		if udsLis, err = listenUnix(path); err != nil {
+			log.Fatalf("Failed to listen on %s: %v", path, err)
+		}
+		go func() {
+			log.Printf("gRPC server listening on unix://%s", path)
+			if err := grpcServer.Serve(udsLis); err != nil {
+				log.Fatalf("gRPC server error: %v", err)
+			}
+		}()
+	}
+
 	// Start WebSocket HTTP server
 	wsMux := http.NewServeMux()
 	wsMux.HandleFunc("/ws", hub.HandleWebSocket)
+	wsMux.Handle("POST /api/v1/push/openmetrics", authenticator.HTTPMiddleware(http.HandlerFunc(ingestServer.HandleTextPush)))
 	wsMux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	wsMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.Query().Has("verbose") {
+			w.Write([]byte("OK"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":           "ok",
+			"pipeline_latency": hub.Latency().Summaries(),
+		})
+	})
+	apiServer.Register(wsMux)
 	wsServer := &http.Server{
 		Addr:    ":8080",
 		Handler: wsMux,
 	}
+	wsLis, err := listen("ws", wsServer.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on WebSocket port: %v", err)
+	}
 	go func() {
 		log.Println("WebSocket server listening on :8080")
-		if err := wsServer.ListenAndServe(); err != http.ErrServerClosed {
+		if err := wsServer.Serve(wsLis); err != http.ErrServerClosed {
 			log.Fatalf("WebSocket server error: %v", err)
 		}
 	}()
@@ -73,13 +245,18 @@ func main() {
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
 	exporter.Register()
+	usageTracker.Register()
 	metricsServer := &http.Server{
 		Addr:    ":9100",
 		Handler: metricsMux,
 	}
+	metricsLis, err := listen("metrics", metricsServer.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on metrics port: %v", err)
+	}
 	go func() {
 		log.Println("Prometheus metrics server listening on :9100")
-		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+		if err := metricsServer.Serve(metricsLis); err != http.ErrServerClosed {
 			log.Fatalf("Metrics server error: %v", err)
 		}
 	}()
@@ -87,18 +264,86 @@ func main() {
 	// Start broadcast loop
 	go hub.StartBroadcastLoop(16 * time.Millisecond)
 
-	// Graceful shutdown
+	// Log the noisiest services when cardinality crosses the thresholds
+	go cardinality.Monitor(registry, ingestServer.Accounting(), cardinality.Thresholds{
+		Series:        envInt("TELEMETRY_CARDINALITY_SERIES_THRESHOLD", 10000),
+		SamplesPerSec: float64(envInt("TELEMETRY_CARDINALITY_SAMPLES_THRESHOLD", 100000)),
+	}, time.Minute)
+
+	// Mark reporting gaps for services that went quiet
+	go staleness.Run(time.Second)
+
+	// Roll up per-key usage and persist closed hours
+	go usageTracker.Run(time.Minute)
+
+	// Tell a handoff parent it can drain
+	signalReady()
+
+	// Graceful shutdown; SIGUSR2 hands the listeners to a new process first
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	handedOff := false
+	for !handedOff {
+		sig := <-sigChan
+		if sig != syscall.SIGUSR2 {
+			break
+		}
+		log.Println("Handing listeners to a new process...")
+		usageTracker.Flush()
+		if err := handoff(registry, []net.Listener{grpcLis, wsLis, metricsLis}); err != nil {
+			log.Printf("Handoff failed, still serving: %v", err)
+			continue
+		}
+		handedOff = true
+		if udsLis != nil {
+			// The child has bound the path again; closing ours must not
+			// remove its socket file
+			udsLis.SetUnlinkOnClose(false)
+		}
+	}
 
 	log.Println("Shutting down...")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	grpcServer.GracefulStop()
+	// Agent streams are long-lived; give them until the deadline to close
+	// and then cut them so they reconnect
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
 	wsServer.Shutdown(ctx)
 	metricsServer.Shutdown(ctx)
+	hub.Stop()
+	if !handedOff {
+		// After a handoff the new process owns the usage file and the
+		// snapshot
+		usageTracker.Flush()
+		if snapshotPath != "" {
+			if err := saveSnapshot(registry, snapshotPath); err != nil {
+				log.Printf("Failed to save snapshot: %v", err)
+			} else {
+				log.Printf("Saved snapshot to %s", snapshotPath)
+			}
+		}
+	}
 
 	log.Println("Aggregator stopped")
 }
+
+// envInt reads an integer environment variable, falling back to def
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("Ignoring invalid %s=%q", key, v)
+	}
+	return def
+}
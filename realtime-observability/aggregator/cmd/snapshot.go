@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// loadSnapshot restores the registry saved at the last shutdown; a
+// missing file is a first start. A snapshot that fails to load is kept
+// aside as path.bad, so the next shutdown does not overwrite it.
+func loadSnapshot(registry *buffer.Registry, path string) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to open snapshot: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if err := registry.LoadSnapshot(f); err != nil {
+		log.Printf("Failed to load snapshot %s, starting empty: %v", path, err)
+		if err := os.Rename(path, path+".bad"); err != nil {
+			log.Printf("Failed to set aside snapshot: %v", err)
+		}
+		return
+	}
+	log.Printf("Loaded snapshot %s", path)
+}
+
+// saveSnapshot writes the registry to path through a temporary file, so
+// a crash mid-write leaves the previous snapshot in place
+func saveSnapshot(registry *buffer.Registry, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = registry.SaveSnapshot(f)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
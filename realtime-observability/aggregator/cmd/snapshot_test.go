@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// seriesOf returns every series of a registry: its catalog entries, the
+// samples of each ring and the rollups of gauges and counters
+func seriesOf(t *testing.T, r *buffer.Registry) map[string]interface{} {
+	t.Helper()
+	result := make(map[string]interface{})
+	for _, e := range r.Catalog() {
+		key := e.Kind + " " + e.Service + "/" + e.Metric
+		switch e.Kind {
+		case "histogram":
+			ring, _ := r.FindHistogramRing(e.Service, e.Metric)
+			var hists []buffer.HistogramData
+			for _, h := range ring.Snapshot() {
+				if !h.IsMarker() {
+					hists = append(hists, h)
+				}
+			}
+			result[key] = hists
+			continue
+		case "counter":
+			ring, _ := r.FindCounterRing(e.Service, e.Metric)
+			result[key] = withoutMarkers(ring.Snapshot())
+		default:
+			ring, _ := r.FindRing(e.Service, e.Metric)
+			result[key] = withoutMarkers(ring.Snapshot())
+		}
+		for _, level := range buffer.RollupLevels {
+			points, ok := r.QueryRollup(e.Service, e.Metric, level.Resolution, 0, math.MaxInt64)
+			if !ok {
+				t.Fatalf("%s has no %v rollup", key, level.Resolution)
+			}
+			result[key+" @"+level.Resolution.String()] = points
+		}
+	}
+	return result
+}
+
+func withoutMarkers(samples []buffer.Sample) []buffer.Sample {
+	var result []buffer.Sample
+	for _, s := range samples {
+		if !s.IsMarker() {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func TestSnapshotSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.snapshot")
+	start := time.Unix(1000, 0).UnixNano()
+
+	old := buffer.NewRegistry()
+	defer old.Close()
+	route := buffer.SeriesName("latency", map[string]string{"route": "/cart"})
+	for i := range 150 {
+		ts := start + int64(i)*int64(time.Second)
+		old.PushGauge("checkout", "pod-a", "cpu", buffer.Sample{Ts: ts, Val: float64(i % 7)})
+		old.PushGauge("checkout", "pod-b", "cpu", buffer.Sample{Ts: ts, Val: 1})
+		old.PushGauge("checkout", "", route, buffer.Sample{Ts: ts, Val: float64(i)})
+		old.PushCounter("checkout", "", "requests_total", buffer.CounterSample(ts, uint64(i*3)))
+		old.PushCounter("checkout", "", "cpu_seconds", buffer.FloatCounterSample(ts, float64(i)/4))
+		old.PushHistogram("checkout", "", "latency", buffer.HistogramData{
+			Ts: ts, Bounds: []float64{10, 100}, Counts: []uint64{uint64(i), 1, 0}, Sum: float64(i), Count: uint64(i + 1), HasSum: true,
+		})
+	}
+	old.PushGauge("billing", "", "queue", buffer.Sample{Ts: start, Val: 3})
+	old.MarkGap("billing")
+
+	if err := saveSnapshot(old, path); err != nil {
+		t.Fatalf("saveSnapshot: %v", err)
+	}
+	restarted := buffer.NewRegistry()
+	defer restarted.Close()
+	loadSnapshot(restarted, path)
+
+	want, got := seriesOf(t, old), seriesOf(t, restarted)
+	// Six series, all but the histogram with rollups
+	if n := 6 + 5*len(buffer.RollupLevels); len(want) != n {
+		t.Fatalf("saved %d series and rollups, want %d", len(want), n)
+	}
+	for key, w := range want {
+		if !reflect.DeepEqual(got[key], w) {
+			t.Errorf("%s after the restart = %v, want %v", key, got[key], w)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("restart has %d series and rollups, want %d", len(got), len(want))
+	}
+}
+
+func TestBadSnapshotIsSetAside(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.snapshot")
+	registry := buffer.NewRegistry()
+	defer registry.Close()
+
+	// A first start has nothing to load
+	loadSnapshot(registry, path)
+
+	registry.GetRing("checkout", "cpu").Push(buffer.Sample{Ts: 1e9, Val: 1})
+	if err := saveSnapshot(registry, path); err != nil {
+		t.Fatalf("saveSnapshot: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-8], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := buffer.NewRegistry()
+	defer restarted.Close()
+	loadSnapshot(restarted, path)
+	if n := len(restarted.Catalog()); n != 0 {
+		t.Fatalf("truncated snapshot loaded %d series, want none", n)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("truncated snapshot left in place: %v", err)
+	}
+	if _, err := os.Stat(path + ".bad"); err != nil {
+		t.Fatalf("truncated snapshot not set aside: %v", err)
+	}
+}
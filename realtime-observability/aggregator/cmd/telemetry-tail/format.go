@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yourorg/aggregator/wsclient"
+)
+
+// row is one displayed series value
+type row struct {
+	Key   string `json:"key"`
+	Kind  string `json:"kind"`
+	Ts    int64  `json:"ts"`
+	Value string `json:"value"`
+}
+
+// filter selects series by service and metric globs (path.Match syntax)
+type filter struct {
+	service string
+	metric  string
+}
+
+func (f filter) match(key string) bool {
+	service, metric, ok := strings.Cut(key, "/")
+	if !ok {
+		return false
+	}
+	// Percentile keys carry a ":p99" or ":avg" suffix
+	if i := strings.LastIndexByte(metric, ':'); i >= 0 {
+		metric = metric[:i]
+	}
+	okService, _ := path.Match(f.service, service)
+	okMetric, _ := path.Match(f.metric, metric)
+	return okService && okMetric
+}
+
+// rows flattens the matching series of a snapshot, sorted by key
+func rows(snap wsclient.Snapshot, f filter) []row {
+	var result []row
+	add := func(key, kind string, ts int64, value string) {
+		if f.match(key) {
+			result = append(result, row{Key: key, Kind: kind, Ts: ts, Value: value})
+		}
+	}
+
+	for key, s := range snap.Gauges {
+		add(key, "gauge", s.Ts, sampleValue(s))
+	}
+	for key, s := range snap.Counters {
+		add(key, "counter", s.Ts, sampleValue(s))
+	}
+	for key, h := range snap.Histograms {
+		add(key, "histogram", h.Ts, histogramValue(h))
+	}
+	for key, p := range snap.Percentiles {
+		value := formatFloat(p.Val)
+		if p.LowConfidence {
+			value += " (low confidence)"
+		}
+		add(key, "percentile", p.Ts, value)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Key != result[j].Key {
+			return result[i].Key < result[j].Key
+		}
+		return result[i].Kind < result[j].Kind
+	})
+	return result
+}
+
+func sampleValue(s wsclient.Sample) string {
+	switch {
+	case s.Marker != "":
+		return "<" + s.Marker + ">"
+	case s.Exact != "":
+		return s.Exact
+	default:
+		return formatFloat(s.Val)
+	}
+}
+
+// histogramValue summarizes a window as its observation count, plus the
+// mean when the agent sent a sum
+func histogramValue(h wsclient.HistogramData) string {
+	if h.Marker != "" {
+		return "<" + h.Marker + ">"
+	}
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	value := "n=" + strconv.FormatUint(count, 10)
+	if h.Sum != nil && h.Count != nil && *h.Count > 0 {
+		value += " avg=" + formatFloat(*h.Sum/float64(*h.Count))
+	}
+	return value
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+// formatter writes one update in an output format
+type formatter interface {
+	write(w io.Writer, snap wsclient.Snapshot, rows []row, status string) error
+}
+
+// tableFormat redraws aligned columns in place; with once set it prints a
+// single table without terminal control codes
+type tableFormat struct {
+	once bool
+}
+
+func (t tableFormat) write(w io.Writer, snap wsclient.Snapshot, rows []row, status string) error {
+	if !t.once {
+		// Home the cursor and clear the screen
+		fmt.Fprint(w, "\033[H\033[2J")
+		fmt.Fprintf(w, "%s  %s  %d series\n\n", time.Unix(0, snap.Timestamp).Format("15:04:05.000"), status, len(rows))
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIES\tKIND\tVALUE\tAGE")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Key, r.Kind, r.Value, age(snap.Timestamp, r.Ts))
+	}
+	return tw.Flush()
+}
+
+// age is how old a sample was when the snapshot was taken
+func age(now, ts int64) string {
+	if ts <= 0 || now < ts {
+		return "-"
+	}
+	return time.Duration(now - ts).Round(time.Millisecond).String()
+}
+
+// linesFormat prints one "time key kind value" line per series per update,
+// for piping into grep or awk
+type linesFormat struct{}
+
+func (linesFormat) write(w io.Writer, snap wsclient.Snapshot, rows []row, _ string) error {
+	ts := time.Unix(0, snap.Timestamp).UTC().Format(time.RFC3339Nano)
+	for _, r := range rows {
+		if _, err := fmt.Fprintf(w, "%s %s %s %s\n", ts, r.Key, r.Kind, r.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonFormat prints one JSON object per update
+type jsonFormat struct{}
+
+func (jsonFormat) write(w io.Writer, snap wsclient.Snapshot, rows []row, _ string) error {
+	if rows == nil {
+		rows = []row{}
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"timestamp": snap.Timestamp,
+		"series":    rows,
+	})
+}
+
+func newFormatter(name string, once bool) (formatter, error) {
+	switch name {
+	case "table":
+		return tableFormat{once: once}, nil
+	case "lines":
+		return linesFormat{}, nil
+	case "json":
+		return jsonFormat{}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q (want table, lines or json)", name)
+}
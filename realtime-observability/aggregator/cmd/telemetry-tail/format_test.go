@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/yourorg/aggregator/wsclient"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// fixtureSnapshot decodes testdata/snapshot.json, a v2 snapshot frame
+// holding each kind of series, gap markers and a percentile
+func fixtureSnapshot(t *testing.T) wsclient.Snapshot {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "snapshot.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap wsclient.Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	return snap
+}
+
+// checkGolden compares got with testdata/name
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s changed\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestFormatsGolden(t *testing.T) {
+	snap := fixtureSnapshot(t)
+	all := rows(snap, filter{service: "*", metric: "*"})
+	for _, name := range []string{"table", "lines", "json"} {
+		t.Run(name, func(t *testing.T) {
+			out, err := newFormatter(name, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := out.write(&buf, snap, all, "connected"); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, name+".txt", buf.Bytes())
+		})
+	}
+}
+
+func TestRowsFilter(t *testing.T) {
+	snap := fixtureSnapshot(t)
+	got := rows(snap, filter{service: "checkout", metric: "lat*"})
+	var keys []string
+	for _, r := range got {
+		keys = append(keys, r.Key+" "+r.Kind)
+	}
+	// The percentile's ":p99" suffix does not stop its metric matching
+	want := []string{"checkout/latency histogram", "checkout/latency:p99 percentile"}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("rows = %v, want %v", keys, want)
+	}
+}
+
+func TestTableRedrawsInPlace(t *testing.T) {
+	snap := fixtureSnapshot(t)
+	var buf bytes.Buffer
+	if err := (tableFormat{}).write(&buf, snap, nil, "reconnecting"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("\033[H\033[2J")) || !bytes.Contains(buf.Bytes(), []byte("reconnecting  0 series")) {
+		t.Fatalf("live table = %q, want a cleared screen and the status line", buf.String())
+	}
+}
+
+func TestNewFormatterRejectsUnknown(t *testing.T) {
+	if _, err := newFormatter("csv", false); err == nil {
+		t.Fatal("newFormatter accepted csv")
+	}
+}
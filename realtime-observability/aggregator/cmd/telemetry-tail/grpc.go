@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/yourorg/aggregator/wsclient"
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcSource streams snapshots from the TelemetryQuery Watch RPC, converted
+// to the WS client's types so the formatters serve both transports
+type grpcSource struct {
+	conn    *grpc.ClientConn
+	client  pb.TelemetryQueryClient
+	ctx     context.Context
+	dropped atomic.Uint64
+}
+
+func dialGRPC(ctx context.Context, addr, apiKey string) (*grpcSource, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", apiKey)
+	}
+	return &grpcSource{conn: conn, client: pb.NewTelemetryQueryClient(conn), ctx: ctx}, nil
+}
+
+func (g *grpcSource) Close() error {
+	return g.conn.Close()
+}
+
+// latest fetches the current values once
+func (g *grpcSource) latest(subs []wsclient.Subscription) (wsclient.Snapshot, error) {
+	snap, err := g.client.GetLatest(g.ctx, &pb.GetLatestRequest{Subscriptions: querySubscriptions(subs)})
+	if err != nil {
+		return wsclient.Snapshot{}, err
+	}
+	return fromQuery(snap), nil
+}
+
+// watch streams snapshots until ctx ends, re-opening the stream with
+// backoff when it fails; the channel is closed when ctx ends
+func (g *grpcSource) watch(subs []wsclient.Subscription, onStatus func(string)) <-chan wsclient.Snapshot {
+	out := make(chan wsclient.Snapshot, 1)
+	req := &pb.WatchRequest{Subscriptions: querySubscriptions(subs)}
+
+	go func() {
+		defer close(out)
+		backoff := wsclient.DefaultMinBackoff
+		for {
+			stream, err := g.client.Watch(g.ctx, req)
+			for err == nil {
+				var snap *pb.QuerySnapshot
+				if snap, err = stream.Recv(); err != nil {
+					break
+				}
+				onStatus("live")
+				backoff = wsclient.DefaultMinBackoff
+				g.dropped.Add(snap.Skipped)
+				g.deliver(out, fromQuery(snap))
+			}
+			if g.ctx.Err() != nil {
+				return
+			}
+			onStatus("reconnecting…")
+			log.Printf("reconnecting… (%v)", err)
+			select {
+			case <-g.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, wsclient.DefaultMaxBackoff)
+		}
+	}()
+	return out
+}
+
+// deliver keeps only the newest snapshot pending, like the WS client
+func (g *grpcSource) deliver(out chan wsclient.Snapshot, snap wsclient.Snapshot) {
+	for {
+		select {
+		case out <- snap:
+			return
+		default:
+		}
+		select {
+		case <-out:
+			g.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+func querySubscriptions(subs []wsclient.Subscription) []*pb.Subscription {
+	result := make([]*pb.Subscription, 0, len(subs))
+	for _, sub := range subs {
+		result = append(result, &pb.Subscription{
+			Service:     sub.Service,
+			Metric:      sub.Metric,
+			Percentiles: sub.Percentiles,
+			WindowMs:    sub.WindowMs,
+		})
+	}
+	return result
+}
+
+// fromQuery converts a query snapshot to the WS snapshot shape
+func fromQuery(q *pb.QuerySnapshot) wsclient.Snapshot {
+	snap := wsclient.Snapshot{
+		Timestamp:   int64(q.TimestampNs),
+		Gauges:      make(map[string]wsclient.Sample),
+		Counters:    make(map[string]wsclient.Sample),
+		Histograms:  make(map[string]wsclient.HistogramData),
+		Percentiles: make(map[string]wsclient.Percentile),
+	}
+	for _, v := range q.Series {
+		key := v.Service + "/" + v.Metric
+		ts := int64(v.Sample.GetTimestampNs())
+		switch v.Kind {
+		case "gauge":
+			snap.Gauges[key] = wsclient.Sample{Ts: ts, Val: v.Sample.GetGauge(), Marker: v.Marker}
+		case "counter":
+			s := wsclient.Sample{Ts: ts, Marker: v.Marker}
+			if f, ok := v.Sample.GetValue().(*pb.MetricSample_FloatCounter); ok {
+				s.Val = f.FloatCounter
+			} else if v.Marker == "" {
+				s.Val = float64(v.Sample.GetCounter())
+				s.Exact = strconv.FormatUint(v.Sample.GetCounter(), 10)
+			}
+			snap.Counters[key] = s
+		case "histogram":
+			h := wsclient.HistogramData{Ts: ts, Marker: v.Marker}
+			if hist := v.Sample.GetHistogram(); hist != nil {
+				h.Bounds, h.Counts = hist.Bounds, hist.Counts
+				h.Sum, h.Count = hist.Sum, hist.Count
+			}
+			snap.Histograms[key] = h
+		}
+	}
+	for _, p := range q.Percentiles {
+		snap.Percentiles[p.Service+"/"+p.Metric+":"+p.Stat] = wsclient.Percentile{
+			Ts:            int64(p.TimestampNs),
+			Val:           p.Value,
+			Count:         p.Count,
+			LowConfidence: p.LowConfidence,
+		}
+	}
+	return snap
+}
@@ -0,0 +1,177 @@
+// telemetry-tail streams live metrics from the aggregator's WebSocket hub
+// to the terminal.
+//
+//	telemetry-tail --addr ws://agg:8080/ws --service checkout --metric 'latency*' --interval 1s
+//	telemetry-tail --grpc agg:9000 --service checkout --metric latency --percentiles 50,99
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/yourorg/aggregator/wsclient"
+)
+
+func main() {
+	addr := flag.String("addr", "ws://localhost:8080/ws", "aggregator WebSocket URL")
+	grpcAddr := flag.String("grpc", "", "read from the gRPC query API at host:port instead of --addr")
+	apiKey := flag.String("api-key", os.Getenv("TELEMETRY_API_KEY"), "API key sent as x-api-key")
+	service := flag.String("service", "*", "service glob")
+	metric := flag.String("metric", "*", "metric glob")
+	interval := flag.Duration("interval", time.Second, "minimum time between updates (0 = every snapshot)")
+	format := flag.String("format", "table", "output format: table, lines or json")
+	percentiles := flag.String("percentiles", "", "comma-separated histogram percentiles, e.g. 50,99 (needs an exact --service and --metric)")
+	latest := flag.Bool("latest", false, "print the current values once and exit")
+	flag.Parse()
+
+	log.SetFlags(0)
+	log.SetPrefix("telemetry-tail: ")
+
+	out, err := newFormatter(*format, *latest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	subs, err := subscriptions(*service, *metric, *percentiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	f := filter{service: *service, metric: *metric}
+	var status atomic.Value
+	status.Store("live")
+	var snapshots <-chan wsclient.Snapshot
+	var dropped func() uint64
+	if *grpcAddr != "" {
+		src, err := dialGRPC(ctx, *grpcAddr, *apiKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer src.Close()
+		dropped = src.dropped.Load
+		if *latest {
+			snap, err := src.latest(subs)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := out.write(os.Stdout, snap, rows(snap, f), "live"); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		snapshots = src.watch(subs, func(s string) { status.Store(s) })
+	} else {
+		client, err := wsclient.Dial(*addr, wsclient.Options{
+			APIKey: *apiKey,
+			OnEvent: func(e wsclient.Event) {
+				if e.Type == "error" {
+					log.Printf("server error %s: %s", e.Code, e.Message)
+				}
+			},
+			OnDisconnect: func(err error) {
+				status.Store("reconnecting…")
+				log.Printf("reconnecting… (%v)", err)
+			},
+			OnConnect: func() {
+				status.Store("live")
+				log.Printf("reconnected")
+			},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer client.Close()
+		dropped = client.Dropped
+
+		if snapshots, err = client.Subscribe(subs...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	write := func(snap wsclient.Snapshot) {
+		s := status.Load().(string)
+		if n := dropped(); n > 0 {
+			s += fmt.Sprintf(" (%d dropped)", n)
+		}
+		if err := out.write(os.Stdout, snap, rows(snap, f), s); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *latest {
+		select {
+		case snap := <-snapshots:
+			write(snap)
+		case <-time.After(10 * time.Second):
+			log.Fatal("no snapshot within 10s")
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	// Coalesce snapshots so the terminal updates at most once per interval
+	var tick <-chan time.Time
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var pending *wsclient.Snapshot
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case snap, ok := <-snapshots:
+			if !ok {
+				return
+			}
+			if tick == nil {
+				write(snap)
+			} else {
+				pending = &snap
+			}
+		case <-tick:
+			if pending != nil {
+				write(*pending)
+				pending = nil
+			}
+		}
+	}
+}
+
+// subscriptions narrows the server stream when the selection is exact;
+// globs are filtered client side over the full stream
+func subscriptions(service, metric, percentiles string) ([]wsclient.Subscription, error) {
+	exact := !strings.ContainsAny(service, "*?[") && !strings.ContainsAny(metric, "*?[")
+
+	var qs []float64
+	for _, field := range strings.Split(percentiles, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		q, err := strconv.ParseFloat(field, 64)
+		if err != nil || q <= 0 || q > 100 {
+			return nil, fmt.Errorf("invalid percentile %q", field)
+		}
+		qs = append(qs, q)
+	}
+	if len(qs) > 0 && !exact {
+		return nil, fmt.Errorf("--percentiles needs an exact --service and --metric")
+	}
+
+	if !exact {
+		return nil, nil
+	}
+	return []wsclient.Subscription{{Service: service, Metric: metric, Percentiles: qs}}, nil
+}
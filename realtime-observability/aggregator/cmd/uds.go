@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// listenUnix binds the gRPC Unix socket at path, first removing a socket
+// file left by an aggregator that did not exit cleanly. A socket something
+// still answers on is only taken over by a handoff child, whose parent is
+// about to drain; any other file at path is left alone.
+func listenUnix(path string) (*net.UnixListener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			if !inHandoffChild() {
+				return nil, fmt.Errorf("%s is in use by another process", path)
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	return net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+}
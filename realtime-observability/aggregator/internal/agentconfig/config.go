@@ -0,0 +1,198 @@
+// Package agentconfig holds the per-service overrides the aggregator pushes
+// to agents through the WatchConfig RPC
+package agentconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// DefaultLease is how long agents keep a pushed config without hearing
+// it again
+const DefaultLease = 30 * time.Second
+
+// Config overrides part of the local configuration of one service's
+// agents. Zero fields override nothing.
+type Config struct {
+	// PushIntervalMs replaces the agents' push interval
+	PushIntervalMs int64 `json:"push_interval_ms"`
+	// MetricDenylist names metrics left out of batches; a trailing *
+	// matches a prefix
+	MetricDenylist []string `json:"metric_denylist"`
+	// HistogramSampleRate replaces the sample rate of the named histograms
+	HistogramSampleRate map[string]float64 `json:"histogram_sample_rate"`
+	// FeatureFlags sets flags the agents declare; others are ignored
+	FeatureFlags map[string]bool `json:"feature_flags"`
+}
+
+// Validate checks a configuration for values agents cannot apply
+func (c Config) Validate() error {
+	if c.PushIntervalMs < 0 || c.PushIntervalMs > 1<<31 {
+		return fmt.Errorf("push_interval_ms %d is out of range", c.PushIntervalMs)
+	}
+	for _, pattern := range c.MetricDenylist {
+		if pattern == "" || pattern == "*" {
+			return fmt.Errorf("metric_denylist entry %q would match every metric", pattern)
+		}
+	}
+	for name, rate := range c.HistogramSampleRate {
+		if !(rate > 0 && rate <= 1) {
+			return fmt.Errorf("histogram_sample_rate for %q: %v is not in (0, 1]", name, rate)
+		}
+	}
+	for name := range c.FeatureFlags {
+		if name == "" {
+			return fmt.Errorf("feature_flags has an empty name")
+		}
+	}
+	return nil
+}
+
+// Version hashes the configuration, so a reload that leaves a service's
+// section alone, or an aggregator restart, keeps its version. It is never
+// 0, which agents read as no overrides.
+func (c Config) Version() uint64 {
+	// Maps marshal with sorted keys, so equal configs hash alike
+	data, _ := json.Marshal(c)
+	h := fnv.New64a()
+	h.Write(data)
+	return max(h.Sum64(), 1)
+}
+
+// Proto returns the document sent to agents, holding for lease
+func (c Config) Proto(lease time.Duration) *pb.AgentConfig {
+	return &pb.AgentConfig{
+		Version:             c.Version(),
+		PushIntervalMs:      uint32(c.PushIntervalMs),
+		MetricDenylist:      c.MetricDenylist,
+		HistogramSampleRate: c.HistogramSampleRate,
+		FeatureFlags:        c.FeatureFlags,
+		LeaseMs:             uint32(lease.Milliseconds()),
+	}
+}
+
+// Store holds the configurations of a file, reloaded when it changes
+type Store struct {
+	path  string
+	lease time.Duration
+
+	data     []byte
+	services map[string]Config
+	// changed is closed, and replaced, by a reload that changes the file
+	changed chan struct{}
+	mu      sync.RWMutex
+}
+
+// LoadFile reads {"services": {"name": {...}}} from path. Agents keep a
+// pushed config for lease, or DefaultLease when it is zero.
+func LoadFile(path string, lease time.Duration) (*Store, error) {
+	if lease <= 0 {
+		lease = DefaultLease
+	}
+	s := &Store{path: path, lease: lease, changed: make(chan struct{})}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseFile decodes and validates every service section
+func parseFile(data []byte) (map[string]Config, error) {
+	var file struct {
+		Services map[string]Config `json:"services"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for service, cfg := range file.Services {
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("service %q: %w", service, err)
+		}
+	}
+	if file.Services == nil {
+		file.Services = make(map[string]Config)
+	}
+	return file.Services, nil
+}
+
+// Reload re-reads the file and reports whether it changed. A file that
+// cannot be read or is invalid leaves the loaded configurations in place.
+func (s *Store) Reload() (bool, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	same := s.data != nil && bytes.Equal(data, s.data)
+	s.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	services, err := parseFile(data)
+	if err != nil {
+		return false, fmt.Errorf("parse %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data, s.services = data, services
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return true, nil
+}
+
+// Run reloads the file every interval
+func (s *Store) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changed, err := s.Reload()
+		switch {
+		case err != nil:
+			log.Printf("Agent config reload failed, keeping the previous one: %v", err)
+		case changed:
+			log.Printf("Reloaded agent config with %d services from %s", s.Len(), s.path)
+		}
+	}
+}
+
+// Len returns the number of services with a section
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.services)
+}
+
+// Lease returns how long agents keep a pushed config
+func (s *Store) Lease() time.Duration {
+	return s.lease
+}
+
+// Changed returns a channel closed by the next reload that changes the
+// file
+func (s *Store) Changed() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changed
+}
+
+// Document returns what a service's agents are sent: its section, or
+// version 0 to drop any overrides when it has none
+func (s *Store) Document(service string) *pb.AgentConfig {
+	s.mu.RLock()
+	cfg, ok := s.services[service]
+	s.mu.RUnlock()
+	if !ok {
+		return &pb.AgentConfig{LeaseMs: uint32(s.lease.Milliseconds())}
+	}
+	return cfg.Proto(s.lease)
+}
@@ -0,0 +1,64 @@
+package agentconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadKeepsVersionsAndLastGoodConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"services": {"checkout": {"push_interval_ms": 100, "feature_flags": {"b": true, "a": false}}}}`)
+	s, err := LoadFile(path, time.Second)
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	doc := s.Document("checkout")
+	if doc.Version == 0 || doc.PushIntervalMs != 100 || doc.LeaseMs != 1000 {
+		t.Fatalf("Document = %v, want a version, 100ms and a 1s lease", doc)
+	}
+	if other := s.Document("cart"); other.Version != 0 || other.LeaseMs != 1000 {
+		t.Fatalf("Document(cart) = %v, want version 0", other)
+	}
+
+	if changed, err := s.Reload(); changed || err != nil {
+		t.Fatalf("Reload of an unchanged file = %v, %v; want no change", changed, err)
+	}
+
+	// The same section, reformatted and beside a new one, keeps its version
+	changed := s.Changed()
+	write(`{"services": {
+		"cart": {"metric_denylist": ["debug_*"]},
+		"checkout": {"feature_flags": {"a": false, "b": true}, "push_interval_ms": 100}
+	}}`)
+	if ok, err := s.Reload(); !ok || err != nil {
+		t.Fatalf("Reload = %v, %v; want a change", ok, err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatal("Changed was not closed by the reload")
+	}
+	if got := s.Document("checkout").Version; got != doc.Version {
+		t.Fatalf("checkout version = %d after reload, want %d", got, doc.Version)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", s.Len())
+	}
+
+	// An invalid file leaves the loaded configs in place
+	write(`{"services": {"checkout": {"histogram_sample_rate": {"latency": 2}}}}`)
+	if _, err := s.Reload(); err == nil {
+		t.Fatal("Reload accepted a sample rate of 2")
+	}
+	if got := s.Document("checkout").Version; got != doc.Version {
+		t.Fatalf("checkout version = %d after a bad reload, want %d", got, doc.Version)
+	}
+}
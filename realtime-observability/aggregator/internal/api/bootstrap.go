@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultBootstrapTTL = 15 * time.Minute
+	maxBootstrapTTL     = 7 * 24 * time.Hour
+)
+
+// handleMintBootstrapToken creates a single-use bootstrap token scoped to a
+// service ({"service": "checkout", "ttl_seconds": 900})
+func (s *Server) handleMintBootstrapToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Service    string `json:"service"`
+		TTLSeconds int    `json:"ttl_seconds"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+	if body.Service == "" {
+		writeError(w, http.StatusBadRequest, "service is required")
+		return
+	}
+	ttl := defaultBootstrapTTL
+	if body.TTLSeconds > 0 {
+		ttl = time.Duration(body.TTLSeconds) * time.Second
+	}
+	if ttl > maxBootstrapTTL {
+		writeError(w, http.StatusBadRequest, "ttl_seconds may be at most 604800")
+		return
+	}
+
+	secret, token, err := s.auth.MintBootstrapToken(body.Service, ttl)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token":      secret,
+		"id":         token.ID,
+		"service":    token.Service,
+		"expires_at": token.ExpiresAt,
+	})
+}
+
+// handleListBootstrapTokens lists tokens without their secrets
+func (s *Server) handleListBootstrapTokens(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tokens": s.auth.BootstrapTokens()})
+}
+
+// handleRevokeBootstrapToken revokes a token and the keys issued from it
+func (s *Server) handleRevokeBootstrapToken(w http.ResponseWriter, r *http.Request) {
+	if !s.auth.RevokeBootstrapToken(r.PathValue("id")) {
+		writeError(w, http.StatusNotFound, "unknown bootstrap token")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+const (
+	// defaultCompareWindow is used when a compare request omits window
+	defaultCompareWindow = time.Minute
+
+	// defaultCompareStaleAfter flags instances quiet for longer; the
+	// staleness sweeper forgets them a little later
+	defaultCompareStaleAfter = 5 * time.Second
+)
+
+// compareMetric is how a requested metric is read from an instance's rings
+type compareMetric struct {
+	name string
+	kind string
+	// series is the ring's name: name, or the histogram behind latency_p99
+	series string
+	// quantile is set for a histogram read as a percentile
+	quantile float64
+}
+
+// instanceValue is one instance's windowed aggregate of a metric and where
+// it stands in the fleet
+type instanceValue struct {
+	Value         float64 `json:"value"`
+	ZScore        float64 `json:"z_score"`
+	RatioToMedian float64 `json:"ratio_to_median,omitempty"`
+}
+
+// instanceComparison is one instance in the compare endpoint
+type instanceComparison struct {
+	Instance   string                   `json:"instance"`
+	Attributes map[string]string        `json:"attributes,omitempty"`
+	LastSeen   time.Time                `json:"last_seen"`
+	Stale      bool                     `json:"stale"`
+	MaxAbsZ    float64                  `json:"max_abs_z"`
+	Metrics    map[string]instanceValue `json:"metrics"`
+}
+
+// fleetStats summarizes one metric over the live instances that have it
+type fleetStats struct {
+	Kind           string   `json:"kind"`
+	Instances      int      `json:"instances"`
+	Median         float64  `json:"median"`
+	Mean           float64  `json:"mean"`
+	Stddev         float64  `json:"stddev"`
+	Max            float64  `json:"max"`
+	MaxMedianRatio float64  `json:"max_median_ratio,omitempty"`
+	Ranking        []string `json:"ranking"`
+}
+
+// handleCompareInstances lists a service's instances side by side, each
+// with the windowed aggregate of the requested metrics and its z-score
+// against the live instances
+// (?metrics=latency_p99,rps,error_rate&window=60s&stale_after=5s)
+func (s *Server) handleCompareInstances(w http.ResponseWriter, r *http.Request) {
+	service := r.PathValue("service")
+	q := r.URL.Query()
+
+	var names []string
+	for _, name := range strings.Split(q.Get("metrics"), ",") {
+		if name = strings.TrimSpace(name); name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		writeError(w, http.StatusBadRequest, "metrics is required")
+		return
+	}
+	window, err := durationParam(q.Get("window"), defaultCompareWindow)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "window "+err.Error())
+		return
+	}
+	staleAfter, err := durationParam(q.Get("stale_after"), defaultCompareStaleAfter)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "stale_after "+err.Error())
+		return
+	}
+
+	metrics := make([]compareMetric, 0, len(names))
+	for _, name := range names {
+		m, ok := s.resolveCompareMetric(service, name)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no series %s/%s", service, name))
+			return
+		}
+		metrics = append(metrics, m)
+	}
+
+	now := time.Now()
+	instances := s.registry.Instances()[service]
+	if len(instances) == 0 {
+		writeError(w, http.StatusNotFound, "no instances of "+service)
+		return
+	}
+	result := make([]instanceComparison, 0, len(instances))
+	for _, inst := range instances {
+		c := instanceComparison{
+			Instance:   inst.Instance,
+			Attributes: inst.Attributes,
+			LastSeen:   inst.LastSeen,
+			Stale:      now.Sub(inst.LastSeen) > staleAfter,
+			Metrics:    make(map[string]instanceValue),
+		}
+		for _, m := range metrics {
+			if v, ok := s.windowedValue(service, inst.Instance, m, now.Add(-window).UnixNano(), window); ok {
+				c.Metrics[m.name] = instanceValue{Value: v}
+			}
+		}
+		result = append(result, c)
+	}
+
+	stats := make(map[string]fleetStats, len(metrics))
+	for _, m := range metrics {
+		stats[m.name] = rankInstances(result, m)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].MaxAbsZ > result[j].MaxAbsZ })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"service":        service,
+		"window_ms":      window.Milliseconds(),
+		"stale_after_ms": staleAfter.Milliseconds(),
+		"metrics":        stats,
+		"instances":      result,
+	})
+}
+
+// durationParam parses a duration such as 60s, or returns def for ""
+func durationParam(v string, def time.Duration) (time.Duration, error) {
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("must be a positive duration such as 60s")
+	}
+	return d, nil
+}
+
+// resolveCompareMetric finds the series behind a requested name: a gauge,
+// counter or histogram of that name, or name_p<q> for a percentile of a
+// histogram
+func (s *Server) resolveCompareMetric(service, name string) (compareMetric, bool) {
+	m := compareMetric{name: name, series: name}
+	if _, ok := s.registry.FindRing(service, name); ok {
+		m.kind = "gauge"
+		return m, true
+	}
+	if _, ok := s.registry.FindCounterRing(service, name); ok {
+		m.kind = "counter"
+		return m, true
+	}
+	if _, ok := s.registry.FindHistogramRing(service, name); ok {
+		m.kind = "histogram"
+		return m, true
+	}
+	i := strings.LastIndex(name, "_p")
+	if i <= 0 {
+		return m, false
+	}
+	q, err := strconv.ParseFloat(name[i+2:], 64)
+	if err != nil || q <= 0 || q > 100 {
+		return m, false
+	}
+	if _, ok := s.registry.FindHistogramRing(service, name[:i]); !ok {
+		return m, false
+	}
+	m.kind, m.series, m.quantile = "histogram", name[:i], q
+	return m, true
+}
+
+// windowedValue aggregates an instance's samples of m since since: a
+// gauge's mean, a counter's per-second rate, and a histogram's percentile,
+// or its mean when no percentile was asked for
+func (s *Server) windowedValue(service, instance string, m compareMetric, since int64, window time.Duration) (float64, bool) {
+	switch m.kind {
+	case "gauge":
+		ring, ok := s.registry.FindInstanceRing(service, instance, m.series)
+		if !ok {
+			return 0, false
+		}
+		var sum float64
+		var n int
+		for _, smp := range ring.SnapshotSince(since) {
+			if !smp.IsMarker() {
+				sum += smp.Val
+				n++
+			}
+		}
+		if n == 0 {
+			return 0, false
+		}
+		return sum / float64(n), true
+	case "counter":
+		ring, ok := s.registry.FindInstanceCounterRing(service, instance, m.series)
+		if !ok {
+			return 0, false
+		}
+		if latest, ok := ring.Latest(); !ok || latest.Ts < since {
+			return 0, false
+		}
+		return ring.RatePerSecond(window)
+	default:
+		ring, ok := s.registry.FindInstanceHistogramRing(service, instance, m.series)
+		if !ok {
+			return 0, false
+		}
+		h, ok := ring.MergeSince(since)
+		if !ok || h.Total() == 0 {
+			return 0, false
+		}
+		if m.quantile == 0 {
+			if mean, ok := h.Mean(); ok {
+				return mean, true
+			}
+			return buffer.Percentile(h.Bounds, h.Counts, 50), true
+		}
+		return buffer.Percentile(h.Bounds, h.Counts, m.quantile), true
+	}
+}
+
+// rankInstances computes the fleet statistics of m over the live instances
+// that have a value, fills in each one's z-score and ratio to the median,
+// and ranks them furthest from the mean first. Stale instances keep their
+// value but are left out of the statistics.
+func rankInstances(instances []instanceComparison, m compareMetric) fleetStats {
+	stats := fleetStats{Kind: m.kind, Ranking: []string{}}
+	var values []float64
+	for _, c := range instances {
+		if v, ok := c.Metrics[m.name]; ok && !c.Stale {
+			values = append(values, v.Value)
+		}
+	}
+	if len(values) == 0 {
+		return stats
+	}
+
+	sort.Float64s(values)
+	n := len(values)
+	stats.Instances = n
+	stats.Median = values[n/2]
+	if n%2 == 0 {
+		stats.Median = (values[n/2-1] + values[n/2]) / 2
+	}
+	stats.Max = values[n-1]
+	if stats.Median != 0 {
+		stats.MaxMedianRatio = stats.Max / stats.Median
+	}
+	for _, v := range values {
+		stats.Mean += v
+	}
+	stats.Mean /= float64(n)
+	for _, v := range values {
+		stats.Stddev += (v - stats.Mean) * (v - stats.Mean)
+	}
+	stats.Stddev = math.Sqrt(stats.Stddev / float64(n))
+
+	var ranked []*instanceComparison
+	for i := range instances {
+		c := &instances[i]
+		v, ok := c.Metrics[m.name]
+		if !ok {
+			continue
+		}
+		if stats.Stddev > 0 {
+			v.ZScore = (v.Value - stats.Mean) / stats.Stddev
+		}
+		if stats.Median != 0 {
+			v.RatioToMedian = v.Value / stats.Median
+		}
+		c.Metrics[m.name] = v
+		if !c.Stale {
+			c.MaxAbsZ = math.Max(c.MaxAbsZ, math.Abs(v.ZScore))
+			ranked = append(ranked, c)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return math.Abs(ranked[i].Metrics[m.name].ZScore) > math.Abs(ranked[j].Metrics[m.name].ZScore)
+	})
+	for _, c := range ranked {
+		stats.Ranking = append(stats.Ranking, c.Instance)
+	}
+	return stats
+}
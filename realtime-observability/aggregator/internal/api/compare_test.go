@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// compareResponse is the compare endpoint's body
+type compareResponse struct {
+	Metrics   map[string]fleetStats `json:"metrics"`
+	Instances []instanceComparison  `json:"instances"`
+}
+
+func TestCompareInstancesRanksDegradedInstance(t *testing.T) {
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	now := time.Now()
+	bounds := []float64{10, 50, 100, 500, 1000}
+
+	// pod-3 is slow and failing; pod-5 was as bad but stopped reporting
+	for i := 1; i <= 5; i++ {
+		instance := fmt.Sprintf("pod-%d", i)
+		degraded := i == 3 || i == 5
+		lastSeen := now
+		if i == 5 {
+			lastSeen = now.Add(-30 * time.Second)
+		}
+		registry.SeenInstance("checkout", instance, map[string]string{"pod": instance}, lastSeen)
+
+		for s := range 10 {
+			ts := lastSeen.Add(time.Duration(s-10) * time.Second).UnixNano()
+			errorRate, counts := 0.01, []uint64{80, 15, 5, 0, 0, 0}
+			if degraded {
+				errorRate, counts = 0.2, []uint64{0, 5, 15, 60, 20, 0}
+			}
+			if err := registry.PushGauge("checkout", instance, "error_rate", buffer.Sample{Ts: ts, Val: errorRate}); err != nil {
+				t.Fatal(err)
+			}
+			if err := registry.PushCounter("checkout", instance, "requests_total", buffer.CounterSample(ts, uint64(100*s))); err != nil {
+				t.Fatal(err)
+			}
+			if err := registry.PushHistogram("checkout", instance, "latency", buffer.HistogramData{Ts: ts, Bounds: bounds, Counts: counts}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s := &Server{registry: registry}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/services/{service}/instances/compare", s.handleCompareInstances)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/services/checkout/instances/compare?metrics=latency_p99,requests_total,error_rate&window=60s", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp compareResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Instances) != 5 || resp.Instances[0].Instance != "pod-3" {
+		t.Fatalf("instances ranked %v, want pod-3 first of 5", instanceNames(resp.Instances))
+	}
+	for _, name := range []string{"latency_p99", "error_rate"} {
+		stats := resp.Metrics[name]
+		if stats.Instances != 4 || len(stats.Ranking) != 4 || stats.Ranking[0] != "pod-3" {
+			t.Errorf("%s: %d live instances ranked %v, want pod-3 first of 4", name, stats.Instances, stats.Ranking)
+		}
+		if stats.MaxMedianRatio < 2 {
+			t.Errorf("%s: max/median = %v, want the outlier at least twice the median", name, stats.MaxMedianRatio)
+		}
+		if z := resp.Instances[0].Metrics[name].ZScore; z < 1.5 {
+			t.Errorf("%s: pod-3 z-score = %v, want at least 1.5", name, z)
+		}
+	}
+	if rate := resp.Instances[0].Metrics["requests_total"].Value; rate != 100 {
+		t.Errorf("requests_total rate = %v, want 100/s", rate)
+	}
+
+	stale := resp.Instances[len(resp.Instances)-1]
+	for _, c := range resp.Instances {
+		if c.Instance == "pod-5" {
+			stale = c
+		}
+	}
+	if v := stale.Metrics["error_rate"].Value; !stale.Stale || math.Abs(v-0.2) > 1e-9 {
+		t.Errorf("pod-5 = %+v, want it listed with its values and flagged stale", stale)
+	}
+	for _, c := range resp.Instances {
+		if c.Stale != (c.Instance == "pod-5") {
+			t.Errorf("%s stale = %v", c.Instance, c.Stale)
+		}
+	}
+}
+
+func TestCompareInstancesRejectsUnknownMetric(t *testing.T) {
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	registry.SeenInstance("checkout", "pod-1", nil, time.Now())
+	if err := registry.PushGauge("checkout", "pod-1", "cpu", buffer.Sample{Ts: time.Now().UnixNano(), Val: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{registry: registry}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/services/{service}/instances/compare", s.handleCompareInstances)
+	for query, want := range map[string]int{
+		"metrics=cpu":               http.StatusOK,
+		"metrics=cpu_p99":           http.StatusNotFound,
+		"metrics=nope":              http.StatusNotFound,
+		"":                          http.StatusBadRequest,
+		"metrics=cpu&window=soon":   http.StatusBadRequest,
+		"metrics=cpu&window=-5s":    http.StatusBadRequest,
+		"metrics=cpu&stale_after=x": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/services/checkout/instances/compare?"+query, nil))
+		if rec.Code != want {
+			t.Errorf("?%s: status = %d, want %d: %s", query, rec.Code, want, rec.Body)
+		}
+	}
+}
+
+func instanceNames(instances []instanceComparison) []string {
+	var names []string
+	for _, c := range instances {
+		names = append(names, c.Instance)
+	}
+	return names
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/yourorg/aggregator/internal/auth"
+	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/cardinality"
+	"github.com/yourorg/aggregator/internal/export"
+	"github.com/yourorg/aggregator/internal/health"
+	"github.com/yourorg/aggregator/internal/usage"
+	"github.com/yourorg/aggregator/internal/ws"
+)
+
+// Server exposes the registry over HTTP for tooling and admin tasks
+type Server struct {
+	registry *buffer.Registry
+	auth     *auth.Authenticator
+	rates    cardinality.RateSource
+	views    *ws.ViewStore
+	usage    *usage.Tracker
+	health   *health.Scorer
+}
+
+// NewServer creates a new API server
+func NewServer(registry *buffer.Registry, authenticator *auth.Authenticator, rates cardinality.RateSource, views *ws.ViewStore, usage *usage.Tracker) *Server {
+	return &Server{
+		registry: registry,
+		auth:     authenticator,
+		rates:    rates,
+		views:    views,
+		usage:    usage,
+	}
+}
+
+// SetHealth adds health scores to the summary endpoint
+func (s *Server) SetHealth(scorer *health.Scorer) {
+	s.health = scorer
+}
+
+// Register mounts the API routes on mux
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.Handle("GET /api/admin/state", s.auth.HTTPMiddleware(http.HandlerFunc(s.handleExportState)))
+	mux.Handle("GET /api/admin/usage", s.auth.HTTPMiddleware(http.HandlerFunc(s.handleUsage)))
+	mux.Handle("POST /api/admin/bootstrap-tokens", s.auth.AdminMiddleware(http.HandlerFunc(s.handleMintBootstrapToken)))
+	mux.Handle("GET /api/admin/bootstrap-tokens", s.auth.AdminMiddleware(http.HandlerFunc(s.handleListBootstrapTokens)))
+	mux.Handle("DELETE /api/admin/bootstrap-tokens/{id}", s.auth.AdminMiddleware(http.HandlerFunc(s.handleRevokeBootstrapToken)))
+	mux.Handle("GET /federate", s.auth.HTTPMiddleware(http.HandlerFunc(s.handleFederate)))
+	mux.HandleFunc("GET /api/v1/cardinality", s.handleCardinality)
+	mux.HandleFunc("GET /api/v1/exemplars", s.handleExemplars)
+	mux.HandleFunc("GET /api/v1/events", s.handleEvents)
+	mux.HandleFunc("GET /api/v1/summary", s.handleSummary)
+	mux.HandleFunc("GET /api/stats", s.handleStats)
+	mux.HandleFunc("GET /api/v1/services/{service}/instances/compare", s.handleCompareInstances)
+
+	mux.Handle("DELETE /api/v1/services/{service}", s.auth.HTTPMiddleware(http.HandlerFunc(s.handlePurgeService)))
+	mux.Handle("DELETE /api/v1/services/{service}/metrics/{metric}", s.auth.HTTPMiddleware(http.HandlerFunc(s.handlePurgeMetric)))
+
+	mux.Handle("GET /api/v1/views", s.auth.HTTPMiddleware(http.HandlerFunc(s.handleListViews)))
+	mux.Handle("GET /api/v1/views/{name}", s.auth.HTTPMiddleware(http.HandlerFunc(s.handleGetView)))
+	mux.Handle("PUT /api/v1/views/{name}", s.auth.HTTPMiddleware(http.HandlerFunc(s.handlePutView)))
+	mux.Handle("DELETE /api/v1/views/{name}", s.auth.HTTPMiddleware(http.HandlerFunc(s.handleDeleteView)))
+}
+
+// handleExportState streams the full registry state in the export format
+func (s *Server) handleExportState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="state.bin"`)
+	if err := s.registry.ExportState(w); err != nil {
+		log.Printf("State export failed: %v", err)
+	}
+}
+
+// handleFederate exposes raw recent samples in the Prometheus text format
+// (?match[]=service="checkout"&match[]=metric=~"latency.*"&last=1)
+func (s *Server) handleFederate(w http.ResponseWriter, r *http.Request) {
+	matchers, err := export.ParseMatchers(r.URL.Query()["match[]"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	last := 1
+	if v := r.URL.Query().Get("last"); v != "" {
+		if last, err = strconv.Atoi(v); err != nil || last < 1 {
+			writeError(w, http.StatusBadRequest, "last must be a positive integer")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := export.WriteFederation(w, s.registry, export.FederateOptions{
+		Matchers: matchers,
+		Last:     last,
+	}); err != nil {
+		log.Printf("Federation write failed: %v", err)
+	}
+}
+
+// handleUsage reports per-key ingest usage (?key=&by=hour|day)
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = usage.ByHour
+	}
+	if by != usage.ByHour && by != usage.ByDay {
+		writeError(w, http.StatusBadRequest, "by must be one of hour, day")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"by":    by,
+		"usage": s.usage.Report(r.URL.Query().Get("key"), by),
+	})
+}
+
+// handleCardinality reports series counts, ingest rates and memory estimates
+// per service plus a top-K view (?sort=series|samples_per_sec|bytes&limit=10)
+func (s *Server) handleCardinality(w http.ResponseWriter, r *http.Request) {
+	by := r.URL.Query().Get("sort")
+	if by == "" {
+		by = cardinality.SortSeries
+	}
+	if !cardinality.ValidSort(by) {
+		writeError(w, http.StatusBadRequest, "sort must be one of series, samples_per_sec, bytes")
+		return
+	}
+
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	report := cardinality.Build(s.registry, s.rates)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_series":    report.TotalSeries,
+		"samples_per_sec": report.SamplesPerSec,
+		"estimated_bytes": report.EstimatedBytes,
+		"services":        report.Services,
+		"top":             report.TopK(by, limit),
+		"sort":            by,
+	})
+}
+
+// serviceSummary is one service in the summary endpoint
+type serviceSummary struct {
+	Service   string              `json:"service"`
+	Series    buffer.SeriesCounts `json:"series"`
+	Health    *health.Result      `json:"health,omitempty"`
+	Instances []buffer.Instance   `json:"instances"`
+}
+
+// handleSummary lists every service with its series counts, latest health
+// evaluation and reporting instances with their resource attributes
+func (s *Server) handleSummary(w http.ResponseWriter, r *http.Request) {
+	counts := s.registry.SeriesCounts()
+	instances := s.registry.Instances()
+	services := make([]serviceSummary, 0, len(counts))
+	for service, c := range counts {
+		summary := serviceSummary{Service: service, Series: c, Instances: instances[service]}
+		if summary.Instances == nil {
+			summary.Instances = []buffer.Instance{}
+		}
+		if s.health != nil {
+			if result, ok := s.health.Result(service); ok {
+				summary.Health = &result
+			}
+		}
+		services = append(services, summary)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Service < services[j].Service })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"services": services})
+}
+
+// handleStats returns Registry.Stats: series counts, limits, ring sizes,
+// samples written and the memory estimate
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.registry.Stats())
+}
+
+// handleEvents returns the newest agent events, either for one service
+// or for every service that has them (?service=&limit=)
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := buffer.EventRingSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	if service := q.Get("service"); service != "" {
+		events := s.registry.Events(service, limit)
+		if events == nil {
+			events = []buffer.Event{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"service": service,
+			"events":  events,
+		})
+		return
+	}
+
+	result := make(map[string][]buffer.Event)
+	for _, service := range s.registry.EventServices() {
+		result[service] = s.registry.Events(service, limit)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": result})
+}
+
+// handleExemplars returns stored slow-request exemplars, either for one
+// metric (?service=&metric=) or for every metric that has them
+func (s *Server) handleExemplars(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := buffer.ExemplarRingSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	service, metric := q.Get("service"), q.Get("metric")
+	if service != "" && metric != "" {
+		exemplars := s.registry.Exemplars(service, metric, limit)
+		if exemplars == nil {
+			exemplars = []buffer.Exemplar{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"service":   service,
+			"metric":    metric,
+			"exemplars": exemplars,
+		})
+		return
+	}
+
+	result := make(map[string][]buffer.Exemplar)
+	for _, key := range s.registry.ExemplarKeys() {
+		if service != "" && key.Service != service {
+			continue
+		}
+		if metric != "" && key.Name != metric {
+			continue
+		}
+		result[key.String()] = s.registry.Exemplars(key.Service, key.Name, limit)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"exemplars": result})
+}
+
+// handlePurgeService deletes every series of a service (?dry_run=true reports only)
+func (s *Server) handlePurgeService(w http.ResponseWriter, r *http.Request) {
+	service := r.PathValue("service")
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	summary := s.registry.PurgeService(service, dryRun)
+	s.writePurge(w, service, "", dryRun, summary)
+}
+
+// handlePurgeMetric deletes one metric of a service (?dry_run=true reports only)
+func (s *Server) handlePurgeMetric(w http.ResponseWriter, r *http.Request) {
+	service, metric := r.PathValue("service"), r.PathValue("metric")
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	summary := s.registry.PurgeMetric(service, metric, dryRun)
+	s.writePurge(w, service, metric, dryRun, summary)
+}
+
+func (s *Server) writePurge(w http.ResponseWriter, service, metric string, dryRun bool, summary buffer.PurgeSummary) {
+	if summary.Total() == 0 {
+		writeError(w, http.StatusNotFound, "no matching series")
+		return
+	}
+	if !dryRun {
+		log.Printf("Purged %d series for service=%s metric=%s", summary.Total(), service, metric)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"service": service,
+		"metric":  metric,
+		"dry_run": dryRun,
+		"removed": summary,
+	})
+}
+
+// writeJSON encodes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// writeError writes a JSON error body
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/yourorg/aggregator/internal/ws"
+)
+
+// maxViewBody bounds view definition uploads
+const maxViewBody = 1 << 20
+
+// handleListViews returns all named views
+func (s *Server) handleListViews(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"views": s.views.List()})
+}
+
+// handleGetView returns a single view
+func (s *Server) handleGetView(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	subs, ok := s.views.Get(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown view")
+		return
+	}
+	writeJSON(w, http.StatusOK, ws.View{Name: name, Subscriptions: subs})
+}
+
+// handlePutView creates or replaces a view; connected subscribers pick up
+// the new definition on the next snapshot
+func (s *Server) handlePutView(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Subscriptions []ws.Subscription `json:"subscriptions"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxViewBody)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid view body: "+err.Error())
+		return
+	}
+
+	view := ws.View{Name: r.PathValue("name"), Subscriptions: body.Subscriptions}
+	if err := ws.ValidateView(view); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.views.Put(view)
+	writeJSON(w, http.StatusOK, view)
+}
+
+// handleDeleteView removes a view
+func (s *Server) handleDeleteView(w http.ResponseWriter, r *http.Request) {
+	if !s.views.Delete(r.PathValue("name")) {
+		writeError(w, http.StatusNotFound, "unknown view")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,39 +2,61 @@ package auth
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 
+	pb "github.com/yourorg/telemetry/gen/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
+// AnonymousKey is the key name reported when authentication is disabled
+const AnonymousKey = "anonymous"
+
 // Authenticator handles API key authentication
 type Authenticator struct {
-	apiKeys map[string]bool
-	enabled bool
+	apiKeys   map[string]bool
+	names     map[string]string
+	enabled   bool
+	bootstrap *bootstrapStore
 }
 
+type (
+	keyNameContextKey      struct{}
+	serviceScopeContextKey struct{}
+)
+
 // NewAuthenticator creates a new authenticator
 func NewAuthenticator() *Authenticator {
 	auth := &Authenticator{
-		apiKeys: make(map[string]bool),
-		enabled: false,
+		apiKeys:   make(map[string]bool),
+		names:     make(map[string]string),
+		enabled:   false,
+		bootstrap: newBootstrapStore(),
 	}
 
-	// Load API keys from environment
+	// Load API keys from environment; entries may be named as "name:key"
 	keysEnv := os.Getenv("TELEMETRY_API_KEYS")
 	if keysEnv != "" {
 		auth.enabled = true
 		keys := strings.Split(keysEnv, ",")
 		for _, key := range keys {
 			key = strings.TrimSpace(key)
-			if key != "" {
-				auth.apiKeys[key] = true
+			if key == "" {
+				continue
 			}
+			if name, secret, ok := strings.Cut(key, ":"); ok && name != "" && secret != "" {
+				auth.apiKeys[secret] = true
+				auth.names[secret] = name
+				continue
+			}
+			auth.apiKeys[key] = true
 		}
 		log.Printf("Authentication enabled with %d API keys", len(auth.apiKeys))
 	} else {
@@ -44,15 +66,74 @@ func NewAuthenticator() *Authenticator {
 	return auth
 }
 
-// ValidateAPIKey checks if the provided API key is valid
+// ValidateAPIKey checks if the provided API key is valid; keys issued by
+// ExchangeToken count until they expire or are revoked
 func (a *Authenticator) ValidateAPIKey(key string) bool {
 	if !a.enabled {
 		return true
 	}
-	return a.apiKeys[key]
+	if a.apiKeys[key] {
+		return true
+	}
+	_, ok := a.issued(key)
+	return ok
+}
+
+// ValidateAdminKey checks a key for admin endpoints; issued keys are
+// agent credentials and never qualify
+func (a *Authenticator) ValidateAdminKey(key string) bool {
+	return !a.enabled || a.apiKeys[key]
+}
+
+// ValidateReadKey checks a key for the query API; issued keys may only
+// report their own service and never read
+func (a *Authenticator) ValidateReadKey(key string) bool {
+	return !a.enabled || a.apiKeys[key]
+}
+
+// KeyName returns the configured name of an API key, or a short fingerprint
+// for unnamed keys so the secret never appears in reports or metric labels
+func (a *Authenticator) KeyName(key string) string {
+	if !a.enabled || key == "" {
+		return AnonymousKey
+	}
+	if name, ok := a.names[key]; ok {
+		return name
+	}
+	if service, ok := a.issued(key); ok {
+		return "issued:" + service
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// KeyNameFromContext returns the key name attached by the stream
+// interceptor, or AnonymousKey
+func KeyNameFromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(keyNameContextKey{}).(string); ok {
+		return name
+	}
+	return AnonymousKey
+}
+
+// ServiceScope returns the service an issued key may report for; ok is
+// false for configured keys
+func (a *Authenticator) ServiceScope(key string) (string, bool) {
+	if a.apiKeys[key] {
+		return "", false
+	}
+	return a.issued(key)
+}
+
+// ServiceScopeFromContext returns the service an issued key may report
+// for; ok is false for unrestricted keys
+func ServiceScopeFromContext(ctx context.Context) (string, bool) {
+	service, ok := ctx.Value(serviceScopeContextKey{}).(string)
+	return service, ok
 }
 
-// UnaryInterceptor returns a gRPC unary interceptor for authentication
+// UnaryInterceptor returns a gRPC unary interceptor for authentication.
+// ExchangeToken is exempt: the bootstrap token is its credential.
 func (a *Authenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context,
@@ -60,7 +141,10 @@ func (a *Authenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	) (interface{}, error) {
-		if err := a.authenticate(ctx); err != nil {
+		if info.FullMethod == pb.TelemetryIngestor_ExchangeToken_FullMethodName {
+			return handler(ctx, req)
+		}
+		if err := a.authenticate(ctx, info.FullMethod); err != nil {
 			return nil, err
 		}
 		return handler(ctx, req)
@@ -75,15 +159,41 @@ func (a *Authenticator) StreamInterceptor() grpc.StreamServerInterceptor {
 		info *grpc.StreamServerInfo,
 		handler grpc.StreamHandler,
 	) error {
-		if err := a.authenticate(ss.Context()); err != nil {
+		if err := a.authenticate(ss.Context(), info.FullMethod); err != nil {
 			return err
 		}
-		return handler(srv, ss)
+		return handler(srv, &namedStream{ServerStream: ss, ctx: a.withKeyName(ss.Context())})
 	}
 }
 
-// authenticate validates the API key from context metadata
-func (a *Authenticator) authenticate(ctx context.Context) error {
+// namedStream carries the caller's key name in its context
+type namedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *namedStream) Context() context.Context {
+	return s.ctx
+}
+
+// withKeyName attaches the name of the request's API key to ctx, and the
+// service scope of an issued key
+func (a *Authenticator) withKeyName(ctx context.Context) context.Context {
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if keys := md.Get("x-api-key"); len(keys) > 0 {
+			key = keys[0]
+		}
+	}
+	if service, ok := a.ServiceScope(key); ok {
+		ctx = context.WithValue(ctx, serviceScopeContextKey{}, service)
+	}
+	return context.WithValue(ctx, keyNameContextKey{}, a.KeyName(key))
+}
+
+// authenticate validates the API key from context metadata. TelemetryQuery
+// methods read every service, so they need a configured key.
+func (a *Authenticator) authenticate(ctx context.Context, fullMethod string) error {
 	if !a.enabled {
 		return nil
 	}
@@ -101,10 +211,50 @@ func (a *Authenticator) authenticate(ctx context.Context) error {
 	if !a.ValidateAPIKey(keys[0]) {
 		return status.Error(codes.PermissionDenied, "invalid API key")
 	}
+	if queryMethod(fullMethod) && !a.ValidateReadKey(keys[0]) {
+		return status.Error(codes.PermissionDenied, "issued keys cannot query")
+	}
 
 	return nil
 }
 
+// queryMethod reports whether a gRPC method belongs to TelemetryQuery
+func queryMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+pb.TelemetryQuery_ServiceDesc.ServiceName+"/")
+}
+
+// HTTPMiddleware rejects HTTP requests without a valid API key, taken from
+// the x-api-key header or a bearer token (what Prometheus scrapers send)
+func (a *Authenticator) HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.enabled && !a.ValidateAPIKey(RequestKey(r)) {
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminMiddleware is HTTPMiddleware restricted to configured keys
+func (a *Authenticator) AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.ValidateAdminKey(RequestKey(r)) {
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestKey returns the API key of an HTTP request, from the x-api-key
+// header or a bearer token
+func RequestKey(r *http.Request) string {
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
 // AddAPIKey adds a new API key at runtime
 func (a *Authenticator) AddAPIKey(key string) {
 	a.apiKeys[key] = true
@@ -114,6 +264,7 @@ func (a *Authenticator) AddAPIKey(key string) {
 // RemoveAPIKey removes an API key
 func (a *Authenticator) RemoveAPIKey(key string) {
 	delete(a.apiKeys, key)
+	delete(a.names, key)
 }
 
 // Enable enables authentication
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bootstrap defaults
+const (
+	DefaultIssuedKeyTTL  = time.Hour
+	DefaultMaxIssuedKeys = 10000
+)
+
+// Bootstrap errors
+var (
+	ErrTokenInvalid = errors.New("bootstrap token is invalid or expired")
+	ErrTokenUsed    = errors.New("bootstrap token has already been used")
+	ErrTooManyKeys  = errors.New("too many issued keys")
+)
+
+// BootstrapToken is a single-use credential an agent trades for its own
+// API key. Keys issued from it, and keys renewed from those, are revoked
+// together with it.
+type BootstrapToken struct {
+	ID        string    `json:"id"`
+	Service   string    `json:"service"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Used      bool      `json:"used"`
+	Revoked   bool      `json:"revoked"`
+	Keys      int       `json:"active_keys"`
+
+	secret string
+}
+
+// issuedKey is a per-instance API key handed out by ExchangeToken
+type issuedKey struct {
+	parent    *BootstrapToken
+	instance  string
+	expiresAt time.Time
+}
+
+// bootstrapStore tracks bootstrap tokens and the keys issued from them
+type bootstrapStore struct {
+	tokens  map[string]*BootstrapToken // by secret
+	byID    map[string]*BootstrapToken
+	keys    map[string]*issuedKey
+	keyTTL  time.Duration
+	maxKeys int
+	now     func() time.Time
+	mu      sync.Mutex
+}
+
+func newBootstrapStore() *bootstrapStore {
+	return &bootstrapStore{
+		tokens:  make(map[string]*BootstrapToken),
+		byID:    make(map[string]*BootstrapToken),
+		keys:    make(map[string]*issuedKey),
+		keyTTL:  DefaultIssuedKeyTTL,
+		maxKeys: DefaultMaxIssuedKeys,
+		now:     time.Now,
+	}
+}
+
+// SetIssuedKeyLimits sets the lifetime of keys issued by ExchangeToken and
+// how many may be live at once
+func (a *Authenticator) SetIssuedKeyLimits(ttl time.Duration, maxKeys int) {
+	a.bootstrap.mu.Lock()
+	defer a.bootstrap.mu.Unlock()
+	if ttl > 0 {
+		a.bootstrap.keyTTL = ttl
+	}
+	if maxKeys > 0 {
+		a.bootstrap.maxKeys = maxKeys
+	}
+}
+
+// MintBootstrapToken creates a single-use token that an agent reporting as
+// service can exchange within ttl. The secret is returned only here.
+func (a *Authenticator) MintBootstrapToken(service string, ttl time.Duration) (string, BootstrapToken, error) {
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", BootstrapToken{}, err
+	}
+	id, err := randomHex(6)
+	if err != nil {
+		return "", BootstrapToken{}, err
+	}
+
+	b := a.bootstrap
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cleanup()
+	tok := &BootstrapToken{
+		ID:        id,
+		Service:   service,
+		ExpiresAt: b.now().Add(ttl),
+		secret:    "bt_" + secret,
+	}
+	b.tokens[tok.secret] = tok
+	b.byID[id] = tok
+	return tok.secret, *tok, nil
+}
+
+// BootstrapTokens lists tokens that are unexpired or still have live keys
+func (a *Authenticator) BootstrapTokens() []BootstrapToken {
+	b := a.bootstrap
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cleanup()
+	result := make([]BootstrapToken, 0, len(b.byID))
+	for _, tok := range b.byID {
+		result = append(result, *tok)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ExpiresAt.Before(result[j].ExpiresAt) })
+	return result
+}
+
+// RevokeBootstrapToken revokes a token and every key issued from it. It
+// reports whether the token was known.
+func (a *Authenticator) RevokeBootstrapToken(id string) bool {
+	b := a.bootstrap
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tok, ok := b.byID[id]
+	if !ok {
+		return false
+	}
+	tok.Revoked = true
+	for key, k := range b.keys {
+		if k.parent == tok {
+			delete(b.keys, key)
+		}
+	}
+	tok.Keys = 0
+	return true
+}
+
+// ExchangeToken trades an unused bootstrap token, or a live key issued from
+// one, for a new per-instance key. A renewed key leaves the old one valid
+// until it expires so in-flight streams are not cut off.
+func (a *Authenticator) ExchangeToken(bootstrapToken, currentKey, instance string) (string, time.Time, string, error) {
+	b := a.bootstrap
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cleanup()
+	now := b.now()
+
+	var parent *BootstrapToken
+	if currentKey != "" {
+		k, ok := b.keys[currentKey]
+		if !ok || !now.Before(k.expiresAt) {
+			return "", time.Time{}, "", ErrTokenInvalid
+		}
+		parent = k.parent
+	} else {
+		tok, ok := b.tokens[bootstrapToken]
+		if !ok || tok.Revoked || !now.Before(tok.ExpiresAt) {
+			return "", time.Time{}, "", ErrTokenInvalid
+		}
+		if tok.Used {
+			return "", time.Time{}, "", ErrTokenUsed
+		}
+		parent = tok
+	}
+	if len(b.keys) >= b.maxKeys {
+		return "", time.Time{}, "", ErrTooManyKeys
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", time.Time{}, "", err
+	}
+	key := "ik_" + secret
+	expires := now.Add(b.keyTTL)
+	b.keys[key] = &issuedKey{parent: parent, instance: instance, expiresAt: expires}
+	parent.Used = true
+	parent.Keys++
+	return key, expires, parent.Service, nil
+}
+
+// issued returns the service an issued key is scoped to
+func (a *Authenticator) issued(key string) (string, bool) {
+	b := a.bootstrap
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	k, ok := b.keys[key]
+	if !ok || !b.now().Before(k.expiresAt) {
+		return "", false
+	}
+	return k.parent.Service, true
+}
+
+// cleanup drops expired keys, and tokens that can no longer be exchanged
+// and have no live keys left; caller holds b.mu
+func (b *bootstrapStore) cleanup() {
+	now := b.now()
+	for key, k := range b.keys {
+		if !now.Before(k.expiresAt) {
+			delete(b.keys, key)
+			k.parent.Keys--
+		}
+	}
+	for secret, tok := range b.tokens {
+		exchangeable := !tok.Used && !tok.Revoked && now.Before(tok.ExpiresAt)
+		if !exchangeable && tok.Keys == 0 {
+			delete(b.tokens, secret)
+			delete(b.byID, tok.ID)
+		}
+	}
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock makes the bootstrap store read its time from the returned
+// pointer
+func fakeClock(a *Authenticator) *time.Time {
+	now := time.Unix(1000, 0)
+	a.bootstrap.now = func() time.Time { return now }
+	return &now
+}
+
+func TestExchangeAndRenew(t *testing.T) {
+	a := NewAuthenticator()
+	now := fakeClock(a)
+	a.SetIssuedKeyLimits(10*time.Minute, 0)
+
+	secret, tok, err := a.MintBootstrapToken("checkout", time.Minute)
+	if err != nil {
+		t.Fatalf("MintBootstrapToken: %v", err)
+	}
+	if !tok.ExpiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("token expires %v, want a minute from now", tok.ExpiresAt)
+	}
+
+	key, expires, service, err := a.ExchangeToken(secret, "", "pod-1")
+	if err != nil || service != "checkout" || !expires.Equal(now.Add(10*time.Minute)) {
+		t.Fatalf("ExchangeToken = %v, %v, %v; want checkout for 10m", expires, service, err)
+	}
+	if scope, ok := a.ServiceScope(key); !ok || scope != "checkout" {
+		t.Fatalf("ServiceScope = %q, %v; want checkout", scope, ok)
+	}
+
+	// Renewal past the token's own expiry; the old key stays valid
+	*now = now.Add(5 * time.Minute)
+	renewed, _, service, err := a.ExchangeToken("", key, "pod-1")
+	if err != nil || service != "checkout" || renewed == key {
+		t.Fatalf("renewal = %q, %q, %v; want a new checkout key", renewed, service, err)
+	}
+	if _, ok := a.ServiceScope(key); !ok {
+		t.Fatal("renewal revoked the old key")
+	}
+	toks := a.BootstrapTokens()
+	if len(toks) != 1 || !toks[0].Used || toks[0].Keys != 2 {
+		t.Fatalf("BootstrapTokens = %+v, want one used token with 2 keys", toks)
+	}
+}
+
+func TestTokenReplayRejected(t *testing.T) {
+	a := NewAuthenticator()
+	fakeClock(a)
+
+	secret, tok, _ := a.MintBootstrapToken("checkout", time.Minute)
+	key, _, _, err := a.ExchangeToken(secret, "", "pod-1")
+	if err != nil {
+		t.Fatalf("ExchangeToken: %v", err)
+	}
+	if _, _, _, err := a.ExchangeToken(secret, "", "pod-2"); !errors.Is(err, ErrTokenUsed) {
+		t.Fatalf("replayed exchange = %v, want ErrTokenUsed", err)
+	}
+	if _, _, _, err := a.ExchangeToken("bt_unknown", "", "pod-2"); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("unknown token = %v, want ErrTokenInvalid", err)
+	}
+
+	// Revoking the token takes its keys along
+	if !a.RevokeBootstrapToken(tok.ID) {
+		t.Fatal("RevokeBootstrapToken did not know the token")
+	}
+	if _, ok := a.ServiceScope(key); ok {
+		t.Fatal("key of a revoked token is still valid")
+	}
+	if _, _, _, err := a.ExchangeToken("", key, "pod-1"); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("renewal after revocation = %v, want ErrTokenInvalid", err)
+	}
+}
+
+func TestTokenAndKeyExpiry(t *testing.T) {
+	a := NewAuthenticator()
+	now := fakeClock(a)
+	a.SetIssuedKeyLimits(time.Hour, 1)
+
+	late, _, _ := a.MintBootstrapToken("cart", time.Minute)
+	secret, _, _ := a.MintBootstrapToken("checkout", 2*time.Minute)
+
+	*now = now.Add(time.Minute)
+	if _, _, _, err := a.ExchangeToken(late, "", "pod-1"); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("exchange at the expiry = %v, want ErrTokenInvalid", err)
+	}
+	key, _, _, err := a.ExchangeToken(secret, "", "pod-1")
+	if err != nil {
+		t.Fatalf("ExchangeToken: %v", err)
+	}
+	if _, _, _, err := a.ExchangeToken("", key, "pod-1"); !errors.Is(err, ErrTooManyKeys) {
+		t.Fatalf("renewal over the key limit = %v, want ErrTooManyKeys", err)
+	}
+
+	*now = now.Add(time.Hour)
+	if _, ok := a.ServiceScope(key); ok {
+		t.Fatal("key is valid past its TTL")
+	}
+	if _, _, _, err := a.ExchangeToken("", key, "pod-1"); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("renewal of an expired key = %v, want ErrTokenInvalid", err)
+	}
+	// Neither token can be exchanged or has live keys
+	if toks := a.BootstrapTokens(); len(toks) != 0 {
+		t.Fatalf("BootstrapTokens = %+v, want none", toks)
+	}
+}
@@ -0,0 +1,464 @@
+package buffer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GaugeAggregation says how the instances of a service combine their
+// values of a gauge into the service's series
+type GaugeAggregation int
+
+const (
+	// GaugeAvg averages the instances' latest values
+	GaugeAvg GaugeAggregation = iota
+	// GaugeSum adds them up, for gauges such as request rates
+	GaugeSum
+)
+
+func (a GaugeAggregation) String() string {
+	if a == GaugeSum {
+		return "sum"
+	}
+	return "avg"
+}
+
+// DefaultGaugeAggregation applies to gauges not set with
+// SetGaugeAggregation; other gauges are averaged
+var DefaultGaugeAggregation = map[string]GaugeAggregation{
+	"rps":      GaugeSum,
+	"inflight": GaugeSum,
+}
+
+// ParseGaugeAggregation parses "metric=sum,metric=avg"
+func ParseGaugeAggregation(s string) (map[string]GaugeAggregation, error) {
+	result := make(map[string]GaugeAggregation)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, mode, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("gauge aggregation %q: expected metric=sum or metric=avg", entry)
+		}
+		switch mode {
+		case "sum":
+			result[name] = GaugeSum
+		case "avg":
+			result[name] = GaugeAvg
+		default:
+			return nil, fmt.Errorf("gauge aggregation %q: unknown mode %q", entry, mode)
+		}
+	}
+	return result, nil
+}
+
+// SetGaugeAggregation sets how gauges combine across instances, by metric
+// name without labels, on top of DefaultGaugeAggregation. It applies to
+// series created from now on.
+func (r *Registry) SetGaugeAggregation(modes map[string]GaugeAggregation) {
+	r.mu.Lock()
+	r.gaugeAggregation = modes
+	r.mu.Unlock()
+}
+
+// gaugeAggregationLocked returns the aggregation of a gauge series; caller
+// holds the lock
+func (r *Registry) gaugeAggregationLocked(series string) GaugeAggregation {
+	name, _ := SplitSeriesName(series)
+	if mode, ok := r.gaugeAggregation[name]; ok {
+		return mode
+	}
+	return DefaultGaugeAggregation[name]
+}
+
+// InstanceKey identifies one instance's series of a metric
+type InstanceKey struct {
+	Service  string
+	Instance string
+	Name     string
+}
+
+func (k InstanceKey) String() string {
+	return k.Service + "@" + k.Instance + "/" + k.Name
+}
+
+// Metric returns the key of the service series the instance feeds
+func (k InstanceKey) Metric() MetricKey {
+	return MetricKey{Service: k.Service, Name: k.Name}
+}
+
+// instanceSeries holds the per-instance rings behind a service's gauge or
+// counter series. mu serializes pushes so the aggregates reach the
+// service ring in order, and gap markers with them, so every ring has a
+// single writer.
+type instanceSeries struct {
+	mu    sync.Mutex
+	rings map[string]*Ring
+	size  int
+	order OrderPolicy
+	gauge GaugeAggregation
+
+	// last is the newest aggregate timestamp; total is a counter's running
+	// sum of the instances' increases
+	last  int64
+	total Sample
+}
+
+// instanceRing returns an instance's ring in the series of key, creating
+// it within the series limits, against which every instance ring counts.
+// A ring created for a series deleted meanwhile is not kept.
+func (r *Registry) instanceRing(series map[MetricKey]*instanceSeries, key MetricKey, s *instanceSeries, instance string) (*Ring, error) {
+	s.mu.Lock()
+	ring, ok := s.rings[instance]
+	s.mu.Unlock()
+	if ok {
+		return ring, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkLimitsLocked(key.Service); err != nil {
+		r.reject(key.Service)
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ring, ok = s.rings[instance]; ok {
+		return ring, nil
+	}
+	ring = NewRingWithPolicy(s.size, s.order)
+	if series[key] != s {
+		return ring, nil
+	}
+	s.rings[instance] = ring
+	r.countInstanceRingsLocked(key.Service, 1, ring.Cap())
+	return ring, nil
+}
+
+// countInstanceRingsLocked adds n instance rings of size slots, or removes
+// them for a negative n; caller holds the write lock
+func (r *Registry) countInstanceRingsLocked(service string, n, size int) {
+	c := r.serviceCounts(service)
+	c.Instances += n
+	c.slots += n * size
+	r.instanceRings += n
+}
+
+// dropInstanceSeriesLocked removes the per-instance rings behind a deleted
+// service series; caller holds the write lock
+func (r *Registry) dropInstanceSeriesLocked(series map[MetricKey]*instanceSeries, key MetricKey) {
+	s, ok := series[key]
+	if !ok {
+		return
+	}
+	delete(series, key)
+	s.mu.Lock()
+	r.countInstanceRingsLocked(key.Service, -len(s.rings), s.size)
+	s.mu.Unlock()
+}
+
+// stamp returns the timestamp for the next aggregate: ts, or the previous
+// aggregate's when an instance's clock is behind, so the service ring
+// does not drop it; caller holds mu
+func (s *instanceSeries) stamp(ts int64) int64 {
+	s.last = max(s.last, ts)
+	return s.last
+}
+
+// combine returns the gauge's aggregate over the instances' latest values;
+// ok is false when none has a value. Caller holds mu.
+func (s *instanceSeries) combine() (float64, bool) {
+	var sum float64
+	var n int
+	for _, ring := range s.rings {
+		if latest, ok := ring.Latest(); ok && !latest.IsMarker() {
+			sum += latest.Val
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	if s.gauge == GaugeAvg {
+		return sum / float64(n), true
+	}
+	return sum, true
+}
+
+// add adds an instance's counter increase from prev to s to the running
+// total, which turns float once any instance sends a float counter;
+// caller holds mu
+func (s *instanceSeries) add(prev, sample Sample) {
+	if sample.Float || prev.Float || s.total.Float {
+		s.total.Float = true
+		s.total.Val += sample.CounterIncrease(prev)
+		return
+	}
+	s.total.Count += sample.CounterDelta(prev)
+	s.total.Val = float64(s.total.Count)
+}
+
+// instanceSeriesFor returns the per-instance rings behind the service ring
+// of key in rings, creating them in series. A new counter's total starts
+// from the service ring's latest value so it does not appear to reset.
+// Like instanceRing, rings created for a service ring deleted meanwhile
+// are not kept, so a purge never leaves instances behind.
+func (r *Registry) instanceSeriesFor(series map[MetricKey]*instanceSeries, rings map[MetricKey]*Ring, key MetricKey, service *Ring) *instanceSeries {
+	r.mu.RLock()
+	s, ok := series[key]
+	r.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok = series[key]; ok {
+		return s
+	}
+	s = &instanceSeries{
+		rings: make(map[string]*Ring),
+		size:  r.ringSizeFor(key.Name, r.ringSize),
+		order: r.order,
+		gauge: r.gaugeAggregationLocked(key.Name),
+	}
+	if latest, ok := service.Latest(); ok && !latest.IsMarker() {
+		s.last = latest.Ts
+		s.total = latest
+	}
+	if rings[key] == service {
+		series[key] = s
+	}
+	return s
+}
+
+// PushGauge stores a gauge sample from an instance in its own ring, then
+// pushes the aggregate over the service's instances to the service's
+// ring, see GaugeAggregation. Without an instance the sample goes to the
+// service's ring as is. Either way the series' lock is held, so gap
+// markers never race the push. The error wraps ErrSeriesLimit when the
+// service ring or a new instance's ring is past the limits.
+func (r *Registry) PushGauge(service, instance, name string, sample Sample) error {
+	ring, err := r.TryGetRing(service, name)
+	if err != nil {
+		return err
+	}
+	key := MetricKey{Service: service, Name: name}
+	s := r.instanceSeriesFor(r.instanceGauges, r.gauges, key, ring)
+	if instance == "" {
+		s.mu.Lock()
+		ring.Push(sample)
+		s.mu.Unlock()
+		return nil
+	}
+
+	own, err := r.instanceRing(r.instanceGauges, key, s, instance)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	own.Push(sample)
+	if val, ok := s.combine(); ok {
+		ring.Push(Sample{Ts: s.stamp(sample.Ts), Val: val})
+	}
+	return nil
+}
+
+// PushCounter stores a counter sample from an instance in its own ring,
+// then pushes the sum of the service's instances to the service's ring.
+// The sum adds each instance's increase, so an instance restarting or
+// leaving does not make it go backwards. Without an instance the sample
+// goes to the service's ring as is. The error is PushGauge's.
+func (r *Registry) PushCounter(service, instance, name string, sample Sample) error {
+	ring, err := r.TryGetCounterRing(service, name)
+	if err != nil {
+		return err
+	}
+	key := MetricKey{Service: service, Name: name}
+	s := r.instanceSeriesFor(r.instanceCounters, r.counters, key, ring)
+	if instance == "" {
+		s.mu.Lock()
+		ring.Push(sample)
+		s.mu.Unlock()
+		return nil
+	}
+
+	own, err := r.instanceRing(r.instanceCounters, key, s, instance)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, seen := own.Latest()
+	if seen && sample.Ts < prev.Ts {
+		// Out of order: the instance's ring keeps or drops it by policy,
+		// but it is no increase
+		own.Push(sample)
+		return nil
+	}
+	if prev.IsMarker() {
+		// Back from a gap: the increase runs from the last value before it
+		prev, seen = own.latestValue()
+	}
+	own.Push(sample)
+	if !seen {
+		prev = Sample{}
+	}
+	s.add(prev, sample)
+	total := s.total
+	total.Ts = s.stamp(sample.Ts)
+	ring.Push(total)
+	return nil
+}
+
+// forgetInstanceLocked drops an instance's rings, so it leaves the
+// aggregates from their next push; caller holds the write lock
+func (r *Registry) forgetInstanceLocked(service, instance string) {
+	for _, series := range []map[MetricKey]*instanceSeries{r.instanceGauges, r.instanceCounters} {
+		for key, s := range series {
+			if key.Service != service {
+				continue
+			}
+			s.mu.Lock()
+			if ring, ok := s.rings[instance]; ok {
+				delete(s.rings, instance)
+				r.countInstanceRingsLocked(service, -1, ring.Cap())
+			}
+			s.mu.Unlock()
+		}
+	}
+	for key, s := range r.instanceHistograms {
+		if key.Service != service {
+			continue
+		}
+		s.mu.Lock()
+		if ring, ok := s.rings[instance]; ok {
+			delete(s.rings, instance)
+			r.countInstanceHistogramRingsLocked(service, -1, ring.Cap())
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ListInstances returns, sorted, the instances with series of a service
+func (r *Registry) ListInstances(service string) []string {
+	r.mu.RLock()
+	seen := make(map[string]struct{})
+	for _, series := range []map[MetricKey]*instanceSeries{r.instanceGauges, r.instanceCounters} {
+		for key, s := range series {
+			if key.Service != service {
+				continue
+			}
+			s.mu.Lock()
+			for instance := range s.rings {
+				seen[instance] = struct{}{}
+			}
+			s.mu.Unlock()
+		}
+	}
+	for key, s := range r.instanceHistograms {
+		if key.Service != service {
+			continue
+		}
+		s.mu.Lock()
+		for instance := range s.rings {
+			seen[instance] = struct{}{}
+		}
+		s.mu.Unlock()
+	}
+	r.mu.RUnlock()
+
+	result := make([]string, 0, len(seen))
+	for instance := range seen {
+		result = append(result, instance)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// FindInstanceRing returns an instance's gauge ring without creating it
+func (r *Registry) FindInstanceRing(service, instance, name string) (*Ring, bool) {
+	return r.findInstanceRing(r.instanceGauges, service, instance, name)
+}
+
+// FindInstanceCounterRing returns an instance's counter ring without
+// creating it
+func (r *Registry) FindInstanceCounterRing(service, instance, name string) (*Ring, bool) {
+	return r.findInstanceRing(r.instanceCounters, service, instance, name)
+}
+
+func (r *Registry) findInstanceRing(series map[MetricKey]*instanceSeries, service, instance, name string) (*Ring, bool) {
+	r.mu.RLock()
+	s, ok := series[MetricKey{Service: service, Name: name}]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ring, ok := s.rings[instance]
+	return ring, ok
+}
+
+// InstanceSnapshot holds the latest value of each instance's gauge and
+// counter series
+type InstanceSnapshot struct {
+	Gauges   map[InstanceKey]Sample
+	Counters map[InstanceKey]Sample
+}
+
+// LatestSnapshotByInstance returns the latest value of every instance's
+// gauge and counter series. Instances' histogram rings are read with
+// FindInstanceHistogramRing.
+func (r *Registry) LatestSnapshotByInstance() InstanceSnapshot {
+	snapshot := InstanceSnapshot{
+		Gauges:   make(map[InstanceKey]Sample),
+		Counters: make(map[InstanceKey]Sample),
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	latestByInstance(r.instanceGauges, snapshot.Gauges)
+	latestByInstance(r.instanceCounters, snapshot.Counters)
+	return snapshot
+}
+
+func latestByInstance(series map[MetricKey]*instanceSeries, into map[InstanceKey]Sample) {
+	for key, s := range series {
+		s.mu.Lock()
+		for instance, ring := range s.rings {
+			if latest, ok := ring.Latest(); ok {
+				into[InstanceKey{Service: key.Service, Instance: instance, Name: key.Name}] = latest
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// LatestSnapshotByService is LatestSnapshot with the gauges fed by
+// instances aggregated afresh over the instances known now, so one that
+// was forgotten drops out before the next push
+func (r *Registry) LatestSnapshotByService() LatestSnapshot {
+	snapshot := r.LatestSnapshot()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key, s := range r.instanceGauges {
+		latest, ok := snapshot.Gauges[key]
+		if !ok || latest.IsMarker() {
+			continue
+		}
+		s.mu.Lock()
+		if val, ok := s.combine(); ok {
+			latest.Val = val
+			snapshot.Gauges[key] = latest
+		}
+		s.mu.Unlock()
+	}
+	return snapshot
+}
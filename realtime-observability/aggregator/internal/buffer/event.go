@@ -0,0 +1,111 @@
+package buffer
+
+import (
+	"sort"
+	"sync"
+)
+
+// EventRingSize is the number of events kept per service
+const EventRingSize = 256
+
+// Event is a discrete occurrence reported by an agent, such as a deploy
+type Event struct {
+	Ts         int64             `json:"ts"`
+	Instance   string            `json:"instance,omitempty"`
+	Kind       string            `json:"kind"`
+	Message    string            `json:"message,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// EventRing keeps the most recent events of a service
+type EventRing struct {
+	data []Event
+	idx  uint64
+	size uint64
+	mu   sync.RWMutex
+}
+
+// NewEventRing creates a new event ring buffer
+func NewEventRing(size int) *EventRing {
+	return &EventRing{
+		data: make([]Event, size),
+		size: uint64(size),
+	}
+}
+
+// Push adds an event, overwriting the oldest once full
+func (r *EventRing) Push(e Event) {
+	r.mu.Lock()
+	r.data[r.idx%r.size] = e
+	r.idx++
+	r.mu.Unlock()
+}
+
+// SnapshotLast returns up to n of the newest events, oldest first
+func (r *EventRing) SnapshotLast(n int) []Event {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := uint64(n)
+	if count > r.size {
+		count = r.size
+	}
+	if count > r.idx {
+		count = r.idx
+	}
+
+	result := make([]Event, 0, count)
+	for i := r.idx - count; i < r.idx; i++ {
+		result = append(result, r.data[i%r.size])
+	}
+	return result
+}
+
+// AddEvents records events for a service
+func (r *Registry) AddEvents(service string, events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	r.mu.RLock()
+	ring, exists := r.events[service]
+	r.mu.RUnlock()
+
+	if !exists {
+		r.mu.Lock()
+		if ring, exists = r.events[service]; !exists {
+			ring = NewEventRing(EventRingSize)
+			r.events[service] = ring
+		}
+		r.mu.Unlock()
+	}
+
+	for _, e := range events {
+		ring.Push(e)
+	}
+}
+
+// Events returns up to limit of the newest events of a service
+func (r *Registry) Events(service string, limit int) []Event {
+	r.mu.RLock()
+	ring, exists := r.events[service]
+	r.mu.RUnlock()
+
+	if !exists {
+		return nil
+	}
+	return ring.SnapshotLast(limit)
+}
+
+// EventServices returns every service with stored events, sorted
+func (r *Registry) EventServices() []string {
+	r.mu.RLock()
+	services := make([]string, 0, len(r.events))
+	for service := range r.events {
+		services = append(services, service)
+	}
+	r.mu.RUnlock()
+
+	sort.Strings(services)
+	return services
+}
@@ -0,0 +1,185 @@
+package buffer
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultSweepInterval is how often stale series are looked for when
+// Options.SweepInterval is zero
+const DefaultSweepInterval = 30 * time.Second
+
+// Evicted returns how many series the janitor has evicted
+func (r *Registry) Evicted() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.evicted
+}
+
+// seriesActivity is a ring's sample count when the janitor last saw it
+// change
+type seriesActivity struct {
+	count uint64
+	since time.Time
+}
+
+// janitor tracks when each ring last took a sample, by comparing sample
+// counts between sweeps, so pushes pay nothing for it. Rings are keyed by
+// pointer: a series deleted and created again starts afresh. Only the
+// janitor goroutine touches the maps.
+type janitor struct {
+	ttl      time.Duration
+	rings    map[*Ring]seriesActivity
+	histRing map[*HistogramRing]seriesActivity
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// staleSeries is a series the janitor found idle, with the sample count
+// it was idle at
+type staleSeries struct {
+	key   MetricKey
+	kind  seriesKind
+	count uint64
+}
+
+// seriesKind says which map of the registry holds a series
+type seriesKind int
+
+const (
+	gaugeSeries seriesKind = iota
+	counterSeries
+	histogramSeries
+)
+
+func (r *Registry) runJanitor(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.janitor.stop:
+			return
+		case now := <-ticker.C:
+			if n := r.sweep(now); n > 0 {
+				log.Printf("Evicted %d series idle for over %v", n, r.janitor.ttl)
+			}
+		}
+	}
+}
+
+// observe records a ring's sample count at now and reports whether it has
+// not changed for the TTL
+func observe[R comparable](ttl time.Duration, prev, next map[R]seriesActivity, ring R, count uint64, now time.Time) bool {
+	a, ok := prev[ring]
+	if !ok || a.count != count {
+		a = seriesActivity{count: count, since: now}
+	}
+	next[ring] = a
+	return now.Sub(a.since) >= ttl
+}
+
+// sweep evicts the series idle for the TTL and returns how many it did.
+// Candidates are found under the read lock and removed under the write
+// lock only if their sample count has not moved meanwhile. A push that
+// got the ring before the eviction lands in the evicted ring and is lost;
+// the next one creates the series again.
+func (r *Registry) sweep(now time.Time) int {
+	j := r.janitor
+	rings := make(map[*Ring]seriesActivity, len(j.rings))
+	histRings := make(map[*HistogramRing]seriesActivity, len(j.histRing))
+	var stale []staleSeries
+
+	r.mu.RLock()
+	for key, ring := range r.gauges {
+		if count := ring.Count(); observe(j.ttl, j.rings, rings, ring, count, now) {
+			stale = append(stale, staleSeries{key, gaugeSeries, count})
+		}
+	}
+	for key, ring := range r.counters {
+		if count := ring.Count(); observe(j.ttl, j.rings, rings, ring, count, now) {
+			stale = append(stale, staleSeries{key, counterSeries, count})
+		}
+	}
+	for key, ring := range r.histograms {
+		if count := ring.count(); observe(j.ttl, j.histRing, histRings, ring, count, now) {
+			stale = append(stale, staleSeries{key, histogramSeries, count})
+		}
+	}
+	r.mu.RUnlock()
+	j.rings, j.histRing = rings, histRings
+	if len(stale) == 0 {
+		return 0
+	}
+
+	var deleted []MetricKey
+	r.mu.Lock()
+	for _, s := range stale {
+		if !r.evictLocked(s) {
+			continue
+		}
+		deleted = append(deleted, s.key)
+		if s.kind == histogramSeries {
+			delete(r.exemplars, s.key)
+		}
+	}
+	for _, key := range deleted {
+		_, gauge := r.gauges[key]
+		_, counter := r.counters[key]
+		_, hist := r.histograms[key]
+		if !gauge && !counter && !hist {
+			delete(r.metadata, key)
+		}
+		if c, ok := r.seriesCounts[key.Service]; ok && c.Total() == 0 {
+			delete(r.seriesCounts, key.Service)
+		}
+	}
+	r.evicted += uint64(len(deleted))
+	hooks := r.deleteHooks
+	r.mu.Unlock()
+
+	for _, key := range uniqueKeys(deleted) {
+		for _, hook := range hooks {
+			hook(key)
+		}
+	}
+	return len(deleted)
+}
+
+// evictLocked deletes a stale series unless it took a sample since it was
+// found; caller holds the write lock
+func (r *Registry) evictLocked(s staleSeries) bool {
+	switch s.kind {
+	case gaugeSeries:
+		ring, ok := r.gauges[s.key]
+		if !ok || ring.Count() != s.count {
+			return false
+		}
+		delete(r.gauges, s.key)
+		r.dropInstanceSeriesLocked(r.instanceGauges, s.key)
+		c := r.serviceCounts(s.key.Service)
+		c.Gauges--
+		c.slots -= ring.Cap()
+	case counterSeries:
+		ring, ok := r.counters[s.key]
+		if !ok || ring.Count() != s.count {
+			return false
+		}
+		delete(r.counters, s.key)
+		r.dropInstanceSeriesLocked(r.instanceCounters, s.key)
+		c := r.serviceCounts(s.key.Service)
+		c.Counters--
+		c.slots -= ring.Cap()
+	case histogramSeries:
+		ring, ok := r.histograms[s.key]
+		if !ok || ring.count() != s.count {
+			return false
+		}
+		delete(r.histograms, s.key)
+		r.dropInstanceHistogramsLocked(s.key)
+		c := r.serviceCounts(s.key.Service)
+		c.Histograms--
+		c.histogramSlots -= ring.Cap()
+	}
+	return true
+}
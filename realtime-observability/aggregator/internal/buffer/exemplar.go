@@ -0,0 +1,110 @@
+package buffer
+
+import (
+	"sync"
+)
+
+// ExemplarRingSize is the number of exemplars kept per metric
+const ExemplarRingSize = 32
+
+// Exemplar is a single slow observation reported with a histogram
+type Exemplar struct {
+	Ts        int64             `json:"ts"`
+	Value     float64           `json:"value"`
+	Operation string            `json:"operation,omitempty"`
+	TraceID   string            `json:"trace_id,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// ExemplarRing keeps the most recent exemplars for a metric
+type ExemplarRing struct {
+	data []Exemplar
+	idx  uint64
+	size uint64
+	mu   sync.RWMutex
+}
+
+// NewExemplarRing creates a new exemplar ring buffer
+func NewExemplarRing(size int) *ExemplarRing {
+	return &ExemplarRing{
+		data: make([]Exemplar, size),
+		size: uint64(size),
+	}
+}
+
+// Push adds an exemplar, overwriting the oldest once full
+func (r *ExemplarRing) Push(e Exemplar) {
+	r.mu.Lock()
+	r.data[r.idx%r.size] = e
+	r.idx++
+	r.mu.Unlock()
+}
+
+// SnapshotLast returns up to n of the newest exemplars, oldest first
+func (r *ExemplarRing) SnapshotLast(n int) []Exemplar {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := uint64(n)
+	if count > r.size {
+		count = r.size
+	}
+	if count > r.idx {
+		count = r.idx
+	}
+
+	result := make([]Exemplar, 0, count)
+	for i := r.idx - count; i < r.idx; i++ {
+		result = append(result, r.data[i%r.size])
+	}
+	return result
+}
+
+// AddExemplars records exemplars for a histogram metric
+func (r *Registry) AddExemplars(service, name string, exemplars ...Exemplar) {
+	if len(exemplars) == 0 {
+		return
+	}
+	key := MetricKey{Service: service, Name: name}
+
+	r.mu.RLock()
+	ring, exists := r.exemplars[key]
+	r.mu.RUnlock()
+
+	if !exists {
+		r.mu.Lock()
+		if ring, exists = r.exemplars[key]; !exists {
+			ring = NewExemplarRing(ExemplarRingSize)
+			r.exemplars[key] = ring
+		}
+		r.mu.Unlock()
+	}
+
+	for _, e := range exemplars {
+		ring.Push(e)
+	}
+}
+
+// Exemplars returns up to limit of the newest exemplars for a metric
+func (r *Registry) Exemplars(service, name string, limit int) []Exemplar {
+	r.mu.RLock()
+	ring, exists := r.exemplars[MetricKey{Service: service, Name: name}]
+	r.mu.RUnlock()
+
+	if !exists {
+		return nil
+	}
+	return ring.SnapshotLast(limit)
+}
+
+// ExemplarKeys returns every metric with stored exemplars
+func (r *Registry) ExemplarKeys() []MetricKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]MetricKey, 0, len(r.exemplars))
+	for key := range r.exemplars {
+		keys = append(keys, key)
+	}
+	return keys
+}
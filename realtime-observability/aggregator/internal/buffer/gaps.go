@@ -0,0 +1,124 @@
+package buffer
+
+import (
+	"fmt"
+	"slices"
+)
+
+// DefaultGapFactor is how many typical intervals apart two samples must be
+// for the stretch between them to count as a gap
+const DefaultGapFactor = 3
+
+// Gap is a stretch of a series without samples: From is the timestamp of
+// the last sample before it and To of the first after it, or of the end
+// of the series for a gap still open
+type Gap struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// Contains reports whether ts falls strictly inside the gap
+func (g Gap) Contains(ts int64) bool {
+	return ts > g.From && ts < g.To
+}
+
+// Overlaps reports whether [start, end) reaches inside the gap
+func (g Gap) Overlaps(start, end int64) bool {
+	return start < g.To && end > g.From+1
+}
+
+// FillPolicy says what a query reports for the time inside a gap
+type FillPolicy string
+
+const (
+	// FillNone reports nulls, so charts break the line
+	FillNone FillPolicy = "none"
+	// FillPrevious carries the last value before the gap forward, flagged
+	FillPrevious FillPolicy = "previous"
+	// FillZero reports zeros, flagged
+	FillZero FillPolicy = "zero"
+)
+
+// ParseFillPolicy parses none, previous or zero; "" is FillNone
+func ParseFillPolicy(s string) (FillPolicy, error) {
+	switch p := FillPolicy(s); p {
+	case "":
+		return FillNone, nil
+	case FillNone, FillPrevious, FillZero:
+		return p, nil
+	}
+	return "", fmt.Errorf("fill %q: must be none, previous or zero", s)
+}
+
+// TypicalInterval returns the median spacing of a series' consecutive
+// samples, given oldest first; ok is false with fewer than two. Taking
+// the median keeps a few gaps or bursts from moving it.
+func TypicalInterval(ts []int64) (int64, bool) {
+	if len(ts) < 2 {
+		return 0, false
+	}
+	deltas := make([]int64, 0, len(ts)-1)
+	for i := 1; i < len(ts); i++ {
+		if d := ts[i] - ts[i-1]; d > 0 {
+			deltas = append(deltas, d)
+		}
+	}
+	if len(deltas) == 0 {
+		return 0, false
+	}
+	slices.Sort(deltas)
+	return deltas[len(deltas)/2], true
+}
+
+// FindGaps returns the gaps in samples, oldest first: consecutive samples
+// further apart than factor times the series' typical interval, and every
+// stretch a gap marker opens, however short. A series quiet for as long
+// before end, or left in a gap marker, ends in a gap open until end; pass
+// 0 for no end. Factors below 1 mean DefaultGapFactor.
+func FindGaps(samples []Sample, factor float64, end int64) []Gap {
+	return findGaps(len(samples), func(i int) (int64, Marker) {
+		return samples[i].Ts, samples[i].Marker
+	}, factor, end)
+}
+
+// FindHistogramGaps is FindGaps over histogram windows
+func FindHistogramGaps(windows []HistogramData, factor float64, end int64) []Gap {
+	return findGaps(len(windows), func(i int) (int64, Marker) {
+		return windows[i].Ts, windows[i].Marker
+	}, factor, end)
+}
+
+// findGaps walks n entries, oldest first, given by at
+func findGaps(n int, at func(i int) (int64, Marker), factor float64, end int64) []Gap {
+	if factor < 1 {
+		factor = DefaultGapFactor
+	}
+	ts := make([]int64, 0, n)
+	for i := range n {
+		if t, m := at(i); m == MarkerNone {
+			ts = append(ts, t)
+		}
+	}
+	interval, ok := TypicalInterval(ts)
+	limit := int64(float64(interval) * factor)
+	long := func(from, to int64) bool { return ok && to-from > limit }
+
+	var gaps []Gap
+	var prev int64
+	havePrev, marked := false, false
+	for i := range n {
+		t, m := at(i)
+		if m != MarkerNone {
+			marked = marked || m == MarkerGap
+			continue
+		}
+		if havePrev && (marked || long(prev, t)) {
+			gaps = append(gaps, Gap{From: prev, To: t})
+		}
+		prev, havePrev, marked = t, true, false
+	}
+	if havePrev && end > prev && (marked || long(prev, end)) {
+		gaps = append(gaps, Gap{From: prev, To: end})
+	}
+	return gaps
+}
@@ -0,0 +1,55 @@
+package buffer
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// holeySamples returns samples a second apart from base over [0s, 10s)
+// and [20s, 30s), leaving a 10-second hole
+func holeySamples(base int64) []Sample {
+	var samples []Sample
+	for i := range int64(30) {
+		if i < 10 || i >= 20 {
+			samples = append(samples, Sample{Ts: base + i*int64(time.Second), Val: float64(i)})
+		}
+	}
+	return samples
+}
+
+func TestFindGaps(t *testing.T) {
+	const s = int64(time.Second)
+	samples := holeySamples(0)
+
+	if got, want := FindGaps(samples, DefaultGapFactor, 0), []Gap{{From: 9 * s, To: 20 * s}}; !slices.Equal(got, want) {
+		t.Fatalf("gaps = %v, want %v", got, want)
+	}
+	if got := FindGaps(samples, 20, 0); len(got) != 0 {
+		t.Fatalf("gaps with factor 20 = %v, want none", got)
+	}
+	// Quiet since the last sample, as of a minute in
+	if got, want := FindGaps(samples, DefaultGapFactor, 60*s), []Gap{{9 * s, 20 * s}, {29 * s, 60 * s}}; !slices.Equal(got, want) {
+		t.Fatalf("gaps until 60s = %v, want %v", got, want)
+	}
+
+	// A marked gap counts however short
+	marked := []Sample{{Ts: 0}, {Ts: s}, {Ts: s + 1, Marker: MarkerGap}, {Ts: 2*s - 1, Marker: MarkerResume}, {Ts: 2 * s}, {Ts: 3 * s}}
+	if got, want := FindGaps(marked, DefaultGapFactor, 0), []Gap{{From: s, To: 2 * s}}; !slices.Equal(got, want) {
+		t.Fatalf("marked gaps = %v, want %v", got, want)
+	}
+	if got, want := FindGaps(marked[:3], DefaultGapFactor, 5*s), []Gap{{From: s, To: 5 * s}}; !slices.Equal(got, want) {
+		t.Fatalf("open marked gap = %v, want %v", got, want)
+	}
+}
+
+func TestParseFillPolicy(t *testing.T) {
+	for in, want := range map[string]FillPolicy{"": FillNone, "none": FillNone, "previous": FillPrevious, "zero": FillZero} {
+		if got, err := ParseFillPolicy(in); err != nil || got != want {
+			t.Errorf("ParseFillPolicy(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseFillPolicy("linear"); err == nil {
+		t.Error("ParseFillPolicy(linear) succeeded")
+	}
+}
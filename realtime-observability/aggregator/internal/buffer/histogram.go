@@ -0,0 +1,189 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoHistograms is returned by MergeHistograms when every histogram is a
+// marker, or there are none
+var ErrNoHistograms = errors.New("no histograms to merge")
+
+// BoundsMismatchError is returned by MergeHistograms for a histogram whose
+// buckets differ from the first's. Index is its position in the arguments.
+type BoundsMismatchError struct {
+	Index      int
+	Want, Got  []float64
+	WantCounts int
+	GotCounts  int
+}
+
+func (e BoundsMismatchError) Error() string {
+	return fmt.Sprintf("histogram %d: bounds %v with %d buckets differ from %v with %d buckets",
+		e.Index, e.Got, e.GotCounts, e.Want, e.WantCounts)
+}
+
+// MergeHistograms sums histograms with identical bounds into one carrying
+// the newest timestamp. Markers are skipped. The merged sum and count are
+// only set when every histogram carried them. The result shares the first
+// histogram's Bounds.
+func MergeHistograms(hs ...HistogramData) (HistogramData, error) {
+	var merged HistogramData
+	first := true
+	for i, h := range hs {
+		if h.IsMarker() {
+			continue
+		}
+		if first {
+			merged = HistogramData{
+				Bounds: h.Bounds,
+				Counts: make([]uint64, len(h.Counts)),
+				HasSum: true,
+			}
+			first = false
+		} else if len(h.Counts) != len(merged.Counts) || !sameBounds(h.Bounds, merged.Bounds) {
+			return HistogramData{}, BoundsMismatchError{
+				Index:      i,
+				Want:       merged.Bounds,
+				Got:        h.Bounds,
+				WantCounts: len(merged.Counts),
+				GotCounts:  len(h.Counts),
+			}
+		}
+		for j, c := range h.Counts {
+			merged.Counts[j] += c
+		}
+		merged.Ts = max(merged.Ts, h.Ts)
+		merged.Sum += h.Sum
+		merged.Count += h.Count
+		merged.HasSum = merged.HasSum && h.HasSum
+	}
+	if first {
+		return HistogramData{}, ErrNoHistograms
+	}
+	if !merged.HasSum {
+		merged.Sum, merged.Count = 0, 0
+	}
+	return merged, nil
+}
+
+// MergeSince merges every histogram window with Ts >= since that shares the
+// newest window's bounds, see MergeHistograms. Windows with other bounds
+// are skipped. ok is false when no window is in range or the series is in
+// a reporting gap.
+func (r *HistogramRing) MergeSince(since int64) (HistogramData, bool) {
+	return r.mergeNewest(func(_ int, h HistogramData) bool {
+		return h.Ts >= since
+	})
+}
+
+// MergeLast merges the newest n windows that share the newest window's
+// bounds; with a window a second, MergeLast(2) covers the last two
+// seconds. Markers among them count towards n. ok is
+// false when the ring is empty, n < 1 or the series is in a reporting gap.
+func (r *HistogramRing) MergeLast(n int) (HistogramData, bool) {
+	return r.mergeNewest(func(i int, _ HistogramData) bool {
+		return i < n
+	})
+}
+
+// mergeNewest merges windows from the newest back for as long as keep
+// accepts them, given how many came before, skipping markers and windows
+// with other bounds than the newest's
+func (r *HistogramRing) mergeNewest(keep func(i int, h HistogramData) bool) (HistogramData, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.idx == 0 {
+		return HistogramData{}, false
+	}
+	newest := r.data[(r.idx-1)%r.size]
+	if newest.IsMarker() || !keep(0, newest) {
+		return HistogramData{}, false
+	}
+
+	var start uint64
+	if r.idx > r.size {
+		start = r.idx - r.size
+	}
+	var windows []HistogramData
+	for i, n := r.idx, 0; i > start; i, n = i-1, n+1 {
+		h := r.data[(i-1)%r.size]
+		if !keep(n, h) {
+			break
+		}
+		if h.IsMarker() || len(h.Counts) != len(newest.Counts) || !sameBounds(h.Bounds, newest.Bounds) {
+			continue
+		}
+		windows = append(windows, h)
+	}
+	merged, err := MergeHistograms(windows...)
+	return merged, err == nil
+}
+
+// Total returns the number of observations in the histogram
+func (h HistogramData) Total() uint64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	return total
+}
+
+// Percentile estimates the q-th percentile (0-100) from bucket upper bounds
+// and counts by interpolating linearly inside the bucket holding the rank.
+// counts may carry one extra overflow bucket, which reports the last bound.
+func Percentile(bounds []float64, counts []uint64, q float64) float64 {
+	if len(bounds) == 0 || len(counts) == 0 {
+		return 0
+	}
+
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q / 100 * float64(total)
+	var cumulative uint64
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if float64(cumulative+c) < rank {
+			cumulative += c
+			continue
+		}
+		if i >= len(bounds) {
+			return bounds[len(bounds)-1]
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = bounds[i-1]
+		} else if bounds[0] < 0 {
+			lower = bounds[0]
+		}
+		upper := bounds[i]
+		fraction := (rank - float64(cumulative)) / float64(c)
+		if fraction < 0 {
+			fraction = 0
+		}
+		return lower + (upper-lower)*fraction
+	}
+	return bounds[len(bounds)-1]
+}
+
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
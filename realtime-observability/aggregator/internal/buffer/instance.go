@@ -0,0 +1,88 @@
+package buffer
+
+import (
+	"maps"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Instance is an agent instance of a service with the resource attributes
+// of its newest batch (host, pid, pod, ...)
+type Instance struct {
+	Instance   string            `json:"instance"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	LastSeen   time.Time         `json:"last_seen"`
+}
+
+// instanceKey identifies an instance in the registry's metadata table
+type instanceKey struct {
+	service, instance string
+}
+
+// instanceEntry is an Instance as stored. The attributes are replaced,
+// never modified, under the write lock; lastSeen is updated under the
+// read lock.
+type instanceEntry struct {
+	attributes map[string]string
+	lastSeen   atomic.Int64 // UnixNano
+}
+
+// SeenInstance records a batch from an instance. In the steady state the
+// instance exists with the same attributes, and only its last-seen time
+// is updated, under the read lock so ingest does not serialize on it. The
+// write lock is taken to add an instance or replace its attributes, whose
+// map is copied only then.
+func (r *Registry) SeenInstance(service, instance string, attributes map[string]string, seen time.Time) {
+	key := instanceKey{service: service, instance: instance}
+
+	r.mu.RLock()
+	inst, ok := r.instances[key]
+	if ok && maps.Equal(inst.attributes, attributes) {
+		inst.lastSeen.Store(seen.UnixNano())
+		r.mu.RUnlock()
+		return
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inst, ok = r.instances[key]
+	if !ok {
+		inst = &instanceEntry{}
+		r.instances[key] = inst
+	}
+	if !ok || !maps.Equal(inst.attributes, attributes) {
+		inst.attributes = maps.Clone(attributes)
+	}
+	inst.lastSeen.Store(seen.UnixNano())
+}
+
+// ForgetInstance drops an instance that stopped reporting, along with its
+// series
+func (r *Registry) ForgetInstance(service, instance string) {
+	r.mu.Lock()
+	delete(r.instances, instanceKey{service: service, instance: instance})
+	r.forgetInstanceLocked(service, instance)
+	r.mu.Unlock()
+}
+
+// Instances returns the known instances of every service, each sorted by
+// instance ID. The attribute maps are shared and must not be modified.
+func (r *Registry) Instances() map[string][]Instance {
+	r.mu.RLock()
+	result := make(map[string][]Instance)
+	for key, inst := range r.instances {
+		result[key.service] = append(result[key.service], Instance{
+			Instance:   key.instance,
+			Attributes: inst.attributes,
+			LastSeen:   time.Unix(0, inst.lastSeen.Load()),
+		})
+	}
+	r.mu.RUnlock()
+
+	for _, instances := range result {
+		sort.Slice(instances, func(i, j int) bool { return instances[i].Instance < instances[j].Instance })
+	}
+	return result
+}
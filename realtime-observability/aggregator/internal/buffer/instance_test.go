@@ -0,0 +1,50 @@
+package buffer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSeenInstanceUpdatesLastSeenAndAttributes(t *testing.T) {
+	r := NewRegistry()
+	attrs := map[string]string{"host.name": "a"}
+	t0 := time.Unix(100, 0)
+	r.SeenInstance("checkout", "pod-1", attrs, t0)
+	r.SeenInstance("checkout", "pod-1", attrs, t0.Add(time.Second))
+
+	got := r.Instances()["checkout"]
+	if len(got) != 1 || !got[0].LastSeen.Equal(t0.Add(time.Second)) || got[0].Attributes["host.name"] != "a" {
+		t.Fatalf("instances = %+v", got)
+	}
+
+	// The stored attributes are a copy, replaced when they differ
+	attrs["host.name"] = "mutated"
+	if got := r.Instances()["checkout"][0].Attributes["host.name"]; got != "a" {
+		t.Fatalf("stored attributes changed with the caller's map: %q", got)
+	}
+	r.SeenInstance("checkout", "pod-1", map[string]string{"host.name": "b"}, t0.Add(2*time.Second))
+	if got := r.Instances()["checkout"][0].Attributes["host.name"]; got != "b" {
+		t.Fatalf("attributes = %q, want replaced with b", got)
+	}
+}
+
+func TestSeenInstanceConcurrent(t *testing.T) {
+	r := NewRegistry()
+	attrs := map[string]string{"host.name": "a"}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				r.SeenInstance("checkout", "pod-1", attrs, time.Unix(int64(i), 0))
+				r.Instances()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := r.Instances()["checkout"]; len(got) != 1 {
+		t.Fatalf("instances = %+v", got)
+	}
+}
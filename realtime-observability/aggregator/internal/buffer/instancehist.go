@@ -0,0 +1,208 @@
+package buffer
+
+import "sync"
+
+// instanceHistograms holds the per-instance rings behind a service's
+// histogram series. mu serializes pushes so windows reach the service
+// ring in order, and gap markers with them.
+type instanceHistograms struct {
+	mu    sync.Mutex
+	rings map[string]*HistogramRing
+	size  int
+	order OrderPolicy
+
+	// canonical is the service series' layout, see SetCanonicalBounds
+	key       MetricKey
+	canonical canonicalBounds
+
+	// bucket is the width of the service ring's merged windows
+	bucket int64
+}
+
+// instanceHistogramsFor returns the per-instance rings behind the service
+// histogram ring of key, creating them; like instanceSeriesFor, they are
+// not kept when that ring was deleted meanwhile
+func (r *Registry) instanceHistogramsFor(key MetricKey, service *HistogramRing) *instanceHistograms {
+	r.mu.RLock()
+	s, ok := r.instanceHistograms[key]
+	r.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok = r.instanceHistograms[key]; ok {
+		return s
+	}
+	s = &instanceHistograms{
+		rings:  make(map[string]*HistogramRing),
+		size:   r.ringSizeFor(key.Name, r.histogramRingSize),
+		order:  r.order,
+		key:    key,
+		bucket: r.histogramBucket,
+	}
+	s.canonical, _ = r.canonicalFor(key)
+	if r.histograms[key] == service {
+		r.instanceHistograms[key] = s
+	}
+	return s
+}
+
+// instanceHistogramRing returns an instance's ring in s, creating it
+// within the series limits like instanceRing
+func (r *Registry) instanceHistogramRing(s *instanceHistograms, instance string) (*HistogramRing, error) {
+	s.mu.Lock()
+	ring, ok := s.rings[instance]
+	s.mu.Unlock()
+	if ok {
+		return ring, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkLimitsLocked(s.key.Service); err != nil {
+		r.reject(s.key.Service)
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ring, ok = s.rings[instance]; ok {
+		return ring, nil
+	}
+	ring = NewHistogramRingWithPolicy(s.size, s.order)
+	ring.key = s.key
+	ring.canonical = s.canonical
+	if r.instanceHistograms[s.key] != s {
+		return ring, nil
+	}
+	s.rings[instance] = ring
+	r.countInstanceHistogramRingsLocked(s.key.Service, 1, ring.Cap())
+	return ring, nil
+}
+
+// countInstanceHistogramRingsLocked is countInstanceRingsLocked for
+// histogram rings; caller holds the write lock
+func (r *Registry) countInstanceHistogramRingsLocked(service string, n, size int) {
+	c := r.serviceCounts(service)
+	c.Instances += n
+	c.histogramSlots += n * size
+	r.instanceRings += n
+}
+
+// dropInstanceHistogramsLocked removes the per-instance rings behind a
+// deleted histogram series; caller holds the write lock
+func (r *Registry) dropInstanceHistogramsLocked(key MetricKey) {
+	s, ok := r.instanceHistograms[key]
+	if !ok {
+		return
+	}
+	delete(r.instanceHistograms, key)
+	s.mu.Lock()
+	r.countInstanceHistogramRingsLocked(key.Service, -len(s.rings), s.size)
+	s.mu.Unlock()
+}
+
+// PushHistogram stores a histogram window from an instance in its own
+// ring, where the out-of-order policy applies to that instance's windows
+// alone. A window the instance's ring keeps is then merged into the
+// service's ring, which holds one window per time bucket of
+// Options.HistogramBucket summed bucket-wise over every instance that
+// reported in it, see pushAligned. Instances pushing on different cadences
+// land in the same buckets, and a bucket is updated as each instance
+// arrives rather than waiting for all of them. Without an instance the
+// window goes to the service's ring as is. The error is PushGauge's.
+func (r *Registry) PushHistogram(service, instance, name string, h HistogramData) error {
+	ring, err := r.TryGetHistogramRing(service, name)
+	if err != nil {
+		return err
+	}
+	s := r.instanceHistogramsFor(MetricKey{Service: service, Name: name}, ring)
+	if instance == "" {
+		s.mu.Lock()
+		ring.Push(h)
+		s.mu.Unlock()
+		return nil
+	}
+
+	own, err := r.instanceHistogramRing(s, instance)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := own.Dropped()
+	own.Push(h)
+	if own.Dropped() != dropped {
+		return nil
+	}
+	ring.pushAligned(h, s.bucket)
+	return nil
+}
+
+// pushAligned adds h to the window of the time bucket of width holding
+// h.Ts, or stores it as that bucket's window stamped at the bucket's
+// start. A window with other bounds is kept apart, in the same bucket. A
+// new bucket's window is stamped no earlier than a newer gap marker, so it
+// does not land inside the gap. Once the ring is full, a window for a
+// bucket older than any held is dropped and counted.
+func (r *HistogramRing) pushAligned(h HistogramData, width int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h = r.canonicalize(h)
+	start := h.Ts - h.Ts%width
+	var oldest uint64
+	if r.idx > r.size {
+		oldest = r.idx - r.size
+	}
+	for i := r.idx; i > oldest; i-- {
+		w := &r.data[(i-1)%r.size]
+		if w.Ts < start {
+			break
+		}
+		if w.IsMarker() || w.Ts >= start+width {
+			continue
+		}
+		if merged, err := MergeHistograms(*w, h); err == nil {
+			merged.Ts = w.Ts
+			*w = merged
+			return
+		}
+	}
+
+	h.Ts = start
+	if r.idx == 0 {
+		r.data[0] = h
+		r.idx++
+		return
+	}
+	newest := r.data[(r.idx-1)%r.size]
+	switch {
+	case newest.IsMarker() && h.Ts < newest.Ts:
+		h.Ts = newest.Ts
+	case h.Ts < newest.Ts && r.idx >= r.size && h.Ts < r.data[oldest%r.size].Ts:
+		r.dropped++
+		return
+	case h.Ts < newest.Ts:
+		r.insert(h)
+		return
+	}
+	r.data[r.idx%r.size] = h
+	r.idx++
+}
+
+// FindInstanceHistogramRing returns an instance's histogram ring without
+// creating it
+func (r *Registry) FindInstanceHistogramRing(service, instance, name string) (*HistogramRing, bool) {
+	r.mu.RLock()
+	s, ok := r.instanceHistograms[MetricKey{Service: service, Name: name}]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ring, ok := s.rings[instance]
+	return ring, ok
+}
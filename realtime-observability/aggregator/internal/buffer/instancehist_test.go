@@ -0,0 +1,190 @@
+package buffer
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPushHistogramKeepsLaggingInstances(t *testing.T) {
+	r := NewRegistryWithOptions(Options{DisableRollups: true})
+	window := func(ts int64) HistogramData {
+		return HistogramData{Ts: ts, Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1, HasSum: true}
+	}
+
+	// pod-2 runs a second behind pod-1, which the service ring alone
+	// would drop under OrderDrop
+	for i := range int64(5) {
+		ts := (i + 10) * 1e9
+		if err := r.PushHistogram("checkout", "pod-1", "latency", window(ts)); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.PushHistogram("checkout", "pod-2", "latency", window(ts-1e9)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Merged per second: pod-2 alone in the first, both after that
+	ring := r.GetHistogramRing("checkout", "latency")
+	if got := len(ring.Snapshot()); got != 6 {
+		t.Fatalf("service ring holds %d windows, want 6", got)
+	}
+	if merged, _ := ring.MergeLast(10); merged.Count != 10 {
+		t.Fatalf("merged count = %d, want 10", merged.Count)
+	}
+	if got := r.OutOfOrderDrops(); len(got) != 0 {
+		t.Fatalf("drops = %v, want none", got)
+	}
+
+	// A window older than the instance's own newest is dropped and counted
+	if err := r.PushHistogram("checkout", "pod-1", "latency", window(1e9)); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ring.Snapshot()); got != 6 {
+		t.Fatalf("service ring holds %d windows after a stale one, want 6", got)
+	}
+	key := MetricKey{Service: "checkout", Name: "latency"}
+	if got := r.OutOfOrderDrops()[key]; got != 1 {
+		t.Fatalf("drops = %d, want 1", got)
+	}
+
+	if got := r.ListInstances("checkout"); len(got) != 2 {
+		t.Fatalf("instances = %v, want pod-1 and pod-2", got)
+	}
+	own, ok := r.FindInstanceHistogramRing("checkout", "pod-2", "latency")
+	if !ok || len(own.Snapshot()) != 5 {
+		t.Fatalf("pod-2 ring = %v, %v; want 5 windows", own, ok)
+	}
+	if counts := r.SeriesCounts()["checkout"]; counts.Histograms != 1 || counts.Instances != 2 {
+		t.Fatalf("counts = %+v, want 1 histogram and 2 instance rings", counts)
+	}
+
+	r.ForgetInstance("checkout", "pod-2")
+	if _, ok := r.FindInstanceHistogramRing("checkout", "pod-2", "latency"); ok {
+		t.Fatal("pod-2 ring kept after ForgetInstance")
+	}
+	r.DeleteMetric("checkout", "latency")
+	if stats := r.Stats(); stats.Series.Instances != 0 || stats.EstimatedBytes != 0 {
+		t.Fatalf("stats after delete = %+v, want no instance rings or bytes", stats.Series)
+	}
+}
+
+func TestPushHistogramMergesInstances(t *testing.T) {
+	r := NewRegistryWithOptions(Options{DisableRollups: true})
+	bounds := []float64{5, 10, 25, 50, 100, 250, 500, 1000}
+	bucketOf := func(v float64) int {
+		i, _ := slices.BinarySearch(bounds, v)
+		return i
+	}
+
+	// Three instances with their own latency profiles and push cadences;
+	// pod-3 stops reporting half way through
+	instances := []struct {
+		name           string
+		every, offset  time.Duration
+		until          time.Duration
+		median, spread float64
+	}{
+		{"pod-1", 250 * time.Millisecond, 0, 10 * time.Second, 20, 10},
+		{"pod-2", 500 * time.Millisecond, 100 * time.Millisecond, 10 * time.Second, 40, 20},
+		{"pod-3", time.Second, 700 * time.Millisecond, 5 * time.Second, 300, 200},
+	}
+	rng := rand.New(rand.NewSource(1))
+	start := int64(100 * time.Second)
+	pooled := make([]uint64, len(bounds)+1)
+	perSecond := make(map[int64][]uint64)
+	var raw []float64
+
+	type push struct {
+		instance string
+		h        HistogramData
+	}
+	var pushes []push
+	for _, inst := range instances {
+		for at := inst.offset; at < inst.until; at += inst.every {
+			h := HistogramData{Ts: start + int64(at), Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+			for range 50 {
+				v := max(inst.median+rng.NormFloat64()*inst.spread, 0)
+				raw = append(raw, v)
+				h.Counts[bucketOf(v)]++
+				pooled[bucketOf(v)]++
+				h.Sum += v
+				h.Count++
+			}
+			h.HasSum = true
+			second := h.Ts - h.Ts%int64(time.Second)
+			if perSecond[second] == nil {
+				perSecond[second] = make([]uint64, len(bounds)+1)
+			}
+			for i, c := range h.Counts {
+				perSecond[second][i] += c
+			}
+			pushes = append(pushes, push{inst.name, h})
+		}
+	}
+	slices.SortStableFunc(pushes, func(a, b push) int { return int(a.h.Ts - b.h.Ts) })
+	for _, p := range pushes {
+		if err := r.PushHistogram("checkout", p.instance, "latency", p.h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One window per second, each the sum of the instances in it
+	ring := r.GetHistogramRing("checkout", "latency")
+	windows := ring.Snapshot()
+	if len(windows) != 10 {
+		t.Fatalf("service ring holds %d windows, want one per second", len(windows))
+	}
+	for _, w := range windows {
+		if !slices.Equal(w.Counts, perSecond[w.Ts]) {
+			t.Errorf("window at %v = %v, want %v", time.Duration(w.Ts-start), w.Counts, perSecond[w.Ts])
+		}
+	}
+
+	merged, ok := ring.MergeSince(start)
+	if !ok {
+		t.Fatal("nothing to merge")
+	}
+	if !slices.Equal(merged.Counts, pooled) || merged.Count != uint64(len(raw)) {
+		t.Fatalf("merged counts = %v, want the pooled %v", merged.Counts, pooled)
+	}
+	got, want := Percentile(merged.Bounds, merged.Counts, 99), Percentile(bounds, pooled, 99)
+	if got != want {
+		t.Fatalf("merged p99 = %v, pooled p99 = %v", got, want)
+	}
+	slices.Sort(raw)
+	exact := raw[len(raw)*99/100]
+	if b := bucketOf(exact); (b > 0 && got < bounds[b-1]) || (b < len(bounds) && got > bounds[b]) {
+		t.Fatalf("merged p99 = %v outside the bucket of the exact p99 %v", got, exact)
+	}
+}
+
+func TestPushAlignedAfterGap(t *testing.T) {
+	ring := NewHistogramRing(8)
+	window := func(ts int64) HistogramData {
+		return HistogramData{Ts: ts, Bounds: []float64{1}, Counts: []uint64{1, 0}}
+	}
+	width := int64(time.Second)
+
+	ring.pushAligned(window(int64(1500*time.Millisecond)), width)
+	ring.Push(HistogramData{Ts: int64(1600 * time.Millisecond), Marker: MarkerGap})
+	ring.Push(HistogramData{Ts: int64(5400 * time.Millisecond), Marker: MarkerResume})
+	// After the resume marker, in the same second as it
+	ring.pushAligned(window(int64(5500*time.Millisecond)), width)
+	ring.pushAligned(window(int64(5700*time.Millisecond)), width)
+	// Late for the second before the gap
+	ring.pushAligned(window(int64(1900*time.Millisecond)), width)
+
+	var got []string
+	for _, h := range ring.Snapshot() {
+		got = append(got, time.Duration(h.Ts).String()+":"+h.Marker.String())
+	}
+	want := []string{"1s:", "1.6s:gap", "5.4s:resume", "5.4s:"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("windows = %v, want %v", got, want)
+	}
+	if first, last := ring.Snapshot()[0], ring.Snapshot()[3]; first.Counts[0] != 2 || last.Counts[0] != 2 {
+		t.Fatalf("counts = %v and %v, want 2 each", first.Counts, last.Counts)
+	}
+}
@@ -0,0 +1,136 @@
+package buffer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// SeriesName is the registry name of a labeled metric. The registry keys
+// series by name alone, so labels are folded into it in the Prometheus
+// form name{k="v",...}, sorted by label name. Without labels it is the
+// name itself.
+func SeriesName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// SplitSeriesName splits a SeriesName into the metric name and the label
+// list between the braces, which is empty for an unlabeled series
+func SplitSeriesName(series string) (name, labels string) {
+	i := strings.IndexByte(series, '{')
+	if i < 0 || !strings.HasSuffix(series, "}") {
+		return series, ""
+	}
+	return series[:i], series[i+1 : len(series)-1]
+}
+
+// ParseSeriesName splits a SeriesName into the metric name and its labels,
+// unescaping the values; labels is nil for an unlabeled series
+func ParseSeriesName(series string) (name string, labels map[string]string, err error) {
+	name, list := SplitSeriesName(series)
+	if list == "" {
+		return name, nil, nil
+	}
+
+	labels = make(map[string]string)
+	for list != "" {
+		k, rest, ok := strings.Cut(list, `="`)
+		if !ok || k == "" {
+			return "", nil, fmt.Errorf("series %q: expected k=\"v\" pairs", series)
+		}
+		var v strings.Builder
+		i := 0
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+				if rest[i] == 'n' {
+					v.WriteByte('\n')
+				} else {
+					v.WriteByte(rest[i])
+				}
+				continue
+			}
+			v.WriteByte(rest[i])
+		}
+		if i == len(rest) {
+			return "", nil, fmt.Errorf("series %q: unterminated value of %s", series, k)
+		}
+		labels[k] = v.String()
+
+		list = rest[i+1:]
+		if list != "" {
+			if list[0] != ',' {
+				return "", nil, fmt.Errorf("series %q: expected ',' after %s", series, k)
+			}
+			list = list[1:]
+		}
+	}
+	return name, labels, nil
+}
+
+// ParseMetricKey parses MetricKey.String(), "service/name" or
+// "service/name{k="v",...}", as WS payloads and subscriptions key series
+func ParseMetricKey(s string) (MetricKey, error) {
+	service, series, ok := strings.Cut(s, "/")
+	if !ok || service == "" || series == "" {
+		return MetricKey{}, fmt.Errorf("metric key %q: expected service/name", s)
+	}
+	if _, _, err := ParseSeriesName(series); err != nil {
+		return MetricKey{}, err
+	}
+	return MetricKey{Service: service, Name: series}, nil
+}
+
+// GetRingLabeled returns the gauge ring of a labeled series, keyed by
+// SeriesName; without labels it is the unlabeled series
+func (r *Registry) GetRingLabeled(service, name string, labels map[string]string) *Ring {
+	return r.GetRing(service, SeriesName(name, labels))
+}
+
+// GetCounterRingLabeled returns the counter ring of a labeled series, keyed
+// by SeriesName
+func (r *Registry) GetCounterRingLabeled(service, name string, labels map[string]string) *Ring {
+	return r.GetCounterRing(service, SeriesName(name, labels))
+}
+
+// ListLabelSets returns the label sets of a service's series by metric
+// name, in series name order. An unlabeled series has a nil set; series
+// whose names do not parse are left out.
+func (r *Registry) ListLabelSets(service string) map[string][]map[string]string {
+	series := r.ListMetrics(service)
+	sort.Strings(series)
+
+	result := make(map[string][]map[string]string)
+	for _, s := range series {
+		name, labels, err := ParseSeriesName(s)
+		if err != nil {
+			continue
+		}
+		result[name] = append(result[name], labels)
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package buffer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSeriesName(t *testing.T) {
+	tests := []struct {
+		series  string
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{series: "cpu", name: "cpu"},
+		{series: `http_requests{method="GET"}`, name: "http_requests", labels: map[string]string{"method": "GET"}},
+		{series: `http_requests{code="500",method="POST"}`, name: "http_requests", labels: map[string]string{"code": "500", "method": "POST"}},
+		{series: `q{v="a\"b\\c\nd"}`, name: "q", labels: map[string]string{"v": "a\"b\\c\nd"}},
+		{series: `q{v=""}`, name: "q", labels: map[string]string{"v": ""}},
+		{series: `q{v="a,b}"}`, name: "q", labels: map[string]string{"v": "a,b}"}},
+		{series: `q{v}`, wantErr: true},
+		{series: `q{="x"}`, wantErr: true},
+		{series: `q{v="x}`, wantErr: true},
+		{series: `q{a="x"b="y"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		name, labels, err := ParseSeriesName(tt.series)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSeriesName(%q) = %q, %v; want an error", tt.series, name, labels)
+			}
+			continue
+		}
+		if err != nil || name != tt.name || !reflect.DeepEqual(labels, tt.labels) {
+			t.Errorf("ParseSeriesName(%q) = %q, %v, %v; want %q, %v", tt.series, name, labels, err, tt.name, tt.labels)
+		}
+	}
+}
+
+func TestParseSeriesNameInvertsSeriesName(t *testing.T) {
+	labels := map[string]string{"path": `/a"b\c`, "region": "eu\nwest", "code": "200"}
+	name, got, err := ParseSeriesName(SeriesName("requests", labels))
+	if err != nil || name != "requests" || !reflect.DeepEqual(got, labels) {
+		t.Fatalf("round trip = %q, %v, %v; want requests, %v", name, got, err, labels)
+	}
+}
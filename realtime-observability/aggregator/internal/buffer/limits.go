@@ -0,0 +1,140 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+)
+
+// ErrSeriesLimit is wrapped by the errors of TryGetRing,
+// TryGetCounterRing and TryGetHistogramRing for a new series past
+// Options.MaxSeriesPerService or Options.MaxSeriesTotal
+var ErrSeriesLimit = errors.New("series limit reached")
+
+var (
+	errServiceSeriesLimit = fmt.Errorf("%w for the service", ErrSeriesLimit)
+	errTotalSeriesLimit   = fmt.Errorf("%w for the aggregator", ErrSeriesLimit)
+)
+
+// checkLimitsLocked reports whether a new series of service would pass
+// the limits; caller holds the lock
+func (r *Registry) checkLimitsLocked(service string) error {
+	if r.maxSeriesPerService > 0 {
+		if c, ok := r.seriesCounts[service]; ok && c.Total() >= r.maxSeriesPerService {
+			return errServiceSeriesLimit
+		}
+	}
+	if r.maxSeriesTotal > 0 && len(r.gauges)+len(r.counters)+len(r.histograms)+r.instanceRings >= r.maxSeriesTotal {
+		return errTotalSeriesLimit
+	}
+	return nil
+}
+
+// reject counts a new series refused by the limits
+func (r *Registry) reject(service string) {
+	r.rejectMu.Lock()
+	r.rejected[service]++
+	r.rejectMu.Unlock()
+}
+
+// Rejected returns, per service, how many times a new series was refused
+// by the series limits
+func (r *Registry) Rejected() map[string]uint64 {
+	r.rejectMu.Lock()
+	defer r.rejectMu.Unlock()
+	return maps.Clone(r.rejected)
+}
+
+// RegistryStats summarizes what a registry holds and refuses
+type RegistryStats struct {
+	Series              SeriesCounts            `json:"series"`
+	Services            map[string]SeriesCounts `json:"services"`
+	MaxSeriesPerService int                     `json:"max_series_per_service"`
+	MaxSeriesTotal      int                     `json:"max_series_total"`
+	Evicted             uint64                  `json:"evicted"`
+	Rejected            map[string]uint64       `json:"rejected"`
+
+	// Sizes holds the size of every series' ring, sorted by key, which
+	// Options can set per metric
+	Sizes []SeriesSize `json:"sizes"`
+
+	// SamplesWritten counts the samples and histogram windows accepted by
+	// the series held now; evicted and deleted series drop out of it
+	SamplesWritten uint64 `json:"samples_written"`
+
+	// EstimatedBytes approximates the memory of the rings, per-instance
+	// rings and rollups from their sizes and slot widths; RollupBytes is
+	// the rollups' share, counting only the buckets allocated so far
+	EstimatedBytes int64 `json:"estimated_bytes"`
+	RollupBytes    int64 `json:"rollup_bytes"`
+}
+
+// SeriesSize is the number of samples, or histogram windows, a series'
+// ring holds when full
+type SeriesSize struct {
+	Service string `json:"service"`
+	Metric  string `json:"metric"`
+	Kind    string `json:"kind"`
+	Size    int    `json:"size"`
+}
+
+// Stats returns the registry's series counts, limits, evictions,
+// rejections, ring sizes, samples written and memory estimate. It reads
+// each ring's counters but no samples, so it is cheap enough to call
+// every few seconds.
+func (r *Registry) Stats() RegistryStats {
+	r.mu.RLock()
+	stats := RegistryStats{
+		Series: SeriesCounts{
+			Gauges:     len(r.gauges),
+			Counters:   len(r.counters),
+			Histograms: len(r.histograms),
+			Instances:  r.instanceRings,
+		},
+		Services:            make(map[string]SeriesCounts, len(r.seriesCounts)),
+		MaxSeriesPerService: r.maxSeriesPerService,
+		MaxSeriesTotal:      r.maxSeriesTotal,
+		Evicted:             r.evicted,
+	}
+	for service, c := range r.seriesCounts {
+		stats.Services[service] = *c
+		stats.Series.slots += c.slots
+		stats.Series.histogramSlots += c.histogramSlots
+	}
+	stats.Sizes = make([]SeriesSize, 0, stats.Series.Total())
+	add := func(key MetricKey, kind string, size int) {
+		stats.Sizes = append(stats.Sizes, SeriesSize{Service: key.Service, Metric: key.Name, Kind: kind, Size: size})
+	}
+	for key, ring := range r.gauges {
+		add(key, "gauge", ring.Cap())
+		stats.SamplesWritten += ring.Count()
+		stats.RollupBytes += ring.rollup.bytes()
+	}
+	for key, ring := range r.counters {
+		add(key, "counter", ring.Cap())
+		stats.SamplesWritten += ring.Count()
+		stats.RollupBytes += ring.rollup.bytes()
+	}
+	for key, ring := range r.histograms {
+		add(key, "histogram", ring.Cap())
+		stats.SamplesWritten += ring.count()
+	}
+	r.mu.RUnlock()
+
+	stats.EstimatedBytes = stats.Series.EstimatedBytes() + stats.RollupBytes
+
+	sort.Slice(stats.Sizes, func(i, j int) bool {
+		a, b := stats.Sizes[i], stats.Sizes[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		return a.Kind < b.Kind
+	})
+
+	stats.Rejected = r.Rejected()
+	return stats
+}
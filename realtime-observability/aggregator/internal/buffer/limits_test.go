@@ -0,0 +1,66 @@
+package buffer
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+)
+
+func TestStatsEstimatedBytesUsesSlotWidth(t *testing.T) {
+	r := NewRegistryWithOptions(Options{DefaultRingSize: 10, DisableRollups: true})
+	r.GetRing("checkout", "cpu").Push(Sample{Ts: 1, Val: 1})
+
+	stats := r.Stats()
+	want := int64(10 * unsafe.Sizeof(slot{}))
+	if stats.EstimatedBytes != want {
+		t.Fatalf("EstimatedBytes = %d, want %d", stats.EstimatedBytes, want)
+	}
+	if got := stats.Services["checkout"].EstimatedBytes(); got != want {
+		t.Fatalf("service EstimatedBytes = %d, want %d", got, want)
+	}
+}
+
+func TestInstanceRingsCountAgainstSeriesLimits(t *testing.T) {
+	r := NewRegistryWithOptions(Options{MaxSeriesPerService: 3, DefaultRingSize: 10, DisableRollups: true})
+
+	// The service ring plus two instance rings reach the cap of 3
+	for _, instance := range []string{"pod-1", "pod-2"} {
+		if err := r.PushGauge("checkout", instance, "cpu", Sample{Ts: 1, Val: 1}); err != nil {
+			t.Fatalf("push from %s: %v", instance, err)
+		}
+	}
+	err := r.PushGauge("checkout", "pod-3", "cpu", Sample{Ts: 2, Val: 1})
+	if !errors.Is(err, ErrSeriesLimit) {
+		t.Fatalf("push from a third instance: err = %v, want ErrSeriesLimit", err)
+	}
+	if got := r.Rejected()["checkout"]; got != 1 {
+		t.Fatalf("rejected = %d, want 1", got)
+	}
+	// Existing instances keep working at the cap
+	if err := r.PushGauge("checkout", "pod-1", "cpu", Sample{Ts: 3, Val: 2}); err != nil {
+		t.Fatalf("push from an existing instance: %v", err)
+	}
+
+	counts := r.SeriesCounts()["checkout"]
+	if counts.Gauges != 1 || counts.Instances != 2 {
+		t.Fatalf("counts = %+v, want 1 gauge and 2 instance rings", counts)
+	}
+	if got, want := counts.EstimatedBytes(), int64(3*10*unsafe.Sizeof(slot{})); got != want {
+		t.Fatalf("EstimatedBytes = %d, want %d", got, want)
+	}
+
+	// Forgetting an instance frees its slot
+	r.ForgetInstance("checkout", "pod-2")
+	if err := r.PushGauge("checkout", "pod-3", "cpu", Sample{Ts: 4, Val: 1}); err != nil {
+		t.Fatalf("push after forgetting an instance: %v", err)
+	}
+
+	// Deleting the metric drops its instance rings with it
+	r.DeleteMetric("checkout", "cpu")
+	if counts, ok := r.SeriesCounts()["checkout"]; ok {
+		t.Fatalf("counts after delete = %+v, want none", counts)
+	}
+	if stats := r.Stats(); stats.Series.Instances != 0 || stats.EstimatedBytes != 0 {
+		t.Fatalf("stats after delete = %+v", stats.Series)
+	}
+}
@@ -0,0 +1,221 @@
+package buffer
+
+import (
+	"math"
+)
+
+// Marker flags a synthetic sample that records a reporting gap rather than a
+// measured value. Marker samples carry a NaN value (histograms carry no
+// buckets) and must be filtered out by consumers that only want data.
+type Marker uint8
+
+const (
+	// MarkerNone is an ordinary sample
+	MarkerNone Marker = iota
+
+	// MarkerGap opens a gap: the service stopped reporting after the
+	// previous sample
+	MarkerGap
+
+	// MarkerResume closes a gap just before the first sample after it
+	MarkerResume
+)
+
+// String returns the marker name used in API payloads
+func (m Marker) String() string {
+	switch m {
+	case MarkerGap:
+		return "gap"
+	case MarkerResume:
+		return "resume"
+	}
+	return ""
+}
+
+// IsMarker reports whether the sample is a gap or resume marker
+func (s Sample) IsMarker() bool {
+	return s.Marker != MarkerNone
+}
+
+// IsMarker reports whether the histogram is a gap or resume marker
+func (h HistogramData) IsMarker() bool {
+	return h.Marker != MarkerNone
+}
+
+// MarkGap pushes a gap marker into every ring of a service, stamped just
+// after the ring's newest sample. Rings that are empty or already in a gap
+// are skipped. It returns the number of markers written.
+func (r *Registry) MarkGap(service string) int {
+	return r.markService(service, MarkerGap, 0)
+}
+
+// MarkResume closes open gaps in a service's rings with a resume marker
+// stamped just before ts, the first timestamp after the gap. It returns the
+// number of markers written.
+func (r *Registry) MarkResume(service string, ts int64) int {
+	return r.markService(service, MarkerResume, ts)
+}
+
+// markService writes marker m into a service's rings. Each is written
+// under its series' lock, which pushes also hold, so the sweeper calling
+// this is never a second writer beside ingest.
+func (r *Registry) markService(service string, m Marker, ts int64) int {
+	type serviceRing struct {
+		series map[MetricKey]*instanceSeries
+		rings  map[MetricKey]*Ring
+		key    MetricKey
+		ring   *Ring
+	}
+	r.mu.RLock()
+	var rings []serviceRing
+	for key, ring := range r.gauges {
+		if key.Service == service {
+			rings = append(rings, serviceRing{r.instanceGauges, r.gauges, key, ring})
+		}
+	}
+	for key, ring := range r.counters {
+		if key.Service == service {
+			rings = append(rings, serviceRing{r.instanceCounters, r.counters, key, ring})
+		}
+	}
+	histRings := make(map[MetricKey]*HistogramRing)
+	for key, ring := range r.histograms {
+		if key.Service == service {
+			histRings[key] = ring
+		}
+	}
+	r.mu.RUnlock()
+
+	marked := 0
+	for _, sr := range rings {
+		s := r.instanceSeriesFor(sr.series, sr.rings, sr.key, sr.ring)
+		s.mu.Lock()
+		if markRing(sr.ring, m, ts) {
+			marked++
+		}
+		s.mu.Unlock()
+	}
+	for key, ring := range histRings {
+		s := r.instanceHistogramsFor(key, ring)
+		s.mu.Lock()
+		if markHistogramRing(ring, m, ts) {
+			marked++
+		}
+		s.mu.Unlock()
+	}
+	return marked
+}
+
+// MarkInstanceGap pushes a gap marker into every ring of one instance of
+// a service, as MarkGap does for the service's own rings. The instance's
+// gauges then drop out of the service's aggregates until it resumes.
+func (r *Registry) MarkInstanceGap(service, instance string) int {
+	return r.markInstance(service, instance, MarkerGap, 0)
+}
+
+// MarkInstanceResume closes open gaps in one instance's rings, as
+// MarkResume does for the service's own rings
+func (r *Registry) MarkInstanceResume(service, instance string, ts int64) int {
+	return r.markInstance(service, instance, MarkerResume, ts)
+}
+
+// markInstance writes marker m into an instance's rings, each under its
+// series' lock like markService
+func (r *Registry) markInstance(service, instance string, m Marker, ts int64) int {
+	r.mu.RLock()
+	var series []*instanceSeries
+	for _, byKey := range []map[MetricKey]*instanceSeries{r.instanceGauges, r.instanceCounters} {
+		for key, s := range byKey {
+			if key.Service == service {
+				series = append(series, s)
+			}
+		}
+	}
+	var histSeries []*instanceHistograms
+	for key, s := range r.instanceHistograms {
+		if key.Service == service {
+			histSeries = append(histSeries, s)
+		}
+	}
+	r.mu.RUnlock()
+
+	marked := 0
+	for _, s := range series {
+		s.mu.Lock()
+		if ring, ok := s.rings[instance]; ok && markRing(ring, m, ts) {
+			marked++
+		}
+		s.mu.Unlock()
+	}
+	for _, s := range histSeries {
+		s.mu.Lock()
+		if ring, ok := s.rings[instance]; ok && markHistogramRing(ring, m, ts) {
+			marked++
+		}
+		s.mu.Unlock()
+	}
+	return marked
+}
+
+// markerTs returns when to stamp marker m in a ring whose newest entry is
+// at newestTs and carries newest: a gap just after it, a resume just
+// before ts. ok is false for a gap in a ring already in one, and a resume
+// in a ring that is not.
+func markerTs(m Marker, newestTs int64, newest Marker, ts int64) (int64, bool) {
+	if (newest == MarkerGap) == (m == MarkerGap) {
+		return 0, false
+	}
+	if m == MarkerGap {
+		return newestTs + 1, true
+	}
+	return max(ts-1, newestTs), true
+}
+
+// markRing pushes marker m into a non-empty ring, reporting whether it
+// applied; caller holds the series lock
+func markRing(ring *Ring, m Marker, ts int64) bool {
+	newest, ok := ring.Latest()
+	if !ok {
+		return false
+	}
+	at, ok := markerTs(m, newest.Ts, newest.Marker, ts)
+	if ok {
+		ring.Push(Sample{Ts: at, Val: math.NaN(), Marker: m})
+	}
+	return ok
+}
+
+// markHistogramRing is markRing for histogram rings
+func markHistogramRing(ring *HistogramRing, m Marker, ts int64) bool {
+	newest, ok := ring.Latest()
+	if !ok {
+		return false
+	}
+	at, ok := markerTs(m, newest.Ts, newest.Marker, ts)
+	if ok {
+		ring.Push(HistogramData{Ts: at, Marker: m})
+	}
+	return ok
+}
+
+// withoutMarkers returns samples with marker samples removed
+func withoutMarkers(samples []Sample) []Sample {
+	result := samples[:0]
+	for _, s := range samples {
+		if !s.IsMarker() {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// histogramsWithoutMarkers returns histograms with marker entries removed
+func histogramsWithoutMarkers(histograms []HistogramData) []HistogramData {
+	result := histograms[:0]
+	for _, h := range histograms {
+		if !h.IsMarker() {
+			result = append(result, h)
+		}
+	}
+	return result
+}
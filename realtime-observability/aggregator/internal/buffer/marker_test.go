@@ -0,0 +1,49 @@
+package buffer
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMarkersSerializeWithPushes(t *testing.T) {
+	r := NewRegistry()
+	const pushes = 200
+
+	// Instanced and instance-less pushes race the sweeper's markers; each
+	// marker lands in order in the single-writer ring, or -race reports it
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range pushes {
+			r.PushGauge("checkout", "pod-1", "cpu", Sample{Ts: int64(i) * 10, Val: 1})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range pushes {
+			r.PushCounter("checkout", "", "requests_total", CounterSample(int64(i)*10, uint64(i)))
+		}
+	}()
+	markers := 0
+	for range pushes {
+		markers += r.MarkGap("checkout")
+		markers += r.MarkResume("checkout", 0)
+	}
+	wg.Wait()
+
+	written := 0
+	for _, ring := range []*Ring{r.GetRing("checkout", "cpu"), r.GetCounterRing("checkout", "requests_total")} {
+		for _, s := range ring.Snapshot() {
+			if s.IsMarker() {
+				written++
+			}
+		}
+		if ring.Dropped() != 0 {
+			t.Fatalf("ring dropped %d samples, want markers stamped in order", ring.Dropped())
+		}
+	}
+	if written != markers {
+		t.Fatalf("rings hold %d markers, want the %d reported written", written, markers)
+	}
+}
@@ -0,0 +1,115 @@
+package buffer
+
+import (
+	"sort"
+)
+
+// Metadata describes a metric as reported by the agent's Describe API
+type Metadata struct {
+	Type string `json:"type,omitempty"`
+	Unit string `json:"unit,omitempty"`
+	Help string `json:"help,omitempty"`
+}
+
+// SetMetadata records a metric's description. The first description wins;
+// a later, different one from another instance is ignored and counted as a
+// conflict. It reports whether m was stored or already matched.
+func (r *Registry) SetMetadata(service, name string, m Metadata) bool {
+	key := MetricKey{Service: service, Name: name}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if prev, ok := r.metadata[key]; ok {
+		if prev != m {
+			r.metadataConflicts++
+			return false
+		}
+		return true
+	}
+	r.metadata[key] = m
+	return true
+}
+
+// Metadata returns a metric's description
+func (r *Registry) Metadata(service, name string) (Metadata, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.metadata[MetricKey{Service: service, Name: name}]
+	return m, ok
+}
+
+// metadataLocked returns a series' description, falling back to that of
+// its metric name for labeled series; caller holds r.mu
+func (r *Registry) metadataLocked(key MetricKey) Metadata {
+	if m, ok := r.metadata[key]; ok {
+		return m
+	}
+	if name, labels := SplitSeriesName(key.Name); labels != "" {
+		return r.metadata[MetricKey{Service: key.Service, Name: name}]
+	}
+	return Metadata{}
+}
+
+// AllMetadata returns a copy of every recorded description
+func (r *Registry) AllMetadata() map[MetricKey]Metadata {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make(map[MetricKey]Metadata, len(r.metadata))
+	for key, m := range r.metadata {
+		result[key] = m
+	}
+	return result
+}
+
+// MetadataConflicts returns how many conflicting descriptions were ignored
+func (r *Registry) MetadataConflicts() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.metadataConflicts
+}
+
+// CatalogEntry is one series with its storage kind and description
+type CatalogEntry struct {
+	Service string `json:"service"`
+	Metric  string `json:"metric"`
+	Kind    string `json:"kind"`
+	Metadata
+}
+
+// Catalog lists every series with its description, sorted by key
+func (r *Registry) Catalog() []CatalogEntry {
+	r.mu.RLock()
+	result := make([]CatalogEntry, 0, len(r.gauges)+len(r.counters)+len(r.histograms))
+	add := func(key MetricKey, kind string) {
+		result = append(result, CatalogEntry{
+			Service:  key.Service,
+			Metric:   key.Name,
+			Kind:     kind,
+			Metadata: r.metadataLocked(key),
+		})
+	}
+	for key := range r.gauges {
+		add(key, "gauge")
+	}
+	for key := range r.counters {
+		add(key, "counter")
+	}
+	for key := range r.histograms {
+		add(key, "histogram")
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		return a.Kind < b.Kind
+	})
+	return result
+}
@@ -0,0 +1,110 @@
+package buffer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OrderMode selects how rings handle samples older than their newest entry
+type OrderMode int
+
+const (
+	// OrderDrop discards out-of-order samples and counts them
+	OrderDrop OrderMode = iota
+
+	// OrderReorder holds the last Window of writes and releases them in
+	// timestamp order; samples older than the window are still dropped
+	OrderReorder
+)
+
+// OrderPolicy configures out-of-order handling for newly created rings
+type OrderPolicy struct {
+	Mode   OrderMode
+	Window time.Duration
+}
+
+// ParseOrderMode parses "drop" or "reorder"
+func ParseOrderMode(s string) (OrderMode, error) {
+	switch s {
+	case "", "drop":
+		return OrderDrop, nil
+	case "reorder":
+		return OrderReorder, nil
+	}
+	return OrderDrop, fmt.Errorf("unknown out-of-order mode %q (want drop or reorder)", s)
+}
+
+// reorderBuffer holds recent samples sorted by timestamp until they fall
+// behind the newest by more than window
+type reorderBuffer struct {
+	window  int64
+	pending []Sample
+	mu      sync.Mutex
+}
+
+// insert adds s in timestamp order, keeping arrival order for equal stamps
+func (b *reorderBuffer) insert(s Sample) {
+	i := sort.Search(len(b.pending), func(i int) bool { return b.pending[i].Ts > s.Ts })
+	b.pending = append(b.pending, Sample{})
+	copy(b.pending[i+1:], b.pending[i:])
+	b.pending[i] = s
+}
+
+// release removes and returns the samples older than the window
+func (b *reorderBuffer) release() []Sample {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	cutoff := b.pending[len(b.pending)-1].Ts - b.window
+	n := sort.Search(len(b.pending), func(i int) bool { return b.pending[i].Ts > cutoff })
+	if n == 0 {
+		return nil
+	}
+	released := make([]Sample, n)
+	copy(released, b.pending[:n])
+	b.pending = b.pending[:copy(b.pending, b.pending[n:])]
+	return released
+}
+
+// OutOfOrderDrops returns the number of dropped out-of-order samples per key,
+// omitting keys that never dropped one
+func (r *Registry) OutOfOrderDrops() map[MetricKey]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make(map[MetricKey]uint64)
+	for key, ring := range r.gauges {
+		if n := ring.Dropped(); n > 0 {
+			result[key] += n
+		}
+	}
+	for key, ring := range r.counters {
+		if n := ring.Dropped(); n > 0 {
+			result[key] += n
+		}
+	}
+	for key, ring := range r.histograms {
+		if n := ring.Dropped(); n > 0 {
+			result[key] += n
+		}
+	}
+	for key, s := range r.instanceHistograms {
+		s.mu.Lock()
+		for _, ring := range s.rings {
+			if n := ring.Dropped(); n > 0 {
+				result[key] += n
+			}
+		}
+		s.mu.Unlock()
+	}
+	return result
+}
+
+// SetOrderPolicy sets the out-of-order policy for rings created from now on
+func (r *Registry) SetOrderPolicy(policy OrderPolicy) {
+	r.mu.Lock()
+	r.order = policy
+	r.mu.Unlock()
+}
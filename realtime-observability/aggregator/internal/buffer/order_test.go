@@ -0,0 +1,119 @@
+package buffer
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// shuffled returns timestamps 1..n in seconds, each moved at most 4 places
+// by shuffling blocks of 5
+func shuffled(n int) []int64 {
+	rng := rand.New(rand.NewPCG(1, 2))
+	ts := make([]int64, n)
+	for i := range ts {
+		ts[i] = int64(i+1) * int64(time.Second)
+	}
+	for start := 0; start < n; start += 5 {
+		block := ts[start:min(start+5, n)]
+		rng.Shuffle(len(block), func(i, j int) { block[i], block[j] = block[j], block[i] })
+	}
+	return ts
+}
+
+// inOrder returns the timestamps an OrderDrop ring keeps: each one at or
+// above every timestamp before it
+func inOrder(ts []int64) []int64 {
+	var kept []int64
+	for _, t := range ts {
+		if len(kept) == 0 || t >= kept[len(kept)-1] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+func sampleStamps(samples []Sample) []int64 {
+	ts := make([]int64, len(samples))
+	for i, s := range samples {
+		ts[i] = s.Ts
+	}
+	return ts
+}
+
+func histogramStamps(hists []HistogramData) []int64 {
+	ts := make([]int64, len(hists))
+	for i, h := range hists {
+		ts[i] = h.Ts
+	}
+	return ts
+}
+
+func TestShuffledPushes(t *testing.T) {
+	const n = 100
+	seq := shuffled(n)
+	all := slices.Clone(seq)
+	slices.Sort(all)
+	kept := inOrder(seq)
+	if len(kept) == n {
+		t.Fatal("the shuffle left the sequence in order")
+	}
+	// Released far behind the newest whatever the policy
+	late := int64(50 * time.Second)
+	reorder := OrderPolicy{Mode: OrderReorder, Window: 10 * time.Second}
+
+	tests := []struct {
+		name    string
+		policy  OrderPolicy
+		want    []int64
+		dropped uint64
+	}{
+		{"drop", OrderPolicy{Mode: OrderDrop}, kept, uint64(n-len(kept)) + 1},
+		{"reorder", reorder, all, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NewRingWithPolicy(2*n, tt.policy)
+			hists := NewHistogramRingWithPolicy(2*n, tt.policy)
+			for _, ts := range append(slices.Clone(seq), late) {
+				ring.Push(Sample{Ts: ts, Val: float64(ts)})
+				hists.Push(HistogramData{Ts: ts, Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 1})
+			}
+
+			if got := sampleStamps(ring.Snapshot()); !slices.Equal(got, tt.want) {
+				t.Fatalf("ring snapshot = %v, want %v", got, tt.want)
+			}
+			if got := histogramStamps(hists.Snapshot()); !slices.Equal(got, tt.want) {
+				t.Fatalf("histogram snapshot = %v, want %v", got, tt.want)
+			}
+			if ring.Dropped() != tt.dropped || hists.Dropped() != tt.dropped {
+				t.Fatalf("Dropped = %d ring, %d histogram; want %d", ring.Dropped(), hists.Dropped(), tt.dropped)
+			}
+			if latest, _ := ring.Latest(); latest.Ts != int64(n*time.Second) {
+				t.Fatalf("Latest = %d, want %d", latest.Ts, int64(n*time.Second))
+			}
+			if latest, _ := hists.Latest(); latest.Ts != int64(n*time.Second) {
+				t.Fatalf("histogram Latest = %d, want %d", latest.Ts, int64(n*time.Second))
+			}
+		})
+	}
+}
+
+func TestOutOfOrderDropsPerKey(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	r.SetOrderPolicy(OrderPolicy{Mode: OrderDrop})
+
+	seq := shuffled(100)
+	for _, ts := range seq {
+		r.PushGauge("checkout", "", "cpu_usage", Sample{Ts: ts, Val: 1})
+	}
+	r.PushGauge("cart", "", "cpu_usage", Sample{Ts: 1, Val: 1})
+
+	drops := r.OutOfOrderDrops()
+	want := uint64(len(seq) - len(inOrder(seq)))
+	if got := drops[MetricKey{Service: "checkout", Name: "cpu_usage"}]; got != want || len(drops) != 1 {
+		t.Fatalf("OutOfOrderDrops = %v, want %d for checkout only", drops, want)
+	}
+}
@@ -0,0 +1,208 @@
+package buffer
+
+import (
+	"sort"
+	"strings"
+)
+
+// PurgeSummary lists the series removed by a purge, or that would be
+// removed in a dry run
+type PurgeSummary struct {
+	Gauges     []string `json:"gauges"`
+	Counters   []string `json:"counters"`
+	Histograms []string `json:"histograms"`
+	Exemplars  []string `json:"exemplars"`
+}
+
+// Total returns the number of series in the summary
+func (s PurgeSummary) Total() int {
+	return len(s.Gauges) + len(s.Counters) + len(s.Histograms) + len(s.Exemplars)
+}
+
+// DeleteHook is notified after a metric key has been removed from the registry
+type DeleteHook func(key MetricKey)
+
+// OnDelete registers a hook called for every deleted key
+func (r *Registry) OnDelete(hook DeleteHook) {
+	r.mu.Lock()
+	r.deleteHooks = append(r.deleteHooks, hook)
+	r.mu.Unlock()
+}
+
+// ServiceDeleteHook is notified after a service has been purged, once its
+// per-key hooks have run
+type ServiceDeleteHook func(service string)
+
+// OnDeleteService registers a hook called for every purged service, for
+// state kept by service rather than by key
+func (r *Registry) OnDeleteService(hook ServiceDeleteHook) {
+	r.mu.Lock()
+	r.serviceDeleteHooks = append(r.serviceDeleteHooks, hook)
+	r.mu.Unlock()
+}
+
+// DeleteService removes every series of a service, as PurgeService does,
+// and returns how many gauge, counter and histogram series it removed.
+// Snapshots taken from then on, such as the next WebSocket broadcast, no
+// longer include them.
+func (r *Registry) DeleteService(service string) int {
+	summary := r.PurgeService(service, false)
+	return len(summary.Gauges) + len(summary.Counters) + len(summary.Histograms)
+}
+
+// DeleteMetric removes a metric of a service across all types, with every
+// labeled series of it, as PurgeMetric does, and reports whether any
+// existed
+func (r *Registry) DeleteMetric(service, name string) bool {
+	return r.PurgeMetric(service, name, false).Total() > 0
+}
+
+// DeleteMetricLabeled removes the one series of a metric with exactly
+// these labels, across all types, and reports whether it existed; without
+// labels it removes only the unlabeled series
+func (r *Registry) DeleteMetricLabeled(service, name string, labels map[string]string) bool {
+	target := MetricKey{Service: service, Name: SeriesName(name, labels)}
+	return r.purge(func(key MetricKey) bool { return key == target }, false).Total() > 0
+}
+
+// PurgeService removes every series of a service, along with its known
+// instances and events
+func (r *Registry) PurgeService(service string, dryRun bool) PurgeSummary {
+	summary := r.purge(func(key MetricKey) bool { return key.Service == service }, dryRun)
+	if !dryRun {
+		r.mu.Lock()
+		delete(r.events, service)
+		for key := range r.instances {
+			if key.service == service {
+				delete(r.instances, key)
+			}
+		}
+		hooks := r.serviceDeleteHooks
+		r.mu.Unlock()
+
+		r.rejectMu.Lock()
+		delete(r.rejected, service)
+		r.rejectMu.Unlock()
+
+		for _, hook := range hooks {
+			hook(service)
+		}
+	}
+	return summary
+}
+
+// PurgeMetric removes a single metric of a service across all types. A
+// plain name also matches its labeled series, name{...}; a SeriesName
+// matches only itself.
+func (r *Registry) PurgeMetric(service, name string, dryRun bool) PurgeSummary {
+	target := MetricKey{Service: service, Name: name}
+	labeled := name + "{"
+	if strings.IndexByte(name, '{') >= 0 {
+		labeled = ""
+	}
+	return r.purge(func(key MetricKey) bool {
+		return key == target ||
+			labeled != "" && key.Service == service && strings.HasPrefix(key.Name, labeled)
+	}, dryRun)
+}
+
+// purge deletes matching keys under a single write lock, so a concurrent
+// push either lands in the old ring before the purge or creates a fresh
+// ring afterwards; a key is never left half removed
+func (r *Registry) purge(match func(MetricKey) bool, dryRun bool) PurgeSummary {
+	summary := PurgeSummary{
+		Gauges:     []string{},
+		Counters:   []string{},
+		Histograms: []string{},
+		Exemplars:  []string{},
+	}
+	var deleted []MetricKey
+
+	r.mu.Lock()
+	for key, ring := range r.gauges {
+		if match(key) {
+			summary.Gauges = append(summary.Gauges, key.Name)
+			if !dryRun {
+				delete(r.gauges, key)
+				r.dropInstanceSeriesLocked(r.instanceGauges, key)
+				c := r.serviceCounts(key.Service)
+				c.Gauges--
+				c.slots -= ring.Cap()
+				deleted = append(deleted, key)
+			}
+		}
+	}
+	for key, ring := range r.counters {
+		if match(key) {
+			summary.Counters = append(summary.Counters, key.Name)
+			if !dryRun {
+				delete(r.counters, key)
+				r.dropInstanceSeriesLocked(r.instanceCounters, key)
+				c := r.serviceCounts(key.Service)
+				c.Counters--
+				c.slots -= ring.Cap()
+				deleted = append(deleted, key)
+			}
+		}
+	}
+	for key, ring := range r.histograms {
+		if match(key) {
+			summary.Histograms = append(summary.Histograms, key.Name)
+			if !dryRun {
+				delete(r.histograms, key)
+				r.dropInstanceHistogramsLocked(key)
+				c := r.serviceCounts(key.Service)
+				c.Histograms--
+				c.histogramSlots -= ring.Cap()
+				deleted = append(deleted, key)
+			}
+		}
+	}
+	for key := range r.exemplars {
+		if match(key) {
+			summary.Exemplars = append(summary.Exemplars, key.Name)
+			if !dryRun {
+				delete(r.exemplars, key)
+			}
+		}
+	}
+	if !dryRun {
+		for key := range r.metadata {
+			if match(key) {
+				delete(r.metadata, key)
+			}
+		}
+	}
+	for service, c := range r.seriesCounts {
+		if c.Total() == 0 {
+			delete(r.seriesCounts, service)
+		}
+	}
+	hooks := r.deleteHooks
+	r.mu.Unlock()
+
+	for _, key := range uniqueKeys(deleted) {
+		for _, hook := range hooks {
+			hook(key)
+		}
+	}
+
+	sort.Strings(summary.Gauges)
+	sort.Strings(summary.Counters)
+	sort.Strings(summary.Histograms)
+	sort.Strings(summary.Exemplars)
+	return summary
+}
+
+func uniqueKeys(keys []MetricKey) []MetricKey {
+	seen := make(map[MetricKey]struct{}, len(keys))
+	result := keys[:0]
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		result = append(result, key)
+	}
+	return result
+}
@@ -0,0 +1,130 @@
+package buffer
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeleteMetricRemovesLabeledSeries(t *testing.T) {
+	r := NewRegistry()
+	r.GetRing("checkout", "latency")
+	r.GetRingLabeled("checkout", "latency", map[string]string{"route": "/a"})
+	r.GetCounterRingLabeled("checkout", "latency", map[string]string{"route": "/b"})
+	r.GetRing("checkout", "latency_p99")
+	r.GetRingLabeled("cart", "latency", map[string]string{"route": "/a"})
+
+	if !r.DeleteMetric("checkout", "latency") {
+		t.Fatal("DeleteMetric reported nothing removed")
+	}
+	if got, want := sorted(r.ListMetrics("checkout")), []string{"latency_p99"}; !slices.Equal(got, want) {
+		t.Fatalf("checkout metrics = %v, want %v", got, want)
+	}
+	if got := r.ListMetrics("cart"); len(got) != 1 {
+		t.Fatalf("cart metrics = %v, want its labeled latency kept", got)
+	}
+}
+
+func TestDeleteMetricLabeledRemovesOneSeries(t *testing.T) {
+	r := NewRegistry()
+	r.GetRing("checkout", "latency")
+	r.GetRingLabeled("checkout", "latency", map[string]string{"route": "/a"})
+	r.GetRingLabeled("checkout", "latency", map[string]string{"route": "/b"})
+
+	if !r.DeleteMetricLabeled("checkout", "latency", map[string]string{"route": "/a"}) {
+		t.Fatal("DeleteMetricLabeled reported nothing removed")
+	}
+	want := []string{"latency", `latency{route="/b"}`}
+	if got := sorted(r.ListMetrics("checkout")); !slices.Equal(got, want) {
+		t.Fatalf("checkout metrics = %v, want %v", got, want)
+	}
+	if r.DeleteMetricLabeled("checkout", "latency", map[string]string{"route": "/a"}) {
+		t.Fatal("second DeleteMetricLabeled reported a removal")
+	}
+
+	// A SeriesName passed to PurgeMetric matches only itself
+	summary := r.PurgeMetric("checkout", `latency{route="/b"}`, false)
+	if summary.Total() != 1 {
+		t.Fatalf("PurgeMetric of a series name removed %v", summary)
+	}
+}
+
+func sorted(s []string) []string {
+	slices.Sort(s)
+	return s
+}
+
+// TestPurgeWhilePushing purges a service while writers keep pushing to it
+// and to a neighbour; run it with -race. Every purge must leave the counts
+// matching what is left, and the neighbour must lose nothing.
+func TestPurgeWhilePushing(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+
+	pushOnce := func(reg *Registry, service, instance string, ts int64) {
+		reg.PushGauge(service, instance, "cpu_usage", Sample{Ts: ts, Val: 1})
+		reg.PushGauge(service, instance, SeriesName("requests", map[string]string{"route": "/a"}), Sample{Ts: ts, Val: 1})
+		reg.PushCounter(service, instance, "requests_total", CounterSample(ts, uint64(ts)))
+		reg.PushHistogram(service, instance, "latency", HistogramData{Ts: ts, Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 1})
+	}
+	// want holds the counts of the series above on two instances
+	want := NewRegistry()
+	defer want.Close()
+	pushOnce(want, "cart", "a", 1)
+	pushOnce(want, "cart", "b", 1)
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	push := func(service, instance string) {
+		defer wg.Done()
+		for ts := int64(1); !done.Load(); ts++ {
+			pushOnce(r, service, instance, ts)
+		}
+	}
+	for _, instance := range []string{"a", "b"} {
+		wg.Add(2)
+		go push("checkout", instance)
+		go push("cart", instance)
+	}
+
+	duration := 200 * time.Millisecond
+	if testing.Short() {
+		duration = 20 * time.Millisecond
+	}
+	for r.SeriesCounts()["cart"].Histograms == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	purges := 0
+	for start := time.Now(); time.Since(start) < duration; purges++ {
+		if purges%2 == 0 {
+			r.PurgeService("checkout", false)
+		} else {
+			r.PurgeMetric("checkout", "requests", false)
+		}
+	}
+	done.Store(true)
+	wg.Wait()
+
+	r.PurgeService("checkout", false)
+	if metrics := r.ListMetrics("checkout"); len(metrics) != 0 {
+		t.Fatalf("checkout metrics after the purge = %v", metrics)
+	}
+	if instances := r.ListInstances("checkout"); len(instances) != 0 {
+		t.Fatalf("checkout instances after the purge = %v", instances)
+	}
+	if c, ok := r.SeriesCounts()["checkout"]; ok {
+		t.Fatalf("checkout counts after the purge = %+v, want none", c)
+	}
+	if got, want := r.SeriesCounts()["cart"], want.SeriesCounts()["cart"]; got != want {
+		t.Fatalf("cart counts = %+v, want %+v", got, want)
+	}
+
+	// A push after the purge starts the service from scratch
+	pushOnce(r, "checkout", "a", 1)
+	pushOnce(want, "checkout", "a", 1)
+	if got, want := r.SeriesCounts()["checkout"], want.SeriesCounts()["checkout"]; got != want {
+		t.Fatalf("checkout counts after a new push = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,237 @@
+package buffer
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// canonicalBounds fixes the bucket layout of one histogram series. Windows
+// with other bounds are re-bucketed into it on Push so every window in the
+// ring merges and exports consistently.
+type canonicalBounds struct {
+	bounds []float64
+	// counts is the number of buckets, len(bounds) plus an optional
+	// overflow bucket
+	counts int
+}
+
+// Rebucket converts a window to other bounds by spreading each bucket's
+// count over the target buckets in proportion to how much of its range
+// they cover, assuming observations are uniform inside a bucket. The
+// source overflow bucket has no upper edge and lands in the first target
+// bucket above the source's last bound. Rounding uses largest remainders,
+// so the total count is conserved exactly; Sum and Count are unchanged.
+// counts is the length of the result: len(bounds), or len(bounds)+1 for an
+// overflow bucket.
+func Rebucket(h HistogramData, bounds []float64, counts int) HistogramData {
+	out := h
+	out.Bounds = bounds
+	out.Counts = make([]uint64, counts)
+	if len(bounds) == 0 || counts == 0 {
+		return out
+	}
+
+	// target returns the bucket holding value v
+	target := func(v float64) int {
+		i := sort.SearchFloat64s(bounds, v)
+		return min(i, counts-1)
+	}
+
+	shares := make([]float64, counts)
+	for i, c := range h.Counts {
+		if c == 0 {
+			continue
+		}
+		if i >= len(h.Bounds) {
+			// Overflow: everything above the last source bound
+			last := math.Inf(-1)
+			if len(h.Bounds) > 0 {
+				last = h.Bounds[len(h.Bounds)-1]
+			}
+			shares[target(math.Nextafter(last, math.Inf(1)))] += float64(c)
+			continue
+		}
+
+		lo, hi := bucketRange(h.Bounds, i)
+		if hi <= lo {
+			shares[target(hi)] += float64(c)
+			continue
+		}
+		for j := target(math.Nextafter(lo, math.Inf(1))); j < counts; j++ {
+			tlo, thi := bucketRange(bounds, j)
+			if j >= len(bounds) || j == counts-1 {
+				// The last target bucket takes everything above its lower edge
+				thi = math.Inf(1)
+			}
+			overlap := math.Min(hi, thi) - math.Max(lo, tlo)
+			if overlap > 0 {
+				shares[j] += float64(c) * overlap / (hi - lo)
+			}
+			if thi >= hi {
+				break
+			}
+		}
+	}
+
+	// Largest remainder rounding keeps the total exact
+	var total, assigned uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	order := make([]int, counts)
+	for j, s := range shares {
+		out.Counts[j] = uint64(s)
+		assigned += out.Counts[j]
+		order[j] = j
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		fa := shares[order[a]] - math.Floor(shares[order[a]])
+		fb := shares[order[b]] - math.Floor(shares[order[b]])
+		return fa > fb
+	})
+	for k := 0; assigned < total; k = (k + 1) % counts {
+		out.Counts[order[k]]++
+		assigned++
+	}
+	return out
+}
+
+// bucketRange returns the value range of bucket i, matching Percentile: the
+// first bucket starts at 0 unless its bound is negative, and the overflow
+// bucket starts at the last bound
+func bucketRange(bounds []float64, i int) (lo, hi float64) {
+	if i >= len(bounds) {
+		return bounds[len(bounds)-1], math.Inf(1)
+	}
+	hi = bounds[i]
+	switch {
+	case i > 0:
+		lo = bounds[i-1]
+	case hi < 0:
+		lo = hi
+	}
+	return lo, hi
+}
+
+// canonicalize re-buckets h into the ring's canonical layout, fixing the
+// layout from the first window if none was configured; caller holds the
+// write lock
+func (r *HistogramRing) canonicalize(h HistogramData) HistogramData {
+	if h.IsMarker() || len(h.Bounds) == 0 {
+		return h
+	}
+	if r.canonical.bounds == nil {
+		r.canonical = canonicalBounds{bounds: h.Bounds, counts: len(h.Counts)}
+		return h
+	}
+	if len(h.Counts) == r.canonical.counts && sameBounds(h.Bounds, r.canonical.bounds) {
+		return h
+	}
+
+	if r.rebucketed == 0 {
+		log.Printf("Histogram %s: bounds %v differ from canonical %v, re-bucketing",
+			r.key, h.Bounds, r.canonical.bounds)
+	}
+	r.rebucketed++
+	return Rebucket(h, r.canonical.bounds, r.canonical.counts)
+}
+
+// Rebucketed returns the number of windows converted to canonical bounds
+func (r *HistogramRing) Rebucketed() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rebucketed
+}
+
+// Rebucketed returns the number of re-bucketed histogram windows per key,
+// omitting keys whose windows always matched
+func (r *Registry) Rebucketed() map[MetricKey]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make(map[MetricKey]uint64)
+	for key, ring := range r.histograms {
+		if n := ring.Rebucketed(); n > 0 {
+			result[key] = n
+		}
+	}
+	return result
+}
+
+// SetCanonicalBounds configures the bucket layout of histogram metrics
+// instead of taking it from the first window. Keys with Service "*" apply
+// to that metric in every service. Layouts include an overflow bucket.
+func (r *Registry) SetCanonicalBounds(bounds map[MetricKey][]float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.canonical = bounds
+	for key, ring := range r.histograms {
+		if b, ok := r.canonicalFor(key); ok {
+			ring.mu.Lock()
+			ring.canonical = b
+			ring.mu.Unlock()
+		}
+	}
+	for key, s := range r.instanceHistograms {
+		b, ok := r.canonicalFor(key)
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		s.canonical = b
+		for _, ring := range s.rings {
+			ring.mu.Lock()
+			ring.canonical = b
+			ring.mu.Unlock()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// canonicalFor returns the configured layout for a key; caller holds the lock
+func (r *Registry) canonicalFor(key MetricKey) (canonicalBounds, bool) {
+	bounds, ok := r.canonical[key]
+	if !ok {
+		bounds, ok = r.canonical[MetricKey{Service: "*", Name: key.Name}]
+	}
+	if !ok {
+		return canonicalBounds{}, false
+	}
+	return canonicalBounds{bounds: bounds, counts: len(bounds) + 1}, true
+}
+
+// ParseCanonicalBounds parses "service/metric=b1,b2,...;*/metric=..." where
+// a "*" service matches every service
+func ParseCanonicalBounds(s string) (map[MetricKey][]float64, error) {
+	result := make(map[MetricKey][]float64)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, list, ok := strings.Cut(entry, "=")
+		service, metric, okKey := strings.Cut(name, "/")
+		if !ok || !okKey || service == "" || metric == "" {
+			return nil, fmt.Errorf("bounds %q: expected service/metric=b1,b2,...", entry)
+		}
+
+		var bounds []float64
+		for _, field := range strings.Split(list, ",") {
+			b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bounds %q: %w", entry, err)
+			}
+			if len(bounds) > 0 && b <= bounds[len(bounds)-1] {
+				return nil, fmt.Errorf("bounds %q: must be strictly increasing", entry)
+			}
+			bounds = append(bounds, b)
+		}
+		result[MetricKey{Service: service, Name: metric}] = bounds
+	}
+	return result, nil
+}
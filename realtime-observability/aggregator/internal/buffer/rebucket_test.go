@@ -0,0 +1,175 @@
+package buffer
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// Representative layouts in milliseconds: the agent's default, OTel's
+// default, a coarse one and one shifted off every other bound
+var (
+	agentBounds   = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+	otelBounds    = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+	coarseBounds  = []float64{10, 100, 1000}
+	shiftedBounds = []float64{3, 7, 15, 40, 80, 150, 400, 800, 2000, 4000}
+)
+
+var layouts = []struct {
+	name   string
+	bounds []float64
+}{
+	{"agent", agentBounds}, {"otel", otelBounds}, {"coarse", coarseBounds}, {"shifted", shiftedBounds},
+}
+
+// bucketize counts values into bounds plus an overflow bucket
+func bucketize(values []float64, bounds []float64) HistogramData {
+	h := HistogramData{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+	for _, v := range values {
+		h.Counts[sort.SearchFloat64s(bounds, v)]++
+		h.Sum += v
+		h.Count++
+	}
+	h.HasSum = true
+	return h
+}
+
+func total(counts []uint64) uint64 {
+	var n uint64
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+func TestRebucketConservesCount(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	for _, from := range layouts {
+		for _, to := range layouts {
+			src, dst := from.bounds, to.bounds
+			for _, overflow := range []bool{false, true} {
+				counts := len(dst)
+				if overflow {
+					counts++
+				}
+				h := HistogramData{Bounds: src, Counts: make([]uint64, len(src)+1), Sum: 12.5, Count: 99, HasSum: true}
+				for i := range h.Counts {
+					h.Counts[i] = rng.Uint64N(1000)
+				}
+				out := Rebucket(h, dst, counts)
+				name := fmt.Sprintf("%s to %s (overflow %v)", from.name, to.name, overflow)
+				if len(out.Counts) != counts || !slices.Equal(out.Bounds, dst) {
+					t.Fatalf("%s: %d buckets over %v, want %d over %v", name, len(out.Counts), out.Bounds, counts, dst)
+				}
+				if got, want := total(out.Counts), total(h.Counts); got != want {
+					t.Fatalf("%s: total %d, want %d", name, got, want)
+				}
+				if out.Sum != h.Sum || out.Count != h.Count || !out.HasSum {
+					t.Fatalf("%s: sum %v count %d, want them unchanged", name, out.Sum, out.Count)
+				}
+			}
+		}
+	}
+
+	// Counts entirely outside the target range land in its edge buckets
+	out := Rebucket(HistogramData{Bounds: []float64{1, 2}, Counts: []uint64{5, 6, 0}}, []float64{100, 200}, 3)
+	if !slices.Equal(out.Counts, []uint64{11, 0, 0}) {
+		t.Fatalf("below the target range = %v, want [11 0 0]", out.Counts)
+	}
+	out = Rebucket(HistogramData{Bounds: []float64{1000}, Counts: []uint64{0, 7}}, []float64{100, 200}, 3)
+	if !slices.Equal(out.Counts, []uint64{0, 0, 7}) {
+		t.Fatalf("above the target range = %v, want [0 0 7]", out.Counts)
+	}
+}
+
+// spanAt returns the range of the dst buckets overlapping the src bucket
+// holding v: where re-bucketing may have spread the counts around v
+func spanAt(src, dst []float64, v float64) (lo, hi float64) {
+	srcLo, srcHi := bucketRange(src, sort.SearchFloat64s(src, v))
+	lo, _ = bucketRange(dst, sort.SearchFloat64s(dst, math.Nextafter(srcLo, math.Inf(1))))
+	_, hi = bucketRange(dst, sort.SearchFloat64s(dst, srcHi))
+	return lo, hi
+}
+
+// TestRebucketPercentileDrift re-buckets samples of known distributions
+// and bounds how far percentiles drift: a re-bucketed percentile stays
+// within the target buckets overlapping the source bucket that holds the
+// true one, since only the source's resolution is lost
+func TestRebucketPercentileDrift(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	distributions := []struct {
+		name   string
+		sample func() float64
+	}{
+		// Latencies around a median of 80ms
+		{"lognormal", func() float64 { return math.Exp(math.Log(80) + 0.8*rng.NormFloat64()) }},
+		// A cache: most requests fast, some slow
+		{"bimodal", func() float64 {
+			if rng.Float64() < 0.7 {
+				return math.Abs(20 + 5*rng.NormFloat64())
+			}
+			return math.Abs(400 + 80*rng.NormFloat64())
+		}},
+		{"uniform", func() float64 { return 1000 * rng.Float64() }},
+	}
+
+	for _, dist := range distributions {
+		values := make([]float64, 100_000)
+		for i := range values {
+			values[i] = dist.sample()
+		}
+		sorted := slices.Clone(values)
+		slices.Sort(sorted)
+
+		for _, from := range layouts {
+			for _, to := range layouts {
+				src, dst := from.bounds, to.bounds
+				if from.name == to.name {
+					continue
+				}
+				rebucketed := Rebucket(bucketize(values, src), dst, len(dst)+1)
+				direct := bucketize(values, dst)
+				for _, q := range []float64{50, 90, 99} {
+					truth := sorted[int(q/100*float64(len(sorted)))-1]
+					got := Percentile(dst, rebucketed.Counts, q)
+					want := Percentile(dst, direct.Counts, q)
+					lo, hi := spanAt(src, dst, truth)
+					if got < lo || got > hi {
+						t.Errorf("%s %s to %s p%v = %.1f, direct %.1f (true %.1f): outside %v..%v",
+							dist.name, from.name, to.name, q, got, want, truth, lo, hi)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCanonicalBoundsRebucketOnPush(t *testing.T) {
+	r := NewHistogramRing(8)
+	first := bucketize([]float64{1, 3, 30}, agentBounds)
+	r.Push(first)
+	if r.Rebucketed() != 0 {
+		t.Fatal("the first window was re-bucketed")
+	}
+
+	// An exact match is stored as is
+	second := bucketize([]float64{7}, agentBounds)
+	second.Ts = 1
+	r.Push(second)
+	other := bucketize([]float64{3, 30, 300}, otelBounds)
+	other.Ts = 2
+	r.Push(other)
+	if r.Rebucketed() != 1 {
+		t.Fatalf("Rebucketed = %d, want 1", r.Rebucketed())
+	}
+	windows := r.Snapshot()
+	if got := windows[1]; !slices.Equal(got.Counts, second.Counts) || !slices.Equal(got.Bounds, agentBounds) {
+		t.Fatalf("matching window changed to %v over %v", got.Counts, got.Bounds)
+	}
+	if got := windows[2]; !slices.Equal(got.Bounds, agentBounds) || total(got.Counts) != 3 {
+		t.Fatalf("re-bucketed window = %v over %v, want 3 over the agent bounds", got.Counts, got.Bounds)
+	}
+}
@@ -2,43 +2,76 @@ package buffer
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unsafe"
 )
 
 const (
-	// DefaultRingSize is the default size for ring buffers (10 seconds at 100Hz)
+	// DefaultRingSize is the default size for ring buffers (10 seconds at
+	// 100Hz); see Options.DefaultRingSize
 	DefaultRingSize = 1000
 
-	// HistogramRingSize for histogram data (less frequent)
+	// HistogramRingSize for histogram data (less frequent); see
+	// Options.HistogramRingSize
 	HistogramRingSize = 500
+
+	// DefaultHistogramBucket is the time bucket per-instance histogram
+	// windows are merged into; see Options.HistogramBucket
+	DefaultHistogramBucket = time.Second
 )
 
-// MetricKey uniquely identifies a metric
+// MetricKey uniquely identifies a metric of a service; see InstanceKey for
+// the series of one instance
 type MetricKey struct {
 	Service string
 	Name    string
 }
 
 func (k MetricKey) String() string {
-	return fmt.Sprintf("%s/%s", k.Service, k.Name)
+	return k.Service + "/" + k.Name
 }
 
-// HistogramData holds histogram bounds and counts
+// HistogramData holds histogram bounds and counts. Sum and Count are the
+// exact sum and number of observations when HasSum is set; older agents do
+// not send them.
 type HistogramData struct {
 	Ts     int64
 	Bounds []float64
 	Counts []uint64
+	Sum    float64
+	Count  uint64
+	HasSum bool
+	Marker Marker
+}
+
+// Mean returns the exact mean observation; ok is false without a sum or
+// observations
+func (h HistogramData) Mean() (float64, bool) {
+	if !h.HasSum || h.Count == 0 {
+		return 0, false
+	}
+	return h.Sum / float64(h.Count), true
 }
 
 // HistogramRing is a ring buffer for histogram samples
 type HistogramRing struct {
-	data []HistogramData
-	idx  uint64
-	size uint64
-	mu   sync.RWMutex
+	data    []HistogramData
+	idx     uint64
+	size    uint64
+	dropped uint64
+	order   OrderPolicy
+	mu      sync.RWMutex
+
+	key        MetricKey
+	canonical  canonicalBounds
+	rebucketed uint64
 }
 
-// NewHistogramRing creates a new histogram ring buffer
+// NewHistogramRing creates a new histogram ring buffer that drops
+// out-of-order samples
 func NewHistogramRing(size int) *HistogramRing {
 	return &HistogramRing{
 		data: make([]HistogramData, size),
@@ -46,12 +79,58 @@ func NewHistogramRing(size int) *HistogramRing {
 	}
 }
 
-// Push adds a histogram sample
+// NewHistogramRingWithPolicy creates a histogram ring buffer with the given
+// out-of-order policy
+func NewHistogramRingWithPolicy(size int, policy OrderPolicy) *HistogramRing {
+	r := NewHistogramRing(size)
+	r.order = policy
+	return r
+}
+
+// Push adds a histogram sample, re-bucketed to the ring's canonical bounds.
+// Samples older than the newest entry are dropped, or inserted in place when
+// reordering and within the window.
 func (r *HistogramRing) Push(h HistogramData) {
 	r.mu.Lock()
-	r.data[r.idx%r.size] = h
+	defer r.mu.Unlock()
+
+	if r.idx > 0 {
+		newest := r.data[(r.idx-1)%r.size]
+		if h.Ts < newest.Ts {
+			if r.order.Mode != OrderReorder || h.Ts < newest.Ts-int64(r.order.Window) {
+				r.dropped++
+				return
+			}
+			r.insert(r.canonicalize(h))
+			return
+		}
+	}
+	r.data[r.idx%r.size] = r.canonicalize(h)
+	r.idx++
+}
+
+// insert shifts newer entries up one slot and places h in timestamp order;
+// caller holds the write lock
+func (r *HistogramRing) insert(h HistogramData) {
+	// When full, the slot being written is the oldest entry, which is evicted
+	var start uint64
+	if r.idx+1 > r.size {
+		start = r.idx + 1 - r.size
+	}
+	pos := r.idx
+	for pos > start && r.data[(pos-1)%r.size].Ts > h.Ts {
+		r.data[pos%r.size] = r.data[(pos-1)%r.size]
+		pos--
+	}
+	r.data[pos%r.size] = h
 	r.idx++
-	r.mu.Unlock()
+}
+
+// Dropped returns the number of out-of-order samples discarded
+func (r *HistogramRing) Dropped() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.dropped
 }
 
 // Latest returns the most recent histogram
@@ -64,12 +143,115 @@ func (r *HistogramRing) Latest() (HistogramData, bool) {
 	return r.data[(r.idx-1)%r.size], true
 }
 
+// Cap returns the number of windows the ring holds when full
+func (r *HistogramRing) Cap() int {
+	return int(r.size)
+}
+
+// ringSizeFor returns the size of a new ring of a series: its metric's
+// Options.PerMetricSizes entry, or def
+func (r *Registry) ringSizeFor(series string, def int) int {
+	name, _ := SplitSeriesName(series)
+	if size, ok := r.ringSizes[name]; ok {
+		return size
+	}
+	return def
+}
+
+// SeriesCounts holds the number of series of each type
+type SeriesCounts struct {
+	Gauges     int `json:"gauge"`
+	Counters   int `json:"counter"`
+	Histograms int `json:"histogram"`
+	// Instances counts the per-instance rings behind gauge and counter
+	// series, see PushGauge
+	Instances int `json:"instance"`
+
+	// slots and histogramSlots add up the sizes of the rings, which
+	// Options can vary by metric
+	slots          int
+	histogramSlots int
+}
+
+// Total returns the number of series across all types, per-instance rings
+// included
+func (c SeriesCounts) Total() int {
+	return c.Gauges + c.Counters + c.Histograms + c.Instances
+}
+
+// Approximate slot widths used for memory estimates
+const (
+	// sampleBytes is a ring slot: sequence, Ts, Val, Count and flags
+	sampleBytes = int64(unsafe.Sizeof(slot{}))
+	// histogramSlotBytes assumes the agent's default 12 bounds + overflow
+	// bucket: the HistogramData plus 8 bytes per bound and count
+	histogramSlotBytes = int64(unsafe.Sizeof(HistogramData{})) + 12*8 + 13*8
+)
+
+// EstimatedBytes approximates the memory held by the rings of these series
+func (c SeriesCounts) EstimatedBytes() int64 {
+	return int64(c.slots)*sampleBytes + int64(c.histogramSlots)*histogramSlotBytes
+}
+
 // Registry manages all metric ring buffers
 type Registry struct {
 	gauges     map[MetricKey]*Ring
 	counters   map[MetricKey]*Ring
 	histograms map[MetricKey]*HistogramRing
+	exemplars  map[MetricKey]*ExemplarRing
+	metadata   map[MetricKey]Metadata
+	instances  map[instanceKey]*instanceEntry
+	events     map[string]*EventRing
 	mu         sync.RWMutex
+
+	// per-instance rings behind the series that agents push, see
+	// PushGauge and PushHistogram
+	instanceGauges     map[MetricKey]*instanceSeries
+	instanceCounters   map[MetricKey]*instanceSeries
+	instanceHistograms map[MetricKey]*instanceHistograms
+	instanceRings      int
+	gaugeAggregation   map[string]GaugeAggregation
+
+	metadataConflicts uint64
+
+	// janitor evicts idle series, see Options.SeriesTTL; evicted counts
+	// them
+	janitor *janitor
+	evicted uint64
+
+	// Series limits, see Options; zero is unlimited. Pushes for series
+	// refused by them go to the discard rings, and rejected counts them
+	// per service under rejectMu.
+	maxSeriesPerService int
+	maxSeriesTotal      int
+	discard             *Ring
+	discardHist         *HistogramRing
+	rejected            map[string]uint64
+	rejectMu            sync.Mutex
+
+	// series counts per service, maintained as rings are created
+	seriesCounts map[string]*SeriesCounts
+
+	deleteHooks        []DeleteHook
+	serviceDeleteHooks []ServiceDeleteHook
+
+	// out-of-order policy applied to new rings
+	order OrderPolicy
+
+	// noRollups leaves new gauge and counter rings without a Rollup
+	noRollups bool
+
+	// sizes of new rings, see Options.DefaultRingSize
+	ringSize          int
+	histogramRingSize int
+	ringSizes         map[string]int
+
+	// configured histogram layouts, see SetCanonicalBounds
+	canonical map[MetricKey][]float64
+
+	// width of the buckets instances' histogram windows are merged in, see
+	// PushHistogram
+	histogramBucket int64
 }
 
 // NewRegistry creates a new metric registry
@@ -78,80 +260,346 @@ func NewRegistry() *Registry {
 		gauges:     make(map[MetricKey]*Ring),
 		counters:   make(map[MetricKey]*Ring),
 		histograms: make(map[MetricKey]*HistogramRing),
+		exemplars:  make(map[MetricKey]*ExemplarRing),
+		metadata:   make(map[MetricKey]Metadata),
+		instances:  make(map[instanceKey]*instanceEntry),
+		events:     make(map[string]*EventRing),
+
+		instanceGauges:     make(map[MetricKey]*instanceSeries),
+		instanceCounters:   make(map[MetricKey]*instanceSeries),
+		instanceHistograms: make(map[MetricKey]*instanceHistograms),
+		seriesCounts:       make(map[string]*SeriesCounts),
+		discard:            NewRing(2),
+		discardHist:        NewHistogramRing(2),
+		rejected:           make(map[string]uint64),
+
+		ringSize:          DefaultRingSize,
+		histogramRingSize: HistogramRingSize,
+		histogramBucket:   int64(DefaultHistogramBucket),
 	}
 }
 
-// GetRing returns the ring buffer for a gauge metric, creating if needed
-func (r *Registry) GetRing(service, name string) *Ring {
-	key := MetricKey{Service: service, Name: name}
+// Options configures a Registry. The zero value behaves like NewRegistry.
+type Options struct {
+	// SeriesTTL, if set, evicts gauge, counter and histogram series that
+	// have taken no sample for this long, measured on the aggregator's
+	// clock so agent timestamps do not matter
+	SeriesTTL time.Duration
+	// SweepInterval is how often series are checked against SeriesTTL
+	// (DefaultSweepInterval when zero); evictions can lag the TTL by up
+	// to one interval
+	SweepInterval time.Duration
+
+	// MaxSeriesPerService and MaxSeriesTotal, if set, cap the series one
+	// service and the whole registry hold, against a client putting IDs
+	// in metric names. Existing series keep working at the cap; new ones
+	// are refused, see TryGetRing.
+	MaxSeriesPerService int
+	MaxSeriesTotal      int
+
+	// DisableRollups keeps only the raw rings, saving the memory of
+	// RollupLevels; QueryRollup then serves raw samples only
+	DisableRollups bool
+
+	// DefaultRingSize and HistogramRingSize, if set, replace the package
+	// constants for new rings. PerMetricSizes sets the size of a metric's
+	// rings in every service, by metric name without labels, over both.
+	// Sizes must be at least 2, see Validate.
+	DefaultRingSize   int
+	HistogramRingSize int
+	PerMetricSizes    map[string]int
+
+	// HistogramBucket, if set, replaces DefaultHistogramBucket: the time
+	// buckets in which the instances' windows of a histogram are merged
+	// into one window of the service's series
+	HistogramBucket time.Duration
+}
 
-	r.mu.RLock()
-	ring, exists := r.gauges[key]
-	r.mu.RUnlock()
+// Validate reports ring sizes below 2; NewRegistryWithOptions ignores them
+func (o Options) Validate() error {
+	if o.DefaultRingSize != 0 && o.DefaultRingSize < 2 {
+		return fmt.Errorf("ring size %d: must be at least 2", o.DefaultRingSize)
+	}
+	if o.HistogramRingSize != 0 && o.HistogramRingSize < 2 {
+		return fmt.Errorf("histogram ring size %d: must be at least 2", o.HistogramRingSize)
+	}
+	for name, size := range o.PerMetricSizes {
+		if size < 2 {
+			return fmt.Errorf("ring size of %s %d: must be at least 2", name, size)
+		}
+	}
+	return nil
+}
 
-	if exists {
-		return ring
+// ParseRingSizes parses "metric=size,metric=size" for
+// Options.PerMetricSizes
+func ParseRingSizes(s string) (map[string]int, error) {
+	result := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("ring size %q: expected metric=size", entry)
+		}
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("ring size %q: %w", entry, err)
+		}
+		if size < 2 {
+			return nil, fmt.Errorf("ring size %q: must be at least 2", entry)
+		}
+		result[name] = size
 	}
+	return result, nil
+}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// NewRegistryWithOptions creates a registry configured by opts, starting
+// its janitor when SeriesTTL is set; Close stops it
+func NewRegistryWithOptions(opts Options) *Registry {
+	r := NewRegistry()
+	r.maxSeriesPerService = max(opts.MaxSeriesPerService, 0)
+	r.maxSeriesTotal = max(opts.MaxSeriesTotal, 0)
+	r.noRollups = opts.DisableRollups
+	if opts.DefaultRingSize >= 2 {
+		r.ringSize = opts.DefaultRingSize
+	}
+	if opts.HistogramRingSize >= 2 {
+		r.histogramRingSize = opts.HistogramRingSize
+	}
+	if opts.HistogramBucket > 0 {
+		r.histogramBucket = int64(opts.HistogramBucket)
+	}
+	for name, size := range opts.PerMetricSizes {
+		if size < 2 {
+			continue
+		}
+		if r.ringSizes == nil {
+			r.ringSizes = make(map[string]int)
+		}
+		r.ringSizes[name] = size
+	}
+	if opts.SeriesTTL > 0 {
+		every := opts.SweepInterval
+		if every <= 0 {
+			every = DefaultSweepInterval
+		}
+		r.janitor = &janitor{
+			ttl:      opts.SeriesTTL,
+			rings:    make(map[*Ring]seriesActivity),
+			histRing: make(map[*HistogramRing]seriesActivity),
+			stop:     make(chan struct{}),
+		}
+		go r.runJanitor(every)
+	}
+	return r
+}
 
-	// Double-check after acquiring write lock
-	if ring, exists = r.gauges[key]; exists {
-		return ring
+// Close stops the janitor, if any; the registry stays usable
+func (r *Registry) Close() {
+	if r.janitor != nil {
+		r.janitor.stopOnce.Do(func() { close(r.janitor.stop) })
+	}
+}
+
+// serviceCounts returns the series counts for a service; caller holds the write lock
+func (r *Registry) serviceCounts(service string) *SeriesCounts {
+	c, ok := r.seriesCounts[service]
+	if !ok {
+		c = &SeriesCounts{}
+		r.seriesCounts[service] = c
 	}
+	return c
+}
+
+// SeriesCounts returns the number of series per service without scanning the rings
+func (r *Registry) SeriesCounts() map[string]SeriesCounts {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := make(map[string]SeriesCounts, len(r.seriesCounts))
+	for service, c := range r.seriesCounts {
+		result[service] = *c
+	}
+	return result
+}
 
-	ring = NewRing(DefaultRingSize)
-	r.gauges[key] = ring
+// GetRing returns the ring buffer for a gauge metric, creating if needed.
+// Past the series limits it returns a shared ring no snapshot reads.
+func (r *Registry) GetRing(service, name string) *Ring {
+	ring, err := r.TryGetRing(service, name)
+	if err != nil {
+		return r.discard
+	}
 	return ring
 }
 
-// GetCounterRing returns the ring buffer for a counter metric
+// TryGetRing is GetRing that returns an error wrapping ErrSeriesLimit
+// instead of creating a series past the limits
+func (r *Registry) TryGetRing(service, name string) (*Ring, error) {
+	return r.getRing(r.gauges, service, name, func(c *SeriesCounts) { c.Gauges++ })
+}
+
+// GetCounterRing returns the ring buffer for a counter metric. Past the
+// series limits it returns a shared ring no snapshot reads.
 func (r *Registry) GetCounterRing(service, name string) *Ring {
+	ring, err := r.TryGetCounterRing(service, name)
+	if err != nil {
+		return r.discard
+	}
+	return ring
+}
+
+// TryGetCounterRing is GetCounterRing that returns an error wrapping
+// ErrSeriesLimit instead of creating a series past the limits
+func (r *Registry) TryGetCounterRing(service, name string) (*Ring, error) {
+	return r.getRing(r.counters, service, name, func(c *SeriesCounts) { c.Counters++ })
+}
+
+// getRing returns the ring of key in rings, creating it within the limits
+// and counting it with add
+func (r *Registry) getRing(rings map[MetricKey]*Ring, service, name string, add func(*SeriesCounts)) (*Ring, error) {
 	key := MetricKey{Service: service, Name: name}
 
 	r.mu.RLock()
-	ring, exists := r.counters[key]
+	ring, exists := rings[key]
+	var err error
+	if !exists {
+		err = r.checkLimitsLocked(service)
+	}
 	r.mu.RUnlock()
 
 	if exists {
-		return ring
+		return ring, nil
+	}
+	if err != nil {
+		r.reject(service)
+		return nil, err
 	}
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if ring, exists = r.counters[key]; exists {
-		return ring
+	// Double-check after acquiring write lock
+	if ring, exists = rings[key]; exists {
+		return ring, nil
+	}
+	if err := r.checkLimitsLocked(service); err != nil {
+		r.reject(service)
+		return nil, err
 	}
 
-	ring = NewRing(DefaultRingSize)
-	r.counters[key] = ring
-	return ring
+	ring = NewRingWithPolicy(r.ringSizeFor(name, r.ringSize), r.order)
+	if !r.noRollups {
+		ring.rollup = newRollup()
+	}
+	rings[key] = ring
+	c := r.serviceCounts(service)
+	add(c)
+	c.slots += ring.Cap()
+	return ring, nil
 }
 
-// GetHistogramRing returns the ring buffer for a histogram metric
+// GetHistogramRing returns the ring buffer for a histogram metric. Past
+// the series limits it returns a shared ring no snapshot reads.
 func (r *Registry) GetHistogramRing(service, name string) *HistogramRing {
+	ring, err := r.TryGetHistogramRing(service, name)
+	if err != nil {
+		return r.discardHist
+	}
+	return ring
+}
+
+// TryGetHistogramRing is GetHistogramRing that returns an error wrapping
+// ErrSeriesLimit instead of creating a series past the limits
+func (r *Registry) TryGetHistogramRing(service, name string) (*HistogramRing, error) {
 	key := MetricKey{Service: service, Name: name}
 
 	r.mu.RLock()
 	ring, exists := r.histograms[key]
+	var err error
+	if !exists {
+		err = r.checkLimitsLocked(service)
+	}
 	r.mu.RUnlock()
 
 	if exists {
-		return ring
+		return ring, nil
+	}
+	if err != nil {
+		r.reject(service)
+		return nil, err
 	}
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if ring, exists = r.histograms[key]; exists {
-		return ring
+		return ring, nil
+	}
+	if err := r.checkLimitsLocked(service); err != nil {
+		r.reject(service)
+		return nil, err
 	}
 
-	ring = NewHistogramRing(HistogramRingSize)
+	ring = NewHistogramRingWithPolicy(r.ringSizeFor(name, r.histogramRingSize), r.order)
+	ring.key = key
+	ring.canonical, _ = r.canonicalFor(key)
 	r.histograms[key] = ring
-	return ring
+	c := r.serviceCounts(service)
+	c.Histograms++
+	c.histogramSlots += ring.Cap()
+	return ring, nil
+}
+
+// FindHistogramRing returns the histogram ring for a metric without creating it
+func (r *Registry) FindHistogramRing(service, name string) (*HistogramRing, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ring, exists := r.histograms[MetricKey{Service: service, Name: name}]
+	return ring, exists
+}
+
+// FindRing returns the gauge ring for a metric without creating it
+func (r *Registry) FindRing(service, name string) (*Ring, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ring, exists := r.gauges[MetricKey{Service: service, Name: name}]
+	return ring, exists
+}
+
+// FindCounterRing returns the counter ring for a metric without creating it
+func (r *Registry) FindCounterRing(service, name string) (*Ring, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ring, exists := r.counters[MetricKey{Service: service, Name: name}]
+	return ring, exists
+}
+
+// QueryRange returns the samples of a gauge or counter series with
+// start <= Ts < end, oldest first; ok is false when neither exists
+func (r *Registry) QueryRange(service, name string, start, end int64) ([]Sample, bool) {
+	ring, ok := r.FindRing(service, name)
+	if !ok {
+		ring, ok = r.FindCounterRing(service, name)
+	}
+	if !ok {
+		return nil, false
+	}
+	return ring.SnapshotRange(start, end), true
+}
+
+// CounterRate returns the per-second rate of a counter series over
+// window, see Ring.RatePerSecond; ok is false without the series or
+// enough samples
+func (r *Registry) CounterRate(service, name string, window time.Duration) (float64, bool) {
+	ring, ok := r.FindCounterRing(service, name)
+	if !ok {
+		return 0, false
+	}
+	return ring.RatePerSecond(window)
 }
 
 // Snapshot returns all current metrics data
@@ -189,24 +637,36 @@ func (r *Registry) Snapshot() MetricsSnapshot {
 	return snapshot
 }
 
+// LatestSnapshotExemplars is the number of exemplars included per histogram
+const LatestSnapshotExemplars = 5
+
 // LatestSnapshot returns only the latest value for each metric
 type LatestSnapshot struct {
 	Gauges     map[MetricKey]Sample
 	Counters   map[MetricKey]Sample
 	Histograms map[MetricKey]HistogramData
+	Exemplars  map[MetricKey][]Exemplar
 }
 
 // LatestSnapshot returns the most recent value for all metrics
 func (r *Registry) LatestSnapshot() LatestSnapshot {
+	var snapshot LatestSnapshot
+	r.LatestSnapshotInto(&snapshot)
+	return snapshot
+}
+
+// LatestSnapshotInto refills snapshot with the most recent value for all
+// metrics, reusing its maps so a caller polling every tick does not
+// reallocate them
+func (r *Registry) LatestSnapshotInto(snapshot *LatestSnapshot) {
+	snapshot.Gauges = resetMap(snapshot.Gauges)
+	snapshot.Counters = resetMap(snapshot.Counters)
+	snapshot.Histograms = resetMap(snapshot.Histograms)
+	snapshot.Exemplars = resetMap(snapshot.Exemplars)
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	snapshot := LatestSnapshot{
-		Gauges:     make(map[MetricKey]Sample),
-		Counters:   make(map[MetricKey]Sample),
-		Histograms: make(map[MetricKey]HistogramData),
-	}
-
 	for key, ring := range r.gauges {
 		if s, ok := ring.Latest(); ok {
 			snapshot.Gauges[key] = s
@@ -225,7 +685,18 @@ func (r *Registry) LatestSnapshot() LatestSnapshot {
 		}
 	}
 
-	return snapshot
+	for key, ring := range r.exemplars {
+		snapshot.Exemplars[key] = ring.SnapshotLast(LatestSnapshotExemplars)
+	}
+}
+
+// resetMap empties m, keeping its storage, or makes it if nil
+func resetMap[V any](m map[MetricKey]V) map[MetricKey]V {
+	if m == nil {
+		return make(map[MetricKey]V)
+	}
+	clear(m)
+	return m
 }
 
 // ListServices returns all registered services
@@ -251,7 +722,8 @@ func (r *Registry) ListServices() []string {
 	return result
 }
 
-// ListMetrics returns all metric names for a service
+// ListMetrics returns the series names of a service, labeled ones as
+// SeriesName; see ListLabelSets for them by metric name
 func (r *Registry) ListMetrics(service string) []string {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
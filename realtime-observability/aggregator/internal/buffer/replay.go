@@ -0,0 +1,160 @@
+package buffer
+
+import (
+	"time"
+)
+
+// Replayer loops the tail of imported series so a demo registry keeps
+// producing fresh samples until real data for a key arrives
+type Replayer struct {
+	window int64
+	series []*replaySeries
+}
+
+type replaySeries struct {
+	ring      *Ring
+	histRing  *HistogramRing
+	samples   []Sample
+	hists     []HistogramData
+	base      int64 // timestamp that maps to offset zero in the window
+	expected  uint64
+	done      bool
+	nextIndex int
+}
+
+// NewReplayer captures the last window of every series in the registry.
+// It should be created right after ImportState with Rebase enabled.
+func NewReplayer(r *Registry, window time.Duration) *Replayer {
+	p := &Replayer{window: int64(window)}
+	if p.window <= 0 {
+		return p
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, ring := range r.gauges {
+		p.addSamples(ring)
+	}
+	for _, ring := range r.counters {
+		p.addSamples(ring)
+	}
+	for _, ring := range r.histograms {
+		hists := ring.Snapshot()
+		if len(hists) == 0 {
+			continue
+		}
+		newest := hists[len(hists)-1].Ts
+		i := len(hists)
+		for i > 0 && hists[i-1].Ts > newest-p.window {
+			i--
+		}
+		p.series = append(p.series, &replaySeries{
+			histRing: ring,
+			hists:    hists[i:],
+			base:     newest - p.window,
+			expected: ring.count(),
+		})
+	}
+
+	return p
+}
+
+func (p *Replayer) addSamples(ring *Ring) {
+	samples := ring.Snapshot()
+	if len(samples) == 0 {
+		return
+	}
+	newest := samples[len(samples)-1].Ts
+	i := len(samples)
+	for i > 0 && samples[i-1].Ts > newest-p.window {
+		i--
+	}
+	p.series = append(p.series, &replaySeries{
+		ring:     ring,
+		samples:  samples[i:],
+		base:     newest - p.window,
+		expected: ring.Count(),
+	})
+}
+
+// Run replays the captured window every cycle until every series has
+// received real data. Samples are re-stamped into the current cycle.
+func (p *Replayer) Run(interval time.Duration) {
+	if len(p.series) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	cycle := int64(1)
+	cycleStart := time.Now().UnixNano()
+	for now := range ticker.C {
+		pos := now.UnixNano() - cycleStart
+		if pos >= p.window {
+			// Finish the current cycle, skipping any cycles missed entirely
+			p.replayUntil(cycle, p.window)
+			p.rewind()
+			elapsed := pos / p.window
+			cycle += elapsed
+			cycleStart += elapsed * p.window
+			pos -= elapsed * p.window
+		}
+		if !p.replayUntil(cycle, pos) {
+			return
+		}
+	}
+}
+
+// replayUntil pushes every pending sample whose window offset is <= pos and
+// reports whether any series is still being replayed
+func (p *Replayer) replayUntil(cycle, pos int64) bool {
+	active := false
+	shift := cycle * p.window
+	for _, s := range p.series {
+		if s.done {
+			continue
+		}
+		if s.ring != nil {
+			if s.ring.Count() != s.expected {
+				s.done = true
+				continue
+			}
+			for s.nextIndex < len(s.samples) && s.samples[s.nextIndex].Ts-s.base <= pos {
+				sample := s.samples[s.nextIndex]
+				sample.Ts += shift
+				s.ring.Push(sample)
+				s.nextIndex++
+			}
+			s.expected = s.ring.Count()
+		} else {
+			if s.histRing.count() != s.expected {
+				s.done = true
+				continue
+			}
+			for s.nextIndex < len(s.hists) && s.hists[s.nextIndex].Ts-s.base <= pos {
+				h := s.hists[s.nextIndex]
+				h.Ts += shift
+				s.histRing.Push(h)
+				s.nextIndex++
+			}
+			s.expected = s.histRing.count()
+		}
+		active = true
+	}
+	return active
+}
+
+func (p *Replayer) rewind() {
+	for _, s := range p.series {
+		s.nextIndex = 0
+	}
+}
+
+// count returns the total number of histograms written
+func (r *HistogramRing) count() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.idx
+}
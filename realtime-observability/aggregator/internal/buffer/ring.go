@@ -1,96 +1,386 @@
 package buffer
 
 import (
+	"math"
+	"runtime"
+	"slices"
 	"sync/atomic"
+	"time"
 )
 
-// Sample represents a single metric sample with timestamp and value
+// Sample represents a single metric sample with timestamp and value.
+// Counter samples also carry the exact value in Count; Val rounds it once
+// it passes 2^53.
 type Sample struct {
-	Ts  int64
-	Val float64
+	Ts     int64
+	Val    float64
+	Count  uint64
+	Marker Marker
+	// Float marks a float counter sample: Val holds the value and Count is
+	// unused
+	Float bool
+}
+
+// CounterSample returns the sample for a counter value
+func CounterSample(ts int64, count uint64) Sample {
+	return Sample{Ts: ts, Val: float64(count), Count: count}
+}
+
+// FloatCounterSample returns the sample for a float counter value
+func FloatCounterSample(ts int64, value float64) Sample {
+	return Sample{Ts: ts, Val: value, Float: true}
+}
+
+// CounterDelta returns the exact increase from prev to s, treating a
+// decrease as a counter reset that started again from zero
+func (s Sample) CounterDelta(prev Sample) uint64 {
+	if s.Count < prev.Count {
+		return s.Count
+	}
+	return s.Count - prev.Count
+}
+
+// CounterIncrease is CounterDelta for integer and float counters alike;
+// it is exact only while integer increases fit a float64
+func (s Sample) CounterIncrease(prev Sample) float64 {
+	if !s.Float && !prev.Float {
+		return float64(s.CounterDelta(prev))
+	}
+	if s.Val < prev.Val {
+		return s.Val
+	}
+	return s.Val - prev.Val
 }
 
 // Ring is a lock-free ring buffer for metric samples
 // Optimized for single-writer, multiple-reader access pattern
 type Ring struct {
-	data []Sample
-	idx  atomic.Uint64
-	size uint64
+	data    []slot
+	idx     atomic.Uint64
+	size    uint64
+	dropped atomic.Uint64
+
+	// reorder is set for OrderReorder rings; readers then take its lock
+	reorder *reorderBuffer
+
+	// rollup, if set, downsamples what the ring takes, see Options
+	rollup *Rollup
 }
 
-// NewRing creates a new ring buffer with the specified size
+// NewRing creates a new ring buffer with the specified size that drops
+// out-of-order samples
 func NewRing(size int) *Ring {
 	return &Ring{
-		data: make([]Sample, size),
+		data: make([]slot, size),
 		size: uint64(size),
 	}
 }
 
-// Push adds a sample to the ring buffer (lock-free)
+// NewRingWithPolicy creates a ring buffer with the given out-of-order policy
+func NewRingWithPolicy(size int, policy OrderPolicy) *Ring {
+	r := NewRing(size)
+	if policy.Mode == OrderReorder {
+		r.reorder = &reorderBuffer{window: int64(policy.Window)}
+	}
+	return r
+}
+
+// Push adds a sample to the ring buffer (lock-free unless reordering).
+// Samples older than the newest entry are dropped or reordered per policy.
 // Safe for single writer only
 func (r *Ring) Push(s Sample) {
-	i := r.idx.Add(1) - 1
-	r.data[i%r.size] = s
+	if r.reorder != nil {
+		r.pushReordered(s)
+		return
+	}
+	if newest, ok := r.newest(); ok && s.Ts < newest.Ts {
+		r.dropped.Add(1)
+		return
+	}
+	r.append(s)
 }
 
-// Snapshot returns a copy of all samples in order (oldest to newest)
-// Safe for concurrent reads
-func (r *Ring) Snapshot() []Sample {
-	currentIdx := r.idx.Load()
-	result := make([]Sample, 0, r.size)
+func (r *Ring) pushReordered(s Sample) {
+	b := r.reorder
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	var start uint64
-	if currentIdx >= r.size {
-		start = currentIdx - r.size
+	// Already released past this point; it can no longer be placed in order
+	if newest, ok := r.newest(); ok && s.Ts < newest.Ts {
+		r.dropped.Add(1)
+		return
 	}
+	b.insert(s)
+	for _, released := range b.release() {
+		r.append(released)
+	}
+}
 
-	for i := start; i < currentIdx; i++ {
-		result = append(result, r.data[i%r.size])
+// append claims the next index, then writes its slot; readers skip the
+// slot until the write is complete
+func (r *Ring) append(s Sample) {
+	i := r.idx.Add(1) - 1
+	r.data[i%r.size].store(i, s)
+	if r.rollup != nil {
+		r.rollup.add(s)
 	}
+}
 
-	return result
+// newest returns the newest sample written to the ring itself, waiting
+// out a write in flight
+func (r *Ring) newest() (Sample, bool) {
+	for {
+		currentIdx := r.idx.Load()
+		if currentIdx == 0 {
+			return Sample{}, false
+		}
+		if s, ok := r.data[(currentIdx-1)%r.size].load(currentIdx - 1); ok {
+			return s, true
+		}
+		runtime.Gosched()
+	}
+}
+
+// Snapshot returns a copy of all samples in order (oldest to newest)
+// Safe for concurrent reads
+func (r *Ring) Snapshot() []Sample {
+	return r.SnapshotLast(int(r.size))
 }
 
 // SnapshotLast returns the last n samples
 func (r *Ring) SnapshotLast(n int) []Sample {
+	var pending []Sample
+	if r.reorder != nil {
+		r.reorder.mu.Lock()
+		defer r.reorder.mu.Unlock()
+		pending = r.reorder.pending
+	}
+
 	currentIdx := r.idx.Load()
 	count := uint64(n)
 	if count > r.size {
 		count = r.size
 	}
-	if count > currentIdx {
-		count = currentIdx
+	if count > currentIdx+uint64(len(pending)) {
+		count = currentIdx + uint64(len(pending))
 	}
 
-	result := make([]Sample, 0, count)
-	start := currentIdx - count
+	// Buffered samples are newer than anything in the ring
+	fromPending := count
+	if fromPending > uint64(len(pending)) {
+		fromPending = uint64(len(pending))
+	}
+	fromRing := count - fromPending
 
-	for i := start; i < currentIdx; i++ {
-		result = append(result, r.data[i%r.size])
+	result := make([]Sample, 0, count)
+	for i := currentIdx - fromRing; i < currentIdx; i++ {
+		// Skips a slot still being written, or already reused for a
+		// newer sample, rather than read it torn
+		if s, ok := r.data[i%r.size].load(i); ok {
+			result = append(result, s)
+		}
 	}
+	result = append(result, pending[uint64(len(pending))-fromPending:]...)
 
 	return result
 }
 
-// Latest returns the most recent sample
-func (r *Ring) Latest() (Sample, bool) {
+// SnapshotSince returns the samples with Ts >= ts, oldest first
+func (r *Ring) SnapshotSince(ts int64) []Sample {
+	return r.SnapshotRange(ts, math.MaxInt64)
+}
+
+// SnapshotRange returns the samples with start <= Ts < end, oldest first.
+// It scans back from the newest sample and stops at the first one before
+// start, so out-of-order timestamps in the ring may cost samples in range
+// but never add any outside it.
+func (r *Ring) SnapshotRange(start, end int64) []Sample {
+	if start >= end {
+		return nil
+	}
+	var result []Sample
+	r.scanNewest(func(s Sample) bool {
+		if s.Ts < start {
+			return false
+		}
+		if s.Ts < end {
+			result = append(result, s)
+		}
+		return true
+	})
+	slices.Reverse(result)
+	return result
+}
+
+// scanNewest calls visit with the samples newest first, those held for
+// reordering included, until it returns false. Like Snapshot, it looks at
+// no more than size samples in all.
+func (r *Ring) scanNewest(visit func(Sample) bool) {
+	limit := r.size
+	if r.reorder != nil {
+		r.reorder.mu.Lock()
+		defer r.reorder.mu.Unlock()
+		// Buffered samples are newer than anything in the ring
+		pending := r.reorder.pending
+		for i := len(pending) - 1; i >= 0 && limit > 0; i-- {
+			if !visit(pending[i]) {
+				return
+			}
+			limit--
+		}
+	}
+
 	currentIdx := r.idx.Load()
-	if currentIdx == 0 {
-		return Sample{}, false
+	var oldest uint64
+	if currentIdx > limit {
+		oldest = currentIdx - limit
 	}
-	return r.data[(currentIdx-1)%r.size], true
+	for i := currentIdx; i > oldest; i-- {
+		s, ok := r.data[(i-1)%r.size].load(i - 1)
+		if !ok {
+			// Being written, or already reused
+			continue
+		}
+		if !visit(s) {
+			return
+		}
+	}
+}
+
+// RatePerSecond returns a counter's per-second increase over the samples
+// within window of the newest one. Increases are summed sample to sample,
+// a decrease counting as a reset from zero, and divided by the time
+// between the oldest and newest sample rather than by window. ok is false
+// with fewer than two samples, or none apart in time, in the window.
+// Gap markers are skipped.
+func (r *Ring) RatePerSecond(window time.Duration) (float64, bool) {
+	var newest, newer Sample
+	var increase float64
+	seen := false
+	r.scanNewest(func(s Sample) bool {
+		if s.IsMarker() {
+			return true
+		}
+		if !seen {
+			newest, newer, seen = s, s, true
+			return true
+		}
+		if s.Ts < newest.Ts-int64(window) {
+			return false
+		}
+		increase += newer.CounterIncrease(s)
+		newer = s
+		return true
+	})
+	elapsed := newest.Ts - newer.Ts
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return increase / (float64(elapsed) / float64(time.Second)), true
+}
+
+// Latest returns the sample with the highest timestamp
+func (r *Ring) Latest() (Sample, bool) {
+	if r.reorder != nil {
+		r.reorder.mu.Lock()
+		defer r.reorder.mu.Unlock()
+		if n := len(r.reorder.pending); n > 0 {
+			return r.reorder.pending[n-1], true
+		}
+	}
+	return r.newest()
+}
+
+// latestValue returns the newest sample that is not a marker
+func (r *Ring) latestValue() (Sample, bool) {
+	var latest Sample
+	found := false
+	r.scanNewest(func(s Sample) bool {
+		if s.IsMarker() {
+			return true
+		}
+		latest, found = s, true
+		return false
+	})
+	return latest, found
 }
 
-// Count returns the total number of samples written
+// Count returns the total number of samples accepted, including any still
+// held for reordering
 func (r *Ring) Count() uint64 {
+	if r.reorder != nil {
+		r.reorder.mu.Lock()
+		defer r.reorder.mu.Unlock()
+		return r.idx.Load() + uint64(len(r.reorder.pending))
+	}
 	return r.idx.Load()
 }
 
+// Cap returns the number of samples the buffer holds when full
+func (r *Ring) Cap() int {
+	return int(r.size)
+}
+
 // Len returns the current number of valid samples in the buffer
 func (r *Ring) Len() int {
-	count := r.idx.Load()
+	count := r.Count()
 	if count > r.size {
 		return int(r.size)
 	}
 	return int(count)
 }
+
+// Dropped returns the number of out-of-order samples discarded
+func (r *Ring) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// slot holds one ring entry behind a sequence number, a seqlock: while
+// the writer stores sample i the sequence is 2i+1, and 2i+2 once it is
+// complete. Every field is atomic so readers never race the writer, and
+// the sequence tells them whether the fields they read belong together.
+type slot struct {
+	seq   atomic.Uint64
+	ts    atomic.Int64
+	val   atomic.Uint64 // math.Float64bits
+	count atomic.Uint64
+	flags atomic.Uint32 // Marker, plus slotFloat
+}
+
+// slotFloat marks a float counter sample in slot.flags, above the Marker
+const slotFloat = 1 << 8
+
+// store writes sample i; single writer only
+func (s *slot) store(i uint64, sample Sample) {
+	flags := uint32(sample.Marker)
+	if sample.Float {
+		flags |= slotFloat
+	}
+	s.seq.Store(2*i + 1)
+	s.ts.Store(sample.Ts)
+	s.val.Store(math.Float64bits(sample.Val))
+	s.count.Store(sample.Count)
+	s.flags.Store(flags)
+	s.seq.Store(2*i + 2)
+}
+
+// load reads sample i, and reports false if the slot no longer holds it
+// whole: the writer is overwriting it, or already has, with a newer one
+func (s *slot) load(i uint64) (Sample, bool) {
+	want := 2*i + 2
+	if s.seq.Load() != want {
+		return Sample{}, false
+	}
+	flags := s.flags.Load()
+	sample := Sample{
+		Ts:     s.ts.Load(),
+		Val:    math.Float64frombits(s.val.Load()),
+		Count:  s.count.Load(),
+		Marker: Marker(flags & 0xff),
+		Float:  flags&slotFloat != 0,
+	}
+	if s.seq.Load() != want {
+		return Sample{}, false
+	}
+	return sample, true
+}
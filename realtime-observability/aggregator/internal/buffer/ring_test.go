@@ -0,0 +1,152 @@
+package buffer
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRingConcurrentReadsAreNotTorn pushes samples whose Val and Count
+// both derive from Ts at about a million a second while readers check
+// every sample they see; run it with -race
+func TestRingConcurrentReadsAreNotTorn(t *testing.T) {
+	duration := time.Second
+	if testing.Short() {
+		duration = 100 * time.Millisecond
+	}
+	r := NewRing(256)
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer done.Store(true)
+		start := time.Now()
+		for i := int64(1); ; i++ {
+			r.Push(Sample{Ts: i, Val: float64(i), Count: uint64(i)})
+			// Pace to about 1MHz, checking the clock every 1000 pushes
+			if i%1000 == 0 {
+				elapsed := time.Since(start)
+				if elapsed >= duration {
+					return
+				}
+				if ahead := time.Duration(i)*time.Microsecond - elapsed; ahead > 0 {
+					time.Sleep(ahead)
+				}
+			}
+		}
+	}()
+
+	check := func(s Sample) bool {
+		if s.Val != float64(s.Ts) || s.Count != uint64(s.Ts) {
+			t.Errorf("torn sample: %+v", s)
+			return false
+		}
+		return true
+	}
+	for range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				prev := int64(0)
+				for _, s := range r.Snapshot() {
+					if !check(s) {
+						return
+					}
+					if s.Ts <= prev {
+						t.Errorf("snapshot out of order: %d after %d", s.Ts, prev)
+						return
+					}
+					prev = s.Ts
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			prev := int64(0)
+			for !done.Load() {
+				s, ok := r.Latest()
+				if !ok {
+					continue
+				}
+				if !check(s) {
+					return
+				}
+				if s.Ts < prev {
+					t.Errorf("latest went back from %d to %d", prev, s.Ts)
+					return
+				}
+				prev = s.Ts
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := r.Dropped(); got != 0 {
+		t.Fatalf("dropped = %d, want 0", got)
+	}
+}
+
+func TestRatePerSecond(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []Sample
+		window  time.Duration
+		want    float64
+		wantOK  bool
+	}{
+		{
+			name:    "steady",
+			samples: []Sample{CounterSample(0, 0), CounterSample(1e9, 10), CounterSample(2e9, 20)},
+			window:  time.Minute,
+			want:    10, wantOK: true,
+		},
+		{
+			name:    "reset counts from zero",
+			samples: []Sample{CounterSample(0, 100), CounterSample(1e9, 110), CounterSample(2e9, 5)},
+			window:  time.Minute,
+			want:    7.5, wantOK: true,
+		},
+		{
+			name:    "window excludes older samples",
+			samples: []Sample{CounterSample(0, 0), CounterSample(10e9, 1000), CounterSample(11e9, 1002), CounterSample(12e9, 1004)},
+			window:  5 * time.Second,
+			want:    2, wantOK: true,
+		},
+		{
+			name:    "markers are skipped",
+			samples: []Sample{CounterSample(0, 0), {Ts: 1e9, Marker: MarkerGap}, CounterSample(2e9, 4)},
+			window:  time.Minute,
+			want:    2, wantOK: true,
+		},
+		{
+			name:    "float counters",
+			samples: []Sample{FloatCounterSample(0, 0.5), FloatCounterSample(2e9, 1.5)},
+			window:  time.Minute,
+			want:    0.5, wantOK: true,
+		},
+		{
+			name:    "one sample",
+			samples: []Sample{CounterSample(0, 1)},
+			window:  time.Minute,
+		},
+		{
+			name:    "no time between samples",
+			samples: []Sample{CounterSample(1e9, 1), CounterSample(1e9, 2)},
+			window:  time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		r := NewRing(16)
+		for _, s := range tt.samples {
+			r.Push(s)
+		}
+		got, ok := r.RatePerSecond(tt.window)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("%s: RatePerSecond = %v, %v; want %v, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package buffer
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RollupLevel is one downsampled resolution of a series and how many
+// buckets of it a Rollup keeps
+type RollupLevel struct {
+	Resolution time.Duration
+	Buckets    int
+}
+
+// RollupLevels are kept for every gauge and counter series: an hour at
+// 1s, a day at 10s and a week at 1m. A series holding all of them takes
+// about 22320 * 48 bytes, just over 1MB, on top of its raw ring; buckets
+// are allocated as they fill, so a young series takes less.
+var RollupLevels = []RollupLevel{
+	{Resolution: time.Second, Buckets: 3600},
+	{Resolution: 10 * time.Second, Buckets: 8640},
+	{Resolution: time.Minute, Buckets: 10080},
+}
+
+// RollupPoint summarizes the samples of one bucket. Ts is the start of
+// the bucket. Last is the newest value, from which counter rates are
+// derived.
+type RollupPoint struct {
+	Ts    int64   `json:"ts"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Last  float64 `json:"last"`
+	Count uint64  `json:"count"`
+}
+
+// Rollup keeps a series downsampled to each of RollupLevels, updated as
+// samples reach the ring
+type Rollup struct {
+	levels []rollupLevel
+	mu     sync.RWMutex
+}
+
+// rollupLevel holds the closed buckets of a resolution in a ring, oldest
+// at idx once full, and the bucket still filling
+type rollupLevel struct {
+	width  int64
+	size   int
+	points []RollupPoint
+	idx    int
+	open   RollupPoint
+	sum    float64
+}
+
+// newRollup creates a rollup at RollupLevels
+func newRollup() *Rollup {
+	levels := make([]rollupLevel, len(RollupLevels))
+	for i, level := range RollupLevels {
+		levels[i] = rollupLevel{width: int64(level.Resolution), size: level.Buckets}
+	}
+	return &Rollup{levels: levels}
+}
+
+// add folds a sample into every level; markers are skipped. Samples reach
+// it in timestamp order, so one before the open bucket can only come from
+// concurrent pushes and is dropped.
+func (r *Rollup) add(s Sample) {
+	if s.IsMarker() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.levels {
+		r.levels[i].add(s)
+	}
+}
+
+func (l *rollupLevel) add(s Sample) {
+	start := s.Ts - s.Ts%l.width
+	if l.open.Count > 0 && start != l.open.Ts {
+		if start < l.open.Ts {
+			return
+		}
+		l.close()
+	}
+	if l.open.Count == 0 {
+		l.open = RollupPoint{Ts: start, Min: s.Val, Max: s.Val}
+		l.sum = 0
+	}
+	l.open.Min = math.Min(l.open.Min, s.Val)
+	l.open.Max = math.Max(l.open.Max, s.Val)
+	l.open.Last = s.Val
+	l.open.Count++
+	l.sum += s.Val
+}
+
+// close stores the open bucket, overwriting the oldest once full
+func (l *rollupLevel) close() {
+	point := l.current()
+	if len(l.points) < l.size {
+		if len(l.points) == cap(l.points) {
+			// Grow as append would, but never past size
+			grown := make([]RollupPoint, len(l.points), min(max(2*len(l.points), 64), l.size))
+			copy(grown, l.points)
+			l.points = grown
+		}
+		l.points = append(l.points, point)
+	} else {
+		l.points[l.idx] = point
+		l.idx = (l.idx + 1) % l.size
+	}
+	l.open = RollupPoint{}
+}
+
+// current returns the open bucket with its average
+func (l *rollupLevel) current() RollupPoint {
+	point := l.open
+	point.Avg = l.sum / float64(point.Count)
+	return point
+}
+
+// query returns the buckets starting in [start, end), oldest first,
+// including the open one
+func (l *rollupLevel) query(start, end int64) []RollupPoint {
+	var result []RollupPoint
+	for i := range l.points {
+		p := l.points[(l.idx+i)%len(l.points)]
+		if p.Ts >= start && p.Ts < end {
+			result = append(result, p)
+		}
+	}
+	if l.open.Count > 0 && l.open.Ts >= start && l.open.Ts < end {
+		result = append(result, l.current())
+	}
+	return result
+}
+
+// Query returns the buckets of a resolution starting in [start, end),
+// oldest first, the newest still filling; ok is false for a resolution
+// not in RollupLevels
+func (r *Rollup) Query(resolution time.Duration, start, end int64) ([]RollupPoint, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := range r.levels {
+		if r.levels[i].width == int64(resolution) {
+			return r.levels[i].query(start, end), true
+		}
+	}
+	return nil, false
+}
+
+// rollupPointBytes is the width of a RollupPoint, for memory estimates
+const rollupPointBytes = 48
+
+// bytes approximates the memory of the buckets allocated so far; a nil
+// Rollup, with rollups disabled, has none
+func (r *Rollup) bytes() int64 {
+	if r == nil {
+		return 0
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var n int
+	for i := range r.levels {
+		n += cap(r.levels[i].points)
+	}
+	return int64(n) * rollupPointBytes
+}
+
+// levelsCopy returns the levels with their closed buckets oldest first,
+// for ExportState
+func (r *Rollup) levelsCopy() []rollupLevel {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	levels := make([]rollupLevel, len(r.levels))
+	for i, l := range r.levels {
+		points := make([]RollupPoint, 0, len(l.points))
+		points = append(points, l.points[l.idx:]...)
+		points = append(points, l.points[:l.idx]...)
+		l.points, l.idx = points, 0
+		levels[i] = l
+	}
+	return levels
+}
+
+// restore replaces the levels of the same resolution with saved ones,
+// keeping the newest buckets that fit; saved resolutions no longer in
+// RollupLevels are ignored
+func (r *Rollup) restore(saved []rollupLevel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.levels {
+		l := &r.levels[i]
+		for _, s := range saved {
+			if s.width != l.width {
+				continue
+			}
+			l.points = slices.Clone(newestSamples(s.points, uint64(l.size)))
+			l.idx = 0
+			l.open, l.sum = s.open, s.sum
+		}
+	}
+}
+
+// QueryRollup returns a gauge or counter series at a resolution over
+// start <= Ts < end, oldest first. A zero resolution returns the raw
+// samples as one-sample points, for those still in the ring only. ok is
+// false when neither series exists or the resolution is not in
+// RollupLevels.
+func (r *Registry) QueryRollup(service, name string, resolution time.Duration, start, end int64) ([]RollupPoint, bool) {
+	ring, ok := r.FindRing(service, name)
+	if !ok {
+		ring, ok = r.FindCounterRing(service, name)
+	}
+	if !ok {
+		return nil, false
+	}
+	if resolution == 0 {
+		var result []RollupPoint
+		for _, s := range ring.SnapshotRange(start, end) {
+			if !s.IsMarker() {
+				result = append(result, RollupPoint{Ts: s.Ts, Min: s.Val, Max: s.Val, Avg: s.Val, Last: s.Val, Count: 1})
+			}
+		}
+		return result, true
+	}
+	if ring.rollup == nil {
+		return nil, false
+	}
+	return ring.rollup.Query(resolution, start, end)
+}
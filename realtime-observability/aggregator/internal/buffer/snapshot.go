@@ -0,0 +1,38 @@
+package buffer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SaveSnapshot writes every ring and rollup to w in the ExportState
+// format, closed with an empty frame so LoadSnapshot can tell a complete
+// snapshot from a truncated one
+func (r *Registry) SaveSnapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeStateFrames(bw, r.stateRecords())
+	writeStateFrame(bw, nil)
+	return bw.Flush()
+}
+
+// LoadSnapshot loads a snapshot written by SaveSnapshot. Unlike
+// ImportState it is all or nothing: the whole snapshot is decoded first,
+// and a corrupt or truncated one is an error that leaves the registry
+// untouched. Rings and rollups of another size than the current ones keep
+// their newest entries.
+func (r *Registry) LoadSnapshot(rd io.Reader) error {
+	records, skipped, ended, err := readStateRecords(rd)
+	if err != nil {
+		return err
+	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("corrupt snapshot: %w", skipped[0])
+	}
+	if !ended {
+		return errors.New("truncated snapshot")
+	}
+	r.applyStateRecords(records, 0)
+	return nil
+}
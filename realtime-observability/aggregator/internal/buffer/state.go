@@ -0,0 +1,546 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"slices"
+	"time"
+)
+
+// State file layout:
+//
+//	magic "TSTATE" | frame version (uint16)
+//	repeated frames: payload length (uint32) | crc32 (uint32) | payload
+//
+// Each payload is one series and starts with its own record version, so an
+// unknown record version or a corrupt frame only loses that series. Record
+// version 2 stores counter values as uint64 rather than float64 bits and
+// version 3 adds histogram sums and counts; older records are still read.
+// Rollup records follow the rings they belong to. SaveSnapshot ends the
+// file with an empty frame so truncation is detected.
+const (
+	stateMagic        = "TSTATE"
+	stateFrameVersion = 1
+
+	// StateRecordVersion is the series record version written by ExportState
+	StateRecordVersion = 3
+
+	// maxStateFrame bounds a single series record to guard against corrupt lengths
+	maxStateFrame = 64 << 20
+)
+
+const (
+	stateKindGauge     = 1
+	stateKindCounter   = 2
+	stateKindHistogram = 3
+	// stateKindFloatCounter is a counter ring holding float counter
+	// samples; values are stored as float64 bits
+	stateKindFloatCounter = 4
+	// stateKindRollup is the Rollup of the gauge or counter ring of the
+	// same key
+	stateKindRollup = 5
+)
+
+// ImportOptions controls how ImportState loads a state file
+type ImportOptions struct {
+	// Rebase shifts all timestamps so the newest imported sample lands at Now.
+	// Rollups are not imported then, since their buckets would no longer
+	// line up.
+	Rebase bool
+	// Now is the rebase target; zero means time.Now()
+	Now time.Time
+}
+
+// ImportResult summarises an ImportState call
+type ImportResult struct {
+	Imported int
+	Skipped  []KeyError
+	// Offset is the nanosecond shift applied to every timestamp when rebasing
+	Offset int64
+}
+
+// KeyError records why a single series could not be imported
+type KeyError struct {
+	Key MetricKey
+	Err error
+}
+
+func (e KeyError) Error() string {
+	if e.Key == (MetricKey{}) {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+// stateRecord is a decoded series from a state file
+type stateRecord struct {
+	kind       uint8
+	key        MetricKey
+	samples    []Sample
+	histograms []HistogramData
+
+	// rollup records only: the kind of ring the rollup belongs to
+	rollupOf uint8
+	levels   []rollupLevel
+}
+
+// Snapshot returns a copy of all histograms in order (oldest to newest)
+func (r *HistogramRing) Snapshot() []HistogramData {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var start uint64
+	if r.idx >= r.size {
+		start = r.idx - r.size
+	}
+
+	result := make([]HistogramData, 0, r.idx-start)
+	for i := start; i < r.idx; i++ {
+		result = append(result, r.data[i%r.size])
+	}
+	return result
+}
+
+// ExportState writes the full contents of every ring, and their rollups,
+// to w. Gap markers are not exported.
+func (r *Registry) ExportState(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeStateFrames(bw, r.stateRecords())
+	return bw.Flush()
+}
+
+// stateRecords copies every ring into records, rollups last
+func (r *Registry) stateRecords() []stateRecord {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	records := make([]stateRecord, 0, len(r.gauges)+len(r.counters)+len(r.histograms))
+	var rollups []stateRecord
+	for key, ring := range r.gauges {
+		records = append(records, stateRecord{kind: stateKindGauge, key: key, samples: withoutMarkers(ring.Snapshot())})
+		if ring.rollup != nil {
+			rollups = append(rollups, stateRecord{kind: stateKindRollup, key: key, rollupOf: stateKindGauge, levels: ring.rollup.levelsCopy()})
+		}
+	}
+	for key, ring := range r.counters {
+		samples := withoutMarkers(ring.Snapshot())
+		kind := uint8(stateKindCounter)
+		if slices.ContainsFunc(samples, func(s Sample) bool { return s.Float }) {
+			kind = stateKindFloatCounter
+		}
+		records = append(records, stateRecord{kind: kind, key: key, samples: samples})
+		if ring.rollup != nil {
+			rollups = append(rollups, stateRecord{kind: stateKindRollup, key: key, rollupOf: stateKindCounter, levels: ring.rollup.levelsCopy()})
+		}
+	}
+	for key, ring := range r.histograms {
+		records = append(records, stateRecord{kind: stateKindHistogram, key: key, histograms: histogramsWithoutMarkers(ring.Snapshot())})
+	}
+	return append(records, rollups...)
+}
+
+// writeStateFrames writes the file header and a frame per record
+func writeStateFrames(bw *bufio.Writer, records []stateRecord) {
+	bw.WriteString(stateMagic)
+	binary.Write(bw, binary.BigEndian, uint16(stateFrameVersion))
+	for _, rec := range records {
+		writeStateFrame(bw, encodeStateRecord(rec))
+	}
+}
+
+func writeStateFrame(bw *bufio.Writer, payload []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	bw.Write(header[:])
+	bw.Write(payload)
+}
+
+// ImportState loads series written by ExportState into the registry.
+// Series that cannot be decoded are reported in the result and skipped;
+// only an unreadable file header aborts the import.
+func (r *Registry) ImportState(rd io.Reader, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+
+	records, skipped, _, err := readStateRecords(rd)
+	result.Skipped = skipped
+	if err != nil {
+		return result, err
+	}
+
+	if opts.Rebase {
+		now := opts.Now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		if newest := newestStateTs(records); newest > 0 {
+			result.Offset = now.UnixNano() - newest
+		}
+		records = slices.DeleteFunc(records, func(rec stateRecord) bool { return rec.kind == stateKindRollup })
+	}
+
+	r.applyStateRecords(records, result.Offset)
+	for _, rec := range records {
+		if rec.kind != stateKindRollup {
+			result.Imported++
+		}
+	}
+	return result, nil
+}
+
+// readStateRecords decodes a state file. Records that cannot be decoded
+// are returned in skipped; ended reports whether the file closed with
+// SaveSnapshot's empty frame. Only an unreadable header is an error.
+func readStateRecords(rd io.Reader) (records []stateRecord, skipped []KeyError, ended bool, err error) {
+	br := bufio.NewReader(rd)
+	magic := make([]byte, len(stateMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != stateMagic {
+		return nil, nil, false, errors.New("not a state file")
+	}
+	var version uint16
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return nil, nil, false, fmt.Errorf("read state version: %w", err)
+	}
+	if version != stateFrameVersion {
+		return nil, nil, false, fmt.Errorf("unsupported state frame version %d", version)
+	}
+
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if err != io.EOF {
+				skipped = append(skipped, KeyError{Err: fmt.Errorf("truncated frame header: %w", err)})
+			}
+			break
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size == 0 {
+			ended = true
+			break
+		}
+		if size > maxStateFrame {
+			skipped = append(skipped, KeyError{Err: fmt.Errorf("frame length %d exceeds limit", size)})
+			break
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			skipped = append(skipped, KeyError{Err: fmt.Errorf("truncated frame: %w", err)})
+			break
+		}
+
+		rec, err := decodeStateRecord(payload)
+		if err == nil && crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			err = errors.New("checksum mismatch")
+		}
+		if err != nil {
+			skipped = append(skipped, KeyError{Key: rec.key, Err: err})
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, skipped, ended, nil
+}
+
+// applyStateRecords pushes decoded records into the rings, shifting
+// timestamps by offset. Only the newest samples a ring can hold are
+// pushed. A rollup replaces the one its ring built from the samples.
+func (r *Registry) applyStateRecords(records []stateRecord, offset int64) {
+	for _, rec := range records {
+		switch rec.kind {
+		case stateKindGauge:
+			ring := r.GetRing(rec.key.Service, rec.key.Name)
+			for _, s := range newestSamples(rec.samples, ring.size) {
+				s.Ts += offset
+				ring.Push(s)
+			}
+		case stateKindCounter, stateKindFloatCounter:
+			ring := r.GetCounterRing(rec.key.Service, rec.key.Name)
+			for _, s := range newestSamples(rec.samples, ring.size) {
+				s.Ts += offset
+				ring.Push(s)
+			}
+		case stateKindHistogram:
+			ring := r.GetHistogramRing(rec.key.Service, rec.key.Name)
+			for _, h := range newestSamples(rec.histograms, ring.size) {
+				h.Ts += offset
+				ring.Push(h)
+			}
+		case stateKindRollup:
+			get := r.GetRing
+			if rec.rollupOf == stateKindCounter {
+				get = r.GetCounterRing
+			}
+			ring := get(rec.key.Service, rec.key.Name)
+			if ring.rollup != nil {
+				ring.rollup.restore(rec.levels)
+			}
+		}
+	}
+}
+
+// newestSamples returns the last size entries of samples
+func newestSamples[S any](samples []S, size uint64) []S {
+	if uint64(len(samples)) > size {
+		return samples[uint64(len(samples))-size:]
+	}
+	return samples
+}
+
+func newestStateTs(records []stateRecord) int64 {
+	var newest int64
+	for _, rec := range records {
+		if n := len(rec.samples); n > 0 && rec.samples[n-1].Ts > newest {
+			newest = rec.samples[n-1].Ts
+		}
+		if n := len(rec.histograms); n > 0 && rec.histograms[n-1].Ts > newest {
+			newest = rec.histograms[n-1].Ts
+		}
+	}
+	return newest
+}
+
+func encodeStateRecord(rec stateRecord) []byte {
+	buf := make([]byte, 0, 64+len(rec.samples)*16)
+	buf = append(buf, StateRecordVersion, rec.kind)
+	buf = appendStateString(buf, rec.key.Service)
+	buf = appendStateString(buf, rec.key.Name)
+
+	if rec.kind == stateKindRollup {
+		buf = append(buf, rec.rollupOf)
+		buf = binary.AppendUvarint(buf, uint64(len(rec.levels)))
+		for _, l := range rec.levels {
+			buf = binary.AppendUvarint(buf, uint64(l.width))
+			buf = binary.AppendUvarint(buf, uint64(len(l.points)))
+			for _, p := range l.points {
+				buf = appendRollupPoint(buf, p)
+			}
+			if l.open.Count > 0 {
+				buf = append(buf, 1)
+				buf = appendRollupPoint(buf, l.open)
+				buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(l.sum))
+			} else {
+				buf = append(buf, 0)
+			}
+		}
+		return buf
+	}
+
+	if rec.kind == stateKindHistogram {
+		buf = binary.AppendUvarint(buf, uint64(len(rec.histograms)))
+		for _, h := range rec.histograms {
+			buf = binary.BigEndian.AppendUint64(buf, uint64(h.Ts))
+			buf = binary.AppendUvarint(buf, uint64(len(h.Bounds)))
+			for _, b := range h.Bounds {
+				buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(b))
+			}
+			buf = binary.AppendUvarint(buf, uint64(len(h.Counts)))
+			for _, c := range h.Counts {
+				buf = binary.AppendUvarint(buf, c)
+			}
+			if h.HasSum {
+				buf = append(buf, 1)
+				buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(h.Sum))
+				buf = binary.AppendUvarint(buf, h.Count)
+			} else {
+				buf = append(buf, 0)
+			}
+		}
+		return buf
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(rec.samples)))
+	for _, s := range rec.samples {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(s.Ts))
+		if rec.kind == stateKindCounter {
+			buf = binary.BigEndian.AppendUint64(buf, s.Count)
+		} else {
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(s.Val))
+		}
+	}
+	return buf
+}
+
+func appendRollupPoint(buf []byte, p RollupPoint) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(p.Ts))
+	for _, v := range []float64{p.Min, p.Max, p.Avg, p.Last} {
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+	}
+	return binary.AppendUvarint(buf, p.Count)
+}
+
+func (d *stateDecoder) rollupPoint() RollupPoint {
+	return RollupPoint{
+		Ts:    int64(d.uint64()),
+		Min:   math.Float64frombits(d.uint64()),
+		Max:   math.Float64frombits(d.uint64()),
+		Avg:   math.Float64frombits(d.uint64()),
+		Last:  math.Float64frombits(d.uint64()),
+		Count: d.uvarint(),
+	}
+}
+
+func appendStateString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// stateDecoder reads fields from a record payload, remembering the first error
+type stateDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *stateDecoder) byte() uint8 {
+	if d.err != nil || len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *stateDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *stateDecoder) uint64() uint64 {
+	if d.err != nil || len(d.buf) < 8 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v
+}
+
+func (d *stateDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil || uint64(len(d.buf)) < n {
+		d.fail()
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+// count reads a length prefix, rejecting values that cannot fit in the
+// remaining payload given a minimum encoded size per element
+func (d *stateDecoder) count(minSize int) int {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.buf)/minSize) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (d *stateDecoder) fail() {
+	if d.err == nil {
+		d.err = errors.New("malformed record")
+	}
+}
+
+func decodeStateRecord(payload []byte) (stateRecord, error) {
+	var rec stateRecord
+	d := &stateDecoder{buf: payload}
+
+	version := d.byte()
+	rec.kind = d.byte()
+	rec.key.Service = d.string()
+	rec.key.Name = d.string()
+	if d.err != nil {
+		return rec, d.err
+	}
+	if version < 1 || version > StateRecordVersion {
+		return rec, fmt.Errorf("unsupported record version %d", version)
+	}
+
+	switch rec.kind {
+	case stateKindGauge:
+		n := d.count(16)
+		rec.samples = make([]Sample, n)
+		for i := range rec.samples {
+			rec.samples[i].Ts = int64(d.uint64())
+			rec.samples[i].Val = math.Float64frombits(d.uint64())
+		}
+	case stateKindCounter:
+		n := d.count(16)
+		rec.samples = make([]Sample, n)
+		for i := range rec.samples {
+			ts := int64(d.uint64())
+			if version == 1 {
+				rec.samples[i] = CounterSample(ts, uint64(math.Float64frombits(d.uint64())))
+			} else {
+				rec.samples[i] = CounterSample(ts, d.uint64())
+			}
+		}
+	case stateKindFloatCounter:
+		n := d.count(16)
+		rec.samples = make([]Sample, n)
+		for i := range rec.samples {
+			ts := int64(d.uint64())
+			rec.samples[i] = FloatCounterSample(ts, math.Float64frombits(d.uint64()))
+		}
+	case stateKindHistogram:
+		n := d.count(10)
+		rec.histograms = make([]HistogramData, n)
+		for i := range rec.histograms {
+			h := &rec.histograms[i]
+			h.Ts = int64(d.uint64())
+			h.Bounds = make([]float64, d.count(8))
+			for j := range h.Bounds {
+				h.Bounds[j] = math.Float64frombits(d.uint64())
+			}
+			h.Counts = make([]uint64, d.count(1))
+			for j := range h.Counts {
+				h.Counts[j] = d.uvarint()
+			}
+			if version >= 3 && d.byte() == 1 {
+				h.HasSum = true
+				h.Sum = math.Float64frombits(d.uint64())
+				h.Count = d.uvarint()
+			}
+		}
+	case stateKindRollup:
+		rec.rollupOf = d.byte()
+		if rec.rollupOf != stateKindGauge && rec.rollupOf != stateKindCounter {
+			d.fail()
+		}
+		rec.levels = make([]rollupLevel, d.count(3))
+		for i := range rec.levels {
+			l := &rec.levels[i]
+			l.width = int64(d.uvarint())
+			l.points = make([]RollupPoint, d.count(41))
+			for j := range l.points {
+				l.points[j] = d.rollupPoint()
+			}
+			if d.byte() == 1 {
+				l.open = d.rollupPoint()
+				l.sum = math.Float64frombits(d.uint64())
+			}
+		}
+	default:
+		return rec, fmt.Errorf("unknown record kind %d", rec.kind)
+	}
+
+	if d.err == nil && len(d.buf) != 0 {
+		d.fail()
+	}
+	return rec, d.err
+}
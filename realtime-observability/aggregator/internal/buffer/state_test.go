@@ -0,0 +1,201 @@
+package buffer
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// roundTrip exports src and imports it into a fresh registry
+func roundTrip(t *testing.T, src *Registry, opts ImportOptions) (*Registry, ImportResult) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := src.ExportState(&buf); err != nil {
+		t.Fatalf("ExportState: %v", err)
+	}
+	dst := NewRegistryWithOptions(Options{DisableRollups: true})
+	result, err := dst.ImportState(&buf, opts)
+	if err != nil {
+		t.Fatalf("ImportState: %v", err)
+	}
+	if len(result.Skipped) > 0 {
+		t.Fatalf("skipped = %v", result.Skipped)
+	}
+	return dst, result
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	src := NewRegistryWithOptions(Options{DisableRollups: true})
+	gauge := []Sample{{Ts: 1e9, Val: 0.5}, {Ts: 2e9, Val: 0.75}}
+	for _, s := range gauge {
+		src.GetRing("checkout", "cpu").Push(s)
+	}
+	hist := []HistogramData{
+		{Ts: 1e9, Bounds: []float64{0.1, 1}, Counts: []uint64{3, 2, 1}},
+		{Ts: 2e9, Bounds: []float64{0.1, 1}, Counts: []uint64{0, 4, 0}},
+	}
+	for _, h := range hist {
+		src.GetHistogramRing("checkout", "latency").Push(h)
+	}
+
+	dst, result := roundTrip(t, src, ImportOptions{})
+	if result.Imported != 2 {
+		t.Fatalf("imported = %d, want 2", result.Imported)
+	}
+	if got := dst.GetRing("checkout", "cpu").Snapshot(); !reflect.DeepEqual(got, gauge) {
+		t.Fatalf("gauge = %v, want %v", got, gauge)
+	}
+	if got := dst.GetHistogramRing("checkout", "latency").Snapshot(); !reflect.DeepEqual(got, hist) {
+		t.Fatalf("histograms = %v, want %v", got, hist)
+	}
+}
+
+func TestStateImportRebase(t *testing.T) {
+	src := NewRegistryWithOptions(Options{DisableRollups: true})
+	src.GetRing("checkout", "cpu").Push(Sample{Ts: 1e9, Val: 1})
+	src.GetRing("checkout", "cpu").Push(Sample{Ts: 3e9, Val: 2})
+
+	now := time.Unix(100, 0)
+	dst, result := roundTrip(t, src, ImportOptions{Rebase: true, Now: now})
+	if result.Offset != 97e9 {
+		t.Fatalf("offset = %d, want 97e9", result.Offset)
+	}
+	want := []Sample{{Ts: 98e9, Val: 1}, {Ts: 100e9, Val: 2}}
+	if got := dst.GetRing("checkout", "cpu").Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rebased = %v, want %v", got, want)
+	}
+}
+
+func TestStateImportSkipsCorruptSeries(t *testing.T) {
+	src := NewRegistryWithOptions(Options{DisableRollups: true})
+	src.GetRing("checkout", "cpu").Push(Sample{Ts: 1e9, Val: 1})
+	src.GetRing("checkout", "mem").Push(Sample{Ts: 1e9, Val: 2})
+	var buf bytes.Buffer
+	if err := src.ExportState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip the last byte of the file, inside the second series' payload
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+	dst := NewRegistryWithOptions(Options{DisableRollups: true})
+	result, err := dst.ImportState(bytes.NewReader(data), ImportOptions{})
+	if err != nil {
+		t.Fatalf("ImportState: %v", err)
+	}
+	if result.Imported != 1 || len(result.Skipped) != 1 {
+		t.Fatalf("imported %d, skipped %v; want 1 and 1", result.Imported, result.Skipped)
+	}
+
+	if _, err := dst.ImportState(bytes.NewReader([]byte("garbage")), ImportOptions{}); err == nil {
+		t.Fatal("ImportState accepted a file without the header")
+	}
+}
+
+func TestStateKeepsExactCounters(t *testing.T) {
+	src := NewRegistryWithOptions(Options{DisableRollups: true})
+	// Past 2^53 a float64 can no longer tell these values apart
+	want := []Sample{CounterSample(1e9, 1<<53+1), CounterSample(2e9, 1<<53+3)}
+	for _, s := range want {
+		src.GetCounterRing("checkout", "requests").Push(s)
+	}
+
+	dst, _ := roundTrip(t, src, ImportOptions{})
+	got := dst.GetCounterRing("checkout", "requests").Snapshot()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("counters = %v, want %v", got, want)
+	}
+	if delta := got[1].CounterDelta(got[0]); delta != 2 {
+		t.Fatalf("delta = %d, want 2", delta)
+	}
+}
+
+func TestStateKeepsHistogramSums(t *testing.T) {
+	src := NewRegistryWithOptions(Options{DisableRollups: true})
+	want := []HistogramData{
+		{Ts: 1e9, Bounds: []float64{1}, Counts: []uint64{2, 1}, Sum: 3.25, Count: 3, HasSum: true},
+		{Ts: 2e9, Bounds: []float64{1}, Counts: []uint64{1, 0}},
+	}
+	for _, h := range want {
+		src.GetHistogramRing("checkout", "latency").Push(h)
+	}
+
+	dst, _ := roundTrip(t, src, ImportOptions{})
+	got := dst.GetHistogramRing("checkout", "latency").Snapshot()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("histograms = %v, want %v", got, want)
+	}
+	if mean, ok := got[0].Mean(); !ok || mean != 3.25/3 {
+		t.Fatalf("mean = %v, %v; want %v", mean, ok, 3.25/3)
+	}
+}
+
+func TestStateKeepsFloatCounters(t *testing.T) {
+	src := NewRegistryWithOptions(Options{DisableRollups: true})
+	want := []Sample{FloatCounterSample(1e9, 1.5), FloatCounterSample(2e9, 4.25)}
+	for _, s := range want {
+		src.GetCounterRing("checkout", "cpu_seconds").Push(s)
+	}
+
+	dst, _ := roundTrip(t, src, ImportOptions{})
+	got := dst.GetCounterRing("checkout", "cpu_seconds").Snapshot()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("counters = %v, want %v", got, want)
+	}
+	if inc := got[1].CounterIncrease(got[0]); inc != 2.75 {
+		t.Fatalf("increase = %v, want 2.75", inc)
+	}
+}
+
+func TestSnapshotKeepsRollups(t *testing.T) {
+	opts := Options{DefaultRingSize: 4}
+	src := NewRegistryWithOptions(opts)
+	for i := range int64(20) {
+		src.GetRing("checkout", "cpu").Push(Sample{Ts: i * 1e9, Val: float64(i)})
+		src.GetCounterRing("checkout", "requests_total").Push(CounterSample(i*1e9, uint64(i*3)))
+	}
+	var buf bytes.Buffer
+	if err := src.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	dst := NewRegistryWithOptions(opts)
+	if err := dst.LoadSnapshot(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if got := len(dst.GetRing("checkout", "cpu").Snapshot()); got != 4 {
+		t.Fatalf("ring holds %d samples, want 4", got)
+	}
+	// The rollups still cover the samples the rings no longer hold
+	for _, name := range []string{"cpu", "requests_total"} {
+		want, _ := src.QueryRollup("checkout", name, time.Second, 0, 20e9)
+		got, _ := dst.QueryRollup("checkout", name, time.Second, 0, 20e9)
+		if len(want) != 20 || !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s rollup = %v, want %v", name, got, want)
+		}
+	}
+	// A counter's rollup is restored onto the counter, adding no gauge
+	if _, ok := dst.FindRing("checkout", "requests_total"); ok {
+		t.Fatal("counter rollup created a gauge ring")
+	}
+}
+
+func TestLoadSnapshotRejectsTruncated(t *testing.T) {
+	src := NewRegistryWithOptions(Options{DisableRollups: true})
+	src.GetRing("checkout", "cpu").Push(Sample{Ts: 1e9, Val: 1})
+	var buf bytes.Buffer
+	if err := src.SaveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the closing empty frame the snapshot is incomplete
+	data := buf.Bytes()[:buf.Len()-8]
+	dst := NewRegistryWithOptions(Options{DisableRollups: true})
+	if err := dst.LoadSnapshot(bytes.NewReader(data)); err == nil {
+		t.Fatal("LoadSnapshot accepted a truncated snapshot")
+	}
+	if _, ok := dst.FindRing("checkout", "cpu"); ok {
+		t.Fatal("truncated snapshot loaded a series")
+	}
+}
@@ -0,0 +1,131 @@
+package cardinality
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// Sort dimensions for the top-K view
+const (
+	SortSeries  = "series"
+	SortSamples = "samples_per_sec"
+	SortBytes   = "bytes"
+)
+
+// RateSource reports ingested samples/sec per service
+type RateSource interface {
+	SampleRates() map[string]float64
+}
+
+// ServiceReport describes the footprint of a single service
+type ServiceReport struct {
+	Service        string              `json:"service"`
+	Series         buffer.SeriesCounts `json:"series"`
+	TotalSeries    int                 `json:"total_series"`
+	SamplesPerSec  float64             `json:"samples_per_sec"`
+	EstimatedBytes int64               `json:"estimated_bytes"`
+	OutOfOrder     uint64              `json:"out_of_order_dropped"`
+	Rebucketed     uint64              `json:"histograms_rebucketed"`
+}
+
+// Report is the cardinality breakdown across all services
+type Report struct {
+	Services       []ServiceReport `json:"services"`
+	TotalSeries    int             `json:"total_series"`
+	SamplesPerSec  float64         `json:"samples_per_sec"`
+	EstimatedBytes int64           `json:"estimated_bytes"`
+}
+
+// Build assembles a report from the registry's incremental series counts and
+// the ingest sample rates; services are sorted by name
+func Build(registry *buffer.Registry, rates RateSource) Report {
+	counts := registry.SeriesCounts()
+	sampleRates := rates.SampleRates()
+	dropped := make(map[string]uint64)
+	for key, n := range registry.OutOfOrderDrops() {
+		dropped[key.Service] += n
+	}
+	rebucketed := make(map[string]uint64)
+	for key, n := range registry.Rebucketed() {
+		rebucketed[key.Service] += n
+	}
+
+	var report Report
+	report.Services = make([]ServiceReport, 0, len(counts))
+	for service, c := range counts {
+		sr := ServiceReport{
+			Service:        service,
+			Series:         c,
+			TotalSeries:    c.Total(),
+			SamplesPerSec:  sampleRates[service],
+			EstimatedBytes: c.EstimatedBytes(),
+			OutOfOrder:     dropped[service],
+			Rebucketed:     rebucketed[service],
+		}
+		report.Services = append(report.Services, sr)
+		report.TotalSeries += sr.TotalSeries
+		report.SamplesPerSec += sr.SamplesPerSec
+		report.EstimatedBytes += sr.EstimatedBytes
+	}
+
+	sort.Slice(report.Services, func(i, j int) bool {
+		return report.Services[i].Service < report.Services[j].Service
+	})
+	return report
+}
+
+// ValidSort reports whether by names a sort dimension
+func ValidSort(by string) bool {
+	return by == SortSeries || by == SortSamples || by == SortBytes
+}
+
+// TopK returns the k largest services by the given dimension
+func (r Report) TopK(by string, k int) []ServiceReport {
+	top := make([]ServiceReport, len(r.Services))
+	copy(top, r.Services)
+
+	less := func(a, b ServiceReport) bool { return a.TotalSeries > b.TotalSeries }
+	switch by {
+	case SortSamples:
+		less = func(a, b ServiceReport) bool { return a.SamplesPerSec > b.SamplesPerSec }
+	case SortBytes:
+		less = func(a, b ServiceReport) bool { return a.EstimatedBytes > b.EstimatedBytes }
+	}
+	sort.SliceStable(top, func(i, j int) bool { return less(top[i], top[j]) })
+
+	if k > 0 && k < len(top) {
+		top = top[:k]
+	}
+	return top
+}
+
+// Thresholds trigger the periodic cardinality log line; zero disables a check
+type Thresholds struct {
+	Series        int
+	SamplesPerSec float64
+}
+
+// Monitor logs the top services while totals exceed the thresholds
+func Monitor(registry *buffer.Registry, rates RateSource, thresholds Thresholds, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := Build(registry, rates)
+		overSeries := thresholds.Series > 0 && report.TotalSeries >= thresholds.Series
+		overSamples := thresholds.SamplesPerSec > 0 && report.SamplesPerSec >= thresholds.SamplesPerSec
+		if !overSeries && !overSamples {
+			continue
+		}
+
+		log.Printf("Cardinality above threshold: series=%d samples/sec=%.1f est_bytes=%d",
+			report.TotalSeries, report.SamplesPerSec, report.EstimatedBytes)
+		for _, s := range report.TopK(SortSeries, 5) {
+			log.Printf("  service=%s series=%d samples/sec=%.1f est_bytes=%d",
+				s.Service, s.TotalSeries, s.SamplesPerSec, s.EstimatedBytes)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package cardinality
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// rates is a fixed RateSource
+type rates map[string]float64
+
+func (r rates) SampleRates() map[string]float64 { return r }
+
+func TestChattyServiceTopsRanking(t *testing.T) {
+	registry := buffer.NewRegistry()
+	defer registry.Close()
+	sample := buffer.Sample{Ts: 1, Val: 1}
+
+	registry.PushGauge("checkout", "", "cpu_usage", sample)
+	registry.PushCounter("checkout", "", "requests_total", sample)
+	registry.PushGauge("cart", "", "cpu_usage", sample)
+	// search labels every request with its query, 50 series from two instances
+	for i := range 50 {
+		name := buffer.SeriesName("requests", map[string]string{"query": fmt.Sprint(i)})
+		registry.PushGauge("search", "a", name, sample)
+		registry.PushGauge("search", "b", name, sample)
+	}
+
+	report := Build(registry, rates{"checkout": 20, "cart": 5, "search": 400})
+	if len(report.Services) != 3 || report.Services[0].Service != "cart" {
+		t.Fatalf("Services = %v, want cart, checkout and search by name", report.Services)
+	}
+	total := 0
+	for _, s := range report.Services {
+		total += s.TotalSeries
+	}
+	if report.TotalSeries != total || report.SamplesPerSec != 425 {
+		t.Fatalf("totals = %d series, %v samples/sec; want %d, 425", report.TotalSeries, report.SamplesPerSec, total)
+	}
+
+	for _, by := range []string{SortSeries, SortSamples, SortBytes} {
+		top := report.TopK(by, 2)
+		if len(top) != 2 || top[0].Service != "search" {
+			t.Fatalf("TopK(%s, 2) = %v, want search first", by, top)
+		}
+	}
+	search := report.TopK(SortSeries, 1)[0]
+	if search.Series.Gauges != 50 || search.Series.Instances != 100 {
+		t.Fatalf("search series = %+v, want 50 gauges behind 100 instance rings", search.Series)
+	}
+	if top := report.TopK(SortSeries, 0); len(top) != 3 {
+		t.Fatalf("TopK(series, 0) = %d services, want all 3", len(top))
+	}
+}
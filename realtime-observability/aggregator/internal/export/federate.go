@@ -0,0 +1,323 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// Federation limits
+const (
+	DefaultFederateMaxSeries = 10000
+	MaxFederateLast          = 100
+)
+
+// Matcher selects series by label. Supported labels are service, metric
+// (the registry name) and instance; series carry no instance today, so only
+// matchers accepting the empty string select them.
+type Matcher struct {
+	Label string
+	Op    string // =, !=, =~ or !~
+	Value string
+	re    *regexp.Regexp
+}
+
+var matcherPattern = regexp.MustCompile(`^\s*(service|metric|instance)\s*(=~|!~|!=|=)\s*"((?:[^"\\]|\\.)*)"\s*$`)
+
+// ParseMatchers parses match[] selectors. Each selector holds one or more
+// comma-separated matchers, optionally wrapped in braces; all matchers from
+// all selectors must hold for a series to be selected.
+func ParseMatchers(selectors []string) ([]Matcher, error) {
+	var matchers []Matcher
+	for _, sel := range selectors {
+		sel = strings.TrimSpace(sel)
+		sel = strings.TrimSuffix(strings.TrimPrefix(sel, "{"), "}")
+		for _, part := range splitMatchers(sel) {
+			m := matcherPattern.FindStringSubmatch(part)
+			if m == nil {
+				return nil, fmt.Errorf("invalid matcher %q", part)
+			}
+			value, err := strconv.Unquote(`"` + m[3] + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid matcher %q: %w", part, err)
+			}
+			matcher := Matcher{Label: m[1], Op: m[2], Value: value}
+			if matcher.Op == "=~" || matcher.Op == "!~" {
+				// Anchored like Prometheus regex matchers
+				if matcher.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+					return nil, fmt.Errorf("invalid regex in %q: %w", part, err)
+				}
+			}
+			matchers = append(matchers, matcher)
+		}
+	}
+	return matchers, nil
+}
+
+// splitMatchers splits on commas outside quoted values
+func splitMatchers(s string) []string {
+	var parts []string
+	var quoted, escaped bool
+	start := 0
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+func (m Matcher) matches(value string) bool {
+	switch m.Op {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+func matchAll(matchers []Matcher, key buffer.MetricKey) bool {
+	for _, m := range matchers {
+		var value string
+		switch m.Label {
+		case "service":
+			value = key.Service
+		case "metric":
+			value = key.Name
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// FederateOptions selects and bounds a federation response
+type FederateOptions struct {
+	Matchers  []Matcher
+	Last      int // samples per series, newest last (default 1)
+	MaxSeries int // default DefaultFederateMaxSeries
+}
+
+// federatedSeries is one registry series mapped onto an exported family;
+// registry kinds double as Prometheus type names
+type federatedSeries struct {
+	family string
+	kind   string
+	key    buffer.MetricKey
+	labels string
+	help   string
+}
+
+// exportedName maps a registry metric onto the family name and extra labels
+// PrometheusExporter uses for it; other metrics keep a sanitized name
+func exportedName(name, kind string) (string, string) {
+	switch name {
+	case "latency_p50", "latency_p95", "latency_p99":
+		return "service_latency_ms", `,percentile="` + strings.TrimPrefix(name, "latency_") + `"`
+	case "rps":
+		return "service_requests_per_second", ""
+	case "error_rate":
+		return "service_error_rate", ""
+	case "inflight":
+		return "service_inflight_requests", ""
+	case "latency":
+		if kind == "histogram" {
+			return "service_latency_histogram_ms", ""
+		}
+	}
+	family := sanitizeName(name)
+	if kind == "counter" && !strings.HasSuffix(family, "_total") {
+		family += "_total"
+	}
+	return family, ""
+}
+
+// sanitizeName replaces characters not allowed in metric names
+func sanitizeName(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9' && i > 0:
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// WriteFederation streams the newest samples of every matching series in
+// the Prometheus text format with explicit millisecond timestamps. It
+// returns the number of series written; gap markers are never exported.
+func WriteFederation(w io.Writer, registry *buffer.Registry, opts FederateOptions) (int, error) {
+	if opts.Last <= 0 {
+		opts.Last = 1
+	}
+	if opts.Last > MaxFederateLast {
+		opts.Last = MaxFederateLast
+	}
+	if opts.MaxSeries <= 0 {
+		opts.MaxSeries = DefaultFederateMaxSeries
+	}
+
+	var selected []federatedSeries
+	for _, entry := range registry.Catalog() {
+		key := buffer.MetricKey{Service: entry.Service, Name: entry.Metric}
+		if !matchAll(opts.Matchers, key) {
+			continue
+		}
+		name, seriesLabels := buffer.SplitSeriesName(entry.Metric)
+		family, extra := exportedName(name, entry.Kind)
+		if seriesLabels != "" {
+			extra += "," + seriesLabels
+		}
+		selected = append(selected, federatedSeries{
+			family: family,
+			kind:   entry.Kind,
+			key:    key,
+			labels: `service="` + escapeLabel(entry.Service) + `"` + extra,
+			help:   entry.Help,
+		})
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		if selected[i].family != selected[j].family {
+			return selected[i].family < selected[j].family
+		}
+		return selected[i].labels < selected[j].labels
+	})
+
+	bw := bufio.NewWriter(w)
+	written := 0
+	var family, familyKind string
+	for _, s := range selected {
+		if written >= opts.MaxSeries {
+			fmt.Fprintf(bw, "# truncated after %d series\n", written)
+			break
+		}
+		if s.family == family && s.kind != familyKind {
+			// Two registry kinds mapped onto one family; a family has one type
+			continue
+		}
+		if s.family != family {
+			family, familyKind = s.family, s.kind
+			if s.help != "" {
+				fmt.Fprintf(bw, "# HELP %s %s\n", family, escapeHelp(s.help))
+			}
+			fmt.Fprintf(bw, "# TYPE %s %s\n", family, s.kind)
+		}
+		if writeSeries(bw, registry, s, opts.Last) {
+			written++
+		}
+	}
+	return written, bw.Flush()
+}
+
+// writeSeries writes the last n samples of one series
+func writeSeries(w *bufio.Writer, registry *buffer.Registry, s federatedSeries, n int) bool {
+	if s.kind == "histogram" {
+		ring, ok := registry.FindHistogramRing(s.key.Service, s.key.Name)
+		if !ok {
+			return false
+		}
+		hists := ring.Snapshot()
+		if len(hists) > n {
+			hists = hists[len(hists)-n:]
+		}
+		wrote := false
+		for _, h := range hists {
+			if h.IsMarker() {
+				continue
+			}
+			writeHistogram(w, s, h)
+			wrote = true
+		}
+		return wrote
+	}
+
+	find := registry.FindRing
+	if s.kind == "counter" {
+		find = registry.FindCounterRing
+	}
+	ring, ok := find(s.key.Service, s.key.Name)
+	if !ok {
+		return false
+	}
+	wrote := false
+	for _, sample := range ring.SnapshotLast(n) {
+		if sample.IsMarker() {
+			continue
+		}
+		value := formatFloat(sample.Val)
+		if s.kind == "counter" && !sample.Float {
+			value = strconv.FormatUint(sample.Count, 10)
+		}
+		fmt.Fprintf(w, "%s{%s} %s %d\n", s.family, s.labels, value, sample.Ts/1e6)
+		wrote = true
+	}
+	return wrote
+}
+
+// writeHistogram writes cumulative buckets, the count and, when the agent
+// sent one, the sum
+func writeHistogram(w *bufio.Writer, s federatedSeries, h buffer.HistogramData) {
+	ts := h.Ts / 1e6
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		if i < len(h.Counts) {
+			cumulative += h.Counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d %d\n", s.family, s.labels, formatFloat(bound), cumulative, ts)
+	}
+	total := h.Total()
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d %d\n", s.family, s.labels, total, ts)
+	if h.HasSum {
+		fmt.Fprintf(w, "%s_sum{%s} %s %d\n", s.family, s.labels, formatFloat(h.Sum), ts)
+	}
+	fmt.Fprintf(w, "%s_count{%s} %d %d\n", s.family, s.labels, total, ts)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
@@ -0,0 +1,83 @@
+package export
+
+import (
+	"bytes"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// labelMap flattens a parsed metric's labels
+func labelMap(m *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	return labels
+}
+
+func TestFederationParsesWithEscapedLabels(t *testing.T) {
+	const (
+		service = "pay\"ments\\eu\nwest"
+		path    = `/search?q="a\b"` + "\nnext"
+		help    = "Requests by path\\route\nper second"
+	)
+	registry := buffer.NewRegistry()
+	defer registry.Close()
+
+	requests := buffer.SeriesName("requests", map[string]string{"path": path})
+	registry.SetMetadata(service, "requests", buffer.Metadata{Type: "gauge", Help: help})
+	registry.PushGauge(service, "", requests, buffer.Sample{Ts: 2e9, Val: 12.5})
+	registry.PushCounter(service, "", "errors_total", buffer.CounterSample(3e9, 7))
+	registry.GetHistogramRing(service, "latency").Push(buffer.HistogramData{
+		Ts: 4e9, Bounds: []float64{10, 100}, Counts: []uint64{3, 2, 1},
+		Sum: 400, Count: 6, HasSum: true,
+	})
+
+	var out bytes.Buffer
+	n, err := WriteFederation(&out, registry, FederateOptions{})
+	if err != nil || n != 3 {
+		t.Fatalf("WriteFederation = %d, %v; want 3 series", n, err)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(&out)
+	if err != nil {
+		t.Fatalf("output does not parse: %v\n%s", err, out.String())
+	}
+
+	gauge := families["requests"]
+	if gauge == nil || gauge.GetType() != dto.MetricType_GAUGE || len(gauge.Metric) != 1 {
+		t.Fatalf("requests family = %v, want one gauge", gauge)
+	}
+	if gauge.GetHelp() != help {
+		t.Fatalf("help = %q, want %q", gauge.GetHelp(), help)
+	}
+	m := gauge.Metric[0]
+	if labels := labelMap(m); labels["service"] != service || labels["path"] != path {
+		t.Fatalf("labels = %q, want service %q and path %q", labels, service, path)
+	}
+	if m.GetGauge().GetValue() != 12.5 || m.GetTimestampMs() != 2000 {
+		t.Fatalf("requests = %v at %d, want 12.5 at 2000", m.GetGauge().GetValue(), m.GetTimestampMs())
+	}
+
+	counter := families["errors_total"]
+	if counter == nil || counter.GetType() != dto.MetricType_COUNTER {
+		t.Fatalf("errors_total family = %v, want a counter", counter)
+	}
+	if c := counter.Metric[0]; c.GetCounter().GetValue() != 7 || labelMap(c)["service"] != service {
+		t.Fatalf("errors_total = %v", c)
+	}
+
+	hist := families["service_latency_histogram_ms"]
+	if hist == nil || hist.GetType() != dto.MetricType_HISTOGRAM {
+		t.Fatalf("latency family = %v, want a histogram", hist)
+	}
+	h := hist.Metric[0].GetHistogram()
+	if h.GetSampleCount() != 6 || h.GetSampleSum() != 400 || len(h.Bucket) != 3 ||
+		h.Bucket[0].GetCumulativeCount() != 3 || h.Bucket[1].GetCumulativeCount() != 5 {
+		t.Fatalf("histogram = %v, want 6 observations, buckets 3, 5 and +Inf", h)
+	}
+}
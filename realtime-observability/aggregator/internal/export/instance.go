@@ -0,0 +1,46 @@
+package export
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+var (
+	instanceGaugeDesc = prometheus.NewDesc(
+		"service_instance_gauge",
+		"Latest value of a gauge as reported by one instance",
+		[]string{"service", "instance", "metric"}, nil,
+	)
+	instanceCounterDesc = prometheus.NewDesc(
+		"service_instance_counter",
+		"Latest value of a counter as reported by one instance",
+		[]string{"service", "instance", "metric"}, nil,
+	)
+)
+
+// instanceCollector exposes every instance's gauges and counters at
+// scrape time, see PrometheusExporter.SetPerInstance
+type instanceCollector struct {
+	registry *buffer.Registry
+}
+
+func (c instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instanceGaugeDesc
+	ch <- instanceCounterDesc
+}
+
+func (c instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	snapshot := c.registry.LatestSnapshotByInstance()
+	for key, sample := range snapshot.Gauges {
+		if !sample.IsMarker() {
+			ch <- prometheus.MustNewConstMetric(instanceGaugeDesc, prometheus.GaugeValue, sample.Val,
+				key.Service, key.Instance, key.Name)
+		}
+	}
+	for key, sample := range snapshot.Counters {
+		if !sample.IsMarker() {
+			ch <- prometheus.MustNewConstMetric(instanceCounterDesc, prometheus.CounterValue, sample.Val,
+				key.Service, key.Instance, key.Name)
+		}
+	}
+}
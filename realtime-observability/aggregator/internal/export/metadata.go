@@ -0,0 +1,38 @@
+package export
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+var (
+	metricInfoDesc = prometheus.NewDesc(
+		"aggregator_metric_info",
+		"Description reported by the agent for each metric (always 1)",
+		[]string{"service", "metric", "type", "unit", "help"}, nil,
+	)
+	metadataConflictsDesc = prometheus.NewDesc(
+		"aggregator_metadata_conflicts_total",
+		"Conflicting metric descriptions ignored because another instance described the metric first",
+		nil, nil,
+	)
+)
+
+// metadataCollector exposes registry metadata at scrape time
+type metadataCollector struct {
+	registry *buffer.Registry
+}
+
+func (c metadataCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metricInfoDesc
+	ch <- metadataConflictsDesc
+}
+
+func (c metadataCollector) Collect(ch chan<- prometheus.Metric) {
+	for key, m := range c.registry.AllMetadata() {
+		ch <- prometheus.MustNewConstMetric(metricInfoDesc, prometheus.GaugeValue, 1,
+			key.Service, key.Name, m.Type, m.Unit, m.Help)
+	}
+	ch <- prometheus.MustNewConstMetric(metadataConflictsDesc, prometheus.CounterValue,
+		float64(c.registry.MetadataConflicts()))
+}
@@ -0,0 +1,35 @@
+package export
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yourorg/aggregator/internal/pipeline"
+)
+
+var pipelineLatencyDesc = prometheus.NewDesc(
+	"aggregator_pipeline_latency_seconds",
+	"Time samples spend in each stage between ingest and the WebSocket write",
+	[]string{"stage"}, nil,
+)
+
+// pipelineCollector exposes the pipeline latency histograms at scrape time
+type pipelineCollector struct {
+	latency *pipeline.Latency
+}
+
+func (c pipelineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pipelineLatencyDesc
+}
+
+func (c pipelineCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stage := range pipeline.Stages {
+		snap := c.latency.Snapshot(stage)
+		buckets := make(map[float64]uint64, len(pipeline.Bounds))
+		var cumulative uint64
+		for i, bound := range pipeline.Bounds {
+			cumulative += snap.Counts[i]
+			buckets[bound] = cumulative
+		}
+		ch <- prometheus.MustNewConstHistogram(pipelineLatencyDesc, snap.Count, snap.Sum.Seconds(), buckets,
+			stage.String())
+	}
+}
@@ -1,13 +1,18 @@
 package export
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/pipeline"
 )
 
 // PrometheusExporter exports metrics to Prometheus
 type PrometheusExporter struct {
-	registry *buffer.Registry
+	registry    *buffer.Registry
+	latency     *pipeline.Latency
+	perInstance bool
 
 	// Gauge metrics
 	serviceLatency *prometheus.GaugeVec
@@ -99,13 +104,25 @@ func NewPrometheusExporter(registry *buffer.Registry) *PrometheusExporter {
 		bufferSize: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "aggregator_buffer_size",
-				Help: "Current size of metric ring buffers",
+				Help: "Samples, or histogram windows, each series' ring holds when full",
 			},
 			[]string{"service", "metric"},
 		),
 	}
 }
 
+// SetLatency exports the ingest-to-broadcast latency histograms
+func (e *PrometheusExporter) SetLatency(latency *pipeline.Latency) {
+	e.latency = latency
+}
+
+// SetPerInstance also exports every instance's gauges and counters, as
+// service_instance_gauge and service_instance_counter; the service_*
+// metrics always carry the aggregate over instances
+func (e *PrometheusExporter) SetPerInstance(enabled bool) {
+	e.perInstance = enabled
+}
+
 // Register registers all metrics with Prometheus
 func (e *PrometheusExporter) Register() {
 	prometheus.MustRegister(
@@ -117,15 +134,31 @@ func (e *PrometheusExporter) Register() {
 		e.requestsTotal,
 		e.errorsTotal,
 		e.activeConnections,
-		e.bufferSize,
+		metadataCollector{registry: e.registry},
+		rebucketCollector{registry: e.registry},
+		registryCollector{registry: e.registry, bufferSize: e.bufferSize},
 	)
+	if e.latency != nil {
+		prometheus.MustRegister(pipelineCollector{latency: e.latency})
+	}
+	if e.perInstance {
+		prometheus.MustRegister(instanceCollector{registry: e.registry})
+	}
 }
 
+// latencyWindow is how far back UpdateMetrics merges latency histograms:
+// the newest merged bucket at the default Options.HistogramBucket, or the
+// windows pushed without an instance within it
+const latencyWindow = time.Second
+
 // UpdateMetrics updates Prometheus metrics from the registry
 func (e *PrometheusExporter) UpdateMetrics() {
 	snapshot := e.registry.LatestSnapshot()
 
 	for key, sample := range snapshot.Gauges {
+		if sample.IsMarker() {
+			continue
+		}
 		switch key.Name {
 		case "latency_p50":
 			e.serviceLatency.WithLabelValues(key.Service, "p50").Set(sample.Val)
@@ -144,8 +177,13 @@ func (e *PrometheusExporter) UpdateMetrics() {
 
 	// Update histograms
 	for key, hist := range snapshot.Histograms {
-		if key.Name == "latency" {
-			// Calculate percentiles from histogram
+		if key.Name == "latency" && !hist.IsMarker() {
+			// Merge the windows pushed within latencyWindow of the latest
+			if ring, ok := e.registry.FindHistogramRing(key.Service, key.Name); ok {
+				if merged, ok := ring.MergeSince(hist.Ts - int64(latencyWindow) + 1); ok {
+					hist = merged
+				}
+			}
 			p50, p95, p99 := calculatePercentiles(hist.Bounds, hist.Counts)
 			e.serviceLatency.WithLabelValues(key.Service, "p50").Set(p50)
 			e.serviceLatency.WithLabelValues(key.Service, "p95").Set(p95)
@@ -154,46 +192,53 @@ func (e *PrometheusExporter) UpdateMetrics() {
 	}
 }
 
-// calculatePercentiles calculates p50, p95, p99 from histogram data
-func calculatePercentiles(bounds []float64, counts []uint64) (p50, p95, p99 float64) {
-	if len(bounds) == 0 || len(counts) == 0 {
-		return 0, 0, 0
-	}
-
-	var total uint64
-	for _, c := range counts {
-		total += c
+// HandleDelete drops exported series derived from a deleted registry key so
+// Prometheus stops scraping them
+func (e *PrometheusExporter) HandleDelete(key buffer.MetricKey) {
+	service := prometheus.Labels{"service": key.Service}
+	switch key.Name {
+	case "latency_p50":
+		e.serviceLatency.DeleteLabelValues(key.Service, "p50")
+	case "latency_p95":
+		e.serviceLatency.DeleteLabelValues(key.Service, "p95")
+	case "latency_p99":
+		e.serviceLatency.DeleteLabelValues(key.Service, "p99")
+	case "latency":
+		e.serviceLatency.DeletePartialMatch(service)
+		e.latencyHistogram.DeletePartialMatch(service)
+	case "rps":
+		e.serviceRPS.DeletePartialMatch(service)
+	case "error_rate":
+		e.serviceErrors.DeletePartialMatch(service)
+	case "inflight":
+		e.inflight.DeletePartialMatch(service)
+	case "requests_total":
+		e.requestsTotal.DeletePartialMatch(service)
+	case "errors_total":
+		e.errorsTotal.DeletePartialMatch(service)
 	}
+	e.bufferSize.DeleteLabelValues(key.Service, key.Name)
+}
 
-	if total == 0 {
-		return 0, 0, 0
-	}
-
-	target50 := uint64(float64(total) * 0.50)
-	target95 := uint64(float64(total) * 0.95)
-	target99 := uint64(float64(total) * 0.99)
-
-	var cumulative uint64
-	for i, c := range counts {
-		cumulative += c
-		if p50 == 0 && cumulative >= target50 {
-			if i < len(bounds) {
-				p50 = bounds[i]
-			}
-		}
-		if p95 == 0 && cumulative >= target95 {
-			if i < len(bounds) {
-				p95 = bounds[i]
-			}
-		}
-		if p99 == 0 && cumulative >= target99 {
-			if i < len(bounds) {
-				p99 = bounds[i]
-			}
-		}
-	}
+// HandleDeleteService drops every exported series of a purged service,
+// including those recorded directly rather than derived from the registry
+func (e *PrometheusExporter) HandleDeleteService(service string) {
+	labels := prometheus.Labels{"service": service}
+	e.serviceLatency.DeletePartialMatch(labels)
+	e.serviceRPS.DeletePartialMatch(labels)
+	e.serviceErrors.DeletePartialMatch(labels)
+	e.inflight.DeletePartialMatch(labels)
+	e.latencyHistogram.DeletePartialMatch(labels)
+	e.requestsTotal.DeletePartialMatch(labels)
+	e.errorsTotal.DeletePartialMatch(labels)
+	e.bufferSize.DeletePartialMatch(labels)
+}
 
-	return p50, p95, p99
+// calculatePercentiles calculates p50, p95, p99 from histogram data
+func calculatePercentiles(bounds []float64, counts []uint64) (p50, p95, p99 float64) {
+	return buffer.Percentile(bounds, counts, 50),
+		buffer.Percentile(bounds, counts, 95),
+		buffer.Percentile(bounds, counts, 99)
 }
 
 // SetActiveConnections updates the active connections gauge
@@ -0,0 +1,28 @@
+package export
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+var rebucketedDesc = prometheus.NewDesc(
+	"aggregator_histogram_rebucketed_total",
+	"Histogram windows converted to the canonical bounds of their metric",
+	[]string{"service", "metric"}, nil,
+)
+
+// rebucketCollector exposes per-series re-bucketing counts at scrape time
+type rebucketCollector struct {
+	registry *buffer.Registry
+}
+
+func (c rebucketCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rebucketedDesc
+}
+
+func (c rebucketCollector) Collect(ch chan<- prometheus.Metric) {
+	for key, n := range c.registry.Rebucketed() {
+		ch <- prometheus.MustNewConstMetric(rebucketedDesc, prometheus.CounterValue, float64(n),
+			key.Service, key.Name)
+	}
+}
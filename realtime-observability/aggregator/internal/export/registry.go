@@ -0,0 +1,84 @@
+package export
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+var seriesEvictedDesc = prometheus.NewDesc(
+	"aggregator_series_evicted_total",
+	"Series removed after receiving no samples for the series TTL",
+	nil, nil,
+)
+
+var seriesRejectedDesc = prometheus.NewDesc(
+	"aggregator_series_rejected_total",
+	"Requests for a new series refused by the registry's series limits",
+	[]string{"service"}, nil,
+)
+
+var samplesWrittenDesc = prometheus.NewDesc(
+	"aggregator_samples_written",
+	"Samples and histogram windows accepted by the series the registry holds",
+	nil, nil,
+)
+
+var estimatedBytesDesc = prometheus.NewDesc(
+	"aggregator_registry_estimated_bytes",
+	"Approximate memory of the registry's rings and rollups",
+	nil, nil,
+)
+
+var outOfOrderDroppedDesc = prometheus.NewDesc(
+	"aggregator_out_of_order_dropped",
+	"Samples and histogram windows dropped for arriving older than their series' newest, including instances' histogram rings",
+	[]string{"service"}, nil,
+)
+
+// registryCollector exposes registry-wide counts at scrape time from one
+// Registry.Stats call, and sets bufferSize to each series' ring size
+type registryCollector struct {
+	registry   *buffer.Registry
+	bufferSize *prometheus.GaugeVec
+}
+
+func (c registryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- seriesEvictedDesc
+	ch <- seriesRejectedDesc
+	ch <- samplesWrittenDesc
+	ch <- estimatedBytesDesc
+	ch <- outOfOrderDroppedDesc
+	c.bufferSize.Describe(ch)
+}
+
+func (c registryCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.registry.Stats()
+	ch <- prometheus.MustNewConstMetric(seriesEvictedDesc, prometheus.CounterValue,
+		float64(stats.Evicted))
+	for service, n := range stats.Rejected {
+		ch <- prometheus.MustNewConstMetric(seriesRejectedDesc, prometheus.CounterValue,
+			float64(n), service)
+	}
+	// Samples leave the total with their series, so it is not a counter
+	ch <- prometheus.MustNewConstMetric(samplesWrittenDesc, prometheus.GaugeValue,
+		float64(stats.SamplesWritten))
+	ch <- prometheus.MustNewConstMetric(estimatedBytesDesc, prometheus.GaugeValue,
+		float64(stats.EstimatedBytes))
+
+	// Drops leave the sum with their series too
+	dropped := make(map[string]uint64)
+	for key, n := range c.registry.OutOfOrderDrops() {
+		dropped[key.Service] += n
+	}
+	for service, n := range dropped {
+		ch <- prometheus.MustNewConstMetric(outOfOrderDroppedDesc, prometheus.GaugeValue,
+			float64(n), service)
+	}
+
+	// Reset drops series that went away without a delete hook
+	c.bufferSize.Reset()
+	for _, size := range stats.Sizes {
+		c.bufferSize.WithLabelValues(size.Service, size.Metric).Set(float64(size.Size))
+	}
+	c.bufferSize.Collect(ch)
+}
@@ -0,0 +1,171 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config weights and targets the score of one service. Components with a
+// zero weight are left out.
+type Config struct {
+	ErrorWeight      float64 `json:"error_weight"`
+	LatencyWeight    float64 `json:"latency_weight"`
+	SaturationWeight float64 `json:"saturation_weight"`
+	StalenessWeight  float64 `json:"staleness_weight"`
+
+	// WindowMs is how far back error and latency inputs look
+	WindowMs int64 `json:"window_ms"`
+
+	// MaxErrorRate is the errors/requests ratio that scores 0
+	MaxErrorRate float64 `json:"max_error_rate"`
+	// ErrorsMetric and RequestsMetric are counters; requests fall back to
+	// the observation count of LatencyMetric, and the error ratio to the
+	// ErrorRateGauge when the service has no errors counter or requests
+	ErrorsMetric   string `json:"errors_metric"`
+	RequestsMetric string `json:"requests_metric"`
+	ErrorRateGauge string `json:"error_rate_gauge"`
+
+	// LatencyPercentile of the LatencyMetric histogram scores 100 up to
+	// LatencyTargetMs and 0 at twice the target
+	LatencyMetric     string  `json:"latency_metric"`
+	LatencyPercentile float64 `json:"latency_percentile"`
+	LatencyTargetMs   float64 `json:"latency_target_ms"`
+
+	// Saturation maps gauge names to the value that scores 0 (full
+	// saturation); the worst gauge present sets the component
+	Saturation map[string]float64 `json:"saturation"`
+
+	// StaleAfterMs is the data age that starts lowering the staleness
+	// component, which reaches 0 at twice the age
+	StaleAfterMs int64 `json:"stale_after_ms"`
+
+	// Scores below YellowBelow are yellow and below RedBelow red
+	YellowBelow float64 `json:"yellow_below"`
+	RedBelow    float64 `json:"red_below"`
+}
+
+// DefaultConfig returns the formula used for services without overrides
+func DefaultConfig() Config {
+	return Config{
+		ErrorWeight:      0.4,
+		LatencyWeight:    0.3,
+		SaturationWeight: 0.1,
+		StalenessWeight:  0.2,
+
+		WindowMs: 60000,
+
+		MaxErrorRate:   0.05,
+		ErrorsMetric:   "errors_total",
+		RequestsMetric: "requests_total",
+		ErrorRateGauge: "error_rate",
+
+		LatencyMetric:     "latency",
+		LatencyPercentile: 99,
+		LatencyTargetMs:   500,
+
+		Saturation: map[string]float64{
+			"cpu_usage": 100,
+			"inflight":  100,
+		},
+
+		StaleAfterMs: 10000,
+
+		YellowBelow: 80,
+		RedBelow:    50,
+	}
+}
+
+// Validate checks a configuration for values the formula cannot use
+func (c Config) Validate() error {
+	for name, w := range map[string]float64{
+		"error_weight":      c.ErrorWeight,
+		"latency_weight":    c.LatencyWeight,
+		"saturation_weight": c.SaturationWeight,
+		"staleness_weight":  c.StalenessWeight,
+	} {
+		if w < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if c.ErrorWeight+c.LatencyWeight+c.SaturationWeight+c.StalenessWeight == 0 {
+		return fmt.Errorf("at least one weight must be positive")
+	}
+	if c.WindowMs <= 0 || c.StaleAfterMs <= 0 {
+		return fmt.Errorf("window_ms and stale_after_ms must be positive")
+	}
+	if c.MaxErrorRate <= 0 || c.LatencyTargetMs <= 0 {
+		return fmt.Errorf("max_error_rate and latency_target_ms must be positive")
+	}
+	if c.LatencyPercentile <= 0 || c.LatencyPercentile > 100 {
+		return fmt.Errorf("latency_percentile must be in (0, 100]")
+	}
+	for name, max := range c.Saturation {
+		if max <= 0 {
+			return fmt.Errorf("saturation limit for %q must be positive", name)
+		}
+	}
+	if c.RedBelow > c.YellowBelow {
+		return fmt.Errorf("red_below must not exceed yellow_below")
+	}
+	return nil
+}
+
+// Configs is the default formula plus per-service overrides
+type Configs struct {
+	Default  Config
+	Services map[string]Config
+}
+
+// For returns the configuration of a service
+func (c Configs) For(service string) Config {
+	if cfg, ok := c.Services[service]; ok {
+		return cfg
+	}
+	return c.Default
+}
+
+// LoadConfigFile reads {"default": {...}, "services": {"name": {...}}}.
+// Fields left out of "default" keep DefaultConfig values, and fields left
+// out of a service keep the file's default, so an override only names what
+// it changes. Saturation maps merge the same way.
+func LoadConfigFile(path string) (Configs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Configs{}, err
+	}
+
+	var file struct {
+		Default  json.RawMessage            `json:"default"`
+		Services map[string]json.RawMessage `json:"services"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return Configs{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	configs := Configs{Default: DefaultConfig(), Services: make(map[string]Config)}
+	if len(file.Default) > 0 {
+		if err := json.Unmarshal(file.Default, &configs.Default); err != nil {
+			return Configs{}, fmt.Errorf("%s: default: %w", path, err)
+		}
+	}
+	if err := configs.Default.Validate(); err != nil {
+		return Configs{}, fmt.Errorf("%s: default: %w", path, err)
+	}
+
+	for service, raw := range file.Services {
+		cfg := configs.Default
+		cfg.Saturation = make(map[string]float64, len(configs.Default.Saturation))
+		for name, max := range configs.Default.Saturation {
+			cfg.Saturation[name] = max
+		}
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return Configs{}, fmt.Errorf("%s: service %q: %w", path, service, err)
+		}
+		if err := cfg.Validate(); err != nil {
+			return Configs{}, fmt.Errorf("%s: service %q: %w", path, service, err)
+		}
+		configs.Services[service] = cfg
+	}
+	return configs, nil
+}
@@ -0,0 +1,320 @@
+// Package health derives a 0-100 health score and a red/yellow/green status
+// per service from its error rate, latency, saturation and data freshness.
+package health
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// Status values
+const (
+	StatusGreen  = "green"
+	StatusYellow = "yellow"
+	StatusRed    = "red"
+)
+
+// Gauges the scorer writes for every scored service
+const (
+	ScoreMetric      = "health_score"
+	ConfidenceMetric = "health_confidence"
+)
+
+// Score components
+const (
+	ComponentErrors     = "errors"
+	ComponentLatency    = "latency"
+	ComponentSaturation = "saturation"
+	ComponentStaleness  = "staleness"
+)
+
+// Result is the health of a service at one evaluation. Score is the
+// weighted mean of the components that had data; Confidence is the share
+// of the configured weight they carry, so missing inputs lower confidence
+// instead of skewing the score.
+type Result struct {
+	Service    string             `json:"service"`
+	Score      float64            `json:"score"`
+	Status     string             `json:"status"`
+	Confidence float64            `json:"confidence"`
+	Components map[string]float64 `json:"components"`
+	Missing    []string           `json:"missing,omitempty"`
+	Ts         int64              `json:"ts"`
+}
+
+// Scorer evaluates every service on an interval and writes the score back
+// into the registry as gauges, so it streams like any other metric
+type Scorer struct {
+	registry *buffer.Registry
+	configs  Configs
+
+	results map[string]Result
+	mu      sync.RWMutex
+}
+
+// NewScorer creates a scorer using configs
+func NewScorer(registry *buffer.Registry, configs Configs) *Scorer {
+	return &Scorer{
+		registry: registry,
+		configs:  configs,
+		results:  make(map[string]Result),
+	}
+}
+
+// Run evaluates every interval
+func (s *Scorer) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.Evaluate(now)
+	}
+}
+
+// Evaluate scores every service with data and records the results
+func (s *Scorer) Evaluate(now time.Time) {
+	series := make(map[string][]buffer.CatalogEntry)
+	for _, entry := range s.registry.Catalog() {
+		if entry.Metric == ScoreMetric || entry.Metric == ConfidenceMetric {
+			continue
+		}
+		series[entry.Service] = append(series[entry.Service], entry)
+	}
+
+	results := make(map[string]Result, len(series))
+	for service, entries := range series {
+		prev, known := s.Result(service)
+		result := s.score(service, entries, s.configs.For(service), now)
+		results[service] = result
+
+		ts := now.UnixNano()
+		// Through PushGauge, whose series lock keeps gap markers from
+		// racing these writes; past the series limits they are dropped
+		s.registry.PushGauge(service, "", ScoreMetric, buffer.Sample{Ts: ts, Val: result.Score})
+		s.registry.PushGauge(service, "", ConfidenceMetric, buffer.Sample{Ts: ts, Val: result.Confidence})
+
+		if known && prev.Status != result.Status {
+			log.Printf("Service %s health %s -> %s (score %.1f, confidence %.2f)",
+				service, prev.Status, result.Status, result.Score, result.Confidence)
+		}
+	}
+
+	s.mu.Lock()
+	s.results = results
+	s.mu.Unlock()
+}
+
+// Result returns the latest evaluation of a service
+func (s *Scorer) Result(service string) (Result, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.results[service]
+	return r, ok
+}
+
+// Results returns the latest evaluation of every service, sorted by name
+func (s *Scorer) Results() []Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Result, 0, len(s.results))
+	for _, r := range s.results {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Service < result[j].Service })
+	return result
+}
+
+// score combines the components of one service
+func (s *Scorer) score(service string, entries []buffer.CatalogEntry, cfg Config, now time.Time) Result {
+	since := now.Add(-time.Duration(cfg.WindowMs) * time.Millisecond).UnixNano()
+	result := Result{
+		Service:    service,
+		Components: make(map[string]float64),
+		Ts:         now.UnixNano(),
+	}
+
+	var configured, present, weighted float64
+	add := func(name string, weight, value float64, ok bool) {
+		if weight <= 0 {
+			return
+		}
+		configured += weight
+		if !ok {
+			result.Missing = append(result.Missing, name)
+			return
+		}
+		value = round(clamp(value))
+		result.Components[name] = value
+		present += weight
+		weighted += weight * value
+	}
+
+	errorScore, ok := s.errorScore(service, cfg, since)
+	add(ComponentErrors, cfg.ErrorWeight, errorScore, ok)
+	latencyScore, ok := s.latencyScore(service, cfg, since)
+	add(ComponentLatency, cfg.LatencyWeight, latencyScore, ok)
+	saturationScore, ok := s.saturationScore(service, cfg, since)
+	add(ComponentSaturation, cfg.SaturationWeight, saturationScore, ok)
+	add(ComponentStaleness, cfg.StalenessWeight, s.stalenessScore(service, entries, cfg, now), true)
+
+	if present > 0 {
+		result.Score = round(weighted / present)
+		result.Confidence = math.Round(present/configured*100) / 100
+	}
+	switch {
+	case result.Score < cfg.RedBelow:
+		result.Status = StatusRed
+	case result.Score < cfg.YellowBelow:
+		result.Status = StatusYellow
+	default:
+		result.Status = StatusGreen
+	}
+	return result
+}
+
+// errorScore scores errors/requests over the window, falling back to the
+// error rate gauge when no requests were counted. A service with requests
+// but no errors counter has recorded no errors.
+func (s *Scorer) errorScore(service string, cfg Config, since int64) (float64, bool) {
+	requests, ok := s.counterIncrease(service, cfg.RequestsMetric, since)
+	if !ok {
+		if ring, found := s.registry.FindHistogramRing(service, cfg.LatencyMetric); found {
+			if h, merged := ring.MergeSince(since); merged {
+				requests, ok = h.Total(), true
+			}
+		}
+	}
+
+	var rate float64
+	if ok && requests > 0 {
+		errors, _ := s.counterIncrease(service, cfg.ErrorsMetric, since)
+		rate = float64(errors) / float64(requests)
+	} else if v, fresh := s.latestGauge(service, cfg.ErrorRateGauge, since); fresh {
+		rate = v
+	} else {
+		return 0, false
+	}
+	return 100 * (1 - rate/cfg.MaxErrorRate), true
+}
+
+// latencyScore scores the configured percentile of the latency histogram
+// over the window, or a latency_p<q> gauge for agents that precompute it
+func (s *Scorer) latencyScore(service string, cfg Config, since int64) (float64, bool) {
+	var p float64
+	ok := false
+	if ring, found := s.registry.FindHistogramRing(service, cfg.LatencyMetric); found {
+		if h, merged := ring.MergeSince(since); merged && h.Total() > 0 {
+			p, ok = buffer.Percentile(h.Bounds, h.Counts, cfg.LatencyPercentile), true
+		}
+	}
+	if !ok {
+		gauge := cfg.LatencyMetric + "_p" + strconv.FormatFloat(cfg.LatencyPercentile, 'f', -1, 64)
+		if p, ok = s.latestGauge(service, gauge, since); !ok {
+			return 0, false
+		}
+	}
+	return 100 * (2 - p/cfg.LatencyTargetMs), true
+}
+
+// saturationScore is set by the most saturated configured gauge
+func (s *Scorer) saturationScore(service string, cfg Config, since int64) (float64, bool) {
+	worst := 100.0
+	ok := false
+	for name, max := range cfg.Saturation {
+		v, fresh := s.latestGauge(service, name, since)
+		if !fresh {
+			continue
+		}
+		worst = math.Min(worst, 100*(1-v/max))
+		ok = true
+	}
+	return worst, ok
+}
+
+// stalenessScore scores the age of the newest sample across the service's
+// series; a service whose series all end in a gap marker scores 0
+func (s *Scorer) stalenessScore(service string, entries []buffer.CatalogEntry, cfg Config, now time.Time) float64 {
+	var newest int64
+	for _, entry := range entries {
+		var ts int64
+		switch entry.Kind {
+		case "histogram":
+			if ring, ok := s.registry.FindHistogramRing(service, entry.Metric); ok {
+				if h, ok := ring.Latest(); ok && !h.IsMarker() {
+					ts = h.Ts
+				}
+			}
+		case "counter":
+			if ring, ok := s.registry.FindCounterRing(service, entry.Metric); ok {
+				if smp, ok := ring.Latest(); ok && !smp.IsMarker() {
+					ts = smp.Ts
+				}
+			}
+		default:
+			if ring, ok := s.registry.FindRing(service, entry.Metric); ok {
+				if smp, ok := ring.Latest(); ok && !smp.IsMarker() {
+					ts = smp.Ts
+				}
+			}
+		}
+		newest = max(newest, ts)
+	}
+	if newest == 0 {
+		return 0
+	}
+	age := float64(now.UnixNano() - newest)
+	return 100 * (2 - age/float64(time.Duration(cfg.StaleAfterMs)*time.Millisecond))
+}
+
+// counterIncrease sums a counter's increases since a timestamp, treating a
+// drop as a reset; ok is false without two samples to compare
+func (s *Scorer) counterIncrease(service, name string, since int64) (uint64, bool) {
+	ring, found := s.registry.FindCounterRing(service, name)
+	if !found {
+		return 0, false
+	}
+
+	var total uint64
+	var prev buffer.Sample
+	havePrev, ok := false, false
+	for _, smp := range ring.Snapshot() {
+		if smp.IsMarker() {
+			havePrev = false
+			continue
+		}
+		if havePrev && smp.Ts >= since {
+			total += smp.CounterDelta(prev)
+			ok = true
+		}
+		prev, havePrev = smp, true
+	}
+	return total, ok
+}
+
+// latestGauge returns a gauge's newest value if it falls inside the window
+func (s *Scorer) latestGauge(service, name string, since int64) (float64, bool) {
+	ring, found := s.registry.FindRing(service, name)
+	if !found {
+		return 0, false
+	}
+	smp, ok := ring.Latest()
+	if !ok || smp.IsMarker() || smp.Ts < since {
+		return 0, false
+	}
+	return smp.Val, true
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(100, v))
+}
+
+func round(v float64) float64 {
+	return math.Round(v*10) / 10
+}
@@ -0,0 +1,165 @@
+package health
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+func TestScore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	at := func(ago time.Duration) int64 { return now.Add(-ago).UnixNano() }
+	gauge := func(r *buffer.Registry, name string, ago time.Duration, v float64) {
+		r.PushGauge("checkout", "", name, buffer.Sample{Ts: at(ago), Val: v})
+	}
+	counter := func(r *buffer.Registry, name string, from, to uint64) {
+		r.PushCounter("checkout", "", name, buffer.CounterSample(at(30*time.Second), from))
+		r.PushCounter("checkout", "", name, buffer.CounterSample(at(time.Second), to))
+	}
+	fastLatency := func(r *buffer.Registry, n uint64) {
+		r.GetHistogramRing("checkout", "latency").Push(buffer.HistogramData{
+			Ts: at(time.Second), Bounds: []float64{100, 500, 1000}, Counts: []uint64{n, 0, 0, 0},
+		})
+	}
+	stalenessOnly := Config{
+		StalenessWeight: 1, WindowMs: 60000, MaxErrorRate: 1, LatencyPercentile: 99,
+		LatencyTargetMs: 1, StaleAfterMs: 10000, YellowBelow: 80, RedBelow: 50,
+	}
+
+	tests := []struct {
+		name  string
+		cfg   *Config
+		setup func(r *buffer.Registry)
+
+		components map[string]float64
+		missing    []string
+		score      float64
+		confidence float64
+		status     string
+	}{
+		{
+			name: "healthy",
+			setup: func(r *buffer.Registry) {
+				counter(r, "requests_total", 0, 1000)
+				counter(r, "errors_total", 0, 0)
+				fastLatency(r, 1000)
+				gauge(r, "inflight", time.Second, 10)
+			},
+			components: map[string]float64{"errors": 100, "latency": 100, "saturation": 90, "staleness": 100},
+			score:      99, confidence: 1, status: StatusGreen,
+		},
+		{
+			name: "error ratio at half the max",
+			setup: func(r *buffer.Registry) {
+				counter(r, "requests_total", 0, 1000)
+				counter(r, "errors_total", 0, 25)
+			},
+			components: map[string]float64{"errors": 50, "staleness": 100},
+			missing:    []string{"latency", "saturation"},
+			score:      66.7, confidence: 0.6, status: StatusYellow,
+		},
+		{
+			name: "error ratio past the max clamps to 0",
+			setup: func(r *buffer.Registry) {
+				counter(r, "requests_total", 0, 1000)
+				counter(r, "errors_total", 0, 100)
+			},
+			components: map[string]float64{"errors": 0, "staleness": 100},
+			missing:    []string{"latency", "saturation"},
+			score:      33.3, confidence: 0.6, status: StatusRed,
+		},
+		{
+			name: "requests counted from the latency histogram",
+			setup: func(r *buffer.Registry) {
+				fastLatency(r, 200)
+				counter(r, "errors_total", 0, 10)
+			},
+			components: map[string]float64{"errors": 0, "latency": 100, "staleness": 100},
+			missing:    []string{"saturation"},
+			score:      55.6, confidence: 0.9, status: StatusYellow,
+		},
+		{
+			name: "gauge fallbacks for error rate and latency",
+			setup: func(r *buffer.Registry) {
+				gauge(r, "error_rate", time.Second, 0.01)
+				gauge(r, "latency_p99", time.Second, 750)
+			},
+			components: map[string]float64{"errors": 80, "latency": 50, "staleness": 100},
+			missing:    []string{"saturation"},
+			score:      74.4, confidence: 0.9, status: StatusYellow,
+		},
+		{
+			name: "inputs older than the window are missing",
+			setup: func(r *buffer.Registry) {
+				gauge(r, "error_rate", 2*time.Minute, 0)
+				gauge(r, "inflight", 15*time.Second, 0)
+			},
+			components: map[string]float64{"saturation": 100, "staleness": 50},
+			missing:    []string{"errors", "latency"},
+			score:      66.7, confidence: 0.3, status: StatusYellow,
+		},
+		{
+			name: "a gap marker scores staleness 0",
+			setup: func(r *buffer.Registry) {
+				gauge(r, "inflight", time.Second, 0)
+				r.MarkGap("checkout")
+			},
+			components: map[string]float64{"staleness": 0},
+			missing:    []string{"errors", "latency", "saturation"},
+			score:      0, confidence: 0.2, status: StatusRed,
+		},
+		{
+			name:       "yellow_below is green",
+			cfg:        &stalenessOnly,
+			setup:      func(r *buffer.Registry) { gauge(r, "inflight", 12*time.Second, 0) },
+			components: map[string]float64{"staleness": 80},
+			score:      80, confidence: 1, status: StatusGreen,
+		},
+		{
+			name:       "red_below is yellow",
+			cfg:        &stalenessOnly,
+			setup:      func(r *buffer.Registry) { gauge(r, "inflight", 15*time.Second, 0) },
+			components: map[string]float64{"staleness": 50},
+			score:      50, confidence: 1, status: StatusYellow,
+		},
+		{
+			name:       "under red_below is red",
+			cfg:        &stalenessOnly,
+			setup:      func(r *buffer.Registry) { gauge(r, "inflight", 15100*time.Millisecond, 0) },
+			components: map[string]float64{"staleness": 49},
+			score:      49, confidence: 1, status: StatusRed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+			tt.setup(registry)
+			configs := Configs{Default: DefaultConfig()}
+			if tt.cfg != nil {
+				configs.Services = map[string]Config{"checkout": *tt.cfg}
+			}
+			s := NewScorer(registry, configs)
+			s.Evaluate(now)
+
+			got, ok := s.Result("checkout")
+			if !ok {
+				t.Fatal("checkout was not scored")
+			}
+			if !reflect.DeepEqual(got.Components, tt.components) || !reflect.DeepEqual(got.Missing, tt.missing) {
+				t.Fatalf("components = %v missing %v, want %v missing %v", got.Components, got.Missing, tt.components, tt.missing)
+			}
+			if got.Score != tt.score || got.Confidence != tt.confidence || got.Status != tt.status {
+				t.Fatalf("score %v confidence %v %s, want %v, %v, %s", got.Score, got.Confidence, got.Status, tt.score, tt.confidence, tt.status)
+			}
+
+			// The score streams back as a gauge
+			if v, ok := registry.FindRing("checkout", ScoreMetric); !ok {
+				t.Fatal("no health_score gauge")
+			} else if latest, _ := v.Latest(); latest.Val != tt.score {
+				t.Fatalf("health_score = %v, want %v", latest.Val, tt.score)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package ingest
+
+import (
+	"sync"
+	"time"
+)
+
+// rateWindow is the number of one-second buckets kept per service
+const rateWindow = 60
+
+// Accounting tracks samples received per service over the last minute
+type Accounting struct {
+	services map[string]*sampleWindow
+	mu       sync.Mutex
+}
+
+// sampleWindow is a ring of per-second sample counts
+type sampleWindow struct {
+	counts [rateWindow]uint64
+	secs   [rateWindow]int64
+}
+
+// NewAccounting creates an empty accounting table
+func NewAccounting() *Accounting {
+	return &Accounting{
+		services: make(map[string]*sampleWindow),
+	}
+}
+
+// Record adds n samples for a service at the current second
+func (a *Accounting) Record(service string, n int) {
+	sec := time.Now().Unix()
+	slot := sec % rateWindow
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	w, ok := a.services[service]
+	if !ok {
+		w = &sampleWindow{}
+		a.services[service] = w
+	}
+	if w.secs[slot] != sec {
+		w.secs[slot] = sec
+		w.counts[slot] = 0
+	}
+	w.counts[slot] += uint64(n)
+}
+
+// SampleRates returns samples/sec per service averaged over the last minute
+func (a *Accounting) SampleRates() map[string]float64 {
+	now := time.Now().Unix()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := make(map[string]float64, len(a.services))
+	for service, w := range a.services {
+		var total uint64
+		for i, sec := range w.secs {
+			if now-sec < rateWindow {
+				total += w.counts[i]
+			}
+		}
+		result[service] = float64(total) / rateWindow
+	}
+	return result
+}
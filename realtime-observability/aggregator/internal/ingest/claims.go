@@ -0,0 +1,60 @@
+package ingest
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// duplicateLogInterval limits the shared instance ID warning per instance
+const duplicateLogInterval = time.Minute
+
+type streamKey struct {
+	service, instance string
+}
+
+// streamClaims counts the open streams sending as each service and
+// instance. Two at once usually means agents sharing an instance ID, whose
+// samples interleave in one series. A stream replaced by a reconnect can
+// briefly overlap its successor, so the warning hedges.
+type streamClaims struct {
+	open   map[streamKey]int
+	logged map[streamKey]time.Time
+	mu     sync.Mutex
+}
+
+// claim records a stream sending as key, warning if another already is
+func (c *streamClaims) claim(key streamKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open == nil {
+		c.open = make(map[streamKey]int)
+		c.logged = make(map[streamKey]time.Time)
+	}
+	c.open[key]++
+	n := c.open[key]
+	if n < 2 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(c.logged[key]) < duplicateLogInterval {
+		return
+	}
+	c.logged[key] = now
+	log.Printf("%d streams are sending as service=%s instance=%s; agents may share an instance ID",
+		n, key.service, key.instance)
+}
+
+// release forgets a stream's claim on key
+func (c *streamClaims) release(key streamKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open[key] <= 1 {
+		delete(c.open, key)
+		delete(c.logged, key)
+		return
+	}
+	c.open[key]--
+}
@@ -0,0 +1,35 @@
+package ingest
+
+import (
+	"slices"
+
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// cumulativeDelta turns a cumulative agent histogram into the observations
+// since the previous push of the series. A first push, new bounds, or any
+// count that went down, as after an agent restart or a switch from delta,
+// is a reset: the whole histogram counts as new.
+func (s *Server) cumulativeDelta(service, instance, name string, h *pb.Histogram) *pb.Histogram {
+	current := histogramBaseline{bounds: h.Bounds, cumulative: h.Counts, sum: h.GetSum(), count: h.GetCount()}
+	prev, ok := s.cumulativeBaselines.swap(baselineKey{service, instance, name}, current)
+	if !ok || !slices.Equal(prev.bounds, h.Bounds) || len(prev.cumulative) != len(h.Counts) || prev.count > current.count {
+		prev = histogramBaseline{cumulative: make([]uint64, len(h.Counts))}
+	}
+	for i, c := range h.Counts {
+		if c < prev.cumulative[i] {
+			prev = histogramBaseline{cumulative: make([]uint64, len(h.Counts))}
+			break
+		}
+	}
+
+	delta := &pb.Histogram{Bounds: h.Bounds, Counts: make([]uint64, len(h.Counts))}
+	for i, c := range h.Counts {
+		delta.Counts[i] = c - prev.cumulative[i]
+	}
+	if h.Sum != nil && h.Count != nil {
+		sum, count := current.sum-prev.sum, current.count-prev.count
+		delta.Sum, delta.Count = &sum, &count
+	}
+	return delta
+}
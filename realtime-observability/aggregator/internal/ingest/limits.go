@@ -0,0 +1,38 @@
+package ingest
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// rejectionLogInterval limits the series limit warning per service
+const rejectionLogInterval = time.Minute
+
+// seriesRejections counts the samples each service lost to the registry's
+// series limits and logs them at most once per rejectionLogInterval
+type seriesRejections struct {
+	pending map[string]int
+	logged  map[string]time.Time
+	mu      sync.Mutex
+}
+
+// reject counts a sample of a series the registry refused
+func (r *seriesRejections) reject(service, name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending == nil {
+		r.pending = make(map[string]int)
+		r.logged = make(map[string]time.Time)
+	}
+	r.pending[service]++
+	now := time.Now()
+	if now.Sub(r.logged[service]) < rejectionLogInterval {
+		return
+	}
+	log.Printf("Dropped %d samples of new series from service=%s, latest %q: %v",
+		r.pending[service], service, name, err)
+	r.logged[service] = now
+	delete(r.pending, service)
+}
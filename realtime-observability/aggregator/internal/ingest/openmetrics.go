@@ -0,0 +1,316 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/yourorg/aggregator/internal/auth"
+	"github.com/yourorg/aggregator/internal/buffer"
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// Text push limits
+const (
+	maxPushBody   = 10 << 20
+	maxPushSeries = 10000
+
+	// maxHistogramBaselines bounds the cumulative histogram state kept for
+	// delta computation; it is reset when exceeded
+	maxHistogramBaselines = 100000
+)
+
+// Rejection explains why a metric family, or part of it, was not ingested
+type Rejection struct {
+	Family string `json:"family"`
+	Reason string `json:"reason"`
+}
+
+// histogramBaseline is the last cumulative state pushed for a histogram
+type histogramBaseline struct {
+	bounds     []float64
+	cumulative []uint64
+	sum        float64
+	count      uint64
+}
+
+type baselineKey struct {
+	service, instance, name string
+}
+
+// histogramBaselines turns cumulative histograms, from text pushes or
+// agents sending HISTOGRAM_TEMPORALITY_CUMULATIVE, into the per-window
+// deltas the registry stores
+type histogramBaselines struct {
+	last map[baselineKey]histogramBaseline
+	mu   sync.Mutex
+}
+
+// HandleTextPush ingests the Prometheus text exposition format
+// (POST /api/v1/push/openmetrics?service=&instance=). Gauges and untyped
+// metrics become gauges, counters keep their cumulative value, and classic
+// histograms are rebuilt from their buckets. Labeled series are stored
+// under their SeriesName, as agent labels are.
+func (s *Server) HandleTextPush(w http.ResponseWriter, r *http.Request) {
+	received := s.hub.Latency().Now()
+	service := r.URL.Query().Get("service")
+	instance := r.URL.Query().Get("instance")
+	if service == "" {
+		writePushError(w, http.StatusBadRequest, "service is required")
+		return
+	}
+
+	keyName := auth.AnonymousKey
+	if s.auth != nil {
+		key := auth.RequestKey(r)
+		if scope, ok := s.auth.ServiceScope(key); ok && scope != service {
+			writePushError(w, http.StatusForbidden, fmt.Sprintf("key is scoped to service %q", scope))
+			return
+		}
+		keyName = s.auth.KeyName(key)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(http.MaxBytesReader(w, r.Body, maxPushBody))
+	if err != nil {
+		writePushError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	batch, rejected := s.textBatch(service, instance, families, time.Now())
+	samples := 0
+	for _, m := range batch.Metrics {
+		samples += len(m.Samples)
+	}
+	var warning string
+	if len(batch.Metrics) > 0 || len(batch.Descriptions) > 0 {
+		warning = s.ingestBatch(keyName, batch, received)
+	}
+	log.Printf("Received text push from service=%s instance=%s metrics=%d rejected=%d",
+		service, instance, len(batch.Metrics), len(rejected))
+
+	resp := map[string]interface{}{
+		"accepted_samples": samples,
+		"rejected":         rejected,
+	}
+	if warning != "" {
+		resp["warnings"] = []string{warning}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// textBatch converts parsed families into a batch, in family name order
+func (s *Server) textBatch(service, instance string, families map[string]*dto.MetricFamily, now time.Time) (*pb.TelemetryBatch, []Rejection) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	batch := &pb.TelemetryBatch{Service: service, Instance: instance}
+	rejected := []Rejection{}
+	series := 0
+	for _, name := range names {
+		mf := families[name]
+		if series+len(mf.Metric) > maxPushSeries {
+			rejected = append(rejected, Rejection{Family: name, Reason: fmt.Sprintf("push exceeds %d series", maxPushSeries)})
+			continue
+		}
+
+		var metrics []*pb.Metric
+		var reason string
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED, dto.MetricType_COUNTER:
+			metrics, reason = scalarMetrics(mf, now)
+		case dto.MetricType_HISTOGRAM:
+			metrics, reason = s.histogramMetrics(service, instance, mf, now)
+		default:
+			reason = fmt.Sprintf("%s metrics are not supported", mf.GetType())
+		}
+		if reason != "" {
+			rejected = append(rejected, Rejection{Family: name, Reason: reason})
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		for _, m := range metrics {
+			series += len(m.Samples)
+		}
+		batch.Metrics = append(batch.Metrics, metrics...)
+
+		if mf.GetHelp() != "" {
+			kind := "gauge"
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				kind = "counter"
+			case dto.MetricType_HISTOGRAM:
+				kind = "histogram"
+			}
+			batch.Descriptions = append(batch.Descriptions, &pb.MetricDescription{Name: name, Type: kind, Help: mf.GetHelp()})
+		}
+	}
+	return batch, rejected
+}
+
+// textLabels returns a sample's labels, leaving out skip, or nil
+func textLabels(m *dto.Metric, skip string) map[string]string {
+	var labels map[string]string
+	for _, l := range m.Label {
+		if l.GetName() == skip {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(m.Label))
+		}
+		labels[l.GetName()] = l.GetValue()
+	}
+	return labels
+}
+
+// scalarMetrics converts a gauge, untyped or counter family into one
+// metric per label set; counters must hold whole non-negative values since
+// they are stored exactly
+func scalarMetrics(mf *dto.MetricFamily, now time.Time) ([]*pb.Metric, string) {
+	var metrics []*pb.Metric
+	bySeries := make(map[string]*pb.Metric)
+	var reason string
+	for _, m := range mf.Metric {
+		sample := &pb.MetricSample{TimestampNs: sampleTime(m, now)}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			v := m.GetCounter().GetValue()
+			if v < 0 || v != math.Trunc(v) || v >= math.MaxUint64 {
+				reason = fmt.Sprintf("counter value %v is not a non-negative integer", v)
+				continue
+			}
+			sample.Value = &pb.MetricSample_Counter{Counter: uint64(v)}
+		case dto.MetricType_GAUGE:
+			sample.Value = &pb.MetricSample_Gauge{Gauge: m.GetGauge().GetValue()}
+		default:
+			sample.Value = &pb.MetricSample_Gauge{Gauge: m.GetUntyped().GetValue()}
+		}
+		labels := textLabels(m, "")
+		key := buffer.SeriesName(mf.GetName(), labels)
+		metric, ok := bySeries[key]
+		if !ok {
+			metric = &pb.Metric{Name: mf.GetName(), Labels: labels}
+			bySeries[key] = metric
+			metrics = append(metrics, metric)
+		}
+		metric.Samples = append(metric.Samples, sample)
+	}
+	return metrics, reason
+}
+
+// histogramMetrics rebuilds each label set of a classic histogram family,
+// le aside, as one window holding the observations since the previous push
+// of that label set
+func (s *Server) histogramMetrics(service, instance string, mf *dto.MetricFamily, now time.Time) ([]*pb.Metric, string) {
+	var metrics []*pb.Metric
+	var reason string
+	for _, m := range mf.Metric {
+		metric, why := s.histogramMetric(service, instance, mf.GetName(), m, now)
+		if why != "" {
+			reason = why
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, reason
+}
+
+// histogramMetric rebuilds one series of a classic histogram. A count that
+// went down is a reset of the source, and the whole cumulative state counts
+// as new.
+func (s *Server) histogramMetric(service, instance, name string, m *dto.Metric, now time.Time) (*pb.Metric, string) {
+	labels := textLabels(m, "le")
+	h := m.GetHistogram()
+
+	var bounds []float64
+	var cumulative []uint64
+	for _, b := range h.Bucket {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		bounds = append(bounds, b.GetUpperBound())
+		cumulative = append(cumulative, b.GetCumulativeCount())
+	}
+	cumulative = append(cumulative, h.GetSampleCount())
+	for i := 1; i < len(cumulative); i++ {
+		if cumulative[i] < cumulative[i-1] {
+			return nil, "bucket counts are not cumulative"
+		}
+	}
+
+	current := histogramBaseline{bounds: bounds, cumulative: cumulative, sum: h.GetSampleSum(), count: h.GetSampleCount()}
+	prev, ok := s.textBaselines.swap(baselineKey{service, instance, buffer.SeriesName(name, labels)}, current)
+	if !ok || !slices.Equal(prev.bounds, bounds) || prev.count > current.count {
+		prev = histogramBaseline{cumulative: make([]uint64, len(cumulative))}
+	}
+	for i := range cumulative {
+		if cumulative[i] < prev.cumulative[i] {
+			prev = histogramBaseline{cumulative: make([]uint64, len(cumulative))}
+			break
+		}
+	}
+
+	// Per-bucket counts, with the overflow bucket last
+	counts := make([]uint64, len(cumulative))
+	var below uint64
+	for i, c := range cumulative {
+		delta := c - prev.cumulative[i]
+		counts[i] = delta - below
+		below = delta
+	}
+	sum := current.sum - prev.sum
+	count := current.count - prev.count
+
+	return &pb.Metric{
+		Name:   name,
+		Labels: labels,
+		Samples: []*pb.MetricSample{{
+			TimestampNs: sampleTime(m, now),
+			Value: &pb.MetricSample_Histogram{Histogram: &pb.Histogram{
+				Bounds: bounds,
+				Counts: counts,
+				Sum:    &sum,
+				Count:  &count,
+			}},
+		}},
+	}, ""
+}
+
+// swap stores the new baseline for key and returns the previous one
+func (b *histogramBaselines) swap(key baselineKey, next histogramBaseline) (histogramBaseline, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.last == nil || len(b.last) >= maxHistogramBaselines {
+		b.last = make(map[baselineKey]histogramBaseline)
+	}
+	prev, ok := b.last[key]
+	b.last[key] = next
+	return prev, ok
+}
+
+func sampleTime(m *dto.Metric, now time.Time) uint64 {
+	if m.TimestampMs != nil {
+		return uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+	}
+	return uint64(now.UnixNano())
+}
+
+func writePushError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
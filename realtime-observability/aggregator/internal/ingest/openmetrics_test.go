@@ -0,0 +1,151 @@
+package ingest
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/yourorg/aggregator/internal/buffer"
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// parseText runs a text push body through the parser and textBatch
+func parseText(t *testing.T, s *Server, body string) (*pb.TelemetryBatch, []Rejection) {
+	t.Helper()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return s.textBatch("checkout", "pod-1", families, time.Unix(100, 0))
+}
+
+func TestTextBatchScalars(t *testing.T) {
+	batch, rejected := parseText(t, &Server{}, `# HELP cpu CPU usage
+# TYPE cpu gauge
+cpu 0.5
+# TYPE requests counter
+requests 42 5000
+# TYPE fractional counter
+fractional 1.5
+# TYPE labeled gauge
+labeled{path="/"} 1
+labeled{path="/cart",code="200"} 2
+untyped_thing 7
+`)
+
+	byName := make(map[string]*pb.Metric)
+	for _, m := range batch.Metrics {
+		byName[buffer.SeriesName(m.Name, m.Labels)] = m
+	}
+	if got := byName["cpu"].GetSamples()[0]; got.GetGauge() != 0.5 || got.TimestampNs != uint64(100*time.Second) {
+		t.Errorf("cpu = %v, want 0.5 at the push time", got)
+	}
+	if got := byName["requests"].GetSamples()[0]; got.GetCounter() != 42 || got.TimestampNs != uint64(5*time.Second) {
+		t.Errorf("requests = %v, want 42 at its own timestamp", got)
+	}
+	if got := byName["untyped_thing"].GetSamples()[0]; got.GetGauge() != 7 {
+		t.Errorf("untyped_thing = %v, want a gauge of 7", got)
+	}
+	if _, ok := byName["fractional"]; ok {
+		t.Error("fractional counter accepted")
+	}
+	if got := byName[`labeled{path="/"}`].GetSamples(); len(got) != 1 || got[0].GetGauge() != 1 {
+		t.Errorf(`labeled{path="/"} = %v, want 1`, got)
+	}
+	if got := byName[`labeled{code="200",path="/cart"}`].GetSamples(); len(got) != 1 || got[0].GetGauge() != 2 {
+		t.Errorf(`labeled{code="200",path="/cart"} = %v, want 2`, got)
+	}
+
+	families := make([]string, 0, len(rejected))
+	for _, r := range rejected {
+		families = append(families, r.Family)
+	}
+	if want := []string{"fractional"}; !slices.Equal(families, want) {
+		t.Errorf("rejected = %v, want %v", rejected, want)
+	}
+	if len(batch.Descriptions) != 1 || batch.Descriptions[0].Help != "CPU usage" || batch.Descriptions[0].Type != "gauge" {
+		t.Errorf("descriptions = %v, want cpu's help", batch.Descriptions)
+	}
+}
+
+func TestTextBatchHistogramDeltas(t *testing.T) {
+	s := &Server{}
+	histogram := func(le1, le5, count uint64, sum float64) string {
+		return fmt.Sprintf(`# TYPE latency histogram
+latency_bucket{le="1"} %d
+latency_bucket{le="5"} %d
+latency_bucket{le="+Inf"} %d
+latency_sum %v
+latency_count %d
+`, le1, le5, count, sum, count)
+	}
+	window := func(body string) *pb.Histogram {
+		t.Helper()
+		batch, rejected := parseText(t, s, body)
+		if len(rejected) > 0 || len(batch.Metrics) != 1 {
+			t.Fatalf("batch = %v, rejected %v", batch, rejected)
+		}
+		return batch.Metrics[0].Samples[0].GetHistogram()
+	}
+
+	// The first push counts everything so far
+	h := window(histogram(2, 3, 4, 10))
+	if !slices.Equal(h.Bounds, []float64{1, 5}) || !slices.Equal(h.Counts, []uint64{2, 1, 1}) || h.GetCount() != 4 || h.GetSum() != 10 {
+		t.Fatalf("first window = %v", h)
+	}
+	// The next holds only the change
+	h = window(histogram(3, 5, 7, 16))
+	if !slices.Equal(h.Counts, []uint64{1, 1, 1}) || h.GetCount() != 3 || h.GetSum() != 6 {
+		t.Fatalf("second window = %v", h)
+	}
+	// A count that went down is a reset of the source
+	h = window(histogram(1, 1, 1, 0.5))
+	if !slices.Equal(h.Counts, []uint64{1, 0, 0}) || h.GetCount() != 1 || h.GetSum() != 0.5 {
+		t.Fatalf("window after reset = %v", h)
+	}
+}
+
+func TestTextBatchLabeledHistograms(t *testing.T) {
+	s := &Server{}
+	histogram := func(get, post uint64) string {
+		return fmt.Sprintf(`# TYPE latency histogram
+latency_bucket{method="GET",le="1"} %d
+latency_bucket{method="GET",le="+Inf"} %d
+latency_sum{method="GET"} 1
+latency_count{method="GET"} %d
+latency_bucket{method="POST",le="1"} 0
+latency_bucket{method="POST",le="+Inf"} %d
+latency_sum{method="POST"} 2
+latency_count{method="POST"} %d
+`, get, get, get, post, post)
+	}
+	windows := func(body string) map[string]*pb.Histogram {
+		t.Helper()
+		batch, rejected := parseText(t, s, body)
+		if len(rejected) > 0 {
+			t.Fatalf("rejected %v", rejected)
+		}
+		result := make(map[string]*pb.Histogram)
+		for _, m := range batch.Metrics {
+			result[buffer.SeriesName(m.Name, m.Labels)] = m.Samples[0].GetHistogram()
+		}
+		return result
+	}
+
+	first := windows(histogram(2, 5))
+	if len(first) != 2 || first[`latency{method="GET"}`].GetCount() != 2 || first[`latency{method="POST"}`].GetCount() != 5 {
+		t.Fatalf("first windows = %v, want GET 2 and POST 5", first)
+	}
+	// Each label set diffs against its own baseline
+	second := windows(histogram(3, 9))
+	if get := second[`latency{method="GET"}`]; get.GetCount() != 1 || !slices.Equal(get.Counts, []uint64{1, 0}) {
+		t.Errorf("second GET window = %v, want one observation below 1", get)
+	}
+	if post := second[`latency{method="POST"}`]; post.GetCount() != 4 || !slices.Equal(post.Counts, []uint64{0, 4}) {
+		t.Errorf("second POST window = %v, want four overflow observations", post)
+	}
+}
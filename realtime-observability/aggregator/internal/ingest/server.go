@@ -1,36 +1,141 @@
 package ingest
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"time"
 
+	"github.com/yourorg/aggregator/internal/agentconfig"
+	"github.com/yourorg/aggregator/internal/auth"
 	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/usage"
 	"github.com/yourorg/aggregator/internal/ws"
 	pb "github.com/yourorg/telemetry/gen/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // decodes agents with Compression "gzip"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // Server implements the TelemetryIngestor gRPC service
 type Server struct {
 	pb.UnimplementedTelemetryIngestorServer
-	registry *buffer.Registry
-	hub      *ws.Hub
+	registry   *buffer.Registry
+	hub        *ws.Hub
+	accounting *Accounting
+	usage      *usage.Tracker
+	staleness  *StalenessSweeper
+	auth       *auth.Authenticator
+
+	// agentConfig backs WatchConfig; nil leaves it unimplemented
+	agentConfig *agentconfig.Store
+
+	textBaselines       histogramBaselines
+	cumulativeBaselines histogramBaselines
+
+	claims streamClaims
+
+	rejections seriesRejections
+
+	// minPushInterval is sent in every Ack for agents to back off to
+	minPushInterval time.Duration
 }
 
 // NewServer creates a new ingest server
 func NewServer(registry *buffer.Registry, hub *ws.Hub) *Server {
 	return &Server{
-		registry: registry,
-		hub:      hub,
+		registry:   registry,
+		hub:        hub,
+		accounting: NewAccounting(),
+	}
+}
+
+// Accounting returns the per-service ingest accounting
+func (s *Server) Accounting() *Accounting {
+	return s.accounting
+}
+
+// SetUsage enables per-key usage accounting
+func (s *Server) SetUsage(tracker *usage.Tracker) {
+	s.usage = tracker
+}
+
+// SetMinPushInterval asks agents, through every Ack, to push no more
+// often than d; agents with Config.MaxPushInterval slow down to it
+func (s *Server) SetMinPushInterval(d time.Duration) {
+	s.minPushInterval = d
+}
+
+// SetStalenessSweeper enables gap and resume markers for quiet services
+func (s *Server) SetStalenessSweeper(sweeper *StalenessSweeper) {
+	s.staleness = sweeper
+}
+
+// SetAuthenticator enables the ExchangeToken RPC and key attribution on
+// HTTP pushes
+func (s *Server) SetAuthenticator(authenticator *auth.Authenticator) {
+	s.auth = authenticator
+}
+
+// SetAgentConfig enables the WatchConfig RPC, pushing the configurations
+// of store to agents
+func (s *Server) SetAgentConfig(store *agentconfig.Store) {
+	s.agentConfig = store
+}
+
+// ExchangeToken trades a bootstrap token or a live issued key for a new
+// per-instance API key
+func (s *Server) ExchangeToken(ctx context.Context, req *pb.ExchangeTokenRequest) (*pb.ExchangeTokenResponse, error) {
+	if s.auth == nil {
+		return nil, status.Error(codes.Unimplemented, "token exchange is not enabled")
+	}
+	key, expires, service, err := s.auth.ExchangeToken(req.BootstrapToken, req.CurrentKey, req.Instance)
+	switch {
+	case errors.Is(err, auth.ErrTokenInvalid), errors.Is(err, auth.ErrTokenUsed):
+		log.Printf("Token exchange rejected for instance=%s: %v", req.Instance, err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, auth.ErrTooManyKeys):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
 	}
+
+	log.Printf("Issued API key for service=%s instance=%s until %s", service, req.Instance, expires.Format(time.RFC3339))
+	return &pb.ExchangeTokenResponse{
+		ApiKey:    key,
+		ExpiresAt: expires.UnixNano(),
+		Service:   service,
+	}, nil
 }
 
 // StreamTelemetry handles the client streaming RPC
 func (s *Server) StreamTelemetry(stream grpc.ClientStreamingServer[pb.TelemetryBatch, pb.Ack]) error {
+	keyName := auth.KeyNameFromContext(stream.Context())
+	scope, scoped := auth.ServiceScopeFromContext(stream.Context())
+	var warnings []string
+
+	// The service and instance this stream sends as, once known
+	var claimed streamKey
+	defer func() {
+		if claimed != (streamKey{}) {
+			s.claims.release(claimed)
+		}
+	}()
+
 	for {
 		batch, err := stream.Recv()
+		received := s.hub.Latency().Now()
 		if err == io.EOF {
-			return stream.SendAndClose(&pb.Ack{Ok: true})
+			return stream.SendAndClose(&pb.Ack{
+				Ok:            true,
+				Warnings:      warnings,
+				ReceiveTimeNs: uint64(received.UnixNano()),
+
+				MinPushIntervalMs: uint32(s.minPushInterval.Milliseconds()),
+			})
 		}
 		if err != nil {
 			log.Printf("Error receiving batch: %v", err)
@@ -40,43 +145,156 @@ func (s *Server) StreamTelemetry(stream grpc.ClientStreamingServer[pb.TelemetryB
 		log.Printf("Received batch from service=%s instance=%s metrics=%d",
 			batch.Service, batch.Instance, len(batch.Metrics))
 
-		// Process each metric in the batch
-		for _, metric := range batch.Metrics {
-			s.processMetric(batch.Service, batch.Instance, metric)
+		if scoped && batch.Service != scope {
+			return status.Errorf(codes.PermissionDenied, "key is scoped to service %q", scope)
+		}
+		if key := (streamKey{batch.Service, batch.Instance}); key != claimed {
+			if claimed != (streamKey{}) {
+				s.claims.release(claimed)
+			}
+			s.claims.claim(key)
+			claimed = key
+		}
+
+		if warning := s.ingestBatch(keyName, batch, received); warning != "" && len(warnings) == 0 {
+			warnings = append(warnings, warning)
+		}
+	}
+}
+
+// ingestBatch stores one batch and does the per-batch bookkeeping shared by
+// every ingest path. received is when the batch arrived, for pipeline
+// latency. It returns a soft quota warning for the key, if any.
+func (s *Server) ingestBatch(keyName string, batch *pb.TelemetryBatch, received time.Time) string {
+	if s.staleness != nil {
+		s.staleness.Seen(batch.Service, batch.Instance, firstTimestamp(batch))
+	}
+	s.registry.SeenInstance(batch.Service, batch.Instance, batch.Attributes, received)
+
+	for _, d := range batch.Descriptions {
+		s.registry.SetMetadata(batch.Service, d.Name, buffer.Metadata{
+			Type: d.Type,
+			Unit: d.Unit,
+			Help: d.Help,
+		})
+	}
+
+	if len(batch.Events) > 0 {
+		events := make([]buffer.Event, 0, len(batch.Events))
+		for _, e := range batch.Events {
+			events = append(events, buffer.Event{
+				Ts:         int64(e.TimestampNs),
+				Instance:   batch.Instance,
+				Kind:       e.Kind,
+				Message:    e.Message,
+				Attributes: e.Attributes,
+			})
+		}
+		s.registry.AddEvents(batch.Service, events...)
+		s.hub.BroadcastEvents(batch.Service, events)
+	}
+
+	// Process each metric in the batch
+	samples := 0
+	for _, metric := range batch.Metrics {
+		s.processMetric(batch.Service, batch.Instance, metric, batch.HistogramTemporality)
+		samples += len(metric.Samples)
+	}
+	s.accounting.Record(batch.Service, samples)
+	s.hub.Latency().Stored(received)
+
+	var warning string
+	if s.usage != nil {
+		names := make([]string, len(batch.Metrics))
+		for i, metric := range batch.Metrics {
+			names[i] = metric.Name
 		}
+		warning = s.usage.Record(keyName, batch.Service, names, samples, proto.Size(batch))
+	}
 
-		// Notify hub of new data for real-time streaming
-		s.hub.NotifyUpdate(batch.Service)
+	// Notify hub of new data for real-time streaming
+	s.hub.NotifyUpdate(batch.Service)
+	return warning
+}
+
+// firstTimestamp returns the oldest sample timestamp in a batch, or now for
+// a batch without samples
+func firstTimestamp(batch *pb.TelemetryBatch) int64 {
+	var first uint64
+	for _, metric := range batch.Metrics {
+		for _, sample := range metric.Samples {
+			if first == 0 || sample.TimestampNs < first {
+				first = sample.TimestampNs
+			}
+		}
+	}
+	if first == 0 {
+		return time.Now().UnixNano()
 	}
+	return int64(first)
 }
 
-// processMetric routes metrics to appropriate ring buffers
-func (s *Server) processMetric(service, instance string, metric *pb.Metric) {
+// processMetric routes metrics to appropriate ring buffers. Labeled
+// metrics are stored under their SeriesName, and cumulative histograms as
+// the change since the previous push. Gauges and counters are kept per
+// instance and aggregated per service, see Registry.PushGauge, and
+// histograms per instance and in the service's ring, see
+// Registry.PushHistogram.
+func (s *Server) processMetric(service, instance string, metric *pb.Metric, temporality pb.HistogramTemporality) {
+	name := buffer.SeriesName(metric.Name, metric.Labels)
 	for _, sample := range metric.Samples {
 		ts := int64(sample.TimestampNs)
 
 		switch v := sample.Value.(type) {
 		case *pb.MetricSample_Gauge:
-			ring := s.registry.GetRing(service, metric.Name)
-			ring.Push(buffer.Sample{
-				Ts:  ts,
-				Val: v.Gauge,
-			})
+			sample := buffer.Sample{Ts: ts, Val: v.Gauge}
+			if err := s.registry.PushGauge(service, instance, name, sample); err != nil {
+				s.rejections.reject(service, name, err)
+			}
 
 		case *pb.MetricSample_Counter:
-			ring := s.registry.GetCounterRing(service, metric.Name)
-			ring.Push(buffer.Sample{
-				Ts:  ts,
-				Val: float64(v.Counter),
-			})
+			sample := buffer.CounterSample(ts, v.Counter)
+			if err := s.registry.PushCounter(service, instance, name, sample); err != nil {
+				s.rejections.reject(service, name, err)
+			}
+
+		case *pb.MetricSample_FloatCounter:
+			sample := buffer.FloatCounterSample(ts, v.FloatCounter)
+			if err := s.registry.PushCounter(service, instance, name, sample); err != nil {
+				s.rejections.reject(service, name, err)
+			}
 
 		case *pb.MetricSample_Histogram:
-			ring := s.registry.GetHistogramRing(service, metric.Name)
-			ring.Push(buffer.HistogramData{
+			hist := v.Histogram
+			if temporality == pb.HistogramTemporality_HISTOGRAM_TEMPORALITY_CUMULATIVE {
+				hist = s.cumulativeDelta(service, instance, name, hist)
+			}
+			err := s.registry.PushHistogram(service, instance, name, buffer.HistogramData{
 				Ts:     ts,
-				Bounds: v.Histogram.Bounds,
-				Counts: v.Histogram.Counts,
+				Bounds: hist.Bounds,
+				Counts: hist.Counts,
+				Sum:    hist.GetSum(),
+				Count:  hist.GetCount(),
+				HasSum: hist.Sum != nil && hist.Count != nil,
+			})
+			if err != nil {
+				s.rejections.reject(service, name, err)
+				continue
+			}
+		}
+	}
+
+	if len(metric.Exemplars) > 0 {
+		exemplars := make([]buffer.Exemplar, 0, len(metric.Exemplars))
+		for _, e := range metric.Exemplars {
+			exemplars = append(exemplars, buffer.Exemplar{
+				Ts:        int64(e.TimestampNs),
+				Value:     e.Value,
+				Operation: e.Operation,
+				TraceID:   e.TraceId,
+				Labels:    e.Labels,
 			})
 		}
+		s.registry.AddExemplars(service, name, exemplars...)
 	}
 }
@@ -0,0 +1,42 @@
+package ingest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/ws"
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// BenchmarkIngestBatch stores a batch of 200 gauges and a histogram, as
+// an agent pushes them, stamping each round later than the last
+func BenchmarkIngestBatch(b *testing.B) {
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	s := NewServer(registry, ws.NewHub(registry))
+
+	batch := &pb.TelemetryBatch{Service: "checkout", Instance: "pod-1"}
+	var samples []*pb.MetricSample
+	for i := range 200 {
+		sample := &pb.MetricSample{Value: &pb.MetricSample_Gauge{Gauge: float64(i)}}
+		samples = append(samples, sample)
+		batch.Metrics = append(batch.Metrics, &pb.Metric{Name: fmt.Sprintf("gauge_%d", i), Samples: []*pb.MetricSample{sample}})
+	}
+	sum, count := 20.0, uint64(6)
+	hist := &pb.MetricSample{Value: &pb.MetricSample_Histogram{Histogram: &pb.Histogram{
+		Bounds: []float64{1, 10}, Counts: []uint64{1, 2, 3}, Sum: &sum, Count: &count,
+	}}}
+	samples = append(samples, hist)
+	batch.Metrics = append(batch.Metrics, &pb.Metric{Name: "latency", Samples: []*pb.MetricSample{hist}})
+
+	received := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		for _, sample := range samples {
+			sample.TimestampNs = uint64(i+1) * uint64(time.Millisecond)
+		}
+		s.ingestBatch("bench", batch, received)
+	}
+}
@@ -0,0 +1,126 @@
+package ingest
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// instanceForgetFactor is how many staleness thresholds an instance stays
+// known after its last batch, its rings ending in the gap marker, before
+// it is forgotten
+const instanceForgetFactor = 6
+
+// StalenessSweeper writes gap markers into an instance's rings once it has
+// gone quiet, and into its service's rings once every instance has, then
+// resume markers when data returns. An instance dropping out while others
+// keep reporting leaves the service's series without a gap.
+type StalenessSweeper struct {
+	registry  *buffer.Registry
+	threshold time.Duration
+
+	// last batch time per service and instance
+	lastSeen map[string]map[string]time.Time
+	// gapped holds the instances and services with an open gap
+	gapped         map[instanceKey]bool
+	servicesGapped map[string]bool
+	mu             sync.Mutex
+
+	// now stamps batches; tests replace it
+	now func() time.Time
+}
+
+// instanceKey identifies an instance of a service
+type instanceKey struct {
+	service, instance string
+}
+
+// NewStalenessSweeper creates a sweeper that opens a gap after threshold
+// without batches
+func NewStalenessSweeper(registry *buffer.Registry, threshold time.Duration) *StalenessSweeper {
+	return &StalenessSweeper{
+		registry:       registry,
+		threshold:      threshold,
+		lastSeen:       make(map[string]map[string]time.Time),
+		gapped:         make(map[instanceKey]bool),
+		servicesGapped: make(map[string]bool),
+		now:            time.Now,
+	}
+}
+
+// Seen records a batch from an instance. firstTs is the oldest sample
+// timestamp in the batch; open gaps of the instance and its service are
+// closed just before it. Call it before the batch is written to the rings.
+func (s *StalenessSweeper) Seen(service, instance string, firstTs int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instances, ok := s.lastSeen[service]
+	if !ok {
+		instances = make(map[string]time.Time)
+		s.lastSeen[service] = instances
+	}
+	instances[instance] = s.now()
+
+	if key := (instanceKey{service, instance}); s.gapped[key] {
+		delete(s.gapped, key)
+		n := s.registry.MarkInstanceResume(service, instance, firstTs)
+		log.Printf("Instance %s of %s resumed reporting (%d series)", instance, service, n)
+	}
+	if s.servicesGapped[service] {
+		delete(s.servicesGapped, service)
+		n := s.registry.MarkResume(service, firstTs)
+		log.Printf("Service %s resumed reporting (%d series)", service, n)
+	}
+}
+
+// Run sweeps for quiet instances every interval
+func (s *StalenessSweeper) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.sweep(now)
+	}
+}
+
+// sweep opens a gap for every stale instance, and for every service whose
+// instances are all stale. Instances are forgotten after
+// instanceForgetFactor thresholds, here and in the registry, so
+// scaled-down instances do not pile up.
+func (s *StalenessSweeper) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for service, instances := range s.lastSeen {
+		live := 0
+		for instance, seen := range instances {
+			key := instanceKey{service, instance}
+			switch idle := now.Sub(seen); {
+			case idle >= instanceForgetFactor*s.threshold:
+				delete(instances, instance)
+				delete(s.gapped, key)
+				s.registry.ForgetInstance(service, instance)
+			case idle >= s.threshold:
+				if !s.gapped[key] {
+					s.gapped[key] = true
+					n := s.registry.MarkInstanceGap(service, instance)
+					log.Printf("Instance %s of %s stopped reporting; marked a gap in %d series", instance, service, n)
+				}
+			default:
+				live++
+			}
+		}
+		if len(instances) == 0 {
+			delete(s.lastSeen, service)
+		}
+		if live > 0 || s.servicesGapped[service] {
+			continue
+		}
+		s.servicesGapped[service] = true
+		n := s.registry.MarkGap(service)
+		log.Printf("Service %s stopped reporting; marked a gap in %d series", service, n)
+	}
+}
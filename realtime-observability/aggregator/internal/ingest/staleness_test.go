@@ -0,0 +1,88 @@
+package ingest
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+func TestStalenessMarksEachInstanceOnce(t *testing.T) {
+	registry := buffer.NewRegistry()
+	const threshold = 10 * time.Second
+	sweeper := NewStalenessSweeper(registry, threshold)
+	now := time.Unix(1000, 0)
+	sweeper.now = func() time.Time { return now }
+
+	push := func(instance string, ts int64, count uint64) {
+		t.Helper()
+		sweeper.Seen("checkout", instance, ts)
+		if err := registry.PushGauge("checkout", instance, "cpu", buffer.Sample{Ts: ts, Val: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := registry.PushCounter("checkout", instance, "requests_total", buffer.CounterSample(ts, count)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	instanceRing := func(instance string) *buffer.Ring {
+		ring, ok := registry.FindInstanceRing("checkout", instance, "cpu")
+		if !ok {
+			t.Fatalf("no cpu ring for %s", instance)
+		}
+		return ring
+	}
+	serviceRing := registry.GetRing("checkout", "cpu")
+	// want lists the markers expected in the service ring, then pod-1's
+	// and pod-2's
+	check := func(step string, want ...[]buffer.Marker) {
+		t.Helper()
+		for i, ring := range []*buffer.Ring{serviceRing, instanceRing("pod-1"), instanceRing("pod-2")} {
+			var got []buffer.Marker
+			for _, s := range ring.Snapshot() {
+				if s.IsMarker() {
+					got = append(got, s.Marker)
+				}
+			}
+			if !slices.Equal(got, want[i]) {
+				t.Fatalf("%s: ring %d markers = %v, want %v", step, i, got, want[i])
+			}
+		}
+	}
+	gap, resume := buffer.MarkerGap, buffer.MarkerResume
+
+	push("pod-1", 1, 5)
+	push("pod-2", 1, 3)
+	now = now.Add(threshold / 2)
+	push("pod-2", 2, 3)
+
+	// pod-1 alone goes quiet: its rings get the gap, the service's not
+	now = now.Add(threshold / 2)
+	sweeper.sweep(now)
+	sweeper.sweep(now)
+	check("pod-1 stale", nil, []buffer.Marker{gap}, nil)
+
+	// Once pod-2 is quiet too, so is the service
+	now = now.Add(threshold / 2)
+	sweeper.sweep(now)
+	sweeper.sweep(now)
+	check("all stale", []buffer.Marker{gap}, []buffer.Marker{gap}, []buffer.Marker{gap})
+
+	// pod-1's return resumes its rings and the service's, once
+	push("pod-1", 3, 7)
+	push("pod-1", 4, 7)
+	check("pod-1 back", []buffer.Marker{gap, resume}, []buffer.Marker{gap, resume}, []buffer.Marker{gap})
+
+	// Its counter picks up from the value before the gap
+	if total, _ := registry.GetCounterRing("checkout", "requests_total").Latest(); total.Count != 10 {
+		t.Fatalf("requests_total = %d after the gap, want 5+3 plus pod-1's 2 since", total.Count)
+	}
+
+	// pod-2 is forgotten after instanceForgetFactor thresholds
+	now = now.Add(instanceForgetFactor * threshold)
+	sweeper.Seen("checkout", "pod-1", 5)
+	sweeper.sweep(now)
+	if got := registry.ListInstances("checkout"); len(got) != 1 || got[0] != "pod-1" {
+		t.Fatalf("instances = %v, want pod-2 forgotten", got)
+	}
+}
@@ -0,0 +1,42 @@
+package ingest
+
+import (
+	"log"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/auth"
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WatchConfig streams the caller's service configuration: at once, after
+// every reload that changes the file, and every third of the lease so a
+// live aggregator renews it well before agents let it lapse
+func (s *Server) WatchConfig(req *pb.ConfigRequest, stream grpc.ServerStreamingServer[pb.AgentConfig]) error {
+	if s.agentConfig == nil {
+		return status.Error(codes.Unimplemented, "agent config is not enabled")
+	}
+	ctx := stream.Context()
+	if scope, scoped := auth.ServiceScopeFromContext(ctx); scoped && req.Service != scope {
+		return status.Errorf(codes.PermissionDenied, "key is scoped to service %q", scope)
+	}
+
+	log.Printf("Agent config watched by service=%s instance=%s", req.Service, req.Instance)
+	renew := time.NewTicker(s.agentConfig.Lease() / 3)
+	defer renew.Stop()
+	for {
+		// Taken before the document so a reload in between is not missed
+		changed := s.agentConfig.Changed()
+		if err := stream.Send(s.agentConfig.Document(req.Service)); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-renew.C:
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package pipeline measures how long samples take to travel from ingest to
+// a WebSocket write.
+package pipeline
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// Stage is one leg of the ingest-to-broadcast pipeline
+type Stage int
+
+const (
+	// IngestToRegistry runs from batch receipt until its samples are in
+	// the registry
+	IngestToRegistry Stage = iota
+	// RegistryToBuild runs from the newest stored batch until the next
+	// snapshot build starts
+	RegistryToBuild
+	// BuildToWrite runs from a snapshot build until its frame is written
+	// to a client
+	BuildToWrite
+
+	numStages
+)
+
+// Stages lists every stage in pipeline order
+var Stages = []Stage{IngestToRegistry, RegistryToBuild, BuildToWrite}
+
+func (s Stage) String() string {
+	switch s {
+	case IngestToRegistry:
+		return "ingest_to_registry"
+	case RegistryToBuild:
+		return "registry_to_build"
+	case BuildToWrite:
+		return "build_to_write"
+	}
+	return "unknown"
+}
+
+// Bounds are the histogram bucket upper bounds in seconds; the broadcast
+// interval (16ms) sits between two of them
+var Bounds = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.016, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5,
+}
+
+// histogram is a fixed-bucket histogram updated with atomics, so recording
+// never allocates or locks
+type histogram struct {
+	counts [16]atomic.Uint64 // len(Bounds)+1, the last is overflow
+	count  atomic.Uint64
+	sumNs  atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	secs := d.Seconds()
+	i := 0
+	for i < len(Bounds) && secs > Bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sumNs.Add(int64(d))
+}
+
+// Latency records the duration of each pipeline stage. The zero value is
+// not usable; use NewLatency.
+type Latency struct {
+	stages [numStages]histogram
+	now    func() time.Time
+
+	// received is the newest batch receipt time, stored is when that
+	// batch reached the registry, and built is the stored time the last
+	// snapshot build accounted for (all UnixNano)
+	received atomic.Int64
+	stored   atomic.Int64
+	built    atomic.Int64
+}
+
+// NewLatency creates a recorder on the wall clock
+func NewLatency() *Latency {
+	return &Latency{now: time.Now}
+}
+
+// SetClock replaces the clock every stamp is taken from; for tests
+func (l *Latency) SetClock(now func() time.Time) {
+	l.now = now
+}
+
+// Now reads the recorder's clock
+func (l *Latency) Now() time.Time {
+	return l.now()
+}
+
+// Stored records that a batch received at the given time is now in the
+// registry
+func (l *Latency) Stored(received time.Time) {
+	now := l.now()
+	l.stages[IngestToRegistry].observe(now.Sub(received))
+	storeMax(&l.received, received.UnixNano())
+	storeMax(&l.stored, now.UnixNano())
+}
+
+// Built records a snapshot build starting at now. Only builds that pick up
+// a newly stored batch are observed, so idle ticks do not count as delay.
+func (l *Latency) Built(now time.Time) {
+	stored := l.stored.Load()
+	if stored == 0 || l.built.Swap(stored) == stored {
+		return
+	}
+	l.stages[RegistryToBuild].observe(now.Sub(time.Unix(0, stored)))
+}
+
+// Written records a frame from the build at builtNs reaching a client
+func (l *Latency) Written(builtNs int64) {
+	l.stages[BuildToWrite].observe(l.now().Sub(time.Unix(0, builtNs)))
+}
+
+// Received returns the receipt time of the newest batch in UnixNano, or 0
+func (l *Latency) Received() int64 {
+	return l.received.Load()
+}
+
+// StageSnapshot is the cumulative histogram of one stage
+type StageSnapshot struct {
+	Stage  Stage
+	Counts []uint64 // per bucket, len(Bounds)+1
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Snapshot returns the histogram of a stage
+func (l *Latency) Snapshot(stage Stage) StageSnapshot {
+	h := &l.stages[stage]
+	snap := StageSnapshot{
+		Stage:  stage,
+		Counts: make([]uint64, len(Bounds)+1),
+		Count:  h.count.Load(),
+		Sum:    time.Duration(h.sumNs.Load()),
+	}
+	for i := range snap.Counts {
+		snap.Counts[i] = h.counts[i].Load()
+	}
+	return snap
+}
+
+// Summary is a stage's latency for /readyz?verbose
+type Summary struct {
+	Stage string  `json:"stage"`
+	Count uint64  `json:"count"`
+	AvgMs float64 `json:"avg_ms"`
+	P50Ms float64 `json:"p50_ms"`
+	P99Ms float64 `json:"p99_ms"`
+}
+
+// Summaries summarizes every stage since startup
+func (l *Latency) Summaries() []Summary {
+	result := make([]Summary, 0, len(Stages))
+	for _, stage := range Stages {
+		snap := l.Snapshot(stage)
+		s := Summary{Stage: stage.String(), Count: snap.Count}
+		if snap.Count > 0 {
+			s.AvgMs = float64(snap.Sum) / float64(snap.Count) / float64(time.Millisecond)
+			s.P50Ms = buffer.Percentile(Bounds, snap.Counts, 50) * 1000
+			s.P99Ms = buffer.Percentile(Bounds, snap.Counts, 99) * 1000
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// storeMax raises v to n if n is larger
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		cur := v.Load()
+		if n <= cur || v.CompareAndSwap(cur, n) {
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+// bucketOf returns the index of the bucket holding d
+func bucketOf(d time.Duration) int {
+	i := 0
+	for i < len(Bounds) && d.Seconds() > Bounds[i] {
+		i++
+	}
+	return i
+}
+
+func TestStagesReflectInjectedDelays(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLatency()
+	l.SetClock(func() time.Time { return now })
+
+	received := l.Now()
+	now = now.Add(3 * time.Millisecond)
+	l.Stored(received)
+	if l.Received() != received.UnixNano() {
+		t.Fatalf("Received = %d, want %d", l.Received(), received.UnixNano())
+	}
+
+	now = now.Add(20 * time.Millisecond)
+	built := now
+	l.Built(built)
+	// A tick without a newly stored batch is not a delay
+	now = now.Add(16 * time.Millisecond)
+	l.Built(now)
+
+	now = built.Add(40 * time.Millisecond)
+	l.Written(built.UnixNano())
+
+	for _, tt := range []struct {
+		stage Stage
+		delay time.Duration
+	}{
+		{IngestToRegistry, 3 * time.Millisecond},
+		{RegistryToBuild, 20 * time.Millisecond},
+		{BuildToWrite, 40 * time.Millisecond},
+	} {
+		snap := l.Snapshot(tt.stage)
+		if snap.Count != 1 || snap.Sum != tt.delay || snap.Counts[bucketOf(tt.delay)] != 1 {
+			t.Fatalf("%s = %d observations summing to %v in %v, want one of %v", tt.stage, snap.Count, snap.Sum, snap.Counts, tt.delay)
+		}
+	}
+
+	summaries := l.Summaries()
+	if len(summaries) != len(Stages) || summaries[1].Stage != "registry_to_build" || summaries[1].AvgMs != 20 {
+		t.Fatalf("Summaries = %+v, want registry_to_build averaging 20ms", summaries)
+	}
+}
+
+func TestRecordingDoesNotAllocate(t *testing.T) {
+	l := NewLatency()
+	allocs := testing.AllocsPerRun(100, func() {
+		received := l.Now()
+		l.Stored(received)
+		l.Built(l.Now())
+		l.Written(received.UnixNano())
+	})
+	if allocs != 0 {
+		t.Fatalf("recording allocates %v times per batch", allocs)
+	}
+}
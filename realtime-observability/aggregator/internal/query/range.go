@@ -0,0 +1,333 @@
+package query
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MaxRangePoints bounds the steps a single QueryRange may return
+const MaxRangePoints = 11000
+
+// Default aggregations per kind
+const (
+	defaultGaugeAgg     = "avg"
+	defaultCounterAgg   = "increase"
+	defaultHistogramAgg = "p50"
+)
+
+// QueryRange aggregates the retained samples of one series into steps.
+// Steps without samples are omitted, unless they fall inside a gap: a
+// stretch longer than the request's gap factor times the series' typical
+// interval, or one a gap marker opens. Those steps report according to
+// the fill policy, and the gaps are listed in the response.
+func (s *Server) QueryRange(ctx context.Context, req *pb.QueryRangeRequest) (*pb.QueryRangeResponse, error) {
+	if req.Service == "" || req.Metric == "" {
+		return nil, status.Error(codes.InvalidArgument, "service and metric are required")
+	}
+	from, to := int64(req.FromNs), int64(req.ToNs)
+	if to == 0 {
+		to = time.Now().UnixNano()
+	}
+	if to <= from {
+		return nil, status.Error(codes.InvalidArgument, "to_ns must be after from_ns")
+	}
+	step := int64(req.StepNs)
+	if step == 0 {
+		step = to - from
+	}
+	if (to-from+step-1)/step > MaxRangePoints {
+		return nil, status.Errorf(codes.InvalidArgument, "range would return more than %d points; raise step_ns", MaxRangePoints)
+	}
+	fill, err := buffer.ParseFillPolicy(req.Fill)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	factor := req.GapFactor
+	if factor == 0 {
+		factor = s.gapFactor
+	}
+	if factor < 1 {
+		return nil, status.Error(codes.InvalidArgument, "gap_factor must be at least 1")
+	}
+	b := steps{from: from, to: to, step: step}
+
+	var resp *pb.QueryRangeResponse
+	var gaps []buffer.Gap
+	if ring, ok := s.registry.FindRing(req.Service, req.Metric); ok {
+		samples := ring.Snapshot()
+		resp, err = b.gauge(samples, aggOrDefault(req.Agg, defaultGaugeAgg))
+		gaps = buffer.FindGaps(samples, factor, to)
+	} else if ring, ok := s.registry.FindCounterRing(req.Service, req.Metric); ok {
+		samples := ring.Snapshot()
+		resp, err = b.counter(samples, aggOrDefault(req.Agg, defaultCounterAgg))
+		gaps = buffer.FindGaps(samples, factor, to)
+	} else if ring, ok := s.registry.FindHistogramRing(req.Service, req.Metric); ok {
+		windows := ring.Snapshot()
+		resp, err = b.histogram(windows, aggOrDefault(req.Agg, defaultHistogramAgg))
+		gaps = buffer.FindHistogramGaps(windows, factor, to)
+	} else {
+		return nil, status.Errorf(codes.NotFound, "no series %s/%s", req.Service, req.Metric)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.fillGaps(resp, gaps, fill)
+	return resp, nil
+}
+
+func aggOrDefault(agg, def string) string {
+	if agg == "" {
+		return def
+	}
+	return agg
+}
+
+// steps splits [from, to) into buckets of step
+type steps struct {
+	from, to, step int64
+}
+
+// index returns the step holding ts; ok is false outside the range
+func (b steps) index(ts int64) (int64, bool) {
+	if ts < b.from || ts >= b.to {
+		return 0, false
+	}
+	return (ts - b.from) / b.step, true
+}
+
+func (b steps) start(i int64) uint64 {
+	return uint64(b.from + i*b.step)
+}
+
+// fillGaps lists the gaps that reach into the range and adds a point for
+// every empty step inside one: null for FillNone, or flagged and carrying
+// the last value before it, or zero
+func (b steps) fillGaps(resp *pb.QueryRangeResponse, gaps []buffer.Gap, fill buffer.FillPolicy) {
+	for _, g := range gaps {
+		if g.Overlaps(b.from, b.to) {
+			resp.Gaps = append(resp.Gaps, &pb.Gap{FromNs: uint64(g.From), ToNs: uint64(g.To)})
+		}
+	}
+	if len(resp.Gaps) == 0 {
+		return
+	}
+
+	points := resp.Points
+	resp.Points = make([]*pb.RangePoint, 0, len(points))
+	var prev *pb.RangePoint
+	for i := int64(0); b.from+i*b.step < b.to; i++ {
+		start := b.from + i*b.step
+		if len(points) > 0 && points[0].TimestampNs == uint64(start) {
+			prev = points[0]
+			resp.Points = append(resp.Points, prev)
+			points = points[1:]
+			continue
+		}
+		if !slices.ContainsFunc(gaps, func(g buffer.Gap) bool { return g.Overlaps(start, start+b.step) }) {
+			continue
+		}
+		point := &pb.RangePoint{TimestampNs: uint64(start), Filled: true}
+		switch {
+		case fill == buffer.FillPrevious && prev != nil:
+			point.Value = prev.Value
+		case fill == buffer.FillZero:
+		default:
+			point.Null, point.Filled = true, false
+		}
+		resp.Points = append(resp.Points, point)
+	}
+}
+
+// stepAcc accumulates the values of one step
+type stepAcc struct {
+	i                   int64
+	sum, min, max, last float64
+	n                   uint64
+}
+
+func (b steps) gauge(samples []buffer.Sample, agg string) (*pb.QueryRangeResponse, error) {
+	switch agg {
+	case "avg", "min", "max", "sum", "last", "count":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "gauges support avg, min, max, sum, last and count, not %q", agg)
+	}
+
+	resp := &pb.QueryRangeResponse{Kind: "gauge", Agg: agg}
+	var acc *stepAcc
+	flush := func() {
+		if acc == nil {
+			return
+		}
+		var v float64
+		switch agg {
+		case "avg":
+			v = acc.sum / float64(acc.n)
+		case "min":
+			v = acc.min
+		case "max":
+			v = acc.max
+		case "sum":
+			v = acc.sum
+		case "last":
+			v = acc.last
+		case "count":
+			v = float64(acc.n)
+		}
+		resp.Points = append(resp.Points, &pb.RangePoint{TimestampNs: b.start(acc.i), Value: v, Samples: acc.n})
+		acc = nil
+	}
+
+	for _, smp := range samples {
+		i, ok := b.index(smp.Ts)
+		if !ok || smp.IsMarker() {
+			continue
+		}
+		if acc != nil && acc.i != i {
+			flush()
+		}
+		if acc == nil {
+			acc = &stepAcc{i: i, min: math.Inf(1), max: math.Inf(-1)}
+		}
+		acc.sum += smp.Val
+		acc.min = math.Min(acc.min, smp.Val)
+		acc.max = math.Max(acc.max, smp.Val)
+		acc.last = smp.Val
+		acc.n++
+	}
+	flush()
+	return resp, nil
+}
+
+// counter reports per-step increases. A sample's increase over the one
+// before it counts in the sample's step, so a step needs the previous
+// sample, which may fall before from; increases never span a gap marker.
+// Integer increases are summed exactly and float counter increases apart.
+func (b steps) counter(samples []buffer.Sample, agg string) (*pb.QueryRangeResponse, error) {
+	switch agg {
+	case "increase", "rate", "last":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "counters support increase, rate and last, not %q", agg)
+	}
+
+	resp := &pb.QueryRangeResponse{Kind: "counter", Agg: agg}
+	var acc *stepAcc
+	var increase uint64
+	var floatIncrease float64
+	flush := func() {
+		if acc == nil {
+			return
+		}
+		v := float64(increase) + floatIncrease
+		switch agg {
+		case "rate":
+			v /= time.Duration(b.step).Seconds()
+		case "last":
+			v = acc.last
+		}
+		resp.Points = append(resp.Points, &pb.RangePoint{TimestampNs: b.start(acc.i), Value: v, Samples: acc.n})
+		acc, increase, floatIncrease = nil, 0, 0
+	}
+
+	var prev buffer.Sample
+	havePrev := false
+	for _, smp := range samples {
+		if smp.IsMarker() {
+			havePrev = false
+			continue
+		}
+		i, ok := b.index(smp.Ts)
+		if ok {
+			if acc != nil && acc.i != i {
+				flush()
+			}
+			if acc == nil {
+				acc = &stepAcc{i: i}
+			}
+			if havePrev {
+				if smp.Float || prev.Float {
+					floatIncrease += smp.CounterIncrease(prev)
+				} else {
+					increase += smp.CounterDelta(prev)
+				}
+			}
+			acc.last = smp.Val
+			acc.n++
+		}
+		prev, havePrev = smp, true
+	}
+	flush()
+	return resp, nil
+}
+
+// histogram merges the windows of each step with MergeHistograms, skipping
+// windows whose bounds differ from the step's first, as MergeSince does
+func (b steps) histogram(windows []buffer.HistogramData, agg string) (*pb.QueryRangeResponse, error) {
+	var q float64
+	switch {
+	case agg == "avg", agg == "count":
+	case strings.HasPrefix(agg, "p"):
+		v, err := strconv.ParseFloat(agg[1:], 64)
+		if err != nil || v <= 0 || v > 100 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid percentile %q", agg)
+		}
+		q = v
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "histograms support p<q>, avg and count, not %q", agg)
+	}
+
+	resp := &pb.QueryRangeResponse{Kind: "histogram", Agg: agg}
+	var step []buffer.HistogramData
+	var i int64
+	flush := func() {
+		if len(step) == 0 {
+			return
+		}
+		merged, err := buffer.MergeHistograms(step...)
+		n := len(step)
+		step = step[:0]
+		if err != nil {
+			return
+		}
+		var v float64
+		switch agg {
+		case "count":
+			v = float64(merged.Total())
+		case "avg":
+			mean, ok := merged.Mean()
+			if !ok {
+				return
+			}
+			v = mean
+		default:
+			v = buffer.Percentile(merged.Bounds, merged.Counts, q)
+		}
+		resp.Points = append(resp.Points, &pb.RangePoint{TimestampNs: b.start(i), Value: v, Samples: uint64(n)})
+	}
+
+	for _, h := range windows {
+		idx, ok := b.index(h.Ts)
+		if !ok || h.IsMarker() {
+			continue
+		}
+		if len(step) > 0 && idx != i {
+			flush()
+		}
+		if len(step) == 0 {
+			i = idx
+		} else if len(h.Counts) != len(step[0].Counts) || !slices.Equal(h.Bounds, step[0].Bounds) {
+			continue
+		}
+		step = append(step, h)
+	}
+	flush()
+	return resp, nil
+}
@@ -0,0 +1,79 @@
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+func TestQueryRangeFillsGaps(t *testing.T) {
+	const s = int64(time.Second)
+	base := 1000 * s
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	ring := registry.GetRing("checkout", "queue")
+	// A sample a second, with nothing from 10s to 20s
+	for i := range int64(30) {
+		if i < 10 || i >= 20 {
+			ring.Push(buffer.Sample{Ts: base + i*s, Val: float64(i + 1)})
+		}
+	}
+	server := NewServer(registry, nil)
+
+	for _, tc := range []struct {
+		fill   string
+		check  func(p *pb.RangePoint) bool
+		expect string
+	}{
+		{"", func(p *pb.RangePoint) bool { return p.Null && !p.Filled }, "null"},
+		{"none", func(p *pb.RangePoint) bool { return p.Null && !p.Filled }, "null"},
+		{"previous", func(p *pb.RangePoint) bool { return !p.Null && p.Filled && p.Value == 10 }, "10, filled"},
+		{"zero", func(p *pb.RangePoint) bool { return !p.Null && p.Filled && p.Value == 0 }, "0, filled"},
+	} {
+		resp, err := server.QueryRange(context.Background(), &pb.QueryRangeRequest{
+			Service: "checkout", Metric: "queue", Agg: "last", Fill: tc.fill,
+			FromNs: uint64(base), ToNs: uint64(base + 30*s), StepNs: uint64(s),
+		})
+		if err != nil {
+			t.Fatalf("fill %q: %v", tc.fill, err)
+		}
+		if len(resp.Gaps) != 1 || resp.Gaps[0].FromNs != uint64(base+9*s) || resp.Gaps[0].ToNs != uint64(base+20*s) {
+			t.Fatalf("fill %q: gaps = %v, want 9s to 20s", tc.fill, resp.Gaps)
+		}
+		if len(resp.Points) != 30 {
+			t.Fatalf("fill %q: %d points, want one per step", tc.fill, len(resp.Points))
+		}
+		for i, p := range resp.Points {
+			if p.TimestampNs != uint64(base+int64(i)*s) {
+				t.Fatalf("fill %q: point %d at %d", tc.fill, i, p.TimestampNs)
+			}
+			inGap := i >= 10 && i < 20
+			switch {
+			case inGap && !tc.check(p):
+				t.Errorf("fill %q: point %d = %v, want %s", tc.fill, i, p, tc.expect)
+			case !inGap && (p.Null || p.Filled || p.Value != float64(i+1)):
+				t.Errorf("fill %q: point %d = %v, want the sample %d", tc.fill, i, p, i+1)
+			}
+		}
+	}
+
+	// A factor larger than the hole sees none
+	resp, err := server.QueryRange(context.Background(), &pb.QueryRangeRequest{
+		Service: "checkout", Metric: "queue", GapFactor: 20,
+		FromNs: uint64(base), ToNs: uint64(base + 30*s), StepNs: uint64(s),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Gaps) != 0 || len(resp.Points) != 20 {
+		t.Fatalf("gap_factor 20: %d gaps and %d points, want 0 and 20", len(resp.Gaps), len(resp.Points))
+	}
+
+	if _, err := server.QueryRange(context.Background(), &pb.QueryRangeRequest{
+		Service: "checkout", Metric: "queue", Fill: "linear", ToNs: uint64(base + 30*s),
+	}); err == nil {
+		t.Fatal("fill linear accepted")
+	}
+}
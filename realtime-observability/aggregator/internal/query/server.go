@@ -0,0 +1,234 @@
+// Package query implements the TelemetryQuery gRPC service, a typed read
+// API over the registry for programmatic consumers.
+package query
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/ws"
+	pb "github.com/yourorg/telemetry/gen/proto"
+)
+
+// Server implements the TelemetryQuery gRPC service
+type Server struct {
+	pb.UnimplementedTelemetryQueryServer
+	registry *buffer.Registry
+	hub      *ws.Hub
+
+	// gapFactor is QueryRange's gap factor when a request has none
+	gapFactor float64
+}
+
+// NewServer creates a query server; Watch follows the hub's broadcast ticks
+func NewServer(registry *buffer.Registry, hub *ws.Hub) *Server {
+	return &Server{
+		registry:  registry,
+		hub:       hub,
+		gapFactor: buffer.DefaultGapFactor,
+	}
+}
+
+// SetGapFactor sets how many typical intervals apart samples must be for
+// QueryRange to report a gap between them, when a request does not say
+func (s *Server) SetGapFactor(factor float64) {
+	s.gapFactor = factor
+}
+
+// ListServices returns every service with its series counts and reporting
+// instances, sorted by name
+func (s *Server) ListServices(ctx context.Context, req *pb.ListServicesRequest) (*pb.ListServicesResponse, error) {
+	counts := s.registry.SeriesCounts()
+	instances := s.registry.Instances()
+	resp := &pb.ListServicesResponse{Services: make([]*pb.ServiceInfo, 0, len(counts))}
+	for service, c := range counts {
+		info := &pb.ServiceInfo{
+			Name:       service,
+			Gauges:     uint32(c.Gauges),
+			Counters:   uint32(c.Counters),
+			Histograms: uint32(c.Histograms),
+		}
+		for _, inst := range instances[service] {
+			info.Instances = append(info.Instances, &pb.InstanceInfo{
+				Instance:   inst.Instance,
+				Attributes: inst.Attributes,
+				LastSeenNs: uint64(inst.LastSeen.UnixNano()),
+			})
+		}
+		resp.Services = append(resp.Services, info)
+	}
+	sort.Slice(resp.Services, func(i, j int) bool { return resp.Services[i].Name < resp.Services[j].Name })
+	return resp, nil
+}
+
+// ListMetrics returns the catalog of one service, or of every service
+func (s *Server) ListMetrics(ctx context.Context, req *pb.ListMetricsRequest) (*pb.ListMetricsResponse, error) {
+	resp := &pb.ListMetricsResponse{}
+	for _, entry := range s.registry.Catalog() {
+		if req.Service != "" && entry.Service != req.Service {
+			continue
+		}
+		info := &pb.MetricInfo{
+			Service: entry.Service,
+			Name:    entry.Metric,
+			Kind:    entry.Kind,
+		}
+		if entry.Metadata != (buffer.Metadata{}) {
+			info.Description = &pb.MetricDescription{
+				Name: entry.Metric,
+				Type: entry.Type,
+				Unit: entry.Unit,
+				Help: entry.Help,
+			}
+		}
+		resp.Metrics = append(resp.Metrics, info)
+	}
+	return resp, nil
+}
+
+// GetLatest returns the newest value of the selected series
+func (s *Server) GetLatest(ctx context.Context, req *pb.GetLatestRequest) (*pb.QuerySnapshot, error) {
+	now := time.Now().UnixNano()
+	return buildSnapshot(now, s.registry.LatestSnapshot(), ws.NewPercentileCache(s.registry),
+		subscriptions(req.Subscriptions)), nil
+}
+
+// subscriptions converts request subscriptions, dropping invalid
+// percentiles as the WS hub does
+func subscriptions(subs []*pb.Subscription) []ws.Subscription {
+	result := make([]ws.Subscription, 0, len(subs))
+	for _, sub := range subs {
+		result = append(result, ws.Subscription{
+			Service:     sub.Service,
+			Metric:      sub.Metric,
+			Percentiles: ws.ValidPercentiles(append([]float64(nil), sub.Percentiles...)),
+			WindowMs:    sub.WindowMs,
+		})
+	}
+	return result
+}
+
+// buildSnapshot selects the subscribed series of a snapshot, or every
+// series without subscriptions, in key order
+func buildSnapshot(ts int64, latest buffer.LatestSnapshot, percentiles *ws.PercentileCache, subs []ws.Subscription) *pb.QuerySnapshot {
+	snap := &pb.QuerySnapshot{TimestampNs: uint64(ts)}
+
+	add := func(key buffer.MetricKey) {
+		if g, ok := latest.Gauges[key]; ok {
+			snap.Series = append(snap.Series, gaugeValue(key, g))
+		}
+		if c, ok := latest.Counters[key]; ok {
+			snap.Series = append(snap.Series, counterValue(key, c))
+		}
+		if h, ok := latest.Histograms[key]; ok {
+			snap.Series = append(snap.Series, histogramValue(key, h, latest.Exemplars[key]))
+		}
+	}
+
+	if len(subs) == 0 {
+		keys := make(map[buffer.MetricKey]struct{}, len(latest.Gauges)+len(latest.Counters)+len(latest.Histograms))
+		for key := range latest.Gauges {
+			keys[key] = struct{}{}
+		}
+		for key := range latest.Counters {
+			keys[key] = struct{}{}
+		}
+		for key := range latest.Histograms {
+			keys[key] = struct{}{}
+		}
+		sorted := make([]buffer.MetricKey, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].Service != sorted[j].Service {
+				return sorted[i].Service < sorted[j].Service
+			}
+			return sorted[i].Name < sorted[j].Name
+		})
+		for _, key := range sorted {
+			add(key)
+		}
+		return snap
+	}
+
+	for _, sub := range subs {
+		key := buffer.MetricKey{Service: sub.Service, Name: sub.Metric}
+		add(key)
+		if len(sub.Percentiles) == 0 {
+			continue
+		}
+		values := make(map[string]ws.PercentileValue, len(sub.Percentiles)+1)
+		percentiles.Add(sub, values)
+		prefix := key.String() + ":"
+		start := len(snap.Percentiles)
+		for name, v := range values {
+			snap.Percentiles = append(snap.Percentiles, &pb.PercentileValue{
+				Service:       sub.Service,
+				Metric:        sub.Metric,
+				Stat:          strings.TrimPrefix(name, prefix),
+				TimestampNs:   uint64(v.Ts),
+				Value:         v.Val,
+				Count:         v.Count,
+				LowConfidence: v.LowConfidence,
+			})
+		}
+		added := snap.Percentiles[start:]
+		sort.Slice(added, func(i, j int) bool { return added[i].Stat < added[j].Stat })
+	}
+	return snap
+}
+
+func gaugeValue(key buffer.MetricKey, s buffer.Sample) *pb.SeriesValue {
+	v := &pb.SeriesValue{Service: key.Service, Metric: key.Name, Kind: "gauge"}
+	v.Sample = &pb.MetricSample{TimestampNs: uint64(s.Ts)}
+	if s.IsMarker() {
+		v.Marker = s.Marker.String()
+		return v
+	}
+	v.Sample.Value = &pb.MetricSample_Gauge{Gauge: s.Val}
+	return v
+}
+
+func counterValue(key buffer.MetricKey, s buffer.Sample) *pb.SeriesValue {
+	v := &pb.SeriesValue{Service: key.Service, Metric: key.Name, Kind: "counter"}
+	v.Sample = &pb.MetricSample{TimestampNs: uint64(s.Ts)}
+	if s.IsMarker() {
+		v.Marker = s.Marker.String()
+		return v
+	}
+	if s.Float {
+		v.Sample.Value = &pb.MetricSample_FloatCounter{FloatCounter: s.Val}
+	} else {
+		v.Sample.Value = &pb.MetricSample_Counter{Counter: s.Count}
+	}
+	return v
+}
+
+func histogramValue(key buffer.MetricKey, h buffer.HistogramData, exemplars []buffer.Exemplar) *pb.SeriesValue {
+	v := &pb.SeriesValue{Service: key.Service, Metric: key.Name, Kind: "histogram"}
+	v.Sample = &pb.MetricSample{TimestampNs: uint64(h.Ts)}
+	if h.IsMarker() {
+		v.Marker = h.Marker.String()
+		return v
+	}
+	hist := &pb.Histogram{Bounds: h.Bounds, Counts: h.Counts}
+	if h.HasSum {
+		sum, count := h.Sum, h.Count
+		hist.Sum, hist.Count = &sum, &count
+	}
+	v.Sample.Value = &pb.MetricSample_Histogram{Histogram: hist}
+	for _, e := range exemplars {
+		v.Exemplars = append(v.Exemplars, &pb.Exemplar{
+			TimestampNs: uint64(e.Ts),
+			Value:       e.Value,
+			Operation:   e.Operation,
+			TraceId:     e.TraceID,
+			Labels:      e.Labels,
+		})
+	}
+	return v
+}
@@ -0,0 +1,361 @@
+package query_test
+
+import (
+	"context"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/aggregatortest"
+	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/ws"
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// seed pushes a gauge on two instances, an integer and a float counter
+// and a histogram for checkout, and a gauge for cart, recording the
+// instances as ingest does
+func seed(t *testing.T, registry *buffer.Registry, ts int64) {
+	t.Helper()
+	registry.SeenInstance("checkout", "pod-a", map[string]string{"zone": "a"}, time.Unix(0, ts))
+	registry.SeenInstance("checkout", "pod-b", map[string]string{"zone": "b"}, time.Unix(0, ts))
+	pushes := []error{
+		registry.PushGauge("checkout", "pod-a", "queue", buffer.Sample{Ts: ts, Val: 3}),
+		registry.PushGauge("checkout", "pod-b", "queue", buffer.Sample{Ts: ts, Val: 5}),
+		registry.PushCounter("checkout", "pod-a", "requests_total", buffer.CounterSample(ts, 1<<60)),
+		registry.PushCounter("checkout", "pod-a", "bytes_total", buffer.FloatCounterSample(ts, 2.5)),
+		registry.PushHistogram("checkout", "pod-a", "latency_ms", buffer.HistogramData{
+			Ts:     ts,
+			Bounds: []float64{10, 100, 1000},
+			Counts: []uint64{90, 9, 1, 0},
+			Sum:    900, Count: 100, HasSum: true,
+		}),
+		registry.PushGauge("cart", "", "items", buffer.Sample{Ts: ts, Val: 7}),
+	}
+	for _, err := range pushes {
+		if err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+}
+
+func TestListServicesAndMetrics(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{NoAgent: true})
+	seed(t, h.Registry, time.Now().UnixNano())
+	client := h.QueryClient()
+	ctx := context.Background()
+
+	services, err := client.ListServices(ctx, &pb.ListServicesRequest{})
+	if err != nil {
+		t.Fatalf("ListServices: %v", err)
+	}
+	if len(services.Services) != 2 || services.Services[0].Name != "cart" || services.Services[1].Name != "checkout" {
+		t.Fatalf("ListServices = %v, want cart and checkout in order", services.Services)
+	}
+	checkout := services.Services[1]
+	if checkout.Gauges != 1 || checkout.Counters != 2 || checkout.Histograms != 1 {
+		t.Fatalf("checkout counts = %d gauges, %d counters, %d histograms; want 1, 2, 1",
+			checkout.Gauges, checkout.Counters, checkout.Histograms)
+	}
+	var instances []string
+	for _, inst := range checkout.Instances {
+		instances = append(instances, inst.Instance)
+		if inst.Attributes["zone"] == "" || inst.LastSeenNs == 0 {
+			t.Errorf("instance %v, want its attributes and last seen time", inst)
+		}
+	}
+	slices.Sort(instances)
+	if !slices.Equal(instances, []string{"pod-a", "pod-b"}) {
+		t.Fatalf("checkout instances = %v, want pod-a and pod-b", instances)
+	}
+
+	metrics, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{Service: "checkout"})
+	if err != nil {
+		t.Fatalf("ListMetrics: %v", err)
+	}
+	kinds := make(map[string]string)
+	for _, m := range metrics.Metrics {
+		if m.Service != "checkout" {
+			t.Fatalf("ListMetrics(checkout) returned %s/%s", m.Service, m.Name)
+		}
+		kinds[m.Name] = m.Kind
+	}
+	for _, want := range []struct{ name, kind string }{
+		{"queue", "gauge"},
+		{"requests_total", "counter"},
+		{"bytes_total", "counter"},
+		{"latency_ms", "histogram"},
+	} {
+		if kinds[want.name] != want.kind {
+			t.Errorf("ListMetrics kind of %s = %q, want %q", want.name, kinds[want.name], want.kind)
+		}
+	}
+	if len(kinds) != 4 {
+		t.Errorf("ListMetrics(checkout) = %v, want 4 metrics", kinds)
+	}
+
+	all, err := client.ListMetrics(ctx, &pb.ListMetricsRequest{})
+	if err != nil {
+		t.Fatalf("ListMetrics: %v", err)
+	}
+	if len(all.Metrics) != 5 {
+		t.Fatalf("ListMetrics() = %d metrics, want 5 across both services", len(all.Metrics))
+	}
+}
+
+func TestGetLatest(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{NoAgent: true})
+	ts := time.Now().UnixNano()
+	seed(t, h.Registry, ts)
+	client := h.QueryClient()
+	ctx := context.Background()
+
+	// Without subscriptions every series comes back, in key order
+	snap, err := client.GetLatest(ctx, &pb.GetLatestRequest{})
+	if err != nil {
+		t.Fatalf("GetLatest: %v", err)
+	}
+	var names []string
+	for _, v := range snap.Series {
+		names = append(names, v.Service+"/"+v.Metric)
+	}
+	want := []string{"cart/items", "checkout/bytes_total", "checkout/latency_ms", "checkout/queue", "checkout/requests_total"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("GetLatest series = %v, want %v", names, want)
+	}
+
+	snap, err = client.GetLatest(ctx, &pb.GetLatestRequest{Subscriptions: []*pb.Subscription{
+		{Service: "checkout", Metric: "queue"},
+		{Service: "checkout", Metric: "requests_total"},
+		{Service: "checkout", Metric: "bytes_total"},
+		{Service: "checkout", Metric: "latency_ms", Percentiles: []float64{50, 99, 150}},
+	}})
+	if err != nil {
+		t.Fatalf("GetLatest: %v", err)
+	}
+	if len(snap.Series) != 4 {
+		t.Fatalf("GetLatest = %d series, want the 4 subscribed", len(snap.Series))
+	}
+	queue, requests, bytes, latency := snap.Series[0], snap.Series[1], snap.Series[2], snap.Series[3]
+	// The service gauge averages its instances by default
+	if queue.Kind != "gauge" || queue.Sample.GetGauge() != 4 {
+		t.Errorf("queue = %v, want the gauge 4", queue)
+	}
+	if requests.Kind != "counter" || requests.Sample.GetCounter() != 1<<60 {
+		t.Errorf("requests_total = %v, want the exact counter 2^60", requests)
+	}
+	if bytes.Kind != "counter" || bytes.Sample.GetFloatCounter() != 2.5 {
+		t.Errorf("bytes_total = %v, want the float counter 2.5", bytes)
+	}
+	if hist := latency.Sample.GetHistogram(); latency.Kind != "histogram" || hist == nil ||
+		!slices.Equal(hist.Counts, []uint64{90, 9, 1, 0}) || hist.GetCount() != 100 {
+		t.Errorf("latency_ms = %v, want the pushed histogram", latency)
+	}
+
+	// The out-of-range 150 is dropped; the mean rides along
+	var stats []string
+	for _, p := range snap.Percentiles {
+		stats = append(stats, p.Stat)
+		if p.Service != "checkout" || p.Metric != "latency_ms" || p.Count != 100 {
+			t.Errorf("percentile %v, want checkout/latency_ms over 100 observations", p)
+		}
+	}
+	if !slices.Equal(stats, []string{"avg", "p50", "p99"}) {
+		t.Fatalf("percentile stats = %v, want avg, p50, p99", stats)
+	}
+	if avg := snap.Percentiles[0].Value; avg != 9 {
+		t.Errorf("avg = %v, want 9", avg)
+	}
+	if p50 := snap.Percentiles[1].Value; p50 <= 0 || p50 > 10 {
+		t.Errorf("p50 = %v, want it in the first bucket", p50)
+	}
+	if p99 := snap.Percentiles[2].Value; p99 <= 10 || p99 > 100 {
+		t.Errorf("p99 = %v, want it in the second bucket", p99)
+	}
+}
+
+func TestQueryRangeOverGRPC(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{NoAgent: true})
+	const s = int64(time.Second)
+	base := 1000 * s
+	ring := h.Registry.GetRing("checkout", "queue")
+	for i := range int64(10) {
+		ring.Push(buffer.Sample{Ts: base + i*s, Val: float64(i)})
+	}
+
+	resp, err := h.QueryClient().QueryRange(context.Background(), &pb.QueryRangeRequest{
+		Service: "checkout", Metric: "queue", Agg: "max",
+		FromNs: uint64(base), ToNs: uint64(base + 10*s), StepNs: uint64(5 * s),
+	})
+	if err != nil {
+		t.Fatalf("QueryRange: %v", err)
+	}
+	if resp.Kind != "gauge" || resp.Agg != "max" || len(resp.Points) != 2 {
+		t.Fatalf("QueryRange = %v, want two max points of a gauge", resp)
+	}
+	if resp.Points[0].Value != 4 || resp.Points[1].Value != 9 {
+		t.Fatalf("QueryRange points = %v, want 4 and 9", resp.Points)
+	}
+
+	_, err = h.QueryClient().QueryRange(context.Background(), &pb.QueryRangeRequest{Service: "checkout", Metric: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("QueryRange of a missing metric = %v, want NotFound", err)
+	}
+}
+
+// recvWithin receives the next snapshot of a Watch or fails the test
+func recvWithin(t *testing.T, stream pb.TelemetryQuery_WatchClient, timeout time.Duration) *pb.QuerySnapshot {
+	t.Helper()
+	type result struct {
+		snap *pb.QuerySnapshot
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		snap, err := stream.Recv()
+		ch <- result{snap, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("Watch Recv: %v", r.err)
+		}
+		return r.snap
+	case <-time.After(timeout):
+		t.Fatalf("Watch: no snapshot within %v", timeout)
+		return nil
+	}
+}
+
+func TestWatchFollowsUpdates(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{NoAgent: true})
+	seed(t, h.Registry, time.Now().UnixNano())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := h.QueryClient().Watch(ctx, &pb.WatchRequest{Subscriptions: []*pb.Subscription{
+		{Service: "cart", Metric: "items"},
+	}})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	snap := recvWithin(t, stream, 5*time.Second)
+	if len(snap.Series) != 1 || snap.Series[0].Metric != "items" || snap.Series[0].Sample.GetGauge() != 7 {
+		t.Fatalf("Watch snapshot = %v, want only cart/items at 7", snap.Series)
+	}
+
+	if err := h.Registry.PushGauge("cart", "", "items", buffer.Sample{Ts: time.Now().UnixNano(), Val: 8}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for snap.Series[0].Sample.GetGauge() != 8 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Watch never reported the update to 8")
+		}
+		snap = recvWithin(t, stream, 5*time.Second)
+	}
+
+	cancel()
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if err != io.EOF && status.Code(err) != codes.Canceled {
+				t.Fatalf("Recv after cancel = %v, want EOF or Canceled", err)
+			}
+			break
+		}
+	}
+}
+
+func TestWatchUnknownView(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{NoAgent: true})
+
+	stream, err := h.QueryClient().Watch(context.Background(), &pb.WatchRequest{View: "missing"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("Watch of an unknown view = %v, want NotFound", err)
+	}
+}
+
+func TestWatchBandwidthBudget(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{NoAgent: true})
+	seed(t, h.Registry, time.Now().UnixNano())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A 1 byte/sec budget lets a snapshot through only once the window
+	// is empty; the 5ms ticks between are coalesced, as for a WS client
+	stream, err := h.QueryClient().Watch(ctx, &pb.WatchRequest{MaxBytesPerSec: 1})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	recvWithin(t, stream, 5*time.Second)
+	start := time.Now()
+	snap := recvWithin(t, stream, 5*time.Second)
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatalf("second snapshot after %v, want the budget to hold it back about a second", elapsed)
+	}
+	if snap.Skipped == 0 {
+		t.Fatalf("second snapshot Skipped = 0, want the coalesced ticks counted")
+	}
+	if len(snap.Series) != 5 {
+		t.Fatalf("second snapshot = %d series, want all 5", len(snap.Series))
+	}
+}
+
+func TestQueryNeedsReadKey(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{APIKey: "secret", NoAgent: true})
+	h.Hub.Views().Put(ws.View{Name: "cart", Subscriptions: []ws.Subscription{{Service: "cart", Metric: "items"}}})
+	client := h.QueryClient()
+
+	// Issued keys are agent credentials; they report but never read
+	token, _, err := h.Auth.MintBootstrapToken("checkout", time.Minute)
+	if err != nil {
+		t.Fatalf("MintBootstrapToken: %v", err)
+	}
+	issued, _, _, err := h.Auth.ExchangeToken(token, "", "pod-a")
+	if err != nil {
+		t.Fatalf("ExchangeToken: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		want codes.Code
+	}{
+		{"no key", "", codes.Unauthenticated},
+		{"unknown key", "wrong", codes.PermissionDenied},
+		{"issued key", issued, codes.PermissionDenied},
+		{"configured key", "secret", codes.OK},
+	} {
+		ctx := context.Background()
+		if tc.key != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", tc.key)
+		}
+		if _, err := client.ListServices(ctx, &pb.ListServicesRequest{}); status.Code(err) != tc.want {
+			t.Errorf("%s: ListServices = %v, want %v", tc.name, err, tc.want)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		stream, err := client.Watch(ctx, &pb.WatchRequest{View: "cart"})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != tc.want {
+			t.Errorf("%s: Watch = %v, want %v", tc.name, err, tc.want)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,79 @@
+package query
+
+import (
+	"time"
+
+	"github.com/yourorg/aggregator/internal/ws"
+	pb "github.com/yourorg/telemetry/gen/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Watch streams a snapshot of the subscribed series on every hub tick. Like
+// a WS client, a stream over its bandwidth budget skips ticks, and a slow
+// reader only ever has the newest snapshot pending; Skipped on the next
+// snapshot counts the ticks coalesced either way.
+func (s *Server) Watch(req *pb.WatchRequest, stream grpc.ServerStreamingServer[pb.QuerySnapshot]) error {
+	if req.View != "" {
+		if _, ok := s.hub.Views().Get(req.View); !ok {
+			return status.Errorf(codes.NotFound, "no view named %q", req.View)
+		}
+	}
+	subs := subscriptions(req.Subscriptions)
+	minInterval := int64(time.Duration(req.MinIntervalMs) * time.Millisecond)
+
+	// pending holds the newest unsent snapshot; the tick callback replaces
+	// it rather than block the broadcast loop
+	pending := make(chan *pb.QuerySnapshot, 1)
+	var last int64
+	var replaced uint64 // broadcast loop only
+	watcher := s.hub.Watch(func(t *ws.Tick) {
+		if minInterval > 0 && t.Timestamp-last < minInterval {
+			return
+		}
+		tickSubs := subs
+		if req.View != "" {
+			viewSubs, ok := s.hub.Views().Get(req.View)
+			if !ok {
+				// Deleted after subscribing; send nothing, as the hub does
+				return
+			}
+			tickSubs = viewSubs
+		}
+		last = t.Timestamp
+
+		snap := buildSnapshot(t.Timestamp, t.Latest, t.Percentiles, tickSubs)
+		select {
+		case prev := <-pending:
+			replaced += prev.Skipped + 1
+		default:
+		}
+		snap.Skipped = replaced
+		replaced = 0
+		pending <- snap
+	}, req.MaxBytesPerSec)
+	defer watcher.Close()
+
+	var skipped uint64
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-watcher.Done():
+			return status.Error(codes.Unavailable, "aggregator is shutting down")
+		case snap := <-pending:
+			snap.Skipped += skipped
+			if !watcher.Allow(proto.Size(snap)) {
+				skipped = snap.Skipped + 1
+				continue
+			}
+			skipped = 0
+			if err := stream.Send(snap); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Report granularities
+const (
+	ByHour = "hour"
+	ByDay  = "day"
+)
+
+// Counts are the usage totals of one key over a period. For daily rollups
+// Services and Metrics report the busiest hour, since distinct sets are not
+// kept once an hour is closed.
+type Counts struct {
+	Batches  uint64 `json:"batches"`
+	Samples  uint64 `json:"samples"`
+	Bytes    uint64 `json:"bytes"`
+	Services int    `json:"services"`
+	Metrics  int    `json:"metrics"`
+}
+
+// Rollup is the usage of one key for one period
+type Rollup struct {
+	Key    string `json:"key"`
+	Period int64  `json:"period"` // unix seconds at the start of the period
+	Counts
+}
+
+// rollupKey identifies a closed hour
+type rollupKey struct {
+	key  string
+	hour int64
+}
+
+// hourBucket accumulates the current hour for one key
+type hourBucket struct {
+	hour     int64
+	counts   Counts
+	services map[string]struct{}
+	metrics  map[string]struct{}
+	warned   bool
+}
+
+// Tracker records per-key ingest usage with hourly rollups. Closed hours are
+// persisted to a JSON file so a restart loses at most the current hour.
+type Tracker struct {
+	path      string
+	retention time.Duration
+	quotas    map[string]uint64
+
+	current map[string]*hourBucket
+	rollups map[rollupKey]Counts
+	dirty   bool
+	mu      sync.Mutex
+
+	batches       *prometheus.CounterVec
+	samples       *prometheus.CounterVec
+	bytes         *prometheus.CounterVec
+	quotaExceeded *prometheus.CounterVec
+}
+
+// NewTracker creates a tracker persisting to path (empty keeps usage in
+// memory only). quotas maps key names to soft sample limits per hour.
+func NewTracker(path string, retention time.Duration, quotas map[string]uint64) (*Tracker, error) {
+	t := &Tracker{
+		path:      path,
+		retention: retention,
+		quotas:    quotas,
+		current:   make(map[string]*hourBucket),
+		rollups:   make(map[rollupKey]Counts),
+
+		batches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "aggregator_usage_batches_total",
+				Help: "Telemetry batches received per API key",
+			},
+			[]string{"key"},
+		),
+		samples: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "aggregator_usage_samples_total",
+				Help: "Samples received per API key",
+			},
+			[]string{"key"},
+		),
+		bytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "aggregator_usage_bytes_total",
+				Help: "Estimated batch bytes received per API key",
+			},
+			[]string{"key"},
+		),
+		quotaExceeded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "aggregator_usage_quota_exceeded_total",
+				Help: "Batches received while the key was over its soft quota",
+			},
+			[]string{"key"},
+		),
+	}
+
+	if path != "" {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Register registers the usage counters with Prometheus
+func (t *Tracker) Register() {
+	prometheus.MustRegister(t.batches, t.samples, t.bytes, t.quotaExceeded)
+}
+
+// Record adds one batch for key. metrics lists the batch's metric names. It
+// returns a warning when the key is over its soft quota for the hour.
+func (t *Tracker) Record(key, service string, metrics []string, samples, bytes int) string {
+	now := time.Now()
+
+	t.batches.WithLabelValues(key).Inc()
+	t.samples.WithLabelValues(key).Add(float64(samples))
+	t.bytes.WithLabelValues(key).Add(float64(bytes))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucket(key, hourOf(now))
+	b.counts.Batches++
+	b.counts.Samples += uint64(samples)
+	b.counts.Bytes += uint64(bytes)
+	b.services[service] = struct{}{}
+	for _, name := range metrics {
+		b.metrics[service+"/"+name] = struct{}{}
+	}
+
+	quota, ok := t.quotas[key]
+	if !ok || b.counts.Samples <= quota {
+		return ""
+	}
+	t.quotaExceeded.WithLabelValues(key).Inc()
+	if !b.warned {
+		b.warned = true
+		log.Printf("Usage: key %s exceeded its soft quota of %d samples/hour", key, quota)
+	}
+	return fmt.Sprintf("key %s is over its soft quota of %d samples/hour (%d sent)", key, quota, b.counts.Samples)
+}
+
+// bucket returns key's bucket for hour, closing the previous hour first
+func (t *Tracker) bucket(key string, hour int64) *hourBucket {
+	b, ok := t.current[key]
+	if ok && b.hour == hour {
+		return b
+	}
+	if ok {
+		t.close(key, b)
+	}
+	b = &hourBucket{
+		hour:     hour,
+		services: make(map[string]struct{}),
+		metrics:  make(map[string]struct{}),
+	}
+	t.current[key] = b
+	return b
+}
+
+// close moves a bucket into the rollups
+func (t *Tracker) close(key string, b *hourBucket) {
+	c := b.counts
+	c.Services = len(b.services)
+	c.Metrics = len(b.metrics)
+	t.merge(rollupKey{key: key, hour: b.hour}, c)
+	t.dirty = true
+}
+
+// merge adds c to a rollup. The same hour can be closed twice when the
+// aggregator restarts mid-hour.
+func (t *Tracker) merge(rk rollupKey, c Counts) {
+	prev := t.rollups[rk]
+	prev.Batches += c.Batches
+	prev.Samples += c.Samples
+	prev.Bytes += c.Bytes
+	prev.Services = max(prev.Services, c.Services)
+	prev.Metrics = max(prev.Metrics, c.Metrics)
+	t.rollups[rk] = prev
+}
+
+// Report returns usage per key and period (ByHour or ByDay), oldest first,
+// including the current partial hour. An empty key reports every key.
+func (t *Tracker) Report(key, by string) []Rollup {
+	period := int64(time.Hour / time.Second)
+	if by == ByDay {
+		period = int64(24 * time.Hour / time.Second)
+	}
+
+	t.mu.Lock()
+	periods := make(map[rollupKey]Counts)
+	add := func(k string, hour int64, c Counts) {
+		if key != "" && k != key {
+			return
+		}
+		pk := rollupKey{key: k, hour: hour - hour%period}
+		prev := periods[pk]
+		prev.Batches += c.Batches
+		prev.Samples += c.Samples
+		prev.Bytes += c.Bytes
+		prev.Services = max(prev.Services, c.Services)
+		prev.Metrics = max(prev.Metrics, c.Metrics)
+		periods[pk] = prev
+	}
+	for rk, c := range t.rollups {
+		add(rk.key, rk.hour, c)
+	}
+	for k, b := range t.current {
+		c := b.counts
+		c.Services = len(b.services)
+		c.Metrics = len(b.metrics)
+		add(k, b.hour, c)
+	}
+	t.mu.Unlock()
+
+	result := make([]Rollup, 0, len(periods))
+	for pk, c := range periods {
+		result = append(result, Rollup{Key: pk.key, Period: pk.hour, Counts: c})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Period != result[j].Period {
+			return result[i].Period < result[j].Period
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// Run closes finished hours, drops rollups past retention and persists the
+// store every interval
+func (t *Tracker) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.rotate(time.Now(), false)
+	}
+}
+
+// Flush persists everything including the current partial hour; call it on
+// shutdown
+func (t *Tracker) Flush() {
+	t.rotate(time.Now(), true)
+}
+
+// rotate closes stale buckets (all buckets when final) and saves if needed
+func (t *Tracker) rotate(now time.Time, final bool) {
+	hour := hourOf(now)
+	cutoff := now.Add(-t.retention).Unix()
+
+	t.mu.Lock()
+	for key, b := range t.current {
+		if final || b.hour != hour {
+			t.close(key, b)
+			delete(t.current, key)
+		}
+	}
+	for rk := range t.rollups {
+		if t.retention > 0 && rk.hour < cutoff {
+			delete(t.rollups, rk)
+			t.dirty = true
+		}
+	}
+	if !t.dirty || t.path == "" {
+		t.mu.Unlock()
+		return
+	}
+	data, err := t.encode()
+	t.dirty = false
+	t.mu.Unlock()
+
+	if err == nil {
+		err = writeFile(t.path, data)
+	}
+	if err != nil {
+		log.Printf("Usage: failed to save %s: %v", t.path, err)
+	}
+}
+
+// encode serializes the closed rollups; callers hold t.mu
+func (t *Tracker) encode() ([]byte, error) {
+	rollups := make([]Rollup, 0, len(t.rollups))
+	for rk, c := range t.rollups {
+		rollups = append(rollups, Rollup{Key: rk.key, Period: rk.hour, Counts: c})
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		if rollups[i].Period != rollups[j].Period {
+			return rollups[i].Period < rollups[j].Period
+		}
+		return rollups[i].Key < rollups[j].Key
+	})
+	return json.Marshal(struct {
+		Hours []Rollup `json:"hours"`
+	}{rollups})
+}
+
+// load reads previously saved rollups; a missing file is not an error
+func (t *Tracker) load() error {
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Hours []Rollup `json:"hours"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse %s: %w", t.path, err)
+	}
+	for _, r := range file.Hours {
+		t.merge(rollupKey{key: r.Key, hour: r.Period}, r.Counts)
+	}
+	log.Printf("Usage: loaded %d hourly rollups from %s", len(file.Hours), t.path)
+	return nil
+}
+
+// writeFile replaces path atomically
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func hourOf(t time.Time) int64 {
+	return t.Truncate(time.Hour).Unix()
+}
+
+// ParseQuotas parses soft quotas of the form "name=samples_per_hour,..."
+func ParseQuotas(s string) (map[string]uint64, error) {
+	quotas := make(map[string]uint64)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("quota %q: expected name=samples_per_hour", entry)
+		}
+		n, err := strconv.ParseUint(limit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("quota %q: %w", entry, err)
+		}
+		quotas[name] = n
+	}
+	return quotas, nil
+}
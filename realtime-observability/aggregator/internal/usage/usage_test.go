@@ -0,0 +1,70 @@
+package usage
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReportSeparatesKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	tracker, err := NewTracker(path, 0, map[string]uint64{"batch": 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// web pushes 10 small batches, batch 3 large ones across two services
+	for range 10 {
+		if warning := tracker.Record("web", "frontend", []string{"cpu", "requests_total"}, 20, 100); warning != "" {
+			t.Fatalf("web warned under no quota: %s", warning)
+		}
+	}
+	var warning string
+	for i := range 3 {
+		service := "etl"
+		if i == 2 {
+			service = "reports"
+		}
+		warning = tracker.Record("batch", service, []string{"rows_total"}, 200, 4000)
+	}
+	if warning == "" {
+		t.Fatal("batch's 600 samples did not pass its 500 quota")
+	}
+
+	want := map[string]Counts{
+		"web":   {Batches: 10, Samples: 200, Bytes: 1000, Services: 1, Metrics: 2},
+		"batch": {Batches: 3, Samples: 600, Bytes: 12000, Services: 2, Metrics: 2},
+	}
+	check := func(what string, tracker *Tracker) {
+		t.Helper()
+		got := make(map[string]Counts)
+		for _, r := range tracker.Report("", ByDay) {
+			c := got[r.Key]
+			c.Batches += r.Batches
+			c.Samples += r.Samples
+			c.Bytes += r.Bytes
+			c.Services = max(c.Services, r.Services)
+			c.Metrics = max(c.Metrics, r.Metrics)
+			got[r.Key] = c
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: report = %+v, want %+v", what, got, want)
+		}
+	}
+	check("live", tracker)
+
+	// A key filter reports that key alone
+	for _, r := range tracker.Report("web", ByHour) {
+		if r.Key != "web" {
+			t.Fatalf("Report(web) has %s", r.Key)
+		}
+	}
+
+	// Both keys survive a restart apart
+	tracker.Flush()
+	reloaded, err := NewTracker(path, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("reloaded", reloaded)
+}
@@ -0,0 +1,147 @@
+package ws
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// bandwidthSlots of bandwidthSlot each make up the one-second window
+	bandwidthSlots = 10
+	bandwidthSlot  = 100 * time.Millisecond
+
+	// connStatsInterval is how often budgeted clients get a conn_stats message
+	connStatsInterval = 5 * time.Second
+)
+
+// bandwidth enforces a client's bytes/sec budget over a sliding one-second
+// window. Snapshots that would exceed it are skipped; since every snapshot
+// carries the latest values, skipping a tick coalesces it into the next.
+type bandwidth struct {
+	budget int64 // bytes/sec, 0 = unlimited
+
+	slots [bandwidthSlots]int64
+	ids   [bandwidthSlots]int64
+
+	sent      uint64
+	skipped   uint64
+	lastStats time.Time
+	mu        sync.Mutex
+}
+
+// setBudget changes the budget, keeping the window's history
+func (b *bandwidth) setBudget(budget int64) {
+	b.mu.Lock()
+	b.budget = budget
+	b.mu.Unlock()
+}
+
+// inWindow returns the bytes recorded in the window ending at now; caller
+// holds b.mu
+func (b *bandwidth) inWindow(now time.Time) int64 {
+	id := now.UnixNano() / int64(bandwidthSlot)
+	var total int64
+	for i, slotID := range b.ids {
+		if id-slotID < bandwidthSlots {
+			total += b.slots[i]
+		}
+	}
+	return total
+}
+
+// record adds n bytes at now; caller holds b.mu
+func (b *bandwidth) record(now time.Time, n int) {
+	id := now.UnixNano() / int64(bandwidthSlot)
+	i := id % bandwidthSlots
+	if b.ids[i] != id {
+		b.ids[i] = id
+		b.slots[i] = 0
+	}
+	b.slots[i] += int64(n)
+}
+
+// allowSnapshot reports whether a snapshot of n bytes fits the budget and
+// records it if so. A snapshot larger than the whole budget is still let
+// through once the window is empty, so the client is slowed, not starved.
+func (b *bandwidth) allowSnapshot(now time.Time, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.budget > 0 {
+		used := b.inWindow(now)
+		if used+int64(n) > b.budget && used > 0 {
+			b.skipped++
+			return false
+		}
+	}
+	b.record(now, n)
+	b.sent++
+	return true
+}
+
+// count records bytes sent outside the snapshot path (errors, replies)
+func (b *bandwidth) count(n int) {
+	b.mu.Lock()
+	b.record(time.Now(), n)
+	b.mu.Unlock()
+}
+
+// statsMessage returns a conn_stats message when one is due for a budgeted
+// client and resets the tick counters
+func (b *bandwidth) statsMessage(now time.Time) map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.budget <= 0 || now.Sub(b.lastStats) < connStatsInterval {
+		return nil
+	}
+	if b.lastStats.IsZero() {
+		b.lastStats = now
+		return nil
+	}
+
+	level := "full"
+	var skippedRatio float64
+	if total := b.sent + b.skipped; total > 0 {
+		skippedRatio = float64(b.skipped) / float64(total)
+	}
+	if b.skipped > 0 {
+		level = "reduced"
+	}
+
+	msg := map[string]interface{}{
+		"type":                 "conn_stats",
+		"budget_bytes_per_sec": b.budget,
+		"bytes_per_sec":        b.inWindow(now),
+		"ticks_sent":           b.sent,
+		"ticks_coalesced":      b.skipped,
+		"coalesced_ratio":      skippedRatio,
+		"level":                level,
+	}
+	b.sent, b.skipped = 0, 0
+	b.lastStats = now
+	return msg
+}
+
+// clampBudget applies the server limits to a client-requested budget
+func (h *Hub) clampBudget(requested int64) int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if requested <= 0 {
+		return h.defaultBudget
+	}
+	if h.maxBudget > 0 && requested > h.maxBudget {
+		return h.maxBudget
+	}
+	return requested
+}
+
+// SetBandwidthLimits sets the default per-client budget in bytes/sec and
+// the most a client may request in its subscribe message (0 = unlimited)
+func (h *Hub) SetBandwidthLimits(defaultBudget, maxBudget int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.defaultBudget = defaultBudget
+	h.maxBudget = maxBudget
+}
@@ -0,0 +1,136 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+func TestBandwidthBudgetHolds(t *testing.T) {
+	const (
+		budget = 10_000
+		frame  = 1_200
+		tick   = 16 * time.Millisecond
+	)
+	b := &bandwidth{budget: budget}
+	start := time.Unix(1000, 0)
+	if b.statsMessage(start) != nil {
+		t.Fatal("conn_stats before a full interval")
+	}
+
+	type sent struct {
+		at   time.Time
+		tick int
+	}
+	var frames []sent
+	for i := range int(5 * time.Second / tick) {
+		now := start.Add(time.Duration(i) * tick)
+		if b.allowSnapshot(now, frame) {
+			frames = append(frames, sent{now, i})
+		}
+		// No window may carry more than the budget; it is kept in slots,
+		// so it spans at least a second less one slot
+		var inWindow int
+		for _, f := range frames {
+			if now.Sub(f.at) < time.Second-bandwidthSlot {
+				inWindow += frame
+			}
+		}
+		if inWindow > budget {
+			t.Fatalf("%d bytes sent in the window before %v, budget %d", inWindow, now.Sub(start), budget)
+		}
+	}
+
+	// Skipped ticks are coalesced, not starved: the stream keeps near the
+	// budget and never falls more than a window behind
+	if rate := len(frames) * frame / 5; rate < budget*7/10 {
+		t.Fatalf("%d bytes/sec sent, want close to the %d budget", rate, budget)
+	}
+	for i := 1; i < len(frames); i++ {
+		if gap := frames[i].at.Sub(frames[i-1].at); gap > time.Second {
+			t.Fatalf("%v between frames %d and %d", gap, frames[i-1].tick, frames[i].tick)
+		}
+	}
+
+	stats := b.statsMessage(start.Add(5 * time.Second))
+	if stats == nil || stats["level"] != "reduced" || stats["ticks_coalesced"].(uint64) == 0 {
+		t.Fatalf("conn_stats = %v, want a reduced level with coalesced ticks", stats)
+	}
+	if got := stats["ticks_sent"].(uint64); got != uint64(len(frames)) {
+		t.Fatalf("ticks_sent = %d, want %d", got, len(frames))
+	}
+}
+
+func TestOversizedFrameIsNotStarved(t *testing.T) {
+	b := &bandwidth{budget: 100}
+	now := time.Unix(1000, 0)
+	if !b.allowSnapshot(now, 500) {
+		t.Fatal("a frame over the budget was refused on an empty window")
+	}
+	if b.allowSnapshot(now.Add(500*time.Millisecond), 500) {
+		t.Fatal("a second frame was allowed within the window")
+	}
+	if !b.allowSnapshot(now.Add(time.Second), 500) {
+		t.Fatal("a frame was refused once the window emptied")
+	}
+}
+
+// TestSkippedTicksCarryNewestValue checks the hub: ticks over the budget
+// are skipped, and the next frame sent holds the newest value rather than
+// the one that was skipped
+func TestSkippedTicksCarryNewestValue(t *testing.T) {
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	ring := registry.GetRing("checkout", "cpu")
+	h := NewHub(registry)
+	client := &Client{
+		hub:        h,
+		send:       make(chan []byte, 4),
+		bw:         &bandwidth{budget: 1},
+		chunkReady: make(chan struct{}, 1),
+	}
+	client.version.Store(ProtocolV1)
+	h.clients[client] = true
+
+	latest := func() float64 {
+		t.Helper()
+		var msg snapshotMessage
+		select {
+		case data := <-client.send:
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			t.Fatal("no frame was sent")
+		}
+		val := msg.Gauges["checkout/cpu"].Val
+		if val == nil {
+			t.Fatalf("frame carries no cpu value: %+v", msg)
+		}
+		return *val
+	}
+
+	ring.Push(buffer.Sample{Ts: 1, Val: 1})
+	h.broadcastSnapshot()
+	if v := latest(); v != 1 {
+		t.Fatalf("first frame cpu = %v, want 1", v)
+	}
+	for i := 2; i <= 5; i++ {
+		ring.Push(buffer.Sample{Ts: int64(i), Val: float64(i)})
+		h.broadcastSnapshot()
+	}
+	if n := len(client.send); n != 0 {
+		t.Fatalf("%d frames sent over the budget", n)
+	}
+
+	// Empty the window, as a second passing would
+	client.bw.ids = [bandwidthSlots]int64{}
+	h.broadcastSnapshot()
+	if v := latest(); v != 5 {
+		t.Fatalf("frame after coalescing cpu = %v, want the newest 5", v)
+	}
+	if client.bw.skipped != 4 {
+		t.Fatalf("skipped = %d ticks, want 4", client.bw.skipped)
+	}
+}
@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// DefaultMaxFrameBytes is the snapshot size above which v2 clients get the
+// snapshot in chunks
+const DefaultMaxFrameBytes = 1 << 20
+
+// snapshotIDs numbers chunked snapshots across all clients
+var snapshotIDs atomic.Uint64
+
+// chunkSet is one snapshot split into frames; the write pump sends a set
+// back to back, and a newer set replaces one that has not started sending
+type chunkSet [][]byte
+
+// SetMaxFrameBytes sets the snapshot size above which v2 clients receive
+// chunk messages instead of one frame (0 disables chunking)
+func (h *Hub) SetMaxFrameBytes(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxFrameBytes = n
+}
+
+// chunkMessage splits an encoded message into chunk messages of roughly
+// max bytes each. Splits fall on UTF-8 boundaries so every piece is a valid
+// JSON string; concatenating the data fields restores msg exactly.
+func (c *Client) chunkMessage(msg []byte, max int) chunkSet {
+	// Leave room for the envelope and string escaping
+	piece := max / 2
+	if piece < 1024 {
+		piece = 1024
+	}
+
+	var pieces []string
+	for len(msg) > 0 {
+		n := min(piece, len(msg))
+		for n < len(msg) && !utf8.RuneStart(msg[n]) {
+			n--
+		}
+		pieces = append(pieces, string(msg[:n]))
+		msg = msg[n:]
+	}
+
+	id := snapshotIDs.Add(1)
+	set := make(chunkSet, len(pieces))
+	for i, p := range pieces {
+		set[i] = c.encode(map[string]interface{}{
+			"type":        "chunk",
+			"snapshot_id": id,
+			"part":        i + 1,
+			"of":          len(pieces),
+			"data":        p,
+		})
+	}
+	return set
+}
+
+// queueChunks stores a chunk set for the write pump, superseding any set
+// still waiting
+func (c *Client) queueChunks(set chunkSet) {
+	c.chunkMu.Lock()
+	c.chunks = set
+	c.chunkMu.Unlock()
+	select {
+	case c.chunkReady <- struct{}{}:
+	default:
+	}
+}
+
+// dropChunks discards a waiting chunk set; a newer whole snapshot has been
+// queued
+func (c *Client) dropChunks() {
+	c.chunkMu.Lock()
+	c.chunks = nil
+	c.chunkMu.Unlock()
+}
+
+// takeChunks returns and clears the waiting chunk set
+func (c *Client) takeChunks() chunkSet {
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+	set := c.chunks
+	c.chunks = nil
+	return set
+}
@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkedSnapshotReassembles(t *testing.T) {
+	// About 5MB of snapshot JSON, with multi-byte runes and characters
+	// JSON escapes spread across the piece boundaries
+	var payload bytes.Buffer
+	payload.WriteString(`{"type":"snapshot","gauges":{`)
+	for i := 0; payload.Len() < 5<<20; i++ {
+		if i > 0 {
+			payload.WriteByte(',')
+		}
+		fmt.Fprintf(&payload, `"caisse-été-日本/latency{route=\"/p/%d\"}":{"ts":%d,"val":%d.5}`, i, i*1e6, i)
+	}
+	payload.WriteString(`}}`)
+	msg := payload.Bytes()
+
+	client := &Client{}
+	client.version.Store(ProtocolV2)
+	set := client.chunkMessage(msg, DefaultMaxFrameBytes)
+	if len(set) < 5 {
+		t.Fatalf("%d byte snapshot split into %d chunks", len(msg), len(set))
+	}
+
+	var assembled bytes.Buffer
+	var id uint64
+	for i, frame := range set {
+		if len(frame) > DefaultMaxFrameBytes {
+			t.Fatalf("chunk %d is %d bytes, over the %d limit", i+1, len(frame), DefaultMaxFrameBytes)
+		}
+		var part struct {
+			Type       string `json:"type"`
+			SnapshotID uint64 `json:"snapshot_id"`
+			Part       int    `json:"part"`
+			Of         int    `json:"of"`
+			Data       string `json:"data"`
+			Version    int32  `json:"version"`
+		}
+		if err := json.Unmarshal(frame, &part); err != nil {
+			t.Fatalf("chunk %d: %v", i+1, err)
+		}
+		if i == 0 {
+			id = part.SnapshotID
+		}
+		if part.Type != "chunk" || part.SnapshotID != id || part.Part != i+1 || part.Of != len(set) || part.Version != ProtocolV2 {
+			t.Fatalf("chunk %d = %s %d part %d of %d v%d, want chunk %d part %d of %d v%d",
+				i+1, part.Type, part.SnapshotID, part.Part, part.Of, part.Version, id, i+1, len(set), ProtocolV2)
+		}
+		if !utf8.ValidString(part.Data) {
+			t.Fatalf("chunk %d splits a rune", i+1)
+		}
+		assembled.WriteString(part.Data)
+	}
+	if !bytes.Equal(assembled.Bytes(), msg) {
+		t.Fatalf("reassembled %d bytes differ from the %d byte snapshot", assembled.Len(), len(msg))
+	}
+
+	// A later snapshot gets a new id
+	var next struct {
+		SnapshotID uint64 `json:"snapshot_id"`
+	}
+	if err := json.Unmarshal(client.chunkMessage(msg[:4096], 2048)[0], &next); err != nil || next.SnapshotID == id {
+		t.Fatalf("next chunk set has snapshot id %d (%v), want a new one", next.SnapshotID, err)
+	}
+}
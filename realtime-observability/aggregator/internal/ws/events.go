@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// eventMessage is the "event" server message, one per agent event
+type eventMessage struct {
+	Type    string `json:"type"`
+	Version int32  `json:"version"`
+	Service string `json:"service"`
+	buffer.Event
+}
+
+// BroadcastEvents forwards new events of a service to v2 clients whose
+// subscriptions or view include the service, or that subscribed to
+// nothing. v1 clients predate the message type and never get it. Events
+// are counted against a client's bandwidth but never skipped for it; a
+// full send buffer drops them, as it does replies.
+func (h *Hub) BroadcastEvents(service string, events []buffer.Event) {
+	if len(events) == 0 {
+		return
+	}
+	// Encoded once per protocol version in use
+	encoded := make(map[int32][][]byte, 1)
+	encode := func(version int32) [][]byte {
+		if data, ok := encoded[version]; ok {
+			return data
+		}
+		data := make([][]byte, 0, len(events))
+		for _, e := range events {
+			data = append(data, marshal(&eventMessage{
+				Type:    "event",
+				Version: version,
+				Service: service,
+				Event:   e,
+			}))
+		}
+		encoded[version] = data
+		return data
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.clients {
+		version := client.version.Load()
+		if version < ProtocolV2 || !h.wantsService(client, service) {
+			continue
+		}
+		for _, data := range encode(version) {
+			select {
+			case client.send <- data:
+				client.bw.count(len(data))
+			default:
+			}
+		}
+	}
+}
+
+// wantsService reports whether a client's subscriptions cover any metric
+// of service; a client without subscriptions gets everything
+func (h *Hub) wantsService(client *Client, service string) bool {
+	client.subMu.RLock()
+	subs, view := client.subs, client.view
+	client.subMu.RUnlock()
+
+	if view != "" {
+		viewSubs, ok := h.views.Get(view)
+		if !ok {
+			return false
+		}
+		subs = viewSubs
+	}
+	if len(subs) == 0 {
+		return true
+	}
+	for _, sub := range subs {
+		if sub.Service == service {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package ws
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+const (
+	// defaultHistoryWindow is used when a history request omits window_ms
+	defaultHistoryWindow = time.Minute
+
+	// defaultHistoryPercentile turns histogram windows into values when a
+	// history request omits percentile
+	defaultHistoryPercentile = 50
+)
+
+// HistoryRequest asks for the recent samples of one series, to backfill a
+// chart before snapshots take over
+type HistoryRequest struct {
+	Service  string `json:"service"`
+	Metric   string `json:"metric"`
+	WindowMs int64  `json:"window_ms,omitempty"`
+	// Fill is none, previous or zero, see buffer.FillPolicy
+	Fill string `json:"fill,omitempty"`
+	// GapFactor overrides the hub's, see SetGapFactor
+	GapFactor float64 `json:"gap_factor,omitempty"`
+	// Percentile is read from each histogram window
+	Percentile float64 `json:"percentile,omitempty"`
+}
+
+// HistoryPoint is one sample of a history reply. Val is null where the
+// line must break; Filled marks a value the fill policy made up.
+type HistoryPoint struct {
+	Ts     int64    `json:"ts"`
+	Val    *float64 `json:"val"`
+	Filled bool     `json:"filled,omitempty"`
+}
+
+// SetGapFactor sets how many typical intervals apart samples must be for
+// history replies to report a gap between them
+func (h *Hub) SetGapFactor(factor float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.gapFactor = factor
+}
+
+// history builds the reply to a history request, or returns an error
+// code and message
+func (h *Hub) history(req HistoryRequest) (map[string]interface{}, string, string) {
+	fill, err := buffer.ParseFillPolicy(req.Fill)
+	if err != nil {
+		return nil, "invalid_history", err.Error()
+	}
+	window := time.Duration(req.WindowMs) * time.Millisecond
+	if window <= 0 {
+		window = defaultHistoryWindow
+	}
+	factor := req.GapFactor
+	if factor == 0 {
+		h.mu.RLock()
+		factor = h.gapFactor
+		h.mu.RUnlock()
+	}
+	if factor < 1 {
+		return nil, "invalid_history", "gap_factor must be at least 1"
+	}
+	q := req.Percentile
+	if q == 0 {
+		q = defaultHistoryPercentile
+	}
+	if q < 0 || q > 100 {
+		return nil, "invalid_history", "percentile must be in (0, 100]"
+	}
+
+	now := time.Now().UnixNano()
+	since := now - int64(window)
+	var kind string
+	var values []buffer.Sample
+	var gaps []buffer.Gap
+	if ring, ok := h.registry.FindRing(req.Service, req.Metric); ok {
+		kind, values = "gauge", ring.Snapshot()
+		gaps = buffer.FindGaps(values, factor, now)
+	} else if ring, ok := h.registry.FindCounterRing(req.Service, req.Metric); ok {
+		kind, values = "counter", ring.Snapshot()
+		gaps = buffer.FindGaps(values, factor, now)
+	} else if ring, ok := h.registry.FindHistogramRing(req.Service, req.Metric); ok {
+		windows := ring.Snapshot()
+		kind = "histogram"
+		gaps = buffer.FindHistogramGaps(windows, factor, now)
+		for _, w := range windows {
+			v := buffer.Sample{Ts: w.Ts, Marker: w.Marker}
+			if !w.IsMarker() {
+				v.Val = buffer.Percentile(w.Bounds, w.Counts, q)
+			}
+			values = append(values, v)
+		}
+	} else {
+		return nil, "unknown_series", fmt.Sprintf("no series %s/%s", req.Service, req.Metric)
+	}
+
+	var inWindow []buffer.Gap
+	for _, g := range gaps {
+		if g.To > since {
+			inWindow = append(inWindow, g)
+		}
+	}
+	return map[string]interface{}{
+		"type":    "history",
+		"service": req.Service,
+		"metric":  req.Metric,
+		"kind":    kind,
+		"fill":    fill,
+		"points":  historyPoints(values, inWindow, fill, since),
+		"gaps":    nonNil(inWindow),
+	}, "", ""
+}
+
+// historyPoints returns the samples since since with each gap drawn by
+// the fill policy: FillNone puts a null just after the last sample before
+// the gap, FillPrevious repeats that sample's value just before the first
+// after it, and FillZero drops to zero over the gap. Markers are left out.
+func historyPoints(samples []buffer.Sample, gaps []buffer.Gap, fill buffer.FillPolicy, since int64) []HistoryPoint {
+	points := []HistoryPoint{}
+	var prev *float64
+	for _, s := range samples {
+		if s.IsMarker() {
+			continue
+		}
+		for len(gaps) > 0 && gaps[0].To <= s.Ts {
+			points = appendGap(points, gaps[0], fill, prev, since)
+			gaps = gaps[1:]
+		}
+		val := s.Val
+		prev = &val
+		if s.Ts >= since {
+			points = append(points, HistoryPoint{Ts: s.Ts, Val: &val})
+		}
+	}
+	for _, g := range gaps {
+		points = appendGap(points, g, fill, prev, since)
+	}
+	return points
+}
+
+// appendGap adds the points that draw gap g, those before since excepted
+func appendGap(points []HistoryPoint, g buffer.Gap, fill buffer.FillPolicy, prev *float64, since int64) []HistoryPoint {
+	var add []HistoryPoint
+	switch {
+	case fill == buffer.FillPrevious && prev != nil:
+		add = []HistoryPoint{{Ts: g.To - 1, Val: prev, Filled: true}}
+	case fill == buffer.FillZero:
+		zero := 0.0
+		add = []HistoryPoint{{Ts: g.From + 1, Val: &zero, Filled: true}, {Ts: g.To - 1, Val: &zero, Filled: true}}
+	default:
+		add = []HistoryPoint{{Ts: g.From + 1}}
+	}
+	for _, p := range add {
+		if p.Ts >= since {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// nonNil returns gaps, or an empty slice so it encodes as []
+func nonNil(gaps []buffer.Gap) []buffer.Gap {
+	if gaps == nil {
+		return []buffer.Gap{}
+	}
+	return gaps
+}
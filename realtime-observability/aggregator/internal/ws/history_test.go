@@ -0,0 +1,64 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+func TestHistoryGaps(t *testing.T) {
+	const s = int64(time.Second)
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	base := time.Now().UnixNano() - 30*s
+	ring := registry.GetRing("checkout", "queue")
+	// A sample a second, with nothing from 10s to 20s
+	for i := range int64(30) {
+		if i < 10 || i >= 20 {
+			ring.Push(buffer.Sample{Ts: base + i*s, Val: float64(i + 1)})
+		}
+	}
+	h := NewHub(registry)
+
+	for _, tc := range []struct {
+		fill string
+		want []HistoryPoint
+	}{
+		{"none", []HistoryPoint{{Ts: base + 9*s + 1}}},
+		{"previous", []HistoryPoint{{Ts: base + 20*s - 1, Val: ptr(10), Filled: true}}},
+		{"zero", []HistoryPoint{{Ts: base + 9*s + 1, Val: ptr(0), Filled: true}, {Ts: base + 20*s - 1, Val: ptr(0), Filled: true}}},
+	} {
+		reply, code, msg := h.history(HistoryRequest{Service: "checkout", Metric: "queue", WindowMs: 60000, Fill: tc.fill})
+		if reply == nil {
+			t.Fatalf("fill %s: %s: %s", tc.fill, code, msg)
+		}
+		gaps := reply["gaps"].([]buffer.Gap)
+		if len(gaps) != 1 || gaps[0] != (buffer.Gap{From: base + 9*s, To: base + 20*s}) {
+			t.Fatalf("fill %s: gaps = %v, want 9s to 20s", tc.fill, gaps)
+		}
+		points := reply["points"].([]HistoryPoint)
+		if len(points) != 20+len(tc.want) {
+			t.Fatalf("fill %s: %d points, want %d", tc.fill, len(points), 20+len(tc.want))
+		}
+		for i, want := range tc.want {
+			got := points[10+i]
+			if got.Ts != want.Ts || got.Filled != want.Filled || (got.Val == nil) != (want.Val == nil) || (got.Val != nil && *got.Val != *want.Val) {
+				t.Errorf("fill %s: gap point %d = %+v, want %+v", tc.fill, i, got, want)
+			}
+		}
+		if last := points[len(points)-1]; last.Ts != base+29*s || *last.Val != 30 {
+			t.Errorf("fill %s: last point = %+v, want the sample at 29s", tc.fill, last)
+		}
+	}
+
+	if reply, code, _ := h.history(HistoryRequest{Service: "checkout", Metric: "nope"}); reply != nil || code != "unknown_series" {
+		t.Errorf("unknown series: code = %q", code)
+	}
+	if reply, code, _ := h.history(HistoryRequest{Service: "checkout", Metric: "queue", Fill: "linear"}); reply != nil || code != "invalid_history" {
+		t.Errorf("fill linear: code = %q", code)
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
@@ -2,13 +2,17 @@ package ws
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/internal/pipeline"
 )
 
 var upgrader = websocket.Upgrader{
@@ -17,12 +21,25 @@ var upgrader = websocket.Upgrader{
 	},
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    subprotocols(),
 }
 
+// RateWindow is the window of the rate sent with each counter
+const RateWindow = 10 * time.Second
+
 // Subscription defines what metrics a client wants to receive
 type Subscription struct {
 	Service string `json:"service"`
 	Metric  string `json:"metric"`
+
+	// Instance, if set, asks for that instance's gauge or counter instead
+	// of the service's aggregate; it is keyed service@instance/metric
+	Instance string `json:"instance,omitempty"`
+
+	// Percentiles requests server-computed quantiles (0-100] of a
+	// histogram, merged over the last WindowMs (default 5000)
+	Percentiles []float64 `json:"percentiles,omitempty"`
+	WindowMs    int64     `json:"window_ms,omitempty"`
 }
 
 // Client represents a WebSocket client connection
@@ -31,36 +48,101 @@ type Client struct {
 	conn  *websocket.Conn
 	send  chan []byte
 	subs  []Subscription
+	view  string // named view resolved on every snapshot; overrides subs
 	subMu sync.RWMutex
+
+	bw *bandwidth
+
+	// version is the negotiated protocol version, see protocol.go
+	version atomic.Int32
+
+	// chunks is an oversized snapshot waiting for the write pump, see chunk.go
+	chunks     chunkSet
+	chunkMu    sync.Mutex
+	chunkReady chan struct{}
+
+	// built is the build time of the newest queued snapshot, cleared
+	// once it is written
+	built atomic.Int64
 }
 
 // Hub maintains the set of active clients and broadcasts messages
 type Hub struct {
 	registry   *buffer.Registry
+	views      *ViewStore
 	clients    map[*Client]bool
+	watchers   map[*Watcher]bool
 	broadcast  chan []byte
 	register   chan *Client
 	unregister chan *Client
 	updates    chan string
 	mu         sync.RWMutex
+
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// per-client bandwidth budgets in bytes/sec (0 = unlimited)
+	defaultBudget int64
+	maxBudget     int64
+
+	// snapshots above this many bytes are chunked for v2 clients
+	maxFrameBytes int
+
+	// gapFactor is history replies' gap factor, see SetGapFactor
+	gapFactor float64
+
+	// latest is refilled every tick; only the broadcast loop touches it
+	latest buffer.LatestSnapshot
+
+	latency *pipeline.Latency
 }
 
 // NewHub creates a new WebSocket hub
 func NewHub(registry *buffer.Registry) *Hub {
 	return &Hub{
 		registry:   registry,
+		views:      NewViewStore(),
 		clients:    make(map[*Client]bool),
+		watchers:   make(map[*Watcher]bool),
 		broadcast:  make(chan []byte, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		updates:    make(chan string, 1000),
+		done:       make(chan struct{}),
+		latency:    pipeline.NewLatency(),
+
+		maxFrameBytes: DefaultMaxFrameBytes,
+		gapFactor:     buffer.DefaultGapFactor,
 	}
 }
 
+// Views returns the hub's named view definitions
+func (h *Hub) Views() *ViewStore {
+	return h.views
+}
+
+// Latency returns the ingest-to-broadcast latency recorder
+func (h *Hub) Latency() *pipeline.Latency {
+	return h.latency
+}
+
 // Run starts the hub's main event loop
 func (h *Hub) Run() {
 	for {
 		select {
+		case <-h.done:
+			h.mu.Lock()
+			for client := range h.clients {
+				delete(h.clients, client)
+				close(client.send)
+			}
+			for w := range h.watchers {
+				delete(h.watchers, w)
+				w.close()
+			}
+			h.mu.Unlock()
+			return
+
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client] = true
@@ -81,6 +163,7 @@ func (h *Hub) Run() {
 			for client := range h.clients {
 				select {
 				case client.send <- message:
+					client.bw.count(len(message))
 				default:
 					// Client buffer full, skip
 				}
@@ -95,117 +178,288 @@ func (h *Hub) StartBroadcastLoop(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		h.broadcastSnapshot()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.broadcastSnapshot()
+		}
 	}
 }
 
+// Stop ends the hub and broadcast loops and disconnects all clients
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+}
+
 // broadcastSnapshot sends current metrics to all subscribed clients
 func (h *Hub) broadcastSnapshot() {
-	snapshot := h.registry.LatestSnapshot()
+	built := h.latency.Now()
+	h.latency.Built(built)
+	h.registry.LatestSnapshotInto(&h.latest)
+	tick := &broadcastTick{
+		registry:    h.registry,
+		snapshot:    h.latest,
+		percentiles: NewPercentileCache(h.registry),
+		timestamp:   time.Now().UnixNano(),
+		received:    h.latency.Received(),
+		built:       built.UnixNano(),
+	}
 
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
+	h.notifyWatchers(tick)
+
+	now := time.Now()
 	for client := range h.clients {
-		msg := h.buildClientMessage(client, snapshot)
-		if msg != nil {
+		if stats := client.bw.statsMessage(now); stats != nil {
 			select {
-			case client.send <- msg:
+			case client.send <- client.encode(stats):
 			default:
-				// Skip if buffer full
 			}
 		}
+
+		msg := h.buildClientMessage(client, tick)
+		if msg == nil || !client.bw.allowSnapshot(now, len(msg)) {
+			// Over budget: skip this tick, the next snapshot carries the
+			// newest values
+			continue
+		}
+		if h.maxFrameBytes > 0 && len(msg) > h.maxFrameBytes && client.version.Load() >= ProtocolV2 {
+			client.built.Store(tick.built)
+			client.queueChunks(client.chunkMessage(msg, h.maxFrameBytes))
+			continue
+		}
+		client.dropChunks()
+		select {
+		case client.send <- msg:
+			client.built.Store(tick.built)
+		default:
+			// Skip if buffer full
+		}
 	}
 }
 
+// broadcastTick is the state shared by every client in one broadcast
+type broadcastTick struct {
+	registry    *buffer.Registry
+	snapshot    buffer.LatestSnapshot
+	percentiles *PercentileCache
+	timestamp   int64
+
+	// received is when the newest ingested batch arrived and built when
+	// this tick started, on the latency recorder's clock
+	received int64
+	built    int64
+
+	// full is the unfiltered message, encoded once per protocol version
+	// for all clients without subscriptions
+	full    *snapshotMessage
+	encoded map[int32][]byte
+
+	// rates holds each counter's rate once computed, nil when it has none
+	rates map[buffer.MetricKey]*float64
+}
+
+// rate returns a counter's rate over RateWindow, computed once per tick
+func (t *broadcastTick) rate(key buffer.MetricKey) *float64 {
+	if r, ok := t.rates[key]; ok {
+		return r
+	}
+	if t.rates == nil {
+		t.rates = make(map[buffer.MetricKey]*float64)
+	}
+	var result *float64
+	if r, ok := t.registry.CounterRate(key.Service, key.Name, RateWindow); ok {
+		result = &r
+	}
+	t.rates[key] = result
+	return result
+}
+
+// fullMessage returns the encoded unfiltered snapshot for a version
+func (t *broadcastTick) fullMessage(version int32) []byte {
+	if data, ok := t.encoded[version]; ok {
+		return data
+	}
+	if t.full == nil {
+		t.full = &snapshotMessage{
+			Type:       "snapshot",
+			Timestamp:  t.timestamp,
+			Received:   t.received,
+			Gauges:     make(map[string]samplePayload, len(t.snapshot.Gauges)),
+			Counters:   make(map[string]samplePayload, len(t.snapshot.Counters)),
+			Histograms: make(map[string]histogramPayload, len(t.snapshot.Histograms)),
+		}
+		for key, sample := range t.snapshot.Gauges {
+			t.full.Gauges[key.String()] = newSamplePayload(sample)
+		}
+		for key, sample := range t.snapshot.Counters {
+			t.full.Counters[key.String()] = newCounterPayload(sample, t.rate(key))
+		}
+		for key, hist := range t.snapshot.Histograms {
+			t.full.Histograms[key.String()] = newHistogramPayload(hist, t.snapshot.Exemplars[key])
+		}
+		t.encoded = make(map[int32][]byte, 2)
+	}
+	data := encodeSnapshot(version, t.full)
+	t.encoded[version] = data
+	return data
+}
+
 // buildClientMessage creates a message for a specific client based on subscriptions
-func (h *Hub) buildClientMessage(client *Client, snapshot buffer.LatestSnapshot) []byte {
+func (h *Hub) buildClientMessage(client *Client, tick *broadcastTick) []byte {
 	client.subMu.RLock()
 	defer client.subMu.RUnlock()
 
-	if len(client.subs) == 0 {
+	subs := client.subs
+	if client.view != "" {
+		viewSubs, ok := h.views.Get(client.view)
+		if !ok {
+			// View was deleted after subscribing; send nothing rather
+			// than falling back to the unfiltered stream
+			return nil
+		}
+		subs = viewSubs
+	}
+
+	if len(subs) == 0 {
 		// No subscriptions, send all
-		data, _ := json.Marshal(map[string]interface{}{
-			"type":       "snapshot",
-			"timestamp":  time.Now().UnixNano(),
-			"gauges":     convertGauges(snapshot.Gauges),
-			"counters":   convertCounters(snapshot.Counters),
-			"histograms": convertHistograms(snapshot.Histograms),
-		})
-		return data
+		return tick.fullMessage(client.version.Load())
 	}
 
 	// Filter by subscriptions
-	gauges := make(map[string]interface{})
-	counters := make(map[string]interface{})
-	histograms := make(map[string]interface{})
-
-	for _, sub := range client.subs {
+	msg := &snapshotMessage{
+		Type:       "snapshot",
+		Timestamp:  tick.timestamp,
+		Received:   tick.received,
+		Gauges:     make(map[string]samplePayload, len(subs)),
+		Counters:   make(map[string]samplePayload, len(subs)),
+		Histograms: make(map[string]histogramPayload, len(subs)),
+	}
+	snapshot := tick.snapshot
+	for _, sub := range subs {
+		if sub.Instance != "" {
+			h.addInstance(msg, sub)
+			continue
+		}
 		key := buffer.MetricKey{Service: sub.Service, Name: sub.Metric}
+		name := key.String()
 		if g, ok := snapshot.Gauges[key]; ok {
-			gauges[key.String()] = map[string]interface{}{
-				"ts":  g.Ts,
-				"val": g.Val,
-			}
+			msg.Gauges[name] = newSamplePayload(g)
 		}
 		if c, ok := snapshot.Counters[key]; ok {
-			counters[key.String()] = map[string]interface{}{
-				"ts":  c.Ts,
-				"val": c.Val,
-			}
+			msg.Counters[name] = newCounterPayload(c, tick.rate(key))
 		}
 		if hist, ok := snapshot.Histograms[key]; ok {
-			histograms[key.String()] = map[string]interface{}{
-				"ts":     hist.Ts,
-				"bounds": hist.Bounds,
-				"counts": hist.Counts,
+			msg.Histograms[name] = newHistogramPayload(hist, snapshot.Exemplars[key])
+		}
+		if len(sub.Percentiles) > 0 {
+			if msg.Percentiles == nil {
+				msg.Percentiles = make(map[string]PercentileValue)
 			}
+			tick.percentiles.Add(sub, msg.Percentiles)
 		}
 	}
-
-	data, _ := json.Marshal(map[string]interface{}{
-		"type":       "snapshot",
-		"timestamp":  time.Now().UnixNano(),
-		"gauges":     gauges,
-		"counters":   counters,
-		"histograms": histograms,
-	})
-	return data
+	return encodeSnapshot(client.version.Load(), msg)
 }
 
-func convertGauges(gauges map[buffer.MetricKey]buffer.Sample) map[string]interface{} {
-	result := make(map[string]interface{})
-	for key, sample := range gauges {
-		result[key.String()] = map[string]interface{}{
-			"ts":  sample.Ts,
-			"val": sample.Val,
+// addInstance adds an instance's latest gauge or counter value to msg
+func (h *Hub) addInstance(msg *snapshotMessage, sub Subscription) {
+	name := buffer.InstanceKey{Service: sub.Service, Instance: sub.Instance, Name: sub.Metric}.String()
+	if ring, ok := h.registry.FindInstanceRing(sub.Service, sub.Instance, sub.Metric); ok {
+		if g, ok := ring.Latest(); ok {
+			msg.Gauges[name] = newSamplePayload(g)
+		}
+	}
+	if ring, ok := h.registry.FindInstanceCounterRing(sub.Service, sub.Instance, sub.Metric); ok {
+		if c, ok := ring.Latest(); ok {
+			var rate *float64
+			if r, ok := ring.RatePerSecond(RateWindow); ok {
+				rate = &r
+			}
+			msg.Counters[name] = newCounterPayload(c, rate)
 		}
 	}
-	return result
 }
 
-func convertCounters(counters map[buffer.MetricKey]buffer.Sample) map[string]interface{} {
-	result := make(map[string]interface{})
-	for key, sample := range counters {
-		result[key.String()] = map[string]interface{}{
-			"ts":  sample.Ts,
-			"val": sample.Val,
-		}
+// snapshotMessage is the "snapshot" server message
+type snapshotMessage struct {
+	Type        string                      `json:"type"`
+	Version     int32                       `json:"version,omitempty"`
+	Timestamp   int64                       `json:"timestamp"`
+	Received    int64                       `json:"received,omitempty"` // newest batch receipt, UnixNano
+	Gauges      map[string]samplePayload    `json:"gauges"`
+	Counters    map[string]samplePayload    `json:"counters"`
+	Histograms  map[string]histogramPayload `json:"histograms"`
+	Percentiles map[string]PercentileValue  `json:"percentiles,omitempty"`
+}
+
+// samplePayload is a gauge or counter value. Gap markers carry a null
+// value and the marker name so charts can break the line.
+type samplePayload struct {
+	Ts     int64    `json:"ts"`
+	Val    *float64 `json:"val"`
+	Marker string   `json:"marker,omitempty"`
+
+	// Exact is a counter's value as a decimal string: JSON numbers are
+	// float64 to most consumers and lose precision past 2^53
+	Exact string `json:"exact,omitempty"`
+
+	// Rate is a counter's per-second increase over RateWindow, resets
+	// handled, when it has two samples in it
+	Rate *float64 `json:"rate,omitempty"`
+}
+
+// histogramPayload is a histogram value with any recent slow-request
+// exemplars
+type histogramPayload struct {
+	Ts        int64             `json:"ts"`
+	Bounds    []float64         `json:"bounds"`
+	Counts    []uint64          `json:"counts"`
+	Marker    string            `json:"marker,omitempty"`
+	Sum       *float64          `json:"sum,omitempty"`
+	Count     *uint64           `json:"count,omitempty"`
+	Exemplars []buffer.Exemplar `json:"exemplars,omitempty"`
+}
+
+func newSamplePayload(s buffer.Sample) samplePayload {
+	if s.IsMarker() {
+		return samplePayload{Ts: s.Ts, Marker: s.Marker.String()}
 	}
-	return result
+	val := s.Val
+	return samplePayload{Ts: s.Ts, Val: &val}
 }
 
-func convertHistograms(histograms map[buffer.MetricKey]buffer.HistogramData) map[string]interface{} {
-	result := make(map[string]interface{})
-	for key, hist := range histograms {
-		result[key.String()] = map[string]interface{}{
-			"ts":     hist.Ts,
-			"bounds": hist.Bounds,
-			"counts": hist.Counts,
-		}
+func newCounterPayload(s buffer.Sample, rate *float64) samplePayload {
+	payload := newSamplePayload(s)
+	payload.Rate = rate
+	if !s.IsMarker() && !s.Float {
+		payload.Exact = strconv.FormatUint(s.Count, 10)
 	}
-	return result
+	return payload
+}
+
+func newHistogramPayload(hist buffer.HistogramData, exemplars []buffer.Exemplar) histogramPayload {
+	payload := histogramPayload{
+		Ts:        hist.Ts,
+		Bounds:    hist.Bounds,
+		Counts:    hist.Counts,
+		Exemplars: exemplars,
+	}
+	if hist.IsMarker() {
+		payload.Marker = hist.Marker.String()
+	}
+	if hist.HasSum {
+		sum, count := hist.Sum, hist.Count
+		payload.Sum = &sum
+		payload.Count = &count
+	}
+	return payload
 }
 
 // NotifyUpdate signals that new data is available for a service
@@ -230,14 +484,27 @@ func (h *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.mu.RLock()
+	budget := h.defaultBudget
+	h.mu.RUnlock()
+
 	client := &Client{
 		hub:  h,
 		conn: conn,
 		send: make(chan []byte, 256),
 		subs: []Subscription{},
+		bw:   &bandwidth{budget: budget},
+
+		chunkReady: make(chan struct{}, 1),
 	}
+	client.version.Store(int32(protocolFromSubprotocol(conn.Subprotocol())))
 
-	h.register <- client
+	select {
+	case h.register <- client:
+	case <-h.done:
+		conn.Close()
+		return
+	}
 
 	go client.writePump()
 	go client.readPump()
@@ -246,7 +513,10 @@ func (h *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 // readPump handles incoming messages from client
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 		c.conn.Close()
 	}()
 
@@ -270,16 +540,96 @@ func (c *Client) readPump() {
 		var msg struct {
 			Type string         `json:"type"`
 			Subs []Subscription `json:"subscriptions"`
+			Name string         `json:"name"`
+
+			// MaxBytesPerSec requests a bandwidth budget, capped by the
+			// server limit
+			MaxBytesPerSec int64 `json:"max_bytes_per_sec"`
+
+			// Version is the newest protocol the client speaks (hello)
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal(message, &msg); err != nil {
+			c.sendError("invalid_message", "message is not valid JSON")
+			continue
 		}
-		if err := json.Unmarshal(message, &msg); err == nil && msg.Type == "subscribe" {
+
+		switch msg.Type {
+		case "subscribe":
+			for i := range msg.Subs {
+				msg.Subs[i].Percentiles = ValidPercentiles(msg.Subs[i].Percentiles)
+			}
 			c.subMu.Lock()
 			c.subs = msg.Subs
+			c.view = ""
 			c.subMu.Unlock()
+			c.bw.setBudget(c.hub.clampBudget(msg.MaxBytesPerSec))
 			log.Printf("Client subscribed to %d metrics", len(msg.Subs))
+
+		case "subscribe_view":
+			if _, ok := c.hub.views.Get(msg.Name); !ok {
+				c.sendError("unknown_view", fmt.Sprintf("no view named %q", msg.Name))
+				continue
+			}
+			c.subMu.Lock()
+			c.subs = nil
+			c.view = msg.Name
+			c.subMu.Unlock()
+			c.bw.setBudget(c.hub.clampBudget(msg.MaxBytesPerSec))
+			log.Printf("Client subscribed to view %s", msg.Name)
+
+		case "catalog":
+			c.queue(c.encode(map[string]interface{}{
+				"type":    "catalog",
+				"metrics": c.hub.registry.Catalog(),
+			}))
+
+		case "hello":
+			c.handleHello(msg.Version)
+
+		case "history":
+			var req HistoryRequest
+			if err := json.Unmarshal(message, &req); err != nil {
+				c.sendError("invalid_message", "history request is not valid")
+				continue
+			}
+			reply, code, errMsg := c.hub.history(req)
+			if reply == nil {
+				c.sendError(code, errMsg)
+				continue
+			}
+			c.queue(c.encode(reply))
+
+		default:
+			c.sendError("unknown_type", fmt.Sprintf("unknown message type %q", msg.Type))
 		}
 	}
 }
 
+// sendError queues a structured error message for the client
+func (c *Client) sendError(code, message string) {
+	c.queue(c.encode(map[string]interface{}{
+		"type":    "error",
+		"code":    code,
+		"message": message,
+	}))
+}
+
+// queue sends a reply to this client outside the broadcast path
+func (c *Client) queue(data []byte) {
+	// Hold the hub lock so the send channel cannot be closed underneath us
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	if !c.hub.clients[c] {
+		return
+	}
+	select {
+	case c.send <- data:
+		c.bw.count(len(data))
+	default:
+	}
+}
+
 // writePump handles outgoing messages to client
 func (c *Client) writePump() {
 	ticker := time.NewTicker(30 * time.Second)
@@ -313,6 +663,17 @@ func (c *Client) writePump() {
 			if err := w.Close(); err != nil {
 				return
 			}
+			c.wrote()
+
+		case <-c.chunkReady:
+			// A chunk set goes out frame by frame with nothing in between
+			for _, chunk := range c.takeChunks() {
+				c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if err := c.conn.WriteMessage(websocket.TextMessage, chunk); err != nil {
+					return
+				}
+			}
+			c.wrote()
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
@@ -322,3 +683,10 @@ func (c *Client) writePump() {
 		}
 	}
 }
+
+// wrote records pipeline latency for a written snapshot, if one was queued
+func (c *Client) wrote() {
+	if built := c.built.Swap(0); built != 0 {
+		c.hub.latency.Written(built)
+	}
+}
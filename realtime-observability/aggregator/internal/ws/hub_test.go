@@ -0,0 +1,81 @@
+package ws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// benchHub returns a hub over a registry of series gauges, counters and
+// histograms spread over 10 services, with clients attached as the
+// broadcast loop sees them; subs gives each client that many subscriptions
+func benchHub(b *testing.B, series, clients, subs int) *Hub {
+	b.Helper()
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	for i := range series {
+		service, name := fmt.Sprintf("svc-%d", i%10), fmt.Sprintf("metric_%d", i)
+		switch i % 3 {
+		case 0:
+			registry.GetRing(service, name).Push(buffer.Sample{Ts: 1e9, Val: float64(i)})
+		case 1:
+			registry.GetCounterRing(service, name).Push(buffer.CounterSample(1e9, uint64(i)))
+		default:
+			registry.GetHistogramRing(service, name).Push(buffer.HistogramData{
+				Ts: 1e9, Bounds: []float64{1, 10}, Counts: []uint64{1, 2, 3}, Sum: 20, Count: 6, HasSum: true,
+			})
+		}
+	}
+
+	h := NewHub(registry)
+	for c := range clients {
+		client := &Client{
+			hub:        h,
+			send:       make(chan []byte, 1),
+			bw:         &bandwidth{},
+			chunkReady: make(chan struct{}, 1),
+		}
+		client.version.Store(int32(ProtocolV1 + c%2))
+		for s := range subs {
+			i := (c + s*7) % series
+			client.subs = append(client.subs, Subscription{Service: fmt.Sprintf("svc-%d", i%10), Metric: fmt.Sprintf("metric_%d", i)})
+		}
+		h.clients[client] = true
+	}
+	h.maxFrameBytes = 0
+	return h
+}
+
+// drain empties every client's send queue so each tick encodes anew
+func drain(h *Hub) {
+	for client := range h.clients {
+		select {
+		case <-client.send:
+		default:
+		}
+	}
+}
+
+func BenchmarkBroadcastSnapshot(b *testing.B) {
+	for _, subs := range []int{0, 20} {
+		b.Run(fmt.Sprintf("series=5000/clients=200/subs=%d", subs), func(b *testing.B) {
+			h := benchHub(b, 5000, 200, subs)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				h.broadcastSnapshot()
+				drain(h)
+			}
+		})
+	}
+}
+
+func BenchmarkLatestSnapshotInto(b *testing.B) {
+	h := benchHub(b, 5000, 0, 0)
+	var snapshot buffer.LatestSnapshot
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		h.registry.LatestSnapshotInto(&snapshot)
+	}
+}
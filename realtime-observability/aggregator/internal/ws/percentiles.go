@@ -0,0 +1,111 @@
+package ws
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+const (
+	// defaultPercentileWindow is used when a subscription omits window_ms
+	defaultPercentileWindow = 5 * time.Second
+
+	// minPercentileObservations flags windows too sparse for stable quantiles
+	minPercentileObservations = 20
+)
+
+// PercentileValue is a server-computed quantile streamed as a scalar
+type PercentileValue struct {
+	Ts            int64   `json:"ts"`
+	Val           float64 `json:"val"`
+	Count         uint64  `json:"count"`
+	LowConfidence bool    `json:"low_confidence,omitempty"`
+}
+
+type windowKey struct {
+	key    buffer.MetricKey
+	window int64
+}
+
+// PercentileCache merges each (metric, window) once per broadcast so clients
+// sharing a subscription share the work. It is not safe for concurrent use.
+type PercentileCache struct {
+	registry *buffer.Registry
+	now      int64
+	merged   map[windowKey]*buffer.HistogramData
+}
+
+// NewPercentileCache creates a cache for windows ending now
+func NewPercentileCache(registry *buffer.Registry) *PercentileCache {
+	return &PercentileCache{
+		registry: registry,
+		now:      time.Now().UnixNano(),
+		merged:   make(map[windowKey]*buffer.HistogramData),
+	}
+}
+
+// merge returns the histogram merged over the window ending now, or nil
+func (c *PercentileCache) merge(key buffer.MetricKey, window time.Duration) *buffer.HistogramData {
+	wk := windowKey{key: key, window: int64(window)}
+	if h, ok := c.merged[wk]; ok {
+		return h
+	}
+
+	var result *buffer.HistogramData
+	if ring, ok := c.registry.FindHistogramRing(key.Service, key.Name); ok {
+		if h, ok := ring.MergeSince(c.now - int64(window)); ok {
+			result = &h
+		}
+	}
+	c.merged[wk] = result
+	return result
+}
+
+// Add computes the subscription's quantiles into out, keyed as
+// "<service>/<metric>:p<q>", plus "<service>/<metric>:avg" when sums are known
+func (c *PercentileCache) Add(sub Subscription, out map[string]PercentileValue) {
+	key := buffer.MetricKey{Service: sub.Service, Name: sub.Metric}
+	window := time.Duration(sub.WindowMs) * time.Millisecond
+	if window <= 0 {
+		window = defaultPercentileWindow
+	}
+
+	h := c.merge(key, window)
+	if h == nil {
+		return
+	}
+	total := h.Total()
+	for _, q := range sub.Percentiles {
+		out[percentileName(key, q)] = PercentileValue{
+			Ts:            h.Ts,
+			Val:           buffer.Percentile(h.Bounds, h.Counts, q),
+			Count:         total,
+			LowConfidence: total < minPercentileObservations,
+		}
+	}
+	// The exact mean rides along when every merged window carried a sum
+	if mean, ok := h.Mean(); ok {
+		out[key.String()+":avg"] = PercentileValue{
+			Ts:            h.Ts,
+			Val:           mean,
+			Count:         h.Count,
+			LowConfidence: h.Count < minPercentileObservations,
+		}
+	}
+}
+
+func percentileName(key buffer.MetricKey, q float64) string {
+	return key.String() + ":p" + strconv.FormatFloat(q, 'f', -1, 64)
+}
+
+// ValidPercentiles drops quantiles outside (0, 100]
+func ValidPercentiles(qs []float64) []float64 {
+	valid := qs[:0]
+	for _, q := range qs {
+		if q > 0 && q <= 100 {
+			valid = append(valid, q)
+		}
+	}
+	return valid
+}
@@ -0,0 +1,198 @@
+package ws
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// windowSamples holds the samples of one-second windows, newest first
+type windowSamples [][]float64
+
+// bucketize counts samples into bounds, with an overflow bucket
+func bucketize(bounds []float64, samples []float64) []uint64 {
+	counts := make([]uint64, len(bounds)+1)
+	for _, v := range samples {
+		i := 0
+		for i < len(bounds) && v > bounds[i] {
+			i++
+		}
+		counts[i]++
+	}
+	return counts
+}
+
+// pushWindows pushes one histogram window per entry of windows, the first
+// newest, a second apart and half a second off the window edges so a
+// broadcast just after end sees the same windows as the offline check
+func pushWindows(ring *buffer.HistogramRing, bounds []float64, windows windowSamples, end int64) {
+	for k := len(windows) - 1; k >= 0; k-- {
+		var sum float64
+		for _, v := range windows[k] {
+			sum += v
+		}
+		ring.Push(buffer.HistogramData{
+			Ts:     end - int64(k)*int64(time.Second) - int64(500*time.Millisecond),
+			Bounds: bounds,
+			Counts: bucketize(bounds, windows[k]),
+			Sum:    sum, Count: uint64(len(windows[k])), HasSum: true,
+		})
+	}
+}
+
+func TestStreamedPercentilesMatchOffline(t *testing.T) {
+	const (
+		perWindow = 10000
+		inWindow  = 5 // of the 10 windows pushed, those inside window_ms
+	)
+	rng := rand.New(rand.NewPCG(3, 4))
+	linear := make([]float64, 100)
+	for i := range linear {
+		linear[i] = float64(10 * (i + 1))
+	}
+	exponential := []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+	for _, dist := range []struct {
+		metric string
+		bounds []float64
+		draw   func() float64
+		// quantile is the distribution's true q-th percentile
+		quantile func(q float64) float64
+	}{
+		{
+			metric:   "uniform_ms",
+			bounds:   linear,
+			draw:     func() float64 { return rng.Float64() * 1000 },
+			quantile: func(q float64) float64 { return q * 10 },
+		},
+		{
+			metric:   "latency_ms",
+			bounds:   exponential,
+			draw:     func() float64 { return rng.ExpFloat64() * 100 },
+			quantile: func(q float64) float64 { return -100 * math.Log(1-q/100) },
+		},
+	} {
+		windows := make(windowSamples, 10)
+		for k := range windows {
+			windows[k] = make([]float64, perWindow)
+			for i := range windows[k] {
+				if k < inWindow {
+					windows[k][i] = dist.draw()
+				} else {
+					// Older windows sit far off, to show if they leak in
+					windows[k][i] = 4000
+				}
+			}
+		}
+
+		registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+		pushWindows(registry.GetHistogramRing("checkout", dist.metric), dist.bounds, windows, time.Now().UnixNano())
+		h := NewHub(registry)
+		client := &Client{
+			hub:        h,
+			send:       make(chan []byte, 1),
+			bw:         &bandwidth{},
+			chunkReady: make(chan struct{}, 1),
+			subs: []Subscription{{
+				Service: "checkout", Metric: dist.metric,
+				Percentiles: []float64{50, 95, 99, 99.9}, WindowMs: 5000,
+			}},
+		}
+		client.version.Store(ProtocolV1)
+		h.clients[client] = true
+		h.broadcastSnapshot()
+
+		var msg snapshotMessage
+		select {
+		case data := <-client.send:
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			t.Fatalf("%s: no frame was sent", dist.metric)
+		}
+
+		// Offline: the same windows, merged by hand
+		var samples []float64
+		for _, w := range windows[:inWindow] {
+			samples = append(samples, w...)
+		}
+		counts := bucketize(dist.bounds, samples)
+		var sum float64
+		for _, v := range samples {
+			sum += v
+		}
+
+		for _, q := range []struct {
+			name string
+			q    float64
+		}{{"p50", 50}, {"p95", 95}, {"p99", 99}, {"p99.9", 99.9}} {
+			key := "checkout/" + dist.metric + ":" + q.name
+			got, ok := msg.Percentiles[key]
+			if !ok {
+				t.Fatalf("%s: frame has no %s: %v", dist.metric, key, msg.Percentiles)
+			}
+			if want := buffer.Percentile(dist.bounds, counts, q.q); got.Val != want {
+				t.Errorf("%s = %v, want %v computed offline", key, got.Val, want)
+			}
+			if got.Count != inWindow*perWindow || got.LowConfidence {
+				t.Errorf("%s count = %d, low confidence %v; want %d observations, confident",
+					key, got.Count, got.LowConfidence, inWindow*perWindow)
+			}
+
+			// The estimate stays within one bucket of the true quantile
+			truth := dist.quantile(q.q)
+			i := 0
+			for i < len(dist.bounds)-1 && truth > dist.bounds[i] {
+				i++
+			}
+			width := dist.bounds[i]
+			if i > 0 {
+				width -= dist.bounds[i-1]
+			}
+			if math.Abs(got.Val-truth) > width {
+				t.Errorf("%s = %v, true quantile %v; want within the bucket width %v", key, got.Val, truth, width)
+			}
+		}
+
+		avg := msg.Percentiles["checkout/"+dist.metric+":avg"]
+		if want := sum / float64(len(samples)); math.Abs(avg.Val-want) > 1e-9*want {
+			t.Errorf("%s avg = %v, want the exact mean %v", dist.metric, avg.Val, want)
+		}
+	}
+}
+
+func TestSparseWindowIsFlagged(t *testing.T) {
+	bounds := []float64{10, 100, 1000}
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	now := time.Now().UnixNano()
+	pushWindows(registry.GetHistogramRing("checkout", "sparse_ms"), bounds,
+		windowSamples{{5, 50, 50, 500, 900}}, now)
+	pushWindows(registry.GetHistogramRing("checkout", "stale_ms"), bounds,
+		windowSamples{{5}, {5}, {5}, {5}, {5}, {5}, {5}, {5}, {5}, {5}}, now-int64(time.Hour))
+
+	cache := NewPercentileCache(registry)
+	out := make(map[string]PercentileValue)
+	cache.Add(Subscription{Service: "checkout", Metric: "sparse_ms", Percentiles: []float64{50, 99}}, out)
+	cache.Add(Subscription{Service: "checkout", Metric: "stale_ms", Percentiles: []float64{50, 99}}, out)
+
+	for _, key := range []string{"checkout/sparse_ms:p50", "checkout/sparse_ms:p99", "checkout/sparse_ms:avg"} {
+		v, ok := out[key]
+		if !ok {
+			t.Fatalf("no %s: %v", key, out)
+		}
+		if !v.LowConfidence || v.Count != 5 {
+			t.Errorf("%s = %+v, want flagged low confidence over 5 observations", key, v)
+		}
+	}
+	// No window in range reports nothing rather than a stale value
+	for _, key := range []string{"checkout/stale_ms:p50", "checkout/stale_ms:p99", "checkout/stale_ms:avg"} {
+		if v, ok := out[key]; ok {
+			t.Errorf("%s = %+v for a series with no window in range", key, v)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Protocol versions. v1 is the original, unversioned message set; clients
+// that never negotiate get it unchanged. v2 stamps every server message with
+// its version.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	// LatestProtocol is the newest version the server speaks
+	LatestProtocol = ProtocolV2
+
+	subprotocolPrefix = "telemetry.v"
+)
+
+// supportedProtocols lists the versions offered in hello replies
+var supportedProtocols = []int{ProtocolV1, ProtocolV2}
+
+// capabilities advertises optional protocol features; flags flip to true
+// as the features ship
+var capabilities = map[string]bool{
+	"delta":  false,
+	"binary": false,
+	"events": true,
+	"alerts": false,
+	"views":  true,
+	"chunks": true,
+}
+
+// subprotocols are offered during the upgrade, newest first
+func subprotocols() []string {
+	result := make([]string, 0, len(supportedProtocols))
+	for i := len(supportedProtocols) - 1; i >= 0; i-- {
+		result = append(result, fmt.Sprintf("%s%d", subprotocolPrefix, supportedProtocols[i]))
+	}
+	return result
+}
+
+// protocolFromSubprotocol maps a negotiated subprotocol to a version; an
+// empty or unknown one means v1
+func protocolFromSubprotocol(name string) int {
+	var v int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(name, subprotocolPrefix), "%d", &v); err != nil || !protocolSupported(v) {
+		return ProtocolV1
+	}
+	return v
+}
+
+func protocolSupported(v int) bool {
+	for _, s := range supportedProtocols {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHello negotiates the version a client asked for in a hello message
+// and replies with the chosen version and capabilities. A client newer than
+// the server is offered LatestProtocol.
+func (c *Client) handleHello(requested int) {
+	version := requested
+	if version > LatestProtocol {
+		version = LatestProtocol
+	}
+	if !protocolSupported(version) {
+		c.sendError("unsupported_version", fmt.Sprintf("protocol version %d is not supported", requested))
+		return
+	}
+	c.version.Store(int32(version))
+
+	c.queue(c.encode(map[string]interface{}{
+		"type":               "hello",
+		"version":            version,
+		"supported_versions": supportedProtocols,
+		"capabilities":       capabilities,
+	}))
+}
+
+// encode marshals a server message in the client's protocol version
+func (c *Client) encode(msg map[string]interface{}) []byte {
+	if v := c.version.Load(); v >= ProtocolV2 {
+		msg["version"] = v
+	}
+	return marshal(msg)
+}
+
+// encodeSnapshot marshals a snapshot message for a protocol version
+func encodeSnapshot(version int32, msg *snapshotMessage) []byte {
+	if version < ProtocolV2 {
+		return marshal(v1Snapshot(msg))
+	}
+	msg.Version = version
+	return marshal(msg)
+}
+
+// v1Snapshot returns msg in the v1 shapes: values are {ts, val} and
+// histograms {ts, bounds, counts}, without the exact counter values,
+// rates, sums and counts that v2 adds. v1 has no gap markers, so marked
+// series are left out until they resume.
+func v1Snapshot(msg *snapshotMessage) *snapshotMessage {
+	v1 := *msg
+	v1.Version = 0
+	v1.Gauges = v1Samples(msg.Gauges)
+	v1.Counters = v1Samples(msg.Counters)
+	v1.Histograms = make(map[string]histogramPayload, len(msg.Histograms))
+	for name, h := range msg.Histograms {
+		if h.Marker != "" {
+			continue
+		}
+		h.Sum, h.Count = nil, nil
+		v1.Histograms[name] = h
+	}
+	return &v1
+}
+
+func v1Samples(samples map[string]samplePayload) map[string]samplePayload {
+	result := make(map[string]samplePayload, len(samples))
+	for name, s := range samples {
+		if s.Marker != "" {
+			continue
+		}
+		s.Exact, s.Rate = "", nil
+		result[name] = s
+	}
+	return result
+}
+
+// encodeBuffers holds scratch buffers for marshal; snapshots are encoded
+// every tick and would otherwise grow a fresh buffer each time
+var encodeBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// marshal encodes v as JSON, or returns nil if it cannot be encoded
+func marshal(v interface{}) []byte {
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	defer encodeBuffers.Put(buf)
+	buf.Reset()
+
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return nil
+	}
+	// Encode terminates the value with a newline
+	return bytes.Clone(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
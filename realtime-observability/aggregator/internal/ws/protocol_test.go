@@ -0,0 +1,97 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenTick returns a broadcast tick over a registry holding each kind of
+// value: live gauges, counters and histograms from checkout, and billing's
+// series behind a gap marker
+func goldenTick() *broadcastTick {
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	registry.GetRing("checkout", "cpu").Push(buffer.Sample{Ts: 1e9, Val: 0.5})
+	requests := registry.GetCounterRing("checkout", "requests_total")
+	requests.Push(buffer.CounterSample(1e9, 1<<53))
+	requests.Push(buffer.CounterSample(2e9, 1<<53+21))
+	registry.GetCounterRing("checkout", "cpu_seconds").Push(buffer.FloatCounterSample(2e9, 1.25))
+	registry.GetHistogramRing("checkout", "latency").Push(buffer.HistogramData{
+		Ts: 2e9, Bounds: []float64{10, 100}, Counts: []uint64{3, 1, 0}, Sum: 95, Count: 4, HasSum: true,
+	})
+	registry.GetRing("billing", "queue").Push(buffer.Sample{Ts: 1e9, Val: 3})
+	registry.GetHistogramRing("billing", "latency").Push(buffer.HistogramData{
+		Ts: 1e9, Bounds: []float64{10}, Counts: []uint64{1, 0},
+	})
+	registry.MarkGap("billing")
+
+	var snapshot buffer.LatestSnapshot
+	registry.LatestSnapshotInto(&snapshot)
+	return &broadcastTick{
+		registry:    registry,
+		snapshot:    snapshot,
+		percentiles: NewPercentileCache(registry),
+		timestamp:   3e9,
+		received:    2e9,
+	}
+}
+
+// checkGolden compares got, indented, with testdata/name
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, got, "", "  "); err != nil {
+		t.Fatalf("%s: invalid JSON %s: %v", name, got, err)
+	}
+	indented.WriteByte('\n')
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, indented.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(indented.Bytes(), want) {
+		t.Errorf("%s changed; a breaking change needs a new protocol version\ngot:\n%s\nwant:\n%s", name, indented.Bytes(), want)
+	}
+}
+
+func TestSnapshotGolden(t *testing.T) {
+	for _, version := range supportedProtocols {
+		tick := goldenTick()
+		checkGolden(t, fmt.Sprintf("snapshot_v%d.json", version), tick.fullMessage(int32(version)))
+
+		// Subscribed snapshots are built apart from the shared one
+		client := &Client{subs: []Subscription{
+			{Service: "checkout", Metric: "requests_total"},
+			{Service: "billing", Metric: "queue"},
+		}}
+		client.version.Store(int32(version))
+		h := &Hub{registry: tick.registry, views: NewViewStore()}
+		checkGolden(t, fmt.Sprintf("subscribed_v%d.json", version), h.buildClientMessage(client, tick))
+	}
+}
+
+func TestServerMessageGolden(t *testing.T) {
+	for _, version := range supportedProtocols {
+		client := &Client{}
+		client.version.Store(int32(version))
+		checkGolden(t, fmt.Sprintf("error_v%d.json", version), client.encode(map[string]interface{}{
+			"type":    "error",
+			"code":    "unknown_type",
+			"message": `unknown message type "ping"`,
+		}))
+	}
+}
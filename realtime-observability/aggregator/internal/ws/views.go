@@ -0,0 +1,109 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// View is a named, server-side list of subscriptions
+type View struct {
+	Name          string         `json:"name"`
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// ViewStore holds view definitions shared by all clients. Clients subscribed
+// to a view resolve it on every snapshot, so updates apply immediately.
+type ViewStore struct {
+	views map[string][]Subscription
+	mu    sync.RWMutex
+}
+
+// NewViewStore creates an empty view store
+func NewViewStore() *ViewStore {
+	return &ViewStore{
+		views: make(map[string][]Subscription),
+	}
+}
+
+// LoadViewsFile reads view definitions from a JSON file of the form
+// {"views": [{"name": "...", "subscriptions": [...]}]}
+func LoadViewsFile(path string) ([]View, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Views []View `json:"views"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, v := range file.Views {
+		if err := ValidateView(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return file.Views, nil
+}
+
+// ValidateView checks a view definition
+func ValidateView(v View) error {
+	if v.Name == "" {
+		return fmt.Errorf("view name is required")
+	}
+	for i, sub := range v.Subscriptions {
+		if sub.Service == "" || sub.Metric == "" {
+			return fmt.Errorf("view %q: subscription %d needs service and metric", v.Name, i)
+		}
+		for _, q := range sub.Percentiles {
+			if q <= 0 || q > 100 {
+				return fmt.Errorf("view %q: percentile %v out of range (0, 100]", v.Name, q)
+			}
+		}
+	}
+	return nil
+}
+
+// Get returns a view's subscriptions
+func (s *ViewStore) Get(name string) ([]Subscription, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subs, ok := s.views[name]
+	return subs, ok
+}
+
+// Put creates or replaces a view
+func (s *ViewStore) Put(v View) {
+	subs := make([]Subscription, len(v.Subscriptions))
+	copy(subs, v.Subscriptions)
+
+	s.mu.Lock()
+	s.views[v.Name] = subs
+	s.mu.Unlock()
+}
+
+// Delete removes a view, reporting whether it existed
+func (s *ViewStore) Delete(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.views[name]
+	delete(s.views, name)
+	return ok
+}
+
+// List returns all views sorted by name
+func (s *ViewStore) List() []View {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]View, 0, len(s.views))
+	for name, subs := range s.views {
+		result = append(result, View{Name: name, Subscriptions: subs})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
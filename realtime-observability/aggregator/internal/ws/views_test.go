@@ -0,0 +1,257 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// viewMessage is a decoded hub message: a snapshot or an error
+type viewMessage struct {
+	Type        string                     `json:"type"`
+	Code        string                     `json:"code"`
+	Gauges      map[string]json.RawMessage `json:"gauges"`
+	Counters    map[string]json.RawMessage `json:"counters"`
+	Histograms  map[string]json.RawMessage `json:"histograms"`
+	Percentiles map[string]PercentileValue `json:"percentiles"`
+
+	// size is the message's length on the wire
+	size int
+}
+
+// keys returns every series and percentile key of a snapshot, sorted
+func (m viewMessage) keys() []string {
+	var keys []string
+	for _, group := range []map[string]json.RawMessage{m.Gauges, m.Counters, m.Histograms} {
+		for key := range group {
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.Percentiles {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// viewHub runs a hub over a registry holding checkout's cpu and mem
+// gauges, requests_total counter and latency histogram, and returns a
+// connected client's messages and connection
+func viewHub(t *testing.T) (*Hub, *websocket.Conn, <-chan viewMessage) {
+	t.Helper()
+	registry := buffer.NewRegistryWithOptions(buffer.Options{DisableRollups: true})
+	now := time.Now().UnixNano()
+	registry.GetRing("checkout", "cpu").Push(buffer.Sample{Ts: now, Val: 0.5})
+	registry.GetRing("checkout", "mem").Push(buffer.Sample{Ts: now, Val: 512})
+	registry.GetCounterRing("checkout", "requests_total").Push(buffer.CounterSample(now, 100))
+	registry.GetHistogramRing("checkout", "latency").Push(buffer.HistogramData{
+		Ts: now, Bounds: []float64{10, 100}, Counts: []uint64{50, 40, 10},
+	})
+
+	h := NewHub(registry)
+	go h.Run()
+	go h.StartBroadcastLoop(5 * time.Millisecond)
+	srv := httptest.NewServer(http.HandlerFunc(h.HandleWebSocket))
+	t.Cleanup(func() {
+		srv.Close()
+		h.Stop()
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	messages := make(chan viewMessage, 1024)
+	go func() {
+		defer close(messages)
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			for _, line := range bytes.Split(frame, []byte("\n")) {
+				var msg viewMessage
+				if len(line) > 0 && json.Unmarshal(line, &msg) == nil {
+					msg.size = len(line)
+					messages <- msg
+				}
+			}
+		}
+	}()
+	return h, conn, messages
+}
+
+// nextOfType returns the next message of type typ, skipping others
+func nextOfType(t *testing.T, messages <-chan viewMessage, typ string) viewMessage {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				t.Fatalf("websocket closed waiting for a %s", typ)
+			}
+			if msg.Type == typ {
+				return msg
+			}
+		case <-deadline:
+			t.Fatalf("no %s within 5s", typ)
+		}
+	}
+}
+
+// waitForKeys returns the first snapshot carrying exactly keys
+func waitForKeys(t *testing.T, messages <-chan viewMessage, keys []string) viewMessage {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msg := nextOfType(t, messages, "snapshot")
+		if slices.Equal(msg.keys(), keys) {
+			return msg
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot keys = %v, want %v", msg.keys(), keys)
+		}
+	}
+}
+
+func TestSubscribeViewExpands(t *testing.T) {
+	h, conn, messages := viewHub(t)
+	h.Views().Put(View{Name: "fleet-overview", Subscriptions: []Subscription{
+		{Service: "checkout", Metric: "cpu"},
+		{Service: "checkout", Metric: "requests_total"},
+		{Service: "checkout", Metric: "latency", Percentiles: []float64{50, 99}},
+	}})
+
+	if err := conn.WriteJSON(map[string]string{"type": "subscribe_view", "name": "fleet-overview"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := waitForKeys(t, messages, []string{
+		"checkout/cpu", "checkout/latency", "checkout/latency:p50", "checkout/latency:p99", "checkout/requests_total",
+	})
+	if _, ok := msg.Gauges["checkout/cpu"]; !ok {
+		t.Fatalf("cpu not sent as a gauge: %v", msg.keys())
+	}
+	if _, ok := msg.Counters["checkout/requests_total"]; !ok {
+		t.Fatalf("requests_total not sent as a counter: %v", msg.keys())
+	}
+	if p50 := msg.Percentiles["checkout/latency:p50"]; p50.Count != 100 || p50.Val <= 0 || p50.Val > 10 {
+		t.Fatalf("latency p50 = %+v, want it in the first bucket over 100 observations", p50)
+	}
+
+	// A plain subscribe replaces the view
+	if err := conn.WriteJSON(map[string]interface{}{
+		"type":          "subscribe",
+		"subscriptions": []Subscription{{Service: "checkout", Metric: "mem"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitForKeys(t, messages, []string{"checkout/mem"})
+}
+
+func TestUnknownViewIsAnError(t *testing.T) {
+	_, conn, messages := viewHub(t)
+
+	if err := conn.WriteJSON(map[string]string{"type": "subscribe_view", "name": "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := nextOfType(t, messages, "error"); msg.Code != "unknown_view" {
+		t.Fatalf("error code = %q, want unknown_view", msg.Code)
+	}
+	// The client keeps its unfiltered stream
+	waitForKeys(t, messages, []string{"checkout/cpu", "checkout/latency", "checkout/mem", "checkout/requests_total"})
+}
+
+func TestViewUpdatesApplyLive(t *testing.T) {
+	h, conn, messages := viewHub(t)
+	h.Views().Put(View{Name: "wallboard", Subscriptions: []Subscription{{Service: "checkout", Metric: "cpu"}}})
+
+	if err := conn.WriteJSON(map[string]string{"type": "subscribe_view", "name": "wallboard"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForKeys(t, messages, []string{"checkout/cpu"})
+
+	// Subscribers follow the new definition without subscribing again
+	h.Views().Put(View{Name: "wallboard", Subscriptions: []Subscription{
+		{Service: "checkout", Metric: "mem"},
+		{Service: "checkout", Metric: "latency", Percentiles: []float64{90}},
+	}})
+	waitForKeys(t, messages, []string{"checkout/latency", "checkout/latency:p90", "checkout/mem"})
+	for range 5 {
+		if keys := nextOfType(t, messages, "snapshot").keys(); slices.Contains(keys, "checkout/cpu") {
+			t.Fatalf("snapshot after the update still carries cpu: %v", keys)
+		}
+	}
+
+	// A deleted view sends nothing rather than every series
+	h.Views().Delete("wallboard")
+	time.Sleep(50 * time.Millisecond)
+	for len(messages) > 0 {
+		<-messages
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("message after the view was deleted: %s %v", msg.Type, msg.keys())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Putting it back resumes the stream
+	h.Views().Put(View{Name: "wallboard", Subscriptions: []Subscription{{Service: "checkout", Metric: "cpu"}}})
+	waitForKeys(t, messages, []string{"checkout/cpu"})
+}
+
+func TestSubscribeViewClampsBudget(t *testing.T) {
+	h, conn, messages := viewHub(t)
+	h.SetBandwidthLimits(0, 2000)
+	h.Views().Put(View{Name: "wallboard", Subscriptions: []Subscription{{Service: "checkout", Metric: "cpu"}}})
+
+	if err := conn.WriteJSON(map[string]interface{}{
+		"type": "subscribe_view", "name": "wallboard", "max_bytes_per_sec": 1 << 30,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitForKeys(t, messages, []string{"checkout/cpu"})
+
+	h.mu.RLock()
+	var budget int64
+	for client := range h.clients {
+		client.bw.mu.Lock()
+		budget = client.bw.budget
+		client.bw.mu.Unlock()
+	}
+	h.mu.RUnlock()
+	if budget != 2000 {
+		t.Fatalf("budget = %d, want the requested one capped at 2000", budget)
+	}
+
+	// The view's snapshots stay within the cap. A second measured from
+	// here straddles two of the hub's sliding windows, so it may see up to
+	// twice the budget; uncapped, 5ms ticks would send several times that.
+	for len(messages) > 0 {
+		<-messages
+	}
+	start := time.Now()
+	var received int
+	for time.Since(start) < time.Second {
+		select {
+		case msg := <-messages:
+			if msg.Type == "snapshot" {
+				received += msg.size
+			}
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if received > 2*2000 {
+		t.Fatalf("received %d bytes of snapshots in a second, want the 2000 byte budget to hold", received)
+	}
+}
@@ -0,0 +1,87 @@
+package ws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// Tick is the state of one broadcast as seen by a Watcher. Latest is
+// refilled on the next tick, so it is only valid during the callback.
+type Tick struct {
+	Timestamp   int64
+	Latest      buffer.LatestSnapshot
+	Percentiles *PercentileCache
+}
+
+// Watcher receives broadcast ticks outside the WebSocket path, for streams
+// such as the gRPC Watch RPC. It is held to the same bandwidth budget as a
+// WS client.
+type Watcher struct {
+	hub  *Hub
+	fn   func(*Tick)
+	bw   *bandwidth
+	done chan struct{}
+	once sync.Once
+}
+
+// Watch calls fn with every broadcast tick until the watcher is closed.
+// fn runs on the broadcast loop and must not block. maxBytesPerSec is
+// clamped like a WS subscription's max_bytes_per_sec.
+func (h *Hub) Watch(fn func(*Tick), maxBytesPerSec int64) *Watcher {
+	w := &Watcher{
+		hub:  h,
+		fn:   fn,
+		bw:   &bandwidth{budget: h.clampBudget(maxBytesPerSec)},
+		done: make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.done:
+		close(w.done)
+	default:
+		h.watchers[w] = true
+	}
+	return w
+}
+
+// Allow reports whether a message of n bytes fits the budget now and
+// records it if so; a refused message should be coalesced into the next
+func (w *Watcher) Allow(n int) bool {
+	return w.bw.allowSnapshot(time.Now(), n)
+}
+
+// Done is closed when the watcher is closed or the hub stops
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+// Close stops delivering ticks
+func (w *Watcher) Close() {
+	w.hub.mu.Lock()
+	delete(w.hub.watchers, w)
+	w.hub.mu.Unlock()
+	w.close()
+}
+
+func (w *Watcher) close() {
+	w.once.Do(func() { close(w.done) })
+}
+
+// notifyWatchers hands a tick to every watcher; caller holds h.mu
+func (h *Hub) notifyWatchers(tick *broadcastTick) {
+	if len(h.watchers) == 0 {
+		return
+	}
+	t := &Tick{
+		Timestamp:   tick.timestamp,
+		Latest:      tick.snapshot,
+		Percentiles: tick.percentiles,
+	}
+	for w := range h.watchers {
+		w.fn(t)
+	}
+}
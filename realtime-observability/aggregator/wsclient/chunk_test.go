@@ -0,0 +1,51 @@
+package wsclient_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/aggregatortest"
+	"github.com/yourorg/aggregator/internal/buffer"
+	"github.com/yourorg/aggregator/wsclient"
+)
+
+func TestClientReassemblesChunkedSnapshot(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{NoAgent: true, BroadcastInterval: 100 * time.Millisecond})
+
+	// 500 series with 10KB labels make a snapshot of about 5MB, sent in
+	// chunks of at most DefaultMaxFrameBytes
+	const series = 500
+	label := strings.Repeat("été-日本-", 10<<10/len("été-日本-"))
+	for i := range series {
+		name := buffer.SeriesName("latency", map[string]string{"route": fmt.Sprintf("%s%d", label, i)})
+		h.Registry.GetRing("checkout", name).Push(buffer.Sample{Ts: 1e9, Val: float64(i)})
+	}
+
+	c, err := wsclient.Dial(h.WSURL, wsclient.Options{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	snapshots, err := c.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	select {
+	case snap := <-snapshots:
+		if len(snap.Gauges) != series {
+			t.Fatalf("snapshot has %d gauges, want %d", len(snap.Gauges), series)
+		}
+		for i := range series {
+			key := "checkout/" + buffer.SeriesName("latency", map[string]string{"route": fmt.Sprintf("%s%d", label, i)})
+			if g, ok := snap.Gauges[key]; !ok || g.Val != float64(i) {
+				t.Fatalf("gauge %d = %+v, want %d", i, g, i)
+			}
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no snapshot reassembled")
+	}
+}
@@ -0,0 +1,406 @@
+// Package wsclient is a Go client for the aggregator's /ws stream. It
+// negotiates the protocol version, reassembles chunked snapshots,
+// reconnects with backoff and decodes messages into typed structs.
+package wsclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client defaults
+const (
+	DefaultBuffer     = 64
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+
+	// latestProtocol is the newest hub protocol this package speaks
+	latestProtocol = 2
+
+	// The hub pings every 30s; a connection silent for longer than this
+	// is treated as dead
+	readTimeout  = 60 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// ErrClosed is returned by calls on a closed client
+var ErrClosed = errors.New("wsclient: client is closed")
+
+// Options configures a client; the zero value is usable
+type Options struct {
+	// APIKey is sent as x-api-key on every dial
+	APIKey string
+	// Protocol is the newest version to offer (0 = newest supported)
+	Protocol int
+
+	// Buffer is the capacity of the snapshot channel (0 = DefaultBuffer).
+	// When the consumer falls behind the oldest snapshot is dropped and
+	// counted in Dropped.
+	Buffer int
+	// MaxBytesPerSec requests a server bandwidth budget with every
+	// subscription (0 = none)
+	MaxBytesPerSec int64
+
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnEvent receives every message that is not a snapshot, such as
+	// errors and conn_stats, on the read goroutine
+	OnEvent func(Event)
+	// OnConnect runs after every reconnect, once subscriptions are replayed
+	OnConnect func()
+	// OnDisconnect runs when a connection drops, before reconnecting
+	OnDisconnect func(err error)
+
+	// Dialer overrides websocket.DefaultDialer
+	Dialer *websocket.Dialer
+}
+
+// Client is a live connection to the hub. Subscriptions survive
+// reconnects; snapshots older than the last one delivered are discarded,
+// so the stream resumes where it left off. The hub keeps no history, so
+// ticks missed while disconnected are not backfilled.
+type Client struct {
+	url    string
+	opts   Options
+	header http.Header
+
+	conn   *websocket.Conn
+	subMsg map[string]interface{} // replayed on reconnect
+	closed bool
+	connMu sync.Mutex
+
+	snapshots chan Snapshot
+	dropped   atomic.Uint64
+	lastTs    int64 // read goroutine only
+
+	version      atomic.Int32
+	capabilities map[string]bool
+	capMu        sync.RWMutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Dial connects to a hub URL such as ws://localhost:8080/ws. Only the
+// first connection attempt is reported; later drops are retried until
+// Close.
+func Dial(url string, opts Options) (*Client, error) {
+	if opts.Protocol <= 0 || opts.Protocol > latestProtocol {
+		opts.Protocol = latestProtocol
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = DefaultBuffer
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(DefaultMaxBackoff, opts.MinBackoff)
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+
+	c := &Client{
+		url:       url,
+		opts:      opts,
+		header:    http.Header{},
+		snapshots: make(chan Snapshot, opts.Buffer),
+		done:      make(chan struct{}),
+	}
+	if opts.APIKey != "" {
+		c.header.Set("x-api-key", opts.APIKey)
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.wg.Add(1)
+	go c.run(conn)
+	return c, nil
+}
+
+// Subscribe replaces the client's subscriptions and returns the snapshot
+// channel, which is the same for every call and is closed by Close. No
+// subscriptions means every series.
+func (c *Client) Subscribe(subs ...Subscription) (<-chan Snapshot, error) {
+	if subs == nil {
+		subs = []Subscription{}
+	}
+	msg := map[string]interface{}{
+		"type":          "subscribe",
+		"subscriptions": subs,
+	}
+	return c.snapshots, c.setSubscription(msg)
+}
+
+// SubscribeView follows a named view defined on the server
+func (c *Client) SubscribeView(name string) (<-chan Snapshot, error) {
+	msg := map[string]interface{}{
+		"type": "subscribe_view",
+		"name": name,
+	}
+	return c.snapshots, c.setSubscription(msg)
+}
+
+// Dropped returns how many snapshots were discarded because the consumer
+// fell behind
+func (c *Client) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// Version returns the negotiated protocol version
+func (c *Client) Version() int {
+	return int(c.version.Load())
+}
+
+// Capabilities returns the optional features the server advertised
+func (c *Client) Capabilities() map[string]bool {
+	c.capMu.RLock()
+	defer c.capMu.RUnlock()
+
+	result := make(map[string]bool, len(c.capabilities))
+	for k, v := range c.capabilities {
+		result[k] = v
+	}
+	return result
+}
+
+// Close disconnects and waits for the read goroutine to exit
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.connMu.Lock()
+		c.closed = true
+		if c.conn != nil {
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(writeTimeout))
+			c.conn.Close()
+		}
+		c.connMu.Unlock()
+	})
+	c.wg.Wait()
+	return nil
+}
+
+// setSubscription sends msg now and remembers it for reconnects. A failed
+// write is left to the read loop, which reconnects and replays it.
+func (c *Client) setSubscription(msg map[string]interface{}) error {
+	if c.opts.MaxBytesPerSec > 0 {
+		msg["max_bytes_per_sec"] = c.opts.MaxBytesPerSec
+	}
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.subMsg = msg
+	if c.conn != nil {
+		c.writeLocked(msg)
+	}
+	return nil
+}
+
+// dial opens a connection, offering subprotocols newest first, and
+// replays the hello and current subscription
+func (c *Client) dial() (*websocket.Conn, error) {
+	dialer := *c.opts.Dialer
+	dialer.Subprotocols = nil
+	for v := c.opts.Protocol; v >= 1; v-- {
+		dialer.Subprotocols = append(dialer.Subprotocols, fmt.Sprintf("telemetry.v%d", v))
+	}
+
+	conn, _, err := dialer.Dial(c.url, c.header)
+	if err != nil {
+		return nil, fmt.Errorf("wsclient: dial %s: %w", c.url, err)
+	}
+	var version int32 = 1
+	fmt.Sscanf(conn.Subprotocol(), "telemetry.v%d", &version)
+	c.version.Store(version)
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeTimeout))
+	})
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, ErrClosed
+	}
+	c.conn = conn
+	c.writeLocked(map[string]interface{}{"type": "hello", "version": c.opts.Protocol})
+	if c.subMsg != nil {
+		c.writeLocked(c.subMsg)
+	}
+	return conn, nil
+}
+
+// writeLocked sends a JSON message on the current connection; caller
+// holds connMu
+func (c *Client) writeLocked(msg map[string]interface{}) {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	c.conn.WriteJSON(msg)
+}
+
+// run reads until Close, reconnecting with exponential backoff
+func (c *Client) run(conn *websocket.Conn) {
+	defer c.wg.Done()
+	defer close(c.snapshots)
+
+	for {
+		err := c.read(conn)
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if c.opts.OnDisconnect != nil {
+			c.opts.OnDisconnect(err)
+		}
+
+		conn = c.reconnect()
+		if conn == nil {
+			return
+		}
+		if c.opts.OnConnect != nil {
+			c.opts.OnConnect()
+		}
+	}
+}
+
+// reconnect retries dial until it succeeds or the client is closed
+func (c *Client) reconnect() *websocket.Conn {
+	backoff := c.opts.MinBackoff
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, err := c.dial()
+		if err == nil {
+			return conn
+		}
+		if errors.Is(err, ErrClosed) {
+			return nil
+		}
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+}
+
+// read dispatches messages from one connection until it fails. The hub
+// batches queued messages into one frame separated by newlines, and sends
+// oversized snapshots to v2 clients as chunk messages.
+func (c *Client) read(conn *websocket.Conn) error {
+	defer conn.Close()
+
+	var assembling bytes.Buffer
+	var chunkID uint64
+	var next int
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+		for _, line := range bytes.Split(frame, []byte("\n")) {
+			var head struct {
+				Type string `json:"type"`
+			}
+			if len(line) == 0 || json.Unmarshal(line, &head) != nil {
+				continue
+			}
+			if head.Type == "chunk" {
+				var part chunk
+				if json.Unmarshal(line, &part) != nil {
+					continue
+				}
+				if part.SnapshotID != chunkID || part.Part != next {
+					// A set missing a part is dropped
+					assembling.Reset()
+					chunkID, next = part.SnapshotID, 1
+					if part.Part != 1 {
+						continue
+					}
+				}
+				assembling.WriteString(part.Data)
+				next++
+				if part.Part < part.Of {
+					continue
+				}
+				line = append([]byte(nil), assembling.Bytes()...)
+				assembling.Reset()
+				if json.Unmarshal(line, &head) != nil {
+					continue
+				}
+			}
+			c.dispatch(head.Type, line)
+		}
+	}
+}
+
+// dispatch routes one decoded message
+func (c *Client) dispatch(kind string, data []byte) {
+	switch kind {
+	case "snapshot":
+		var snap Snapshot
+		if json.Unmarshal(data, &snap) != nil || snap.Timestamp <= c.lastTs {
+			return
+		}
+		c.lastTs = snap.Timestamp
+		c.deliver(snap)
+		return
+
+	case "hello":
+		var h hello
+		if json.Unmarshal(data, &h) == nil {
+			c.version.Store(int32(h.Version))
+			c.capMu.Lock()
+			c.capabilities = h.Capabilities
+			c.capMu.Unlock()
+		}
+	}
+
+	if c.opts.OnEvent != nil {
+		event := Event{Raw: append(json.RawMessage(nil), data...)}
+		if json.Unmarshal(data, &event) == nil {
+			c.opts.OnEvent(event)
+		}
+	}
+}
+
+// deliver queues a snapshot, dropping the oldest one if the consumer is
+// behind
+func (c *Client) deliver(snap Snapshot) {
+	for {
+		select {
+		case c.snapshots <- snap:
+			return
+		default:
+		}
+		select {
+		case <-c.snapshots:
+			c.dropped.Add(1)
+		default:
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package wsclient_test
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yourorg/aggregator/aggregatortest"
+	"github.com/yourorg/aggregator/wsclient"
+)
+
+func TestClientSubscribesAndReconnects(t *testing.T) {
+	aggregatortest.VerifyNoLeaks(t)
+	h := aggregatortest.New(t, aggregatortest.Options{})
+	h.Agent.SetGauge("cpu", 1)
+	h.Agent.SetGauge("mem", 1)
+	h.WaitForMetric("test-service", "cpu", 5*time.Second)
+
+	proxy := newDropProxy(t, h.WSURL)
+	connected := make(chan struct{}, 1)
+	c, err := wsclient.Dial(proxy.url, wsclient.Options{
+		MinBackoff: 10 * time.Millisecond,
+		OnConnect:  func() { connected <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if c.Version() != 2 {
+		t.Fatalf("Version = %d, want 2", c.Version())
+	}
+	snapshots, err := c.Subscribe(wsclient.Subscription{Service: "test-service", Metric: "cpu"})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	// Ticks broadcast before the hub reads the subscription carry every
+	// series; once it has, mem is left out
+	waitForCPU(t, snapshots, 1)
+
+	// After a dropped connection the client redials and replays the
+	// subscription, so later values keep arriving
+	proxy.drop()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+	h.Agent.SetGauge("cpu", 2)
+	waitForCPU(t, snapshots, 2)
+}
+
+// waitForCPU reads snapshots until one carries cpu at want and, as the
+// subscription asks, no mem
+func waitForCPU(t *testing.T, snapshots <-chan wsclient.Snapshot, want float64) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case snap, ok := <-snapshots:
+			if !ok {
+				t.Fatal("snapshot channel closed")
+			}
+			_, mem := snap.Gauges["test-service/mem"]
+			if s, ok := snap.Gauges["test-service/cpu"]; ok && s.Val == want && !mem {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no snapshot with only cpu = %v", want)
+		}
+	}
+}
+
+// dropProxy forwards TCP connections to the hub and can cut them all, as
+// a network failure would
+type dropProxy struct {
+	url    string
+	target string
+
+	conns []net.Conn
+	mu    sync.Mutex
+}
+
+func newDropProxy(t *testing.T, wsURL string) *dropProxy {
+	t.Helper()
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &dropProxy{target: u.Host}
+	u.Host = lis.Addr().String()
+	p.url = u.String()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", p.target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mu.Unlock()
+			wg.Add(2)
+			go func() { defer wg.Done(); io.Copy(upstream, conn); upstream.Close() }()
+			go func() { defer wg.Done(); io.Copy(conn, upstream); conn.Close() }()
+		}
+	}()
+	t.Cleanup(func() {
+		lis.Close()
+		p.drop()
+		wg.Wait()
+	})
+	return p
+}
+
+// drop closes every connection opened so far
+func (p *dropProxy) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
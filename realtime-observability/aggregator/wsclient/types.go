@@ -0,0 +1,123 @@
+package wsclient
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/yourorg/aggregator/internal/buffer"
+)
+
+// Subscription selects a metric, as in the hub's subscribe message
+type Subscription struct {
+	Service string `json:"service"`
+	Metric  string `json:"metric"`
+
+	// Instance, if set, selects one instance's gauge or counter, keyed
+	// "service@instance/metric" in the snapshot, instead of the service's
+	// aggregate
+	Instance string `json:"instance,omitempty"`
+
+	// Percentiles requests server-computed quantiles (0-100] of a
+	// histogram, merged over the last WindowMs (default 5000)
+	Percentiles []float64 `json:"percentiles,omitempty"`
+	WindowMs    int64     `json:"window_ms,omitempty"`
+}
+
+// Sample is a gauge or counter value
+type Sample struct {
+	Ts     int64   `json:"ts"`
+	Val    float64 `json:"val"`
+	Marker string  `json:"marker,omitempty"` // "gap" or "resume"; Val is then unset
+	Exact  string  `json:"exact,omitempty"`  // counters only: the exact uint64 value
+
+	// Rate is a counter's per-second increase over the last 10s, resets
+	// handled; nil for gauges and counters with too few samples
+	Rate *float64 `json:"rate,omitempty"`
+}
+
+// Exemplar is a slow request attached to a histogram
+type Exemplar struct {
+	Ts        int64             `json:"ts"`
+	Value     float64           `json:"value"`
+	Operation string            `json:"operation,omitempty"`
+	TraceID   string            `json:"trace_id,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// HistogramData is one histogram window; Counts has one more entry than
+// Bounds for the overflow bucket
+type HistogramData struct {
+	Ts        int64      `json:"ts"`
+	Bounds    []float64  `json:"bounds"`
+	Counts    []uint64   `json:"counts"`
+	Sum       *float64   `json:"sum,omitempty"`   // unset for agents that do not send it
+	Count     *uint64    `json:"count,omitempty"` // observations, with Sum
+	Marker    string     `json:"marker,omitempty"`
+	Exemplars []Exemplar `json:"exemplars,omitempty"`
+}
+
+// Percentile is a server-computed quantile of a subscribed histogram
+type Percentile struct {
+	Ts            int64   `json:"ts"`
+	Val           float64 `json:"val"`
+	Count         uint64  `json:"count"`
+	LowConfidence bool    `json:"low_confidence,omitempty"`
+}
+
+// Snapshot is one broadcast tick. Maps are keyed by "service/metric";
+// percentiles by "service/metric:p99" (and ":avg").
+type Snapshot struct {
+	Timestamp   int64                    `json:"timestamp"`          // broadcast time, UnixNano
+	Received    int64                    `json:"received,omitempty"` // newest batch receipt, UnixNano; 0 from older servers
+	Gauges      map[string]Sample        `json:"gauges"`
+	Counters    map[string]Sample        `json:"counters"`
+	Histograms  map[string]HistogramData `json:"histograms"`
+	Percentiles map[string]Percentile    `json:"percentiles,omitempty"`
+}
+
+// Freshness is how long ago the newest sample in the snapshot reached the
+// aggregator, or 0 if the server did not say. It includes clock skew
+// between this host and the aggregator.
+func (s Snapshot) Freshness(now time.Time) time.Duration {
+	if s.Received == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, s.Received))
+}
+
+// Event is any server message other than a snapshot: errors, hello
+// replies, conn_stats, catalogs, and message types added by newer servers
+// (such as alerts and service events). Raw holds the full message.
+type Event struct {
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`    // error events
+	Message string `json:"message,omitempty"` // error and agent events
+
+	Raw json.RawMessage `json:"-"`
+}
+
+// hello is the server's reply to a hello message
+type hello struct {
+	Version      int             `json:"version"`
+	Capabilities map[string]bool `json:"capabilities"`
+}
+
+// chunk is one part of a snapshot the hub split across frames
+type chunk struct {
+	SnapshotID uint64 `json:"snapshot_id"`
+	Part       int    `json:"part"`
+	Of         int    `json:"of"`
+	Data       string `json:"data"`
+}
+
+// ParseKey splits a key of Snapshot's Gauges, Counters or Histograms,
+// "service/name" or "service/name{k="v",...}", into the service, metric
+// name and labels, which are nil for an unlabeled series
+func ParseKey(key string) (service, name string, labels map[string]string, err error) {
+	k, err := buffer.ParseMetricKey(key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	name, labels, err = buffer.ParseSeriesName(k.Name)
+	return k.Service, name, labels, err
+}
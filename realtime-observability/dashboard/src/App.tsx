@@ -4,7 +4,7 @@ import { useMetricsStore, selectServices } from './store';
 import { LatencyChart, ThroughputChart, ErrorRateChart, HistogramChart } from './charts';
 
 function ConnectionStatus() {
-  const { connected, lastUpdate } = useWebSocket();
+  const { connected, lastUpdate, freshnessMs } = useWebSocket();
   
   return (
     <div className="flex items-center gap-2">
@@ -21,6 +21,11 @@ function ConnectionStatus() {
           Last: {new Date(lastUpdate).toLocaleTimeString()}
         </span>
       )}
+      {freshnessMs !== null && (
+        <span className="text-xs text-gray-500" title="Newest sample receipt to this update">
+          Freshness: {freshnessMs.toFixed(0)}ms
+        </span>
+      )}
     </div>
   );
 }
@@ -4,6 +4,8 @@ import { create } from 'zustand';
 export interface Sample {
   ts: number;
   val: number;
+  // Counters only: exact value as a decimal string; val rounds past 2^53
+  exact?: string;
 }
 
 export interface HistogramData {
@@ -34,6 +36,9 @@ interface MetricsStore {
   // Connection state
   connected: boolean;
   lastUpdate: number;
+  // Milliseconds from the newest sample reaching the aggregator to this
+  // update (includes clock skew), or null for servers that do not say
+  freshnessMs: number | null;
   
   // Actions
   update: (data: any) => void;
@@ -60,6 +65,7 @@ export const useMetricsStore = create<MetricsStore>((set, get) => ({
   
   connected: false,
   lastUpdate: 0,
+  freshnessMs: null,
   
   update: (data: any) => {
     const state = get();
@@ -99,7 +105,10 @@ export const useMetricsStore = create<MetricsStore>((set, get) => ({
       }
     }
     
-    set({ lastUpdate: now });
+    // received is the aggregator's receipt time of the newest batch (ns)
+    const freshnessMs = data.received ? Math.max(0, now - data.received / 1e6) : null;
+
+    set({ lastUpdate: now, freshnessMs });
   },
   
   setConnected: (connected: boolean) => set({ connected }),
@@ -100,10 +100,12 @@ export const wsClient = new WebSocketClient();
 export function useWebSocket() {
   const connected = useMetricsStore((state) => state.connected);
   const lastUpdate = useMetricsStore((state) => state.lastUpdate);
+  const freshnessMs = useMetricsStore((state) => state.freshnessMs);
 
   return {
     connected,
     lastUpdate,
+    freshnessMs,
     connect: () => wsClient.connect(),
     disconnect: () => wsClient.disconnect(),
     subscribe: (subs: Array<{ service: string; metric: string }>) => 
@@ -16,6 +16,7 @@ NC='\033[0m' # No Color
 echo -e "${YELLOW}Building aggregator...${NC}"
 cd aggregator
 go build -o bin/aggregator ./cmd
+go build -o bin/telemetry-tail ./cmd/telemetry-tail
 echo -e "${GREEN}✓ Aggregator built${NC}"
 cd ..
 
@@ -24,6 +25,16 @@ echo -e "${YELLOW}Building Go agent example...${NC}"
 cd agent/go/example
 go build -o ../../../bin/agent-example .
 echo -e "${GREEN}✓ Go agent example built${NC}"
+
+# The notelemetry build must compile against the same API and link no gRPC
+echo -e "${YELLOW}Checking notelemetry agent build...${NC}"
+go build -tags notelemetry -o /dev/null .
+go vet -tags notelemetry ..
+if go list -deps -tags notelemetry . | grep -q google.golang.org/grpc; then
+    echo -e "${RED}✗ notelemetry build links gRPC${NC}"
+    exit 1
+fi
+echo -e "${GREEN}✓ notelemetry agent build checked${NC}"
 cd ../../..
 
 # Build dashboard